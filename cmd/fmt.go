@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"bitbucket-runner/internal/format"
+	"bitbucket-runner/internal/models"
+
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// Exit codes of the fmt command
+const (
+	fmtExitUnformatted = 1
+	fmtExitFailure     = 2
+)
+
+var (
+	fmtCheck    bool
+	fmtDiff     bool
+	fmtPipeline string
+)
+
+// fmtCmd represents the fmt command
+var fmtCmd = &cobra.Command{
+	Use:   "fmt [file...]",
+	Short: "Format pipeline configurations",
+	Long: `Rewrite bitbucket-pipelines.yml, or the given files, in a canonical
+layout: two spaces of indentation, the keys of steps in a fixed order
+(name, image, size, trigger, deployment, services, caches, script,
+after-script, artifacts, ...) and quotes only around the values that need
+them. Comments, anchors and aliases are kept.
+
+--pipeline formats the selected pipeline only, given as for run, and
+leaves the rest of the files as they are.
+
+--check writes nothing, lists the files that are not formatted and exits
+with 1 when there are any, for CI. --diff writes nothing and prints the
+changes formatting would make.
+
+The command exits with 2 when a file cannot be read or parsed.`,
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		files := args
+		if len(files) == 0 {
+			files = []string{pipelineFile}
+		}
+		var selector *models.Selector
+		if fmtPipeline != "" {
+			parsed, err := models.ParseSelector(fmtPipeline)
+			if err != nil {
+				return &exitError{Code: fmtExitFailure, Err: err}
+			}
+			selector = &parsed
+		}
+
+		unformatted := 0
+		for _, file := range files {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return &exitError{Code: fmtExitFailure, Err: fmt.Errorf("failed to read pipeline config: %w", err)}
+			}
+			formatted, err := formatFile(data, selector)
+			if err != nil {
+				return &exitError{Code: fmtExitFailure, Err: fmt.Errorf("%s: %w", file, err)}
+			}
+			if bytes.Equal(data, formatted) {
+				continue
+			}
+			unformatted++
+
+			switch {
+			case fmtDiff:
+				fmt.Fprint(cmd.OutOrStdout(), format.Diff(file, data, formatted))
+			case fmtCheck:
+				fmt.Fprintln(cmd.OutOrStdout(), file)
+			default:
+				if err := os.WriteFile(file, formatted, 0644); err != nil {
+					return &exitError{Code: fmtExitFailure, Err: fmt.Errorf("failed to write pipeline config: %w", err)}
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "%s: formatted\n", file)
+			}
+		}
+
+		if fmtCheck && unformatted > 0 {
+			return &exitError{Code: fmtExitUnformatted}
+		}
+		return nil
+	},
+}
+
+// formatFile formats a pipeline file, or only the pipeline of the selector
+// when there is one
+func formatFile(data []byte, selector *models.Selector) ([]byte, error) {
+	if selector == nil {
+		return format.Pipeline(data)
+	}
+	var config models.PipelineConfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse pipeline config: %w", err)
+	}
+	_, selected, err := config.Select(*selector)
+	if err != nil {
+		return nil, err
+	}
+	if selected.Kind == models.PipelineKindDefault {
+		return format.Section(data, "pipelines", "default")
+	}
+	return format.Section(data, "pipelines", string(selected.Kind), selected.Name)
+}
+
+func init() {
+	rootCmd.AddCommand(fmtCmd)
+
+	fmtCmd.Flags().BoolVar(&fmtCheck, "check", false, "list the files that are not formatted and exit with status 1 if any")
+	fmtCmd.Flags().BoolVar(&fmtDiff, "diff", false, "print the changes instead of writing the files")
+	fmtCmd.Flags().StringVar(&fmtPipeline, "pipeline", "", "format only this pipeline")
+	fmtCmd.RegisterFlagCompletionFunc("pipeline", completeSelectors)
+}
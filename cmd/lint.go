@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"bitbucket-runner/internal/validation"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	lintFix      bool
+	lintStrict   bool
+	lintDisable  string
+	lintOutput   string
+	lintPipeline string
+)
+
+// lintCmd represents the lint command
+var lintCmd = &cobra.Command{
+	Use:   "lint [file]",
+	Short: "Check a pipeline configuration for problems and bad practices",
+	Long: `Validate bitbucket-pipelines.yml, or the given file, like the validate
+command, and check it against the lint rules:
+` + ruleList(validation.LintRules) + `
+
+The lint.rules section of the runner configuration sets the severity of any
+rule to error, warning or off, and --disable turns rules off:
+
+  lint:
+    rules:
+      unpinned-image: error
+      long-script-line: off
+
+A "# lint-ignore" comment suppresses the rules it names, or all of them,
+on its line, or on the next line when it stands on a line of its own.
+"# lint-ignore-file" suppresses them in the whole file.
+
+--fix corrects what can be corrected automatically, such as YAML 1.1
+booleans and missing caches, and rewrites the file. --pipeline limits the
+problems reported and fixed in the pipelines section to those of the
+selected pipeline.
+
+The output formats and exit codes are those of the validate command.`,
+	Args:          cobra.MaximumNArgs(1),
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		options, err := validationOptions(lintDisable, lintPipeline)
+		if err != nil {
+			return &exitError{Code: validateExitFailure, Err: err}
+		}
+		options.Lint = true
+		return checkConfigs(cmd, args, options, lintStrict, lintFix, lintOutput)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(lintCmd)
+
+	lintCmd.Flags().BoolVar(&lintFix, "fix", false, "apply the automatic fixes to the file")
+	lintCmd.Flags().BoolVar(&lintStrict, "strict", false, "exit with status 1 on warnings too")
+	lintCmd.Flags().StringVar(&lintDisable, "disable", "", "disable the rules with these comma separated IDs")
+	lintCmd.Flags().StringVarP(&lintOutput, "output", "o", "text", "output format: text, json or sarif")
+	lintCmd.Flags().StringVar(&lintPipeline, "pipeline", "", "only report the problems of this pipeline in the pipelines section")
+	lintCmd.RegisterFlagCompletionFunc("pipeline", completeSelectors)
+}
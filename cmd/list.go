@@ -1,54 +1,315 @@
 package cmd
 
 import (
-	"bitbucket-runner/internal/parser"
+	"encoding/json"
 	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"bitbucket-runner/internal/executor"
+	"bitbucket-runner/internal/models"
+	"bitbucket-runner/internal/parser"
+	"bitbucket-runner/internal/suggest"
+	"bitbucket-runner/internal/transform"
+	"bitbucket-runner/internal/validation"
 
 	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	listOutput string
+	listKinds  string
 )
 
+// listedPipeline is a pipeline as printed by the list command
+type listedPipeline struct {
+	Selector  string            `json:"selector" yaml:"selector"`
+	Kind      string            `json:"kind" yaml:"kind"`
+	Name      string            `json:"name,omitempty" yaml:"name,omitempty"`
+	Variables []models.Variable `json:"variables,omitempty" yaml:"variables,omitempty"`
+	Entries   []listedEntry     `json:"entries" yaml:"entries"`
+}
+
+// listedEntry is an entry of a pipeline: a step, a parallel group or a
+// stage
+type listedEntry struct {
+	Type        string        `json:"type" yaml:"type"`
+	Name        string        `json:"name,omitempty" yaml:"name,omitempty"`
+	Definition  string        `json:"definition,omitempty" yaml:"definition,omitempty"`
+	Image       string        `json:"image,omitempty" yaml:"image,omitempty"`
+	Trigger     string        `json:"trigger,omitempty" yaml:"trigger,omitempty"`
+	FailFast    bool          `json:"fail_fast,omitempty" yaml:"fail_fast,omitempty"`
+	Services    []string      `json:"services,omitempty" yaml:"services,omitempty"`
+	Caches      []string      `json:"caches,omitempty" yaml:"caches,omitempty"`
+	Script      []string      `json:"script,omitempty" yaml:"script,omitempty"`
+	AfterScript []string      `json:"after_script,omitempty" yaml:"after_script,omitempty"`
+	Steps       []listedEntry `json:"steps,omitempty" yaml:"steps,omitempty"`
+}
+
 // listCmd represents the list command
 var listCmd = &cobra.Command{
-	Use:   "list",
+	Use:   "list [selector]",
 	Short: "List available pipelines and steps",
 	Long: `List all available pipelines and their steps from the
-bitbucket-pipelines.yml file in the current directory.`,
-	Run: func(cmd *cobra.Command, args []string) {
-		config, err := parser.ParsePipelineConfig("bitbucket-pipelines.yml")
+bitbucket-pipelines.yml file in the current directory.
+
+Pipelines are listed by selector: default, branches:<name>, tags:<name>,
+pull-requests:<name> or custom:<name>, each with its steps, parallel groups
+and stages. Steps show their effective image, services, caches and manual
+triggers, with YAML anchors and merge keys resolved: steps reusing a step
+of definitions.steps name it as their definition. The json and yaml
+outputs include the effective scripts.
+
+Given a selector, only that pipeline is listed; --kind restricts the list
+to some kinds of pipelines. The overrides of bitbucket-pipelines.local.yml
+and the transforms of the runner configuration are applied, as for a run.`,
+	Args:              cobra.MaximumNArgs(1),
+	ValidArgsFunction: completeSelectorArg,
+	SilenceUsage:      true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if listOutput != "table" && listOutput != "json" && listOutput != "yaml" {
+			return fmt.Errorf("unsupported output format %q (expected table, json or yaml)", listOutput)
+		}
+		kinds, err := parseKinds(listKinds)
 		if err != nil {
-			fmt.Fprintf(cmd.OutOrStdout(), "Error parsing pipeline config: %v\n", err)
-			return
+			return err
 		}
 
-		fmt.Fprintf(cmd.OutOrStdout(), "Available pipelines:\n")
-		if config.Pipelines.Default != nil {
-			fmt.Fprintf(cmd.OutOrStdout(), "- default\n")
+		runnerConfig, err := loadRunnerConfig()
+		if err != nil {
+			return err
 		}
-		for name := range config.Pipelines.Branches {
-			fmt.Fprintf(cmd.OutOrStdout(), "- %s\n", name)
+		options := validation.LintOptions(runnerConfig.Lint)
+		config, err := parser.ParsePipelineConfigWithOptions("bitbucket-pipelines.yml", options)
+		if err != nil {
+			return fmt.Errorf("Error parsing pipeline config: %w", err)
 		}
-		for name := range config.Pipelines.PullRequests {
-			fmt.Fprintf(cmd.OutOrStdout(), "- %s\n", name)
+		importer := parser.NewImporter(runnerConfig.Imports, options)
+		if err := importer.Resolve(cmd.Context(), config); err != nil {
+			return err
 		}
-		for name := range config.Pipelines.Custom {
-			fmt.Fprintf(cmd.OutOrStdout(), "- %s\n", name)
+		sourceDir, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		if _, err := parser.ApplyOverrideFile(parser.LocalPipelineFile, config); err != nil {
+			return err
+		}
+		if len(runnerConfig.Transforms) > 0 {
+			if config, err = transform.Apply(cmd.Context(), config, runnerConfig.Transforms, sourceDir, options, cmd.ErrOrStderr()); err != nil {
+				return err
+			}
+			if err := importer.Resolve(cmd.Context(), config); err != nil {
+				return err
+			}
+		}
+
+		selectors := config.Selectors()
+		if len(args) > 0 {
+			selector, err := models.ParseSelector(args[0])
+			if err != nil {
+				return err
+			}
+			_, selected, err := config.Select(selector)
+			if err != nil {
+				return err
+			}
+			selectors = []models.Selector{selected}
+		}
+
+		engine := executor.NewEngine(nil, runnerConfig, nil, sourceDir, io.Discard)
+		pipelines := []listedPipeline{}
+		for _, selector := range selectors {
+			if len(kinds) > 0 && !kinds[selector.Kind] {
+				continue
+			}
+			pipeline, _, err := config.Select(selector)
+			if err != nil {
+				return err
+			}
+			pipelines = append(pipelines, listPipeline(engine, config, selector, pipeline))
 		}
-		for name := range config.Pipelines.Tags {
-			fmt.Fprintf(cmd.OutOrStdout(), "- %s\n", name)
+
+		switch listOutput {
+		case "json":
+			encoder := json.NewEncoder(cmd.OutOrStdout())
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(pipelines)
+		case "yaml":
+			encoder := yaml.NewEncoder(cmd.OutOrStdout())
+			encoder.SetIndent(2)
+			return encoder.Encode(pipelines)
+		}
+
+		fmt.Fprintf(cmd.OutOrStdout(), "Available pipelines:\n")
+		for _, pipeline := range pipelines {
+			printListedPipeline(cmd.OutOrStdout(), pipeline)
 		}
+		return nil
 	},
+}
+
+// parseKinds parses the comma separated --kind filter
+func parseKinds(filter string) (map[models.PipelineKind]bool, error) {
+	var names []string
+	for _, kind := range models.PipelineKinds {
+		names = append(names, string(kind))
+	}
+
+	kinds := make(map[models.PipelineKind]bool)
+	if filter == "" {
+		return kinds, nil
+	}
+	for _, value := range strings.Split(filter, ",") {
+		value = strings.TrimSpace(value)
+		kind := models.PipelineKind(value)
+		valid := false
+		for _, known := range models.PipelineKinds {
+			valid = valid || kind == known
+		}
+		if !valid {
+			if match, ok := suggest.Closest(value, names); ok {
+				return nil, fmt.Errorf("unknown pipeline kind '%s', did you mean '%s'?", value, match)
+			}
+			return nil, fmt.Errorf("unknown pipeline kind '%s', expected one of %s", value, strings.Join(names, ", "))
+		}
+		kinds[kind] = true
+	}
+	return kinds, nil
+}
+
+// listPipeline resolves the entries of a pipeline. Resolution problems,
+// such as undefined services, are left to run and validate.
+func listPipeline(engine *executor.Engine, config *models.PipelineConfig, selector models.Selector, pipeline models.Pipeline) listedPipeline {
+	ec := models.NewExecutionContext(config, "")
+	ec.PipelineName = selector.String()
+	plan, _ := engine.Plan(pipeline, ec)
 
+	listed := listedPipeline{
+		Selector:  selector.String(),
+		Kind:      string(selector.Kind),
+		Name:      selector.Name,
+		Variables: pipeline.Variables(),
+		Entries:   []listedEntry{},
+	}
+
+	// The plan lists the steps in pipeline order
+	next := 0
+	planned := func() listedEntry {
+		step := plan.Steps[next]
+		next++
+		entry := listedEntry{
+			Type:        "step",
+			Name:        step.Name,
+			Definition:  step.Definition,
+			Image:       step.Image,
+			Script:      step.Script,
+			AfterScript: step.AfterScript,
+		}
+		if step.Trigger != models.TriggerAutomatic {
+			entry.Trigger = step.Trigger
+		}
+		for _, service := range step.Services {
+			entry.Services = append(entry.Services, service.Name)
+		}
+		for _, cache := range step.Caches {
+			entry.Caches = append(entry.Caches, cache.Name)
+		}
+		return entry
+	}
+
+	for _, wrapper := range pipeline {
+		switch {
+		case wrapper.Parallel != nil:
+			group := listedEntry{Type: "parallel", FailFast: wrapper.Parallel.FailFast}
+			for range wrapper.Parallel.Steps {
+				group.Steps = append(group.Steps, planned())
+			}
+			listed.Entries = append(listed.Entries, group)
+		case wrapper.Stage != nil:
+			stage := listedEntry{Type: "stage", Name: wrapper.Stage.Name, Trigger: wrapper.Stage.Trigger}
+			for range wrapper.Stage.Steps {
+				step := planned()
+				if step.Trigger == wrapper.Stage.Trigger {
+					step.Trigger = ""
+				}
+				stage.Steps = append(stage.Steps, step)
+			}
+			listed.Entries = append(listed.Entries, stage)
+		case wrapper.Variables != nil:
+			// Listed with the pipeline
+		default:
+			listed.Entries = append(listed.Entries, planned())
+		}
+	}
+	return listed
+}
+
+// printListedPipeline prints a pipeline as a tree
+func printListedPipeline(out io.Writer, pipeline listedPipeline) {
+	fmt.Fprintf(out, "- %s\n", pipeline.Selector)
+	if len(pipeline.Variables) > 0 {
+		var names []string
+		for _, variable := range pipeline.Variables {
+			names = append(names, variable.Name)
+		}
+		fmt.Fprintf(out, "  variables: %s\n", strings.Join(names, ", "))
+	}
+	printListedEntries(out, pipeline.Entries, "  ")
+}
+
+func printListedEntries(out io.Writer, entries []listedEntry, indent string) {
+	for i, entry := range entries {
+		branch, nested := "├─ ", "│  "
+		if i == len(entries)-1 {
+			branch, nested = "└─ ", "   "
+		}
+
+		fmt.Fprintf(out, "%s%s%s\n", indent, branch, entryLabel(entry))
+		printListedEntries(out, entry.Steps, indent+nested)
+	}
+}
+
+func entryLabel(entry listedEntry) string {
+	var label string
+	switch entry.Type {
+	case "parallel":
+		label = "parallel"
+		if entry.FailFast {
+			label += " (fail-fast)"
+		}
+	case "stage":
+		label = "stage"
+		if entry.Name != "" {
+			label += " " + entry.Name
+		}
+	default:
+		label = entry.Name
+		if entry.Definition != "" {
+			label += "  definition: " + entry.Definition
+		}
+		if entry.Image != "" {
+			label += "  image: " + entry.Image
+		}
+		if len(entry.Services) > 0 {
+			label += "  services: " + strings.Join(entry.Services, ",")
+		}
+		if len(entry.Caches) > 0 {
+			label += "  caches: " + strings.Join(entry.Caches, ",")
+		}
+	}
+
+	if entry.Trigger != "" {
+		label += "  trigger: " + entry.Trigger
+	}
+	return label
 }
 
 func init() {
 	rootCmd.AddCommand(listCmd)
 
-	// Here you will define your flags and configuration settings.
-	// Cobra supports Persistent Flags which will work for this command
-	// and all subcommands, e.g.:
-	// listCmd.PersistentFlags().String("foo", "", "A help for foo")
-
-	// Cobra supports local flags which will only run when this command
-	// is called directly, e.g.:
-	// listCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
-}
\ No newline at end of file
+	listCmd.Flags().StringVarP(&listOutput, "output", "o", "table", "output format: table, json or yaml")
+	listCmd.Flags().StringVar(&listKinds, "kind", "", "only list pipelines of these comma separated kinds: default, branches, tags, pull-requests or custom")
+}
@@ -0,0 +1,45 @@
+package cmd
+
+import (
+	"bitbucket-runner/internal/lsp"
+	"bitbucket-runner/internal/models"
+	"bitbucket-runner/internal/validation"
+
+	"github.com/spf13/cobra"
+)
+
+var lspStdio bool
+
+// lspCmd represents the lsp command
+var lspCmd = &cobra.Command{
+	Use:   "lsp",
+	Short: "Run a language server for pipeline files",
+	Long: `Run a Language Server Protocol server over stdin and stdout for
+bitbucket-pipelines.yml and the runner configuration. Editors get:
+
+  - diagnostics of validate and lint as the file is edited
+  - completion of keys, service and cache names and predefined variables
+  - documentation of fields on hover
+  - go-to-definition from the services and caches of a step to
+    definitions.services and definitions.caches
+
+The lint.rules section of the runner configuration, when one is found,
+sets the severities of the rules.`,
+	Args: cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		var options validation.Options
+		if path, ok := models.RunnerConfigPath(); ok {
+			if config, err := models.LoadRunnerConfigFromFile(path); err == nil {
+				options = validation.LintOptions(config.Lint)
+			}
+		}
+		return lsp.NewServer(cmd.InOrStdin(), cmd.OutOrStdout(), options).Serve()
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(lspCmd)
+
+	// Editors pass --stdio, the only transport
+	lspCmd.Flags().BoolVar(&lspStdio, "stdio", true, "Communicate over stdin and stdout")
+}
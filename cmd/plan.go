@@ -0,0 +1,187 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"bitbucket-runner/internal/executor"
+)
+
+// printPlan writes an execution plan in the requested output format
+func printPlan(out io.Writer, plan *executor.Plan, format string) error {
+	if format == "json" {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(plan)
+	}
+
+	fmt.Fprintf(out, "Pipeline: %s\n", plan.Pipeline)
+	if plan.Override != "" {
+		fmt.Fprintf(out, "Overridden by: %s\n", plan.Override)
+	}
+	if len(plan.Transforms) > 0 {
+		fmt.Fprintf(out, "Transformed by: %s\n", strings.Join(plan.Transforms, ", "))
+	}
+	fmt.Fprintln(out)
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "#\tSTEP\tIMAGE\tPARALLEL\tSERVICES\tCACHES\tARTIFACTS\tTIMEOUT\tCONDITION")
+	for _, step := range plan.Steps {
+		var services, caches []string
+		for _, service := range step.Services {
+			services = append(services, service.Name)
+		}
+		for _, cache := range step.Caches {
+			caches = append(caches, cache.Name)
+		}
+
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			step.Index+1,
+			step.Name,
+			step.Image,
+			parallelLabel(step),
+			listOrDash(services),
+			listOrDash(caches),
+			listOrDash(step.Artifacts),
+			time.Duration(step.Timeout)*time.Second,
+			conditionLabel(step),
+		)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	printPlanRewrites(out, plan)
+	printPlanConditions(out, plan)
+	printPlanScripts(out, plan)
+	printPlanEnvironment(out, plan)
+	return nil
+}
+
+// printPlanScripts prints the effective script of each step, naming the
+// step definition it expands, if any
+func printPlanScripts(out io.Writer, plan *executor.Plan) {
+	for _, step := range plan.Steps {
+		title := step.Name
+		if step.Definition != "" {
+			title += fmt.Sprintf(" (definition %s)", step.Definition)
+		}
+		fmt.Fprintf(out, "\nScript of %s:\n", title)
+		for _, line := range step.Script {
+			fmt.Fprintf(out, "  %s\n", line)
+		}
+		if len(step.AfterScript) > 0 {
+			fmt.Fprintf(out, "After-script of %s:\n", title)
+			for _, line := range step.AfterScript {
+				fmt.Fprintf(out, "  %s\n", line)
+			}
+		}
+	}
+}
+
+// printPlanRewrites lists the images rewritten by the runner configuration
+// with their configured names
+func printPlanRewrites(out io.Writer, plan *executor.Plan) {
+	images := plan.RewrittenImages()
+	if len(images) == 0 {
+		return
+	}
+	fmt.Fprintf(out, "\nRewritten images:\n")
+	for _, image := range images {
+		fmt.Fprintf(out, "  %s -> %s\n", image.Original, image.Image)
+	}
+}
+
+// printPlanConditions lists the changed files that made conditional steps
+// run
+func printPlanConditions(out io.Writer, plan *executor.Plan) {
+	for _, step := range plan.Steps {
+		if step.Decision == nil || len(step.Decision.MatchedFiles) == 0 {
+			continue
+		}
+		fmt.Fprintf(out, "\nChanged files matching the condition of %s:\n", step.Name)
+		for _, file := range step.Decision.MatchedFiles {
+			fmt.Fprintf(out, "  %s\n", file)
+		}
+	}
+}
+
+// printPlanEnvironment prints the variables shared by all steps once,
+// followed by the variables that differ per step
+func printPlanEnvironment(out io.Writer, plan *executor.Plan) {
+	if len(plan.Steps) == 0 {
+		return
+	}
+
+	shared := make(map[string]string)
+	for key, value := range plan.Steps[0].Environment {
+		shared[key] = value
+	}
+	for _, step := range plan.Steps[1:] {
+		for key, value := range shared {
+			if other, ok := step.Environment[key]; !ok || other != value {
+				delete(shared, key)
+			}
+		}
+	}
+
+	fmt.Fprintf(out, "\nEnvironment:\n")
+	for _, key := range sortedKeys(shared) {
+		fmt.Fprintf(out, "  %s=%s\n", key, shared[key])
+	}
+
+	for _, step := range plan.Steps {
+		var own []string
+		for _, key := range sortedKeys(step.Environment) {
+			if _, ok := shared[key]; !ok {
+				own = append(own, fmt.Sprintf("  %s=%s", key, step.Environment[key]))
+			}
+		}
+		if len(own) > 0 {
+			fmt.Fprintf(out, "\nEnvironment of %s:\n%s\n", step.Name, strings.Join(own, "\n"))
+		}
+	}
+}
+
+func parallelLabel(step executor.PlannedStep) string {
+	if step.ParallelGroup == 0 {
+		return "-"
+	}
+	label := fmt.Sprintf("group %d", step.ParallelGroup)
+	if step.FailFast {
+		label += " (fail-fast)"
+	}
+	return label
+}
+
+func conditionLabel(step executor.PlannedStep) string {
+	if step.Decision == nil {
+		return "-"
+	}
+	if !step.Decision.Run {
+		return "skip: " + step.Decision.Reason
+	}
+	return "run: " + step.Decision.Reason
+}
+
+func listOrDash(items []string) string {
+	if len(items) == 0 {
+		return "-"
+	}
+	return strings.Join(items, ",")
+}
+
+// sortedKeys returns the keys of a string map in lexical order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,238 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"bitbucket-runner/internal/executor"
+	"bitbucket-runner/internal/models"
+	"bitbucket-runner/internal/parser"
+	"bitbucket-runner/internal/transform"
+	"bitbucket-runner/internal/validation"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	pullJobs  int
+	pullQuiet bool
+)
+
+// pullCmd represents the pull command
+var pullCmd = &cobra.Command{
+	Use:   "pull [selector]",
+	Short: "Pull the images of the pipelines",
+	Long: `Pull the images the pipelines of bitbucket-pipelines.yml run in, so
+later runs start right away or work offline with the never pull policy.
+
+Images are resolved as for a run, after the imports, the overrides of
+bitbucket-pipelines.local.yml and the transforms: the default image, the
+images of the steps and of the step types of the runner configuration and
+the images of the services and of the pipes, rewritten by the runner
+configuration. Given a selector, only the images of that pipeline are
+pulled.
+
+Images are pulled --jobs at a time, the progress of each pull printed as it
+is made, prefixed with the image, unless --quiet is given. Images already
+present are reported and left alone, unless the pull policy of the runner
+configuration is always. The total size of the images pulled that were not
+up to date is reported at the end, followed by the pipelines that failed to
+resolve, whose resolved images are pulled all the same.`,
+	Args:              cobra.MaximumNArgs(1),
+	ValidArgsFunction: completeSelectorArg,
+	SilenceUsage:      true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if pullJobs < 1 {
+			return fmt.Errorf("--jobs must be at least 1, got %d", pullJobs)
+		}
+
+		runnerConfig, err := loadRunnerConfig()
+		if err != nil {
+			return err
+		}
+		sourceDir, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		options := validation.LintOptions(runnerConfig.Lint)
+		config, err := parser.ParsePipelineConfigWithOptions(pipelineFile, options)
+		if err != nil {
+			return fmt.Errorf("Error parsing pipeline config: %w", err)
+		}
+		importer := parser.NewImporter(runnerConfig.Imports, options)
+		if err := importer.Resolve(cmd.Context(), config); err != nil {
+			return err
+		}
+		if _, err := parser.ApplyOverrideFile(parser.LocalPipelineFile, config); err != nil {
+			return err
+		}
+		if len(runnerConfig.Transforms) > 0 {
+			if config, err = transform.Apply(cmd.Context(), config, runnerConfig.Transforms, sourceDir, options, cmd.ErrOrStderr()); err != nil {
+				return err
+			}
+			if err := importer.Resolve(cmd.Context(), config); err != nil {
+				return err
+			}
+		}
+
+		selectors := config.Selectors()
+		if len(args) > 0 {
+			selector, err := models.ParseSelector(args[0])
+			if err != nil {
+				return err
+			}
+			_, selected, err := config.Select(selector)
+			if err != nil {
+				return err
+			}
+			selectors = []models.Selector{selected}
+		}
+
+		runtime := newContainerRuntime(runnerConfig.Docker)
+		engine := executor.NewEngine(runtime, runnerConfig, nil, sourceDir, io.Discard)
+		images, unresolved := pipelineImages(engine, config, selectors, sourceDir)
+		if len(images) == 0 {
+			fmt.Fprintln(cmd.OutOrStdout(), "No images to pull")
+			return unresolvedError(cmd.OutOrStdout(), unresolved)
+		}
+
+		if err := runtime.Ping(cmd.Context()); err != nil {
+			return fmt.Errorf("container runtime unavailable: %w", err)
+		}
+
+		out := cmd.OutOrStdout()
+		fmt.Fprintf(out, "Pulling %s, %d at a time\n", plural(len(images), "image"), pullJobs)
+		progress := func(image executor.PlannedImage, line string) {
+			fmt.Fprintf(out, "%s: %s\n", image.Image, line)
+		}
+		if pullQuiet {
+			progress = nil
+		}
+		pulls := engine.PullImages(cmd.Context(), images, pullJobs, progress, func(pull executor.ImagePull) {
+			fmt.Fprintf(out, "%s: %s\n", imageLabel(pull.PlannedImage), pullStatus(pull))
+		})
+
+		var pulled, present int
+		var size int64 // of the images pulled that were not up to date
+		var failed []string
+		for _, pull := range pulls {
+			switch {
+			case pull.Err != nil:
+				failed = append(failed, pull.Image)
+			case pull.Present:
+				present++
+			default:
+				pulled++
+				if !pull.Result.UpToDate {
+					size += pull.Result.Size
+				}
+			}
+		}
+		fmt.Fprintf(out, "Pulled %s (image size %s), %d already present", plural(pulled, "image"), executor.FormatSize(size), present)
+		if len(failed) > 0 {
+			fmt.Fprintf(out, ", %d failed", len(failed))
+		}
+		fmt.Fprintln(out)
+
+		if len(failed) > 0 {
+			if err := unresolvedError(out, unresolved); err != nil {
+				return fmt.Errorf("failed to pull %s; %w", strings.Join(failed, ", "), err)
+			}
+			return errors.New("failed to pull " + strings.Join(failed, ", "))
+		}
+		return unresolvedError(out, unresolved)
+	},
+}
+
+// unresolvedPipeline is a pipeline whose images could not all be resolved
+type unresolvedPipeline struct {
+	Selector models.Selector
+	Err      error
+}
+
+// pipelineImages resolves the images of the selected pipelines, each once
+// in order of first use, with the credentials of the first step giving
+// some. The pipelines are resolved as for a run from dir, with the default
+// values of their variables and without a changeset, so that the steps of
+// every condition are included. The images of the pipelines that fail to
+// resolve are kept as far as they resolve, and the pipelines returned.
+func pipelineImages(engine *executor.Engine, config *models.PipelineConfig, selectors []models.Selector, dir string) ([]executor.PlannedImage, []unresolvedPipeline) {
+	var images []executor.PlannedImage
+	var unresolved []unresolvedPipeline
+	index := make(map[string]int)
+	for _, selector := range selectors {
+		pipeline, _, err := config.Select(selector)
+		if err != nil {
+			unresolved = append(unresolved, unresolvedPipeline{selector, err})
+			continue
+		}
+		ec := models.NewExecutionContext(config, dir)
+		ec.PipelineName = selector.String()
+		for _, variable := range pipeline.Variables() {
+			if variable.Default != "" {
+				ec.SetEnvironmentVariable(variable.Name, variable.Default)
+			}
+		}
+		plan, err := engine.Plan(pipeline, ec)
+		if err != nil {
+			unresolved = append(unresolved, unresolvedPipeline{selector, err})
+		}
+		for _, image := range plan.Images() {
+			i, ok := index[image.Image]
+			switch {
+			case !ok:
+				index[image.Image] = len(images)
+				images = append(images, image)
+			case images[i].Auth == nil:
+				images[i].Auth = image.Auth
+			}
+		}
+	}
+	return images, unresolved
+}
+
+// unresolvedError reports the pipelines that failed to resolve and returns
+// an error naming them, or nil when there are none
+func unresolvedError(out io.Writer, unresolved []unresolvedPipeline) error {
+	if len(unresolved) == 0 {
+		return nil
+	}
+	names := make([]string, len(unresolved))
+	for i, pipeline := range unresolved {
+		fmt.Fprintf(out, "%s: failed to resolve: %v\n", pipeline.Selector, pipeline.Err)
+		names[i] = pipeline.Selector.String()
+	}
+	return errors.New("failed to resolve " + strings.Join(names, ", "))
+}
+
+// imageLabel names an image together with its configured name when it was
+// rewritten
+func imageLabel(image executor.PlannedImage) string {
+	if image.Original != "" {
+		return fmt.Sprintf("%s (for %s)", image.Image, image.Original)
+	}
+	return image.Image
+}
+
+// pullStatus describes the outcome of the pull of an image in a few words
+func pullStatus(pull executor.ImagePull) string {
+	switch {
+	case pull.Err != nil:
+		return "failed: " + pull.Err.Error()
+	case pull.Present:
+		return "already present"
+	default:
+		return fmt.Sprintf("%s (%s)", pull.Result.Summary(), pull.Duration.Round(time.Millisecond))
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(pullCmd)
+
+	pullCmd.Flags().IntVarP(&pullJobs, "jobs", "j", 4, "number of images pulled at a time")
+	pullCmd.Flags().BoolVarP(&pullQuiet, "quiet", "q", false, "only print the outcome of each pull")
+}
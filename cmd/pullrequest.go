@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"bitbucket-runner/internal/git"
+	"bitbucket-runner/internal/models"
+)
+
+// pullRequest is a pull request simulated from the local repository
+type pullRequest struct {
+	ID                string
+	SourceBranch      string
+	SourceCommit      string
+	DestinationBranch string
+	DestinationCommit string
+}
+
+// newPullRequest describes a pull request from the checked out branch into
+// destination
+func newPullRequest(ctx context.Context, repo *git.Repository, destination, id string) (*pullRequest, error) {
+	source, err := repo.CurrentBranch(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("--pr requires the source branch to be checked out: %w", err)
+	}
+	sourceCommit, err := repo.ResolveRevision(ctx, "HEAD")
+	if err != nil {
+		return nil, err
+	}
+	destinationCommit, err := repo.ResolveRevision(ctx, destination)
+	if err != nil {
+		return nil, fmt.Errorf("destination branch: %w", err)
+	}
+
+	return &pullRequest{
+		ID:                id,
+		SourceBranch:      source,
+		SourceCommit:      sourceCommit,
+		DestinationBranch: destination,
+		DestinationCommit: destinationCommit,
+	}, nil
+}
+
+// pullRequestFromContext restores the pull request of a persisted run
+func pullRequestFromContext(ec *models.ExecutionContext) (*pullRequest, bool) {
+	id, ok := ec.GetEnvironmentVariable("BITBUCKET_PR_ID")
+	if !ok {
+		return nil, false
+	}
+	pr := &pullRequest{ID: id}
+	pr.SourceBranch, _ = ec.GetEnvironmentVariable("BITBUCKET_BRANCH")
+	pr.SourceCommit, _ = ec.GetEnvironmentVariable("BITBUCKET_COMMIT")
+	pr.DestinationBranch, _ = ec.GetEnvironmentVariable("BITBUCKET_PR_DESTINATION_BRANCH")
+	pr.DestinationCommit, _ = ec.GetEnvironmentVariable("BITBUCKET_PR_DESTINATION_COMMIT")
+	return pr, true
+}
+
+// variables returns the Bitbucket variables of a pull request pipeline
+func (pr *pullRequest) variables() map[string]string {
+	return map[string]string{
+		"BITBUCKET_PR_ID":                 pr.ID,
+		"BITBUCKET_BRANCH":                pr.SourceBranch,
+		"BITBUCKET_COMMIT":                pr.SourceCommit,
+		"BITBUCKET_PR_DESTINATION_BRANCH": pr.DestinationBranch,
+		"BITBUCKET_PR_DESTINATION_COMMIT": pr.DestinationCommit,
+	}
+}
+
+// checkoutMerge builds the merge of the source into the destination commit
+// in a temporary work tree named slug, leaving the working tree of the user
+// untouched. The returned cleanup function removes the work tree.
+func (pr *pullRequest) checkoutMerge(ctx context.Context, repo *git.Repository, slug string) (string, func(), error) {
+	worktree, cleanup, err := checkoutRevision(ctx, repo, pr.DestinationCommit, slug)
+	if err != nil {
+		return "", nil, err
+	}
+
+	message := fmt.Sprintf("Merge %s into %s", pr.SourceBranch, pr.DestinationBranch)
+	if err := worktree.Merge(ctx, pr.SourceCommit, message); err != nil {
+		cleanup()
+		var conflict *git.ConflictError
+		if errors.As(err, &conflict) {
+			return "", nil, fmt.Errorf("'%s' cannot be merged into '%s', resolve the conflicts first: %w", pr.SourceBranch, pr.DestinationBranch, err)
+		}
+		return "", nil, err
+	}
+
+	return worktree.Dir, cleanup, nil
+}
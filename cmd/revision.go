@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"bitbucket-runner/internal/git"
+	"bitbucket-runner/internal/models"
+	"bitbucket-runner/internal/parser"
+	"bitbucket-runner/internal/validation"
+)
+
+// pipelineFile is the pipeline configuration at the root of a repository
+const pipelineFile = "bitbucket-pipelines.yml"
+
+// loadPipelineConfig parses the pipeline configuration of the working tree,
+// or the one committed at revision when revision is set, validating it with
+// options
+func loadPipelineConfig(ctx context.Context, dir, revision string, options validation.Options) (*models.PipelineConfig, error) {
+	if revision == "" {
+		return parser.ParsePipelineConfigWithOptions(pipelineFile, options)
+	}
+
+	repo, err := git.Open(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	data, err := repo.ReadFile(ctx, revision, pipelineFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := validation.ValidatePipelineConfig(revision+":"+pipelineFile, data, options).Err(); err != nil {
+		return nil, err
+	}
+	return parser.NewPipelineParser().ParseYAML(data)
+}
+
+// refVariables returns the Bitbucket variables describing the revision a
+// pipeline runs on
+func refVariables(ref *git.Ref) map[string]string {
+	variables := map[string]string{"BITBUCKET_COMMIT": ref.Commit}
+	if ref.Branch != "" {
+		variables["BITBUCKET_BRANCH"] = ref.Branch
+	}
+	if ref.Tag != "" {
+		variables["BITBUCKET_TAG"] = ref.Tag
+	}
+	return variables
+}
+
+// checkoutRevision checks out a revision into a temporary work tree named
+// slug, leaving the working tree of the user untouched. The returned cleanup
+// function removes the work tree.
+func checkoutRevision(ctx context.Context, repo *git.Repository, revision, slug string) (*git.Repository, func(), error) {
+	tempDir, err := os.MkdirTemp("", "bitbucket-runner-checkout-")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create checkout directory: %w", err)
+	}
+	dir := filepath.Join(tempDir, slug)
+
+	worktree, err := repo.AddWorktree(ctx, dir, revision)
+	if err != nil {
+		os.RemoveAll(tempDir)
+		return nil, nil, err
+	}
+
+	cleanup := func() {
+		// context.Background so an interrupted run still cleans up
+		_ = repo.RemoveWorktree(context.Background(), dir)
+		os.RemoveAll(tempDir)
+	}
+	return worktree, cleanup, nil
+}
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"errors"
 	"fmt"
 	"os"
 
@@ -13,17 +14,44 @@
 	Short: "A CLI tool for running Bitbucket pipelines locally",
 	Long: `bitbucket-runner is a CLI tool that allows you to run Bitbucket pipelines
 locally by parsing bitbucket-pipelines.yml files and executing the defined steps.`,
+	// Execute prints the errors of the commands
+	SilenceErrors: true,
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
+		var exit *exitError
+		if errors.As(err, &exit) {
+			if exit.Err != nil {
+				fmt.Println(exit.Err)
+			}
+			os.Exit(exit.Code)
+		}
 		fmt.Println(err)
 		os.Exit(1)
 	}
 }
 
+// exitError makes the process exit with a specific code, for commands
+// whose exit status is part of their interface. Err is printed if set.
+type exitError struct {
+	Code int
+	Err  error
+}
+
+func (e *exitError) Error() string {
+	if e.Err != nil {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+func (e *exitError) Unwrap() error {
+	return e.Err
+}
+
 func init() {
 	// Here you will define your flags and configuration settings.
 	// Cobra supports persistent flags, which, if defined here,
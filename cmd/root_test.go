@@ -2,14 +2,94 @@
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 
+	"bitbucket-runner/internal/executor"
+	"bitbucket-runner/internal/models"
+	"bitbucket-runner/internal/validation"
+
 	"github.com/spf13/cobra"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
 )
 
+// fakeRuntime stands in for Docker in command tests. Scripts containing
+// "exit 1" fail. Images are present unless listed in missing, and images
+// containing "broken" fail to pull. The onExec hook receives the step
+// container.
+type fakeRuntime struct {
+	scripts []string
+	step    executor.ContainerSpec
+	onExec  func(step executor.ContainerSpec)
+	missing map[string]bool
+
+	mu     sync.Mutex
+	pulled []string
+}
+
+func (f *fakeRuntime) Ping(ctx context.Context) error { return nil }
+
+func (f *fakeRuntime) ImageExists(ctx context.Context, image string) (bool, error) {
+	return !f.missing[image], nil
+}
+
+func (f *fakeRuntime) Pull(ctx context.Context, image string, auth *executor.ImageAuth, progress func(string)) (executor.PullResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pulled = append(f.pulled, image)
+	if strings.Contains(image, "broken") {
+		return executor.PullResult{}, errors.New("manifest unknown")
+	}
+	if progress != nil {
+		progress("a1b2c3: Pull complete")
+	}
+	return executor.PullResult{Layers: 4, Cached: 1, Size: 10 << 20}, nil
+}
+
+func (f *fakeRuntime) Start(ctx context.Context, spec executor.ContainerSpec) (string, error) {
+	if spec.NetworkMode == "" {
+		f.step = spec
+	}
+	return "fake", nil
+}
+
+func (f *fakeRuntime) Exec(ctx context.Context, containerID string, opts executor.ExecOptions) (int, error) {
+	script := opts.Command[len(opts.Command)-1]
+	f.scripts = append(f.scripts, script)
+	if f.onExec != nil {
+		f.onExec(f.step)
+	}
+	if strings.Contains(script, "exit 1") {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func (f *fakeRuntime) Run(ctx context.Context, spec executor.ContainerSpec, stdout, stderr io.Writer) (int, error) {
+	return 0, nil
+}
+
+func (f *fakeRuntime) Remove(ctx context.Context, containerID string) error { return nil }
+
+// useFakeRuntime replaces Docker with a fake runtime for the current test
+func useFakeRuntime(t *testing.T) *fakeRuntime {
+	runtime := &fakeRuntime{}
+	original := newContainerRuntime
+	newContainerRuntime = func(models.DockerConfig) executor.ContainerRuntime { return runtime }
+	t.Cleanup(func() { newContainerRuntime = original })
+	return runtime
+}
+
 func TestRootCommand(t *testing.T) {
 	t.Run("root command exists", func(t *testing.T) {
 		assert.NotNil(t, rootCmd)
@@ -80,6 +160,7 @@ func TestRunCommand(t *testing.T) {
 		oldWd, _ := os.Getwd()
 		defer os.Chdir(oldWd)
 		os.Chdir(tmpDir)
+		useFakeRuntime(t)
 
 		// Create a fresh command instance to avoid state pollution
 		testCmd := &cobra.Command{
@@ -97,6 +178,365 @@ func TestRunCommand(t *testing.T) {
 		outputStr := output.String()
 		assert.Contains(t, outputStr, "Parsed pipeline config")
 	})
+
+	t.Run("resume failed run", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		content := []byte("pipelines:\n  default:\n    - step:\n        name: Build\n        script:\n          - make build\n    - step:\n        name: Test\n        script:\n          - exit 1\n")
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "bitbucket-pipelines.yml"), content, 0644))
+
+		oldWd, _ := os.Getwd()
+		defer os.Chdir(oldWd)
+		os.Chdir(tmpDir)
+		runtime := useFakeRuntime(t)
+		defer func() { runResume = false }()
+
+		testCmd := &cobra.Command{Use: "test"}
+		testCmd.AddCommand(rootCmd)
+		var output bytes.Buffer
+		testCmd.SetOut(&output)
+		testCmd.SetErr(&output)
+
+		testCmd.SetArgs([]string{"bitbucket-runner", "run"})
+		err := testCmd.Execute()
+		require.Error(t, err)
+		assert.Contains(t, output.String(), "Resume it with: bitbucket-runner run --resume")
+		assert.Len(t, runtime.scripts, 2)
+
+		// Fix the failing step and resume from it
+		fixed := bytes.Replace(content, []byte("exit 1"), []byte("make test"), 1)
+		require.NoError(t, os.WriteFile("bitbucket-pipelines.yml", fixed, 0644))
+		output.Reset()
+		runtime.scripts = nil
+
+		testCmd.SetArgs([]string{"bitbucket-runner", "run", "--resume"})
+		err = testCmd.Execute()
+		require.NoError(t, err)
+		assert.Contains(t, output.String(), "from step 2")
+		require.Len(t, runtime.scripts, 1)
+		assert.Contains(t, runtime.scripts[0], "make test")
+	})
+}
+
+func TestRunCommand_DryRun(t *testing.T) {
+	tmpDir := t.TempDir()
+	oldWd, _ := os.Getwd()
+	defer os.Chdir(oldWd)
+	os.Chdir(tmpDir)
+	runtime := useFakeRuntime(t)
+	defer func() { runDryRun, runOutput, runChangesSince, runPipeline = false, "table", "", "default" }()
+
+	execute := func(content string, args ...string) (string, error) {
+		require.NoError(t, os.WriteFile("bitbucket-pipelines.yml", []byte(content), 0644))
+		testCmd := &cobra.Command{Use: "test"}
+		testCmd.AddCommand(rootCmd)
+		var output bytes.Buffer
+		testCmd.SetOut(&output)
+		testCmd.SetErr(&output)
+		testCmd.SetArgs(append([]string{"bitbucket-runner", "run", "--dry-run"}, args...))
+		err := testCmd.Execute()
+		return output.String(), err
+	}
+
+	t.Run("table", func(t *testing.T) {
+		output, err := execute("image: node:16\npipelines:\n  default:\n    - step:\n        name: Build\n        caches: [node]\n        script: [npm ci]\n")
+		require.NoError(t, err)
+		assert.Contains(t, output, "Pipeline: default")
+		assert.Contains(t, output, "Build")
+		assert.Contains(t, output, "node:16")
+		assert.Empty(t, runtime.scripts, "dry-run must not execute steps")
+		assert.NoDirExists(t, filepath.Join(tmpDir, ".bitbucket-runner"))
+	})
+
+	t.Run("transforms", func(t *testing.T) {
+		if _, err := exec.LookPath("sed"); err != nil {
+			t.Skip("sed not available")
+		}
+		require.NoError(t, os.WriteFile("bitbucket-runner.yml", []byte("version: \"1.0\"\ndefaults:\n  image: alpine\n  timeout: 60\ntransforms:\n  - name: ci-script\n    command: sed\n    args: [s/npm test/npm run ci/]\n"), 0644))
+		defer os.Remove("bitbucket-runner.yml")
+
+		output, err := execute("pipelines:\n  default:\n    - step:\n        name: Test\n        script: [npm test]\n")
+		require.NoError(t, err)
+		assert.Contains(t, output, "Pipeline: default\nTransformed by: ci-script\n")
+		assert.Contains(t, output, "\nScript of Test:\n  npm run ci\n")
+
+		require.NoError(t, os.WriteFile("bitbucket-runner.yml", []byte("version: \"1.0\"\ndefaults:\n  image: alpine\n  timeout: 60\ntransforms:\n  - name: drop-script\n    command: sed\n    args: ['s/,\"script\":[^]]*]//']\n"), 0644))
+		_, err = execute("pipelines:\n  default:\n    - step:\n        name: Test\n        script: [npm test]\n")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "transform 'drop-script' returned an invalid configuration")
+	})
+
+	t.Run("local overrides", func(t *testing.T) {
+		require.NoError(t, os.WriteFile("bitbucket-pipelines.local.yml", []byte("pipelines:\n  default:\n    Test:\n      image: mirror.local/node:18\n    Deploy:\n      skip: true\n"), 0644))
+		defer os.Remove("bitbucket-pipelines.local.yml")
+		content := "image: node:18\npipelines:\n  default:\n    - step:\n        name: Test\n        script: [npm test]\n    - step:\n        name: Deploy\n        deployment: production\n        script: [./deploy.sh]\n"
+
+		output, err := execute(content, "--output", "table")
+		require.NoError(t, err)
+		assert.Contains(t, output, "Pipeline: default\nOverridden by: bitbucket-pipelines.local.yml\n")
+		assert.Contains(t, output, "mirror.local/node:18")
+		assert.NotContains(t, output, "Deploy")
+
+		require.NoError(t, os.WriteFile("bitbucket-pipelines.local.yml", []byte("pipelines:\n  default:\n    Deploy to production:\n      skip: true\n"), 0644))
+		_, err = execute(content, "--output", "table")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "bitbucket-pipelines.local.yml:3:5: error: step 'Deploy to production' is not defined in pipeline 'default', named steps: Test, Deploy")
+	})
+
+	t.Run("lint rules", func(t *testing.T) {
+		content := "pipelines:\n  default:\n    - step:\n        deployment: production\n        script: [./deploy.sh]\n    - step:\n        deployment: staging\n        script: [./deploy.sh]\n"
+		_, err := execute(content)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "[deployment-order]")
+
+		require.NoError(t, os.WriteFile("bitbucket-runner.yml", []byte("version: \"1.0\"\ndefaults:\n  image: alpine\n  timeout: 60\nlint:\n  rules:\n    deployment-order: \"off\"\n"), 0644))
+		defer os.Remove("bitbucket-runner.yml")
+		_, err = execute(content)
+		require.NoError(t, err)
+	})
+
+	t.Run("image rewrites", func(t *testing.T) {
+		require.NoError(t, os.WriteFile("bitbucket-runner.yml", []byte("version: \"1.0\"\ndefaults:\n  image: alpine\n  timeout: 60\ndocker:\n  rewrites:\n    - match: node:16\n      replace: node:16-bullseye\n    - match: docker.io/*\n      replace: mirror.local/*\n"), 0644))
+		defer os.Remove("bitbucket-runner.yml")
+		content := "image: node:16\ndefinitions:\n  services:\n    redis:\n      image: redis:7\npipelines:\n  default:\n    - step:\n        services: [redis]\n        script: [npm test]\n    - step:\n        image: ghcr.io/team/build\n        script:\n          - make\n          - pipe: atlassian/slack-notify:2.0.0\n"
+
+		output, err := execute(content, "--output", "table")
+		require.NoError(t, err)
+		assert.Contains(t, output, "\nRewritten images:\n  node:16 -> node:16-bullseye\n  redis:7 -> mirror.local/library/redis:7\n  bitbucketpipelines/slack-notify:2.0.0 -> mirror.local/bitbucketpipelines/slack-notify:2.0.0\n\n")
+
+		output, err = execute(content, "--output", "json")
+		require.NoError(t, err)
+		assert.Contains(t, output, `"image": "node:16-bullseye",`+"\n"+`      "original_image": "node:16",`)
+		assert.Contains(t, output, `"image": "ghcr.io/team/build",`+"\n"+`      "step_type"`)
+		assert.Contains(t, output, `"image": "mirror.local/bitbucketpipelines/slack-notify:2.0.0",`+"\n"+`          "original_image": "bitbucketpipelines/slack-notify:2.0.0"`)
+	})
+
+	t.Run("step definitions", func(t *testing.T) {
+		content := "image: golang:1.21\ndefinitions:\n  steps:\n    - step: &build\n        name: Build\n        script: [go build ./...]\npipelines:\n  default:\n    - step:\n        <<: *build\n        name: Test\n        script: [go test ./...]\n"
+		output, err := execute(content, "--output", "table")
+		require.NoError(t, err)
+		assert.Contains(t, output, "\nScript of Test (definition build):\n  go test ./...\n")
+
+		output, err = execute(content, "--output", "json")
+		require.NoError(t, err)
+		assert.Contains(t, output, `"definition": "build"`)
+	})
+
+	t.Run("json", func(t *testing.T) {
+		output, err := execute("image: node:16\npipelines:\n  default:\n    - step:\n        script: [npm ci]\n", "--output", "json")
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(output, "{"))
+		assert.Contains(t, output, `"image": "node:16"`)
+	})
+
+	t.Run("resolution failure", func(t *testing.T) {
+		_, err := execute("pipelines:\n  default:\n    - step:\n        services: [redis]\n        script: [rake]\n", "--output", "table")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "service 'redis' is not defined")
+	})
+
+	t.Run("branch selector", func(t *testing.T) {
+		content := "image: alpine\npipelines:\n  branches:\n    'release/*':\n      - step:\n          script: [make]\n"
+		output, err := execute(content, "--output", "json", "--pipeline", "branches:release/1.0")
+		require.NoError(t, err)
+		assert.Contains(t, output, `"pipeline": "branches:release/*"`)
+		assert.Contains(t, output, `"BITBUCKET_BRANCH": "release/1.0"`)
+
+		_, err = execute(content, "--pipeline", "branch:release/1.0")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "did you mean 'branches'?")
+		runPipeline = "default"
+	})
+
+	t.Run("changes since requires git", func(t *testing.T) {
+		_, err := execute("image: alpine\npipelines:\n  default:\n    - step:\n        script: [make]\n", "--changes-since", "main")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "--changes-since requires a git repository")
+	})
+}
+
+// gitCommand runs git in dir with a fixed identity
+func gitCommand(t *testing.T, dir string, args ...string) {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+		"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+}
+
+// commitFiles writes files into dir and commits them
+func commitFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+	}
+	gitCommand(t, dir, "add", "--all")
+	gitCommand(t, dir, "commit", "--quiet", "--message", "update")
+}
+
+func TestRunCommand_PullRequest(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+
+	tmpDir := t.TempDir()
+	oldWd, _ := os.Getwd()
+	defer os.Chdir(oldWd)
+	os.Chdir(tmpDir)
+	runtime := useFakeRuntime(t)
+	defer func() { runPR, runDestination = false, "" }()
+
+	pipelines := "image: alpine\npipelines:\n  pull-requests:\n    'feature/*':\n      - step:\n          script: [make test]\n"
+	gitCommand(t, tmpDir, "init", "--quiet", "--initial-branch=main")
+	commitFiles(t, tmpDir, map[string]string{"bitbucket-pipelines.yml": pipelines, "VERSION": "1", ".gitignore": ".bitbucket-runner/\n"})
+	gitCommand(t, tmpDir, "checkout", "--quiet", "-b", "feature/login")
+	commitFiles(t, tmpDir, map[string]string{"login.txt": "login"})
+	gitCommand(t, tmpDir, "checkout", "--quiet", "main")
+	commitFiles(t, tmpDir, map[string]string{"main.txt": "main"})
+	gitCommand(t, tmpDir, "checkout", "--quiet", "feature/login")
+
+	execute := func() (string, error) {
+		testCmd := &cobra.Command{Use: "test"}
+		testCmd.AddCommand(rootCmd)
+		var output bytes.Buffer
+		testCmd.SetOut(&output)
+		testCmd.SetErr(&output)
+		testCmd.SetArgs([]string{"bitbucket-runner", "run", "--pr", "--destination", "main"})
+		err := testCmd.Execute()
+		return output.String(), err
+	}
+
+	t.Run("runs on the merge commit", func(t *testing.T) {
+		var files []string
+		var env map[string]string
+		runtime.onExec = func(step executor.ContainerSpec) {
+			for _, name := range []string{"login.txt", "main.txt"} {
+				if _, err := os.Stat(filepath.Join(step.Volumes[0].Host, name)); err == nil {
+					files = append(files, name)
+				}
+			}
+			env = step.Environment
+		}
+
+		output, err := execute()
+		require.NoError(t, err)
+		assert.Contains(t, output, "Merged feature/login into main")
+		assert.Equal(t, []string{"login.txt", "main.txt"}, files)
+		assert.Equal(t, "1", env["BITBUCKET_PR_ID"])
+		assert.Equal(t, "main", env["BITBUCKET_PR_DESTINATION_BRANCH"])
+		assert.Equal(t, "feature/login", env["BITBUCKET_BRANCH"])
+		assert.NoFileExists(t, filepath.Join(tmpDir, "main.txt"), "the working tree must not change")
+	})
+
+	t.Run("fails on conflicts", func(t *testing.T) {
+		runtime.onExec = nil
+		runtime.scripts = nil
+		gitCommand(t, tmpDir, "checkout", "--quiet", "main")
+		commitFiles(t, tmpDir, map[string]string{"VERSION": "2"})
+		gitCommand(t, tmpDir, "checkout", "--quiet", "feature/login")
+		commitFiles(t, tmpDir, map[string]string{"VERSION": "3"})
+
+		_, err := execute()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "'feature/login' cannot be merged into 'main'")
+		assert.Contains(t, err.Error(), "VERSION")
+		assert.Empty(t, runtime.scripts)
+	})
+}
+
+func TestRunCommand_Ref(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+
+	tmpDir := t.TempDir()
+	oldWd, _ := os.Getwd()
+	defer os.Chdir(oldWd)
+	os.Chdir(tmpDir)
+	runtime := useFakeRuntime(t)
+	defer func() { runRef = "" }()
+
+	pipeline := func(script string) string {
+		return "image: alpine\npipelines:\n  default:\n    - step:\n        script: [" + script + "]\n"
+	}
+	gitCommand(t, tmpDir, "init", "--quiet", "--initial-branch=main")
+	commitFiles(t, tmpDir, map[string]string{"bitbucket-pipelines.yml": pipeline("make old"), ".gitignore": ".bitbucket-runner/\n"})
+	gitCommand(t, tmpDir, "tag", "v1.0")
+	commitFiles(t, tmpDir, map[string]string{"bitbucket-pipelines.yml": pipeline("make new"), "new.txt": "new"})
+	require.NoError(t, os.WriteFile("bitbucket-pipelines.yml", []byte(pipeline("make uncommitted")), 0644))
+
+	var env map[string]string
+	var hasNewFile bool
+	runtime.onExec = func(step executor.ContainerSpec) {
+		env = step.Environment
+		_, err := os.Stat(filepath.Join(step.Volumes[0].Host, "new.txt"))
+		hasNewFile = err == nil
+	}
+
+	testCmd := &cobra.Command{Use: "test"}
+	testCmd.AddCommand(rootCmd)
+	var output bytes.Buffer
+	testCmd.SetOut(&output)
+	testCmd.SetErr(&output)
+	testCmd.SetArgs([]string{"bitbucket-runner", "run", "--ref", "v1.0"})
+
+	require.NoError(t, testCmd.Execute())
+	require.Len(t, runtime.scripts, 1)
+	assert.Contains(t, runtime.scripts[0], "make old", "the configuration is read from the revision")
+	assert.False(t, hasNewFile, "the workspace is a checkout of the revision")
+	assert.Equal(t, "v1.0", env["BITBUCKET_TAG"])
+	assert.Len(t, env["BITBUCKET_COMMIT"], 40)
+	assert.NotContains(t, env, "BITBUCKET_BRANCH")
+}
+
+func TestRunCommand_CustomPipelineVariables(t *testing.T) {
+	tmpDir := t.TempDir()
+	oldWd, _ := os.Getwd()
+	defer os.Chdir(oldWd)
+	os.Chdir(tmpDir)
+	runtime := useFakeRuntime(t)
+	defer func() { runPipeline, runVars = "default", nil }()
+
+	content := `image: alpine
+pipelines:
+  custom:
+    deploy:
+      - variables:
+          - name: Environment
+            default: staging
+            allowed-values: [staging, production]
+          - name: Version
+      - step:
+          script: [./deploy.sh]
+`
+	require.NoError(t, os.WriteFile("bitbucket-pipelines.yml", []byte(content), 0644))
+
+	var env map[string]string
+	runtime.onExec = func(step executor.ContainerSpec) { env = step.Environment }
+
+	testCmd := &cobra.Command{Use: "test"}
+	testCmd.AddCommand(rootCmd)
+	var output bytes.Buffer
+	testCmd.SetOut(&output)
+	testCmd.SetErr(&output)
+	testCmd.SetIn(strings.NewReader(""))
+
+	testCmd.SetArgs([]string{"bitbucket-runner", "run", "--pipeline", "custom:deploy", "--var", "Version=1.4"})
+	require.NoError(t, testCmd.Execute())
+	assert.Equal(t, "staging", env["Environment"])
+	assert.Equal(t, "1.4", env["Version"])
+
+	testCmd.SetArgs([]string{"bitbucket-runner", "run", "--pipeline", "custom:deploy", "--var", "Version=1.4", "--var", "Environment=qa"})
+	err := testCmd.Execute()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not one of the allowed values")
+
+	runVars = nil
+	testCmd.SetArgs([]string{"bitbucket-runner", "run", "--pipeline", "custom:missing"})
+	err = testCmd.Execute()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "pipeline 'custom:missing' is not defined")
 }
 
 func TestListCommand(t *testing.T) {
@@ -151,11 +591,676 @@ func TestListCommand(t *testing.T) {
 		assert.Contains(t, outputStr, "Available pipelines:")
 		assert.Contains(t, outputStr, "- default")
 	})
+
+	t.Run("list selectors and steps", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		content := `pipelines:
+  default:
+    - step:
+        script: [make]
+  branches:
+    release/*:
+      - step:
+          name: Release
+          script: [make release]
+  custom:
+    deploy:
+      - step:
+          script: [make deploy]
+`
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "bitbucket-pipelines.yml"), []byte(content), 0644))
+		oldWd, _ := os.Getwd()
+		defer os.Chdir(oldWd)
+		os.Chdir(tmpDir)
+
+		execute := func(args ...string) (string, error) {
+			testCmd := &cobra.Command{Use: "test"}
+			testCmd.AddCommand(rootCmd)
+			var output bytes.Buffer
+			testCmd.SetOut(&output)
+			testCmd.SetErr(&output)
+			testCmd.SetArgs(args)
+			err := testCmd.Execute()
+			return output.String(), err
+		}
+
+		output, err := execute("bitbucket-runner", "list")
+		require.NoError(t, err)
+		assert.Contains(t, output, "- default\n")
+		assert.Contains(t, output, "- branches:release/*\n")
+		assert.Contains(t, output, "- custom:deploy\n")
+
+		output, err = execute("bitbucket-runner", "list", "branches:release/2.0")
+		require.NoError(t, err)
+		assert.Contains(t, output, "- branches:release/*\n  └─ Release")
+		assert.NotContains(t, output, "custom:deploy")
+
+		_, err = execute("bitbucket-runner", "list", "custom:deply")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "did you mean 'custom:deploy'?")
+
+		output, err = execute("__complete", "bitbucket-runner", "run", "--pipeline", "cu")
+		require.NoError(t, err)
+		assert.Contains(t, output, "custom:deploy")
+		assert.NotContains(t, output, "branches:release/*")
+	})
+
+	t.Run("imported pipelines", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		shared := "export: true\ndefinitions:\n  pipelines:\n    build:\n      - step:\n          name: Maven build\n          script: [mvn verify]\n"
+		require.NoError(t, os.Mkdir(filepath.Join(tmpDir, "shared"), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "shared", "bitbucket-pipelines.yml"), []byte(shared), 0644))
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "bitbucket-pipelines.yml"),
+			[]byte("pipelines:\n  custom:\n    build:\n      import: shared-pipelines:master:build\n"), 0644))
+		oldWd, _ := os.Getwd()
+		defer os.Chdir(oldWd)
+		os.Chdir(tmpDir)
+
+		execute := func() (string, error) {
+			testCmd := &cobra.Command{Use: "test"}
+			testCmd.AddCommand(rootCmd)
+			var output bytes.Buffer
+			testCmd.SetOut(&output)
+			testCmd.SetErr(&output)
+			testCmd.SetArgs([]string{"bitbucket-runner", "list", "--kind", "", "custom:build"})
+			err := testCmd.Execute()
+			return output.String(), err
+		}
+
+		_, err := execute()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "failed to import pipeline 'custom:build': repository 'shared-pipelines' is not in the imports of the runner configuration")
+
+		require.NoError(t, os.WriteFile("bitbucket-runner.yml", []byte("version: \"1.0\"\ndefaults:\n  image: alpine\n  timeout: 60\nimports:\n  shared-pipelines: shared\n"), 0644))
+		output, err := execute()
+		require.NoError(t, err)
+		assert.Contains(t, output, "- custom:build\n  └─ Maven build")
+	})
+}
+
+func TestListCommand_Output(t *testing.T) {
+	tmpDir := t.TempDir()
+	content := `image: node:18
+definitions:
+  services:
+    postgres:
+      image: postgres:15
+pipelines:
+  default:
+    - step:
+        name: Build
+        caches: [node]
+        script: [npm ci]
+    - parallel:
+        fail-fast: true
+        steps:
+          - step:
+              name: Unit
+              services: [postgres]
+              script: [npm test]
+          - step:
+              name: Lint
+              image: node:20
+              script: [npm run lint]
+    - stage:
+        name: Production
+        trigger: manual
+        steps:
+          - step:
+              name: Deploy
+              script: [./deploy.sh]
+  custom:
+    deploy:
+      - variables:
+          - name: Environment
+      - step:
+          script: [./deploy.sh]
+`
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "bitbucket-pipelines.yml"), []byte(content), 0644))
+	oldWd, _ := os.Getwd()
+	defer os.Chdir(oldWd)
+	os.Chdir(tmpDir)
+	defer func() { listOutput, listKinds = "table", "" }()
+
+	execute := func(args ...string) (string, error) {
+		testCmd := &cobra.Command{Use: "test"}
+		testCmd.AddCommand(rootCmd)
+		var output bytes.Buffer
+		testCmd.SetOut(&output)
+		testCmd.SetErr(&output)
+		testCmd.SetArgs(append([]string{"bitbucket-runner", "list"}, args...))
+		err := testCmd.Execute()
+		return output.String(), err
+	}
+
+	t.Run("tree", func(t *testing.T) {
+		output, err := execute()
+		require.NoError(t, err)
+		assert.Equal(t, `Available pipelines:
+- default
+  ├─ Build  image: node:18  caches: node
+  ├─ parallel (fail-fast)
+  │  ├─ Unit  image: node:18  services: postgres
+  │  └─ Lint  image: node:20
+  └─ stage Production  trigger: manual
+     └─ Deploy  image: node:18
+- custom:deploy
+  variables: Environment
+  └─ Step 1  image: node:18
+`, output)
+	})
+
+	t.Run("json", func(t *testing.T) {
+		output, err := execute("--output", "json", "--kind", "custom")
+		require.NoError(t, err)
+
+		var pipelines []listedPipeline
+		require.NoError(t, json.Unmarshal([]byte(output), &pipelines))
+		require.Len(t, pipelines, 1)
+		assert.Equal(t, "custom:deploy", pipelines[0].Selector)
+		assert.Equal(t, "Environment", pipelines[0].Variables[0].Name)
+	})
+
+	t.Run("yaml", func(t *testing.T) {
+		output, err := execute("--output", "yaml", "--kind", "default")
+		require.NoError(t, err)
+
+		var pipelines []listedPipeline
+		require.NoError(t, yaml.Unmarshal([]byte(output), &pipelines))
+		require.Len(t, pipelines, 1)
+		assert.Equal(t, "parallel", pipelines[0].Entries[1].Type)
+		assert.True(t, pipelines[0].Entries[1].FailFast)
+		assert.Equal(t, "manual", pipelines[0].Entries[2].Trigger)
+	})
+
+	t.Run("transforms", func(t *testing.T) {
+		if _, err := exec.LookPath("sed"); err != nil {
+			t.Skip("sed not available")
+		}
+		require.NoError(t, os.WriteFile("bitbucket-runner.yml", []byte("version: \"1.0\"\ndefaults:\n  image: alpine\n  timeout: 60\ntransforms:\n  - name: mirror\n    command: sed\n    args: [s/node:18/mirror.local\\/node:18/]\n"), 0644))
+		defer os.Remove("bitbucket-runner.yml")
+
+		output, err := execute("--output", "table", "--kind", "custom")
+		require.NoError(t, err)
+		assert.Contains(t, output, "└─ Step 1  image: mirror.local/node:18\n")
+	})
+
+	t.Run("unknown kind", func(t *testing.T) {
+		_, err := execute("--output", "table", "--kind", "branch")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "did you mean 'branches'?")
+	})
+
+	t.Run("step definitions", func(t *testing.T) {
+		content := "image: golang:1.21\ndefinitions:\n  steps:\n    - step: &build\n        name: Build\n        script: [go build ./...]\npipelines:\n  default:\n    - step: *build\n    - step:\n        <<: *build\n        name: Test\n        script: [go test ./...]\n"
+		require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "bitbucket-pipelines.yml"), []byte(content), 0644))
+
+		output, err := execute("--output", "table", "--kind", "")
+		require.NoError(t, err)
+		assert.Equal(t, `Available pipelines:
+- default
+  ├─ Build  definition: build  image: golang:1.21
+  └─ Test  definition: build  image: golang:1.21
+`, output)
+
+		output, err = execute("--output", "json")
+		require.NoError(t, err)
+		var pipelines []listedPipeline
+		require.NoError(t, json.Unmarshal([]byte(output), &pipelines))
+		assert.Equal(t, []string{"go test ./..."}, pipelines[0].Entries[1].Script)
+	})
+}
+
+func TestPullCommand(t *testing.T) {
+	tmpDir := t.TempDir()
+	content := `image: node:18
+definitions:
+  services:
+    postgres:
+      image: postgres:15
+pipelines:
+  default:
+    - step:
+        name: Build
+        script: [npm ci]
+    - step:
+        name: Test
+        services: [postgres]
+        script: [npm test]
+  custom:
+    package:
+      - step:
+          image: golang:1.21
+          script: [make]
+    broken:
+      - step:
+          image: broken/image
+          script: [make]
+    deploy:
+      - step:
+          image: golang:1.21
+          script:
+            - pipe: atlassian/aws-s3-deploy:1.1.0
+              variables:
+                S3_BUCKET: my-bucket
+`
+	require.NoError(t, os.WriteFile(filepath.Join(tmpDir, "bitbucket-pipelines.yml"), []byte(content), 0644))
+	oldWd, _ := os.Getwd()
+	defer os.Chdir(oldWd)
+	os.Chdir(tmpDir)
+	defer func() { pullJobs, pullQuiet = 4, false }()
+
+	execute := func(args ...string) (string, error) {
+		testCmd := &cobra.Command{Use: "test"}
+		testCmd.AddCommand(rootCmd)
+		var output bytes.Buffer
+		testCmd.SetOut(&output)
+		testCmd.SetErr(&output)
+		testCmd.SetArgs(append([]string{"bitbucket-runner", "pull"}, args...))
+		err := testCmd.Execute()
+		return output.String(), err
+	}
+
+	t.Run("selected pipeline", func(t *testing.T) {
+		runtime := useFakeRuntime(t)
+		runtime.missing = map[string]bool{"postgres:15": true}
+
+		output, err := execute("default", "--jobs", "2")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"postgres:15"}, runtime.pulled)
+		assert.Contains(t, output, "Pulling 2 images, 2 at a time\n")
+		assert.Contains(t, output, "node:18: already present\n")
+		assert.Contains(t, output, "postgres:15: a1b2c3: Pull complete\npostgres:15: 3 of 4 layers downloaded, image size 10.0 MiB (")
+		assert.True(t, strings.HasSuffix(output, "Pulled 1 image (image size 10.0 MiB), 1 already present\n"), output)
+
+		runtime.pulled = nil
+		output, err = execute("default", "--quiet")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"postgres:15"}, runtime.pulled)
+		assert.NotContains(t, output, "Pull complete")
+		pullQuiet = false
+	})
+
+	t.Run("all pipelines", func(t *testing.T) {
+		runtime := useFakeRuntime(t)
+		runtime.missing = map[string]bool{"node:18": true, "postgres:15": true, "golang:1.21": true, "broken/image": true}
+
+		output, err := execute()
+		require.Error(t, err)
+		assert.Equal(t, "failed to pull broken/image", err.Error())
+		assert.ElementsMatch(t, []string{"node:18", "postgres:15", "golang:1.21", "broken/image"}, runtime.pulled)
+		assert.Contains(t, output, "broken/image: failed: manifest unknown\n")
+		assert.Contains(t, output, "Pulled 3 images (image size 30.0 MiB), 1 already present, 1 failed\n")
+	})
+
+	t.Run("unresolved pipelines", func(t *testing.T) {
+		runtime := useFakeRuntime(t)
+		runtime.missing = map[string]bool{"node:20": true, "postgres:15": true}
+		require.NoError(t, os.WriteFile("bitbucket-runner.yml", []byte("version: \"1.0\"\ndefaults:\n  image: alpine\n  timeout: 60\nlint:\n  rules:\n    undefined-service: \"off\"\n"), 0644))
+		defer os.Remove("bitbucket-runner.yml")
+		require.NoError(t, os.WriteFile("bitbucket-pipelines.yml", []byte(content+"    undefined:\n      - step:\n          image: node:20\n          services: [redis]\n          script: [npm test]\n"), 0644))
+		defer os.WriteFile("bitbucket-pipelines.yml", []byte(content), 0644)
+
+		output, err := execute("custom:undefined")
+		require.Error(t, err)
+		assert.Equal(t, "failed to resolve custom:undefined", err.Error())
+		assert.Equal(t, []string{"node:20"}, runtime.pulled)
+		assert.Contains(t, output, "Pulled 1 image (image size 10.0 MiB), 0 already present\ncustom:undefined: failed to resolve: Step 1: service 'redis' is not defined in definitions.services\n")
+
+		// The other pipelines are pulled as well
+		runtime.pulled = nil
+		_, err = execute()
+		require.Error(t, err)
+		assert.Equal(t, "failed to resolve custom:undefined", err.Error())
+		assert.ElementsMatch(t, []string{"node:20", "postgres:15"}, runtime.pulled)
+	})
+
+	t.Run("pipes", func(t *testing.T) {
+		runtime := useFakeRuntime(t)
+		runtime.missing = map[string]bool{"bitbucketpipelines/aws-s3-deploy:1.1.0": true}
+
+		output, err := execute("custom:deploy")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"bitbucketpipelines/aws-s3-deploy:1.1.0"}, runtime.pulled)
+		assert.Contains(t, output, "golang:1.21: already present\n")
+	})
+
+	t.Run("rewritten images", func(t *testing.T) {
+		runtime := useFakeRuntime(t)
+		runtime.missing = map[string]bool{"mirror.local/library/node:18": true}
+		require.NoError(t, os.WriteFile("bitbucket-runner.yml", []byte("version: \"1.0\"\ndefaults:\n  image: alpine\n  timeout: 60\ndocker:\n  rewrites:\n    - match: node:18\n      replace: mirror.local/library/node:18\n"), 0644))
+		defer os.Remove("bitbucket-runner.yml")
+
+		output, err := execute("custom:package")
+		require.NoError(t, err)
+		assert.Empty(t, runtime.pulled)
+		assert.Contains(t, output, "golang:1.21: already present\n")
+
+		output, err = execute("default")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"mirror.local/library/node:18"}, runtime.pulled)
+		assert.Contains(t, output, "mirror.local/library/node:18 (for node:18): 3 of 4 layers downloaded")
+	})
+
+	t.Run("invalid jobs", func(t *testing.T) {
+		useFakeRuntime(t)
+		_, err := execute("--jobs", "0")
+		require.Error(t, err)
+		assert.Equal(t, "--jobs must be at least 1, got 0", err.Error())
+	})
+}
+
+func TestValidateCommand(t *testing.T) {
+	tmpDir := t.TempDir()
+	oldWd, _ := os.Getwd()
+	defer os.Chdir(oldWd)
+	os.Chdir(tmpDir)
+	defer func() { validateStrict, validateDisable, validateOutput, validatePipeline = false, "", "text", "" }()
+
+	execute := func(content string, args ...string) (string, error) {
+		require.NoError(t, os.WriteFile("bitbucket-pipelines.yml", []byte(content), 0644))
+		testCmd := &cobra.Command{Use: "test"}
+		testCmd.AddCommand(rootCmd)
+		var output bytes.Buffer
+		testCmd.SetOut(&output)
+		testCmd.SetErr(&output)
+		testCmd.SetArgs(append([]string{"bitbucket-runner", "validate"}, args...))
+		err := testCmd.Execute()
+		return output.String(), err
+	}
+	exitCode := func(err error) int {
+		var exit *exitError
+		if errors.As(err, &exit) {
+			return exit.Code
+		}
+		return -1
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		output, err := execute("pipelines:\n  default:\n    - step:\n        script: [make]\n")
+		require.NoError(t, err)
+		assert.Equal(t, "bitbucket-pipelines.yml is valid\n", output)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		output, err := execute("pipelines:\n  default:\n    - step:\n        name: Build\n    - parallel:\n        - step:\n            script: [make]\n")
+		assert.Equal(t, 1, exitCode(err))
+		assert.Equal(t, `bitbucket-pipelines.yml:3:7: error: step 'Build' has no script
+bitbucket-pipelines.yml:5:7: warning: parallel group has a single step, it runs like a regular step
+bitbucket-pipelines.yml is invalid: 1 error, 1 warning
+`, output)
+	})
+
+	t.Run("warnings", func(t *testing.T) {
+		content := "pipelines:\n  default:\n    - parallel:\n        - step:\n            script: [make]\n"
+		output, err := execute(content)
+		require.NoError(t, err)
+		assert.Contains(t, output, "bitbucket-pipelines.yml is valid with 1 warning")
+
+		_, err = execute(content, "--strict")
+		assert.Equal(t, 1, exitCode(err))
+	})
+
+	t.Run("unknown fields", func(t *testing.T) {
+		output, err := execute("pipelines:\n  default:\n    - step:\n        script: [make]\n        after_script: [make clean]\n")
+		assert.Equal(t, 1, exitCode(err))
+		assert.Contains(t, output, `bitbucket-pipelines.yml:5:9: error: unknown field "after_script" in step, did you mean "after-script"?`)
+	})
+
+	t.Run("disable rules", func(t *testing.T) {
+		content := "pipelines:\n  default:\n    - step:\n        services: [redis]\n        script: [make]\n"
+		output, err := execute(content)
+		assert.Equal(t, 1, exitCode(err))
+		assert.Contains(t, output, "bitbucket-pipelines.yml:4:20: error: service 'redis' is not defined in definitions.services [undefined-service]")
+
+		output, err = execute(content, "--disable", "undefined-service")
+		require.NoError(t, err)
+		assert.Equal(t, "bitbucket-pipelines.yml is valid\n", output)
+
+		_, err = execute(content, "--disable", "undefined-services")
+		assert.Equal(t, 2, exitCode(err))
+		assert.Contains(t, err.Error(), "did you mean 'undefined-service'?")
+		validateDisable = ""
+	})
+
+	t.Run("pipeline", func(t *testing.T) {
+		defer func() { validatePipeline = "" }()
+		content := "clone:\n  depth: shallow\npipelines:\n  default:\n    - step:\n        name: Build\n  branches:\n    'release/*':\n      - step:\n          script: [make]\n"
+
+		output, err := execute(content, "--pipeline", "branches:release/1.0")
+		assert.Equal(t, 1, exitCode(err))
+		assert.Equal(t, `bitbucket-pipelines.yml:2:10: error: clone depth must be a whole number, found 'shallow'
+bitbucket-pipelines.yml is invalid: 1 error, 0 warnings
+`, output)
+
+		output, err = execute(content, "--pipeline", "default")
+		assert.Equal(t, 1, exitCode(err))
+		assert.Contains(t, output, "bitbucket-pipelines.yml:5:7: error: step 'Build' has no script\n")
+
+		output, err = execute(content, "--pipeline", "custom:deploy")
+		assert.Equal(t, 1, exitCode(err))
+		assert.Contains(t, output, "bitbucket-pipelines.yml:3:1: error: pipeline 'custom:deploy' is not defined")
+
+		_, err = execute(content, "--pipeline", "nightly")
+		assert.Equal(t, 2, exitCode(err))
+	})
+
+	t.Run("runner configuration", func(t *testing.T) {
+		require.NoError(t, os.WriteFile("bitbucket-runner.yml", []byte("version: \"1.0\"\ndefaults:\n  image: alpine\n  timeout: 60\ndocker:\n  pull_policy: always\n"), 0644))
+		defer os.Remove("bitbucket-runner.yml")
+
+		output, err := execute("pipelines:\n  default:\n    - step:\n        script: [make]\n")
+		assert.Equal(t, 1, exitCode(err))
+		assert.Contains(t, output, "bitbucket-pipelines.yml is valid\n")
+		assert.Contains(t, output, `bitbucket-runner.yml:6:3: error: unknown field "pull_policy" in docker, did you mean "pullPolicy"?`)
+	})
+
+	t.Run("json and sarif output", func(t *testing.T) {
+		defer func() { validateOutput = "text" }()
+		content := "pipelines:\n  default:\n    - step:\n        name: Build\n"
+
+		output, err := execute(content, "-o", "json")
+		assert.Equal(t, 1, exitCode(err))
+		var report validation.Report
+		require.NoError(t, json.Unmarshal([]byte(output), &report))
+		assert.Equal(t, validation.ReportVersion, report.Version)
+		assert.False(t, report.Valid)
+		require.Len(t, report.Files, 1)
+		assert.Equal(t, "step 'Build' has no script", report.Files[0].Diagnostics[0].Message)
+		assert.Len(t, report.Rules, len(validation.Rules))
+
+		output, err = execute(content, "-o", "sarif")
+		assert.Equal(t, 1, exitCode(err))
+		var log validation.SARIFLog
+		require.NoError(t, json.Unmarshal([]byte(output), &log))
+		assert.Equal(t, "2.1.0", log.Version)
+		require.Len(t, log.Runs[0].Results, 1)
+		assert.Equal(t, "bitbucket-pipelines.yml", log.Runs[0].Results[0].Locations[0].PhysicalLocation.ArtifactLocation.URI)
+
+		_, err = execute(content, "-o", "xml")
+		assert.Equal(t, 2, exitCode(err))
+		assert.Contains(t, err.Error(), "unsupported output format")
+	})
+
+	t.Run("unreadable file", func(t *testing.T) {
+		_, err := execute("", "missing.yml")
+		assert.Equal(t, 2, exitCode(err))
+		assert.Contains(t, err.Error(), "failed to read pipeline config")
+	})
+}
+
+func TestLintCommand(t *testing.T) {
+	tmpDir := t.TempDir()
+	oldWd, _ := os.Getwd()
+	defer os.Chdir(oldWd)
+	os.Chdir(tmpDir)
+	defer func() { lintFix, lintStrict, lintDisable, lintOutput, lintPipeline = false, false, "", "text", "" }()
+
+	execute := func(content string, args ...string) (string, error) {
+		require.NoError(t, os.WriteFile("bitbucket-pipelines.yml", []byte(content), 0644))
+		testCmd := &cobra.Command{Use: "test"}
+		testCmd.AddCommand(rootCmd)
+		var output bytes.Buffer
+		testCmd.SetOut(&output)
+		testCmd.SetErr(&output)
+		testCmd.SetArgs(append([]string{"bitbucket-runner", "lint"}, args...))
+		err := testCmd.Execute()
+		return output.String(), err
+	}
+	exitCode := func(err error) int {
+		var exit *exitError
+		if errors.As(err, &exit) {
+			return exit.Code
+		}
+		return -1
+	}
+	content := "image: node:latest\npipelines:\n  default:\n    - step:\n        caches: [pip]\n        script: [npm ci, pip install .]\n"
+
+	t.Run("warnings", func(t *testing.T) {
+		output, err := execute(content)
+		require.NoError(t, err)
+		assert.Equal(t, `bitbucket-pipelines.yml:1:8: warning: image 'node:latest' uses the latest tag, pin it to a version [unpinned-image]
+bitbucket-pipelines.yml:4:7: warning: step runs 'npm ci' without the node cache [missing-cache]
+bitbucket-pipelines.yml is valid with 2 warnings
+`, output)
+
+		_, err = execute(content, "--strict")
+		assert.Equal(t, 1, exitCode(err))
+		lintStrict = false
+	})
+
+	t.Run("severities from the runner configuration", func(t *testing.T) {
+		require.NoError(t, os.WriteFile("bitbucket-runner.yml", []byte("version: \"1.0\"\ndefaults:\n  image: alpine\n  timeout: 60\nlint:\n  rules:\n    unpinned-image: error\n    missing-cache: off\n"), 0644))
+		defer os.Remove("bitbucket-runner.yml")
+
+		output, err := execute(content)
+		assert.Equal(t, 1, exitCode(err))
+		assert.Contains(t, output, "bitbucket-pipelines.yml:1:8: error: image 'node:latest' uses the latest tag, pin it to a version [unpinned-image]\nbitbucket-pipelines.yml is invalid: 1 error, 0 warnings\n")
+	})
+
+	t.Run("fix", func(t *testing.T) {
+		output, err := execute(content, "--fix")
+		require.NoError(t, err)
+		assert.Contains(t, output, "bitbucket-pipelines.yml: fixed 1 problem\n")
+		assert.Contains(t, output, "bitbucket-pipelines.yml is valid with 1 warning\n")
+
+		data, err := os.ReadFile("bitbucket-pipelines.yml")
+		require.NoError(t, err)
+		assert.Contains(t, string(data), "caches: [node, pip]")
+		lintFix = false
+	})
+}
+
+func TestSchemaCommand(t *testing.T) {
+	execute := func(args ...string) (string, error) {
+		testCmd := &cobra.Command{Use: "test"}
+		testCmd.AddCommand(rootCmd)
+		var output bytes.Buffer
+		testCmd.SetOut(&output)
+		testCmd.SetErr(&output)
+		testCmd.SetArgs(append([]string{"bitbucket-runner", "schema"}, args...))
+		err := testCmd.Execute()
+		return output.String(), err
+	}
+
+	for kind, id := range map[string]string{"pipeline": "bitbucket-pipelines.schema.json", "runner": "bitbucket-runner.schema.json"} {
+		output, err := execute(kind)
+		require.NoError(t, err)
+		var schema validation.Schema
+		require.NoError(t, json.Unmarshal([]byte(output), &schema))
+		assert.Equal(t, id, schema.ID)
+	}
+
+	_, err := execute("pipelines")
+	assert.Error(t, err)
+}
+
+func TestFmtCommand(t *testing.T) {
+	tmpDir := t.TempDir()
+	oldWd, _ := os.Getwd()
+	defer os.Chdir(oldWd)
+	os.Chdir(tmpDir)
+	defer func() { fmtCheck, fmtDiff, fmtPipeline = false, false, "" }()
+
+	execute := func(content string, args ...string) (string, error) {
+		require.NoError(t, os.WriteFile("bitbucket-pipelines.yml", []byte(content), 0644))
+		testCmd := &cobra.Command{Use: "test"}
+		testCmd.AddCommand(rootCmd)
+		var output bytes.Buffer
+		testCmd.SetOut(&output)
+		testCmd.SetErr(&output)
+		testCmd.SetArgs(append([]string{"bitbucket-runner", "fmt"}, args...))
+		err := testCmd.Execute()
+		return output.String(), err
+	}
+	exitCode := func(err error) int {
+		var exit *exitError
+		if errors.As(err, &exit) {
+			return exit.Code
+		}
+		return -1
+	}
+	unformatted := "pipelines:\n    default:\n      - step:\n          script: ['make']\n          name: Build\n"
+	formatted := "pipelines:\n  default:\n    - step:\n        name: Build\n        script: [make]\n"
+
+	t.Run("check", func(t *testing.T) {
+		output, err := execute(unformatted, "--check")
+		assert.Equal(t, 1, exitCode(err))
+		assert.Equal(t, "bitbucket-pipelines.yml\n", output)
+
+		output, err = execute(formatted, "--check")
+		require.NoError(t, err)
+		assert.Empty(t, output)
+		fmtCheck = false
+	})
+
+	t.Run("diff", func(t *testing.T) {
+		output, err := execute(unformatted, "--diff")
+		require.NoError(t, err)
+		assert.Contains(t, output, "--- bitbucket-pipelines.yml\n+++ bitbucket-pipelines.yml\n")
+		assert.Contains(t, output, "-          script: ['make']\n")
+		assert.Contains(t, output, "+        script: [make]\n")
+
+		data, err := os.ReadFile("bitbucket-pipelines.yml")
+		require.NoError(t, err)
+		assert.Equal(t, unformatted, string(data))
+		fmtDiff = false
+	})
+
+	t.Run("write", func(t *testing.T) {
+		output, err := execute(unformatted)
+		require.NoError(t, err)
+		assert.Equal(t, "bitbucket-pipelines.yml: formatted\n", output)
+
+		data, err := os.ReadFile("bitbucket-pipelines.yml")
+		require.NoError(t, err)
+		assert.Equal(t, formatted, string(data))
+	})
+
+	t.Run("pipeline", func(t *testing.T) {
+		defer func() { fmtPipeline = "" }()
+		content := "pipelines:\n    default:\n      - step:\n          script: ['make']\n          name: Build\n    custom:\n      deploy:\n        - step:\n            script: ['./deploy.sh']\n            name: Deploy\n"
+
+		output, err := execute(content, "--pipeline", "custom:deploy")
+		require.NoError(t, err)
+		assert.Equal(t, "bitbucket-pipelines.yml: formatted\n", output)
+		data, err := os.ReadFile("bitbucket-pipelines.yml")
+		require.NoError(t, err)
+		assert.Equal(t, "pipelines:\n    default:\n      - step:\n          script: ['make']\n          name: Build\n    custom:\n      deploy:\n        - step:\n            name: Deploy\n            script: [./deploy.sh]\n", string(data))
+
+		_, err = execute(content, "--pipeline", "custom:release")
+		assert.Equal(t, 2, exitCode(err))
+	})
+
+	t.Run("invalid YAML", func(t *testing.T) {
+		_, err := execute("pipelines: [\n")
+		assert.Equal(t, 2, exitCode(err))
+	})
 }
 
 func TestCommandRegistration(t *testing.T) {
 	t.Run("all expected commands are registered", func(t *testing.T) {
-		expectedCommands := []string{"run", "list", "help", "completion"}
+		expectedCommands := []string{"run", "list", "pull", "help", "completion"}
 		actualCommands := make(map[string]bool)
 
 		for _, cmd := range rootCmd.Commands() {
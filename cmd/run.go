@@ -1,38 +1,483 @@
 package cmd
 
 import (
-	"bitbucket-runner/internal/parser"
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"bitbucket-runner/internal/docker"
+	"bitbucket-runner/internal/executor"
+	"bitbucket-runner/internal/git"
+	"bitbucket-runner/internal/models"
+	"bitbucket-runner/internal/parser"
+	"bitbucket-runner/internal/runstore"
+	"bitbucket-runner/internal/transform"
+	"bitbucket-runner/internal/validation"
 
 	"github.com/spf13/cobra"
 )
 
+var (
+	runResume       bool
+	runDebug        bool
+	runStepThrough  bool
+	runDryRun       bool
+	runOutput       string
+	runChangesSince string
+	runPR           bool
+	runDestination  string
+	runPRID         string
+	runRef          string
+	runPipeline     string
+	runVars         []string
+	runVarsFile     string
+)
+
+// newContainerRuntime creates the runtime steps are executed with. It is a
+// variable so tests can replace Docker with a fake runtime.
+var newContainerRuntime = func(config models.DockerConfig) executor.ContainerRuntime {
+	return docker.NewCLI(config)
+}
+
 // runCmd represents the run command
 var runCmd = &cobra.Command{
-	Use:   "run",
+	Use:   "run [run-id]",
 	Short: "Run a Bitbucket pipeline",
 	Long: `Run a Bitbucket pipeline by parsing the bitbucket-pipelines.yml file
-and executing the defined steps in sequence.`,
+and executing the defined steps in sequence.
+
+Every run is persisted together with its artifacts. A failed run can be
+resumed from its first failed step with --resume, reusing the variables,
+build number and artifacts of the original run. Without a run ID the most
+recent failed run is resumed.
+
+With --debug the container of a failed step is kept running together with
+its services and an interactive shell is attached to it. With --step-through
+the run pauses before every step so the workspace can be inspected.
+Containers are removed once the debug session ends.
+
+With --dry-run the execution plan is resolved and printed without contacting
+Docker: step order, parallel groups, effective images, services, caches,
+artifacts, masked environment, timeouts and conditions. The command exits
+non-zero when the plan cannot be resolved.
+
+A bitbucket-pipelines.local.yml file next to bitbucket-pipelines.yml, kept
+out of version control, is merged onto the configuration by pipeline and
+step name to swap images, add environment variables or skip steps locally.
+
+The transforms of the runner configuration rewrite the pipeline
+configuration after it is parsed: each one receives it as JSON on its
+standard input and writes the new configuration on its standard output,
+which is validated before the run. --dry-run shows the transformed plan.
+
+Changeset conditions are evaluated against the files changed between HEAD
+and its previous commit, or the revision given with --changes-since. Steps
+whose condition is not met are skipped. Outside a git repository, or on the
+first commit, conditional steps always run.
+
+With --pr the pull-requests pipeline matching the checked out branch runs on
+the merge of its last commit into --destination, as Bitbucket does. The merge
+is built in a temporary work tree and the run fails when it has conflicts.
+Changeset conditions then compare against the merge base with the
+destination. Uncommitted changes are not part of the merge.
+
+With --ref the pipeline runs as it was at a commit, branch or tag: the
+configuration is read from that revision and the revision is checked out
+into a temporary work tree, so the working tree is left untouched.
+BITBUCKET_COMMIT and BITBUCKET_BRANCH or BITBUCKET_TAG describe the revision.
+
+Pipelines are selected with --pipeline, which takes a selector: default,
+branches:<name>, tags:<name>, pull-requests:<name> or custom:<name>. Branch
+and tag names are matched against the glob patterns of the configuration.
+
+The variables of custom pipelines are taken from --var and --vars-file,
+prompted for on a terminal, or fall back to their default, and must be one
+of their allowed values.`,
+	Args:         cobra.MaximumNArgs(1),
+	SilenceUsage: true,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		config, err := parser.ParsePipelineConfig("bitbucket-pipelines.yml")
+		if len(args) > 0 && !runResume {
+			return errors.New("a run ID can only be given together with --resume")
+		}
+		if runDryRun && (runResume || runDebug || runStepThrough) {
+			return errors.New("--dry-run cannot be combined with --resume, --debug or --step-through")
+		}
+		if runResume && runChangesSince != "" {
+			return errors.New("--changes-since cannot be combined with --resume, the changeset of the original run is reused")
+		}
+		if runPR && runDestination == "" {
+			return errors.New("--pr requires --destination")
+		}
+		if runDestination != "" && !runPR {
+			return errors.New("--destination can only be used together with --pr")
+		}
+		if runResume && runPR {
+			return errors.New("--pr cannot be combined with --resume, the pull request of the original run is reused")
+		}
+		if runRef != "" && (runResume || runPR) {
+			return errors.New("--ref cannot be combined with --resume or --pr")
+		}
+		if runResume && (runPipeline != "default" || len(runVars) > 0 || runVarsFile != "") {
+			return errors.New("--pipeline, --var and --vars-file cannot be combined with --resume, the pipeline and variables of the original run are reused")
+		}
+		if _, err := models.ParseSelector(runPipeline); err != nil {
+			return err
+		}
+		if runPR && runPipeline != "default" {
+			return errors.New("--pipeline cannot be combined with --pr, the pipeline is selected by the source branch")
+		}
+		if runOutput != "table" && runOutput != "json" {
+			return fmt.Errorf("unsupported output format %q (expected table or json)", runOutput)
+		}
+
+		runnerConfig, err := loadRunnerConfig()
+		if err != nil {
+			return err
+		}
+
+		sourceDir, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+		store := runstore.NewStore(filepath.Join(sourceDir, runnerConfig.Defaults.StateDir, "runs"))
+
+		var resumed *models.ExecutionContext
+		if runResume {
+			if resumed, err = loadRunToResume(store, args); err != nil {
+				return err
+			}
+		}
+
+		// A run started with --ref keeps running the revision it was
+		// started on when it is resumed
+		var ref *git.Ref
+		revision := ""
+		switch {
+		case resumed != nil:
+			revision = resumed.Revision
+		case runRef != "":
+			repo, err := git.Open(cmd.Context(), sourceDir)
+			if err != nil {
+				return fmt.Errorf("--ref requires a git repository: %w", err)
+			}
+			if ref, err = repo.ResolveRef(cmd.Context(), runRef); err != nil {
+				return err
+			}
+			revision = ref.Commit
+		}
+
+		options := validation.LintOptions(runnerConfig.Lint)
+		config, err := loadPipelineConfig(cmd.Context(), sourceDir, revision, options)
 		if err != nil {
 			return fmt.Errorf("Error parsing pipeline config: %w", err)
 		}
-		// Using cmd.OutOrStdout() to respect output redirection in tests.
-		fmt.Fprintf(cmd.OutOrStdout(), "Parsed pipeline config: %+v\n", config)
+		importer := parser.NewImporter(runnerConfig.Imports, options)
+		if err := importer.Resolve(cmd.Context(), config); err != nil {
+			return err
+		}
+		if !runDryRun {
+			// Using cmd.OutOrStdout() to respect output redirection in tests.
+			if revision != "" {
+				fmt.Fprintf(cmd.OutOrStdout(), "Parsed pipeline config from bitbucket-pipelines.yml at %s\n", revision)
+			} else {
+				fmt.Fprintf(cmd.OutOrStdout(), "Parsed pipeline config from bitbucket-pipelines.yml\n")
+			}
+		}
+
+		override := ""
+		overridden, err := parser.ApplyOverrideFile(parser.LocalPipelineFile, config)
+		if err != nil {
+			return err
+		}
+		if overridden {
+			override = parser.LocalPipelineFile
+			if !runDryRun {
+				fmt.Fprintf(cmd.OutOrStdout(), "Applied local overrides from %s\n", parser.LocalPipelineFile)
+			}
+		}
+
+		var transforms []string
+		for _, hook := range runnerConfig.Transforms {
+			transforms = append(transforms, hook.Label())
+		}
+		if len(transforms) > 0 {
+			if config, err = transform.Apply(cmd.Context(), config, runnerConfig.Transforms, sourceDir, options, cmd.ErrOrStderr()); err != nil {
+				return err
+			}
+			// Transforms may add imports of their own
+			if err := importer.Resolve(cmd.Context(), config); err != nil {
+				return err
+			}
+			if !runDryRun {
+				fmt.Fprintf(cmd.OutOrStdout(), "Transformed pipeline config with %s\n", strings.Join(transforms, ", "))
+			}
+		}
+
+		ec := resumed
+		var pr *pullRequest
+		if resumed != nil {
+			ec.PipelineConfig = config
+			pr, _ = pullRequestFromContext(ec)
+		} else {
+			buildNumber, err := store.NextBuildNumber()
+			if err != nil {
+				return err
+			}
+			ec = models.NewExecutionContext(config, sourceDir)
+			ec.PipelineName = runPipeline
+			ec.BuildNumber = buildNumber
+
+			head, destination := "HEAD", ""
+			switch {
+			case runPR:
+				if pr, err = selectPullRequestPipeline(cmd.Context(), config, ec, sourceDir); err != nil {
+					return err
+				}
+				destination = pr.DestinationCommit
+			case ref != nil:
+				ec.Revision = ref.Commit
+				for key, value := range refVariables(ref) {
+					ec.SetEnvironmentVariable(key, value)
+				}
+				head = ref.Commit
+			}
+
+			ec.Changeset, err = resolveChangeset(cmd.Context(), sourceDir, head, runChangesSince, destination)
+			if err != nil {
+				return err
+			}
+		}
+
+		pipeline, err := selectPipeline(config, ec)
+		if err != nil {
+			return err
+		}
+
+		in := bufio.NewReader(cmd.InOrStdin())
+		if resumed == nil {
+			provided := make(map[string]string)
+			if runVarsFile != "" {
+				if err := readVarsFile(runVarsFile, provided); err != nil {
+					return err
+				}
+			}
+			if err := parseAssignments(runVars, provided); err != nil {
+				return err
+			}
+
+			var prompt *bufio.Reader
+			if isTerminal(cmd.InOrStdin()) {
+				prompt = in
+			}
+			variables, err := resolveVariables(ec.PipelineName, pipeline.Variables(), provided, prompt, cmd.OutOrStdout())
+			if err != nil {
+				return err
+			}
+			for name, value := range variables {
+				ec.SetEnvironmentVariable(name, value)
+			}
+		}
+
+		// Pull request pipelines run on the merge commit and --ref runs on
+		// a checkout of the revision. Both are rebuilt from the recorded
+		// commits when a run is resumed.
+		workspaceDir := sourceDir
+		if (pr != nil || ec.Revision != "") && !runDryRun {
+			repo, err := git.Open(cmd.Context(), sourceDir)
+			if err != nil {
+				return err
+			}
+			slug := filepath.Base(sourceDir)
+
+			if pr != nil {
+				dir, cleanup, err := pr.checkoutMerge(cmd.Context(), repo, slug)
+				if err != nil {
+					return err
+				}
+				defer cleanup()
+				workspaceDir = dir
+				fmt.Fprintf(cmd.OutOrStdout(), "Merged %s into %s\n", pr.SourceBranch, pr.DestinationBranch)
+			} else {
+				worktree, cleanup, err := checkoutRevision(cmd.Context(), repo, ec.Revision, slug)
+				if err != nil {
+					return err
+				}
+				defer cleanup()
+				workspaceDir = worktree.Dir
+			}
+		}
+
+		engine := executor.NewEngine(newContainerRuntime(runnerConfig.Docker), runnerConfig, store, workspaceDir, cmd.OutOrStdout())
+		engine.SetCacheDir(filepath.Join(sourceDir, runnerConfig.Defaults.StateDir, "caches"))
+		if runDebug || runStepThrough {
+			engine.SetDebugOptions(executor.DebugOptions{
+				ShellOnFailure: runDebug,
+				StepThrough:    runStepThrough,
+				In:             cmd.InOrStdin(),
+				Prompt:         in,
+				TTY:            isTerminal(cmd.InOrStdin()),
+			})
+		}
+
+		if resumed != nil {
+			step := ec.ResumeFromFailure()
+			fmt.Fprintf(cmd.OutOrStdout(), "Resuming run %s (build #%d) from step %d\n", ec.ID, ec.BuildNumber, step+1)
+		} else {
+			engine.InitVariables(ec)
+		}
+
+		if runDryRun {
+			plan, err := engine.Plan(pipeline, ec)
+			if err != nil {
+				return fmt.Errorf("failed to resolve pipeline: %w", err)
+			}
+			plan.Override = override
+			plan.Transforms = transforms
+			return printPlan(cmd.OutOrStdout(), plan.Masked(), runOutput)
+		}
+
+		if ec.ID == "" {
+			ec.ID = runstore.NewRunID()
+			fmt.Fprintf(cmd.OutOrStdout(), "Starting run %s (build #%d)\n", ec.ID, ec.BuildNumber)
+		}
+
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt)
+		defer stop()
+
+		if err := engine.Execute(ctx, pipeline, ec); err != nil {
+			if ec.Status == models.ExecutionStatusFailed || ec.Status == models.ExecutionStatusCancelled {
+				fmt.Fprintf(cmd.OutOrStdout(), "Run %s %s. Resume it with: bitbucket-runner run --resume %s\n", ec.ID, ec.Status, ec.ID)
+			}
+			return err
+		}
+
+		fmt.Fprintf(cmd.OutOrStdout(), "Run %s completed in %s\n", ec.ID, ec.GetTotalDuration().Round(time.Millisecond))
 		return nil
 	},
 }
 
+// loadRunToResume loads the run given as argument, or the most recent failed
+// run when no run ID is given.
+func loadRunToResume(store *runstore.Store, args []string) (*models.ExecutionContext, error) {
+	if len(args) == 0 {
+		ec, err := store.LatestFailed()
+		if errors.Is(err, runstore.ErrNoRuns) {
+			return nil, errors.New("no failed run to resume")
+		}
+		return ec, err
+	}
+
+	ec, err := store.Load(args[0])
+	if err != nil {
+		return nil, err
+	}
+	if ec.Status == models.ExecutionStatusCompleted {
+		return nil, fmt.Errorf("run %s completed successfully, nothing to resume", ec.ID)
+	}
+	return ec, nil
+}
+
+// selectPullRequestPipeline selects the pull-requests pipeline of the
+// checked out branch and sets the pull request variables
+func selectPullRequestPipeline(ctx context.Context, config *models.PipelineConfig, ec *models.ExecutionContext, dir string) (*pullRequest, error) {
+	repo, err := git.Open(ctx, dir)
+	if err != nil {
+		return nil, fmt.Errorf("--pr requires a git repository: %w", err)
+	}
+	pr, err := newPullRequest(ctx, repo, runDestination, runPRID)
+	if err != nil {
+		return nil, err
+	}
+
+	_, pattern, ok := config.GetPullRequestPipeline(pr.SourceBranch)
+	if !ok {
+		return nil, fmt.Errorf("no pull-requests pipeline matches branch '%s'", pr.SourceBranch)
+	}
+	ec.PipelineName = "pull-requests:" + pattern
+	for key, value := range pr.variables() {
+		ec.SetEnvironmentVariable(key, value)
+	}
+	return pr, nil
+}
+
+// resolveChangeset computes the files changed between head and since. When
+// since is empty it compares against the merge base with destination, or
+// the previous commit of head without a destination. It returns nil when there is
+// nothing to compare against.
+func resolveChangeset(ctx context.Context, dir, head, since, destination string) (*models.Changeset, error) {
+	repo, err := git.Open(ctx, dir)
+	if err != nil {
+		if since != "" {
+			return nil, fmt.Errorf("--changes-since requires a git repository: %w", err)
+		}
+		return nil, nil
+	}
+
+	head, err = repo.ResolveRevision(ctx, head)
+	if err != nil {
+		return nil, nil
+	}
+
+	base := since
+	switch {
+	case base == "" && destination != "":
+		if base, err = repo.MergeBase(ctx, head, destination); err != nil {
+			return nil, err
+		}
+	case base == "":
+		base = head + "~1"
+	}
+	baseHash, err := repo.ResolveRevision(ctx, base)
+	if err != nil {
+		if since != "" {
+			return nil, err
+		}
+		// The first commit has no previous commit to compare against
+		return nil, nil
+	}
+
+	files, err := repo.ChangedFiles(ctx, baseHash, head)
+	if err != nil {
+		return nil, err
+	}
+	return &models.Changeset{Base: baseHash, Head: head, Files: files}, nil
+}
+
+// isTerminal reports whether r is an interactive terminal
+func isTerminal(r io.Reader) bool {
+	file, ok := r.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
 func init() {
 	rootCmd.AddCommand(runCmd)
 
-	// Here you will define your flags and configuration settings.
-	// Cobra supports Persistent Flags which will work for this command
-	// and all subcommands, e.g.:
-	// runCmd.PersistentFlags().String("foo", "", "A help for foo")
-
-	// Cobra supports local flags which will only run when this command
-	// is called directly, e.g.:
-	// runCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
-}
\ No newline at end of file
+	runCmd.Flags().BoolVar(&runResume, "resume", false, "resume a failed run from its first failed step")
+	runCmd.Flags().BoolVar(&runDebug, "debug", false, "open a shell in the container of a failed step")
+	runCmd.Flags().BoolVar(&runStepThrough, "step-through", false, "pause before every step")
+	runCmd.Flags().BoolVar(&runDryRun, "dry-run", false, "print the execution plan without running it")
+	runCmd.Flags().StringVar(&runChangesSince, "changes-since", "", "evaluate changeset conditions against the changes since this git revision")
+	runCmd.Flags().BoolVar(&runPR, "pr", false, "run the pull-requests pipeline of the checked out branch")
+	runCmd.Flags().StringVar(&runDestination, "destination", "", "destination branch of the pull request")
+	runCmd.Flags().StringVar(&runPRID, "pr-id", "1", "pull request ID exposed as BITBUCKET_PR_ID")
+	runCmd.Flags().StringVar(&runRef, "ref", "", "run the pipeline as it was at a commit, branch or tag")
+	runCmd.Flags().StringVar(&runPipeline, "pipeline", "default", "pipeline selector: default, branches:<name>, tags:<name>, pull-requests:<name> or custom:<name>")
+	runCmd.RegisterFlagCompletionFunc("pipeline", completeSelectors)
+	runCmd.Flags().StringArrayVar(&runVars, "var", nil, "value of a custom pipeline variable as NAME=VALUE, repeatable")
+	runCmd.Flags().StringVar(&runVarsFile, "vars-file", "", "file with NAME=VALUE lines for custom pipeline variables")
+	runCmd.Flags().StringVarP(&runOutput, "output", "o", "table", "dry-run output format: table or json")
+}
@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"bitbucket-runner/internal/models"
+	"bitbucket-runner/internal/validation"
+)
+
+// loadRunnerConfig loads the runner configuration from the default
+// locations, refusing files with unknown fields or invalid values. Relative
+// clone directories of imports are relative to the configuration file.
+func loadRunnerConfig() (*models.RunnerConfig, error) {
+	path, ok := models.RunnerConfigPath()
+	if !ok {
+		return models.NewDefaultRunnerConfig(), nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file %s: %w", path, err)
+	}
+	if err := validation.ValidateRunnerConfig(path, data).Err(); err != nil {
+		return nil, fmt.Errorf("invalid runner configuration:\n%w", err)
+	}
+	config, err := models.LoadRunnerConfigFromFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for repository, dir := range config.Imports {
+		if !filepath.IsAbs(dir) {
+			config.Imports[repository] = filepath.Join(filepath.Dir(path), dir)
+		}
+	}
+	return config, nil
+}
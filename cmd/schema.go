@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"encoding/json"
+
+	"bitbucket-runner/internal/validation"
+
+	"github.com/spf13/cobra"
+)
+
+// schemaCmd represents the schema command
+var schemaCmd = &cobra.Command{
+	Use:   "schema pipeline|runner",
+	Short: "Print the JSON Schema of a configuration file",
+	Long: `Print the JSON Schema of bitbucket-pipelines.yml (pipeline) or of the
+runner configuration (runner), generated from the structures the runner
+decodes them into. Editors use it for completion and validation, for
+instance with the YAML extension of VS Code:
+
+  bitbucket-runner schema pipeline > .vscode/bitbucket-pipelines.schema.json
+
+  # settings.json
+  "yaml.schemas": {
+    ".vscode/bitbucket-pipelines.schema.json": "bitbucket-pipelines.yml"
+  }`,
+	Args:      cobra.ExactValidArgs(1),
+	ValidArgs: []string{"pipeline", "runner"},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		schema := validation.PipelineSchema()
+		if args[0] == "runner" {
+			schema = validation.RunnerSchema()
+		}
+
+		encoder := json.NewEncoder(cmd.OutOrStdout())
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(schema)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(schemaCmd)
+}
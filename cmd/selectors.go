@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"strings"
+
+	"bitbucket-runner/internal/models"
+	"bitbucket-runner/internal/validation"
+
+	"github.com/spf13/cobra"
+)
+
+// selectPipeline returns the pipeline selected by ec.PipelineName and
+// records the selector of its definition, so a resumed run finds the same
+// pipeline. Selecting a concrete branch or tag sets BITBUCKET_BRANCH or
+// BITBUCKET_TAG unless the run already describes a revision.
+func selectPipeline(config *models.PipelineConfig, ec *models.ExecutionContext) (models.Pipeline, error) {
+	selector, err := models.ParseSelector(ec.PipelineName)
+	if err != nil {
+		return nil, err
+	}
+	pipeline, selected, err := config.Select(selector)
+	if err != nil {
+		return nil, err
+	}
+	ec.PipelineName = selected.String()
+
+	if !strings.ContainsAny(selector.Name, "*?[{") {
+		variable := ""
+		switch selector.Kind {
+		case models.PipelineKindBranches:
+			variable = "BITBUCKET_BRANCH"
+		case models.PipelineKindTags:
+			variable = "BITBUCKET_TAG"
+		}
+		if _, exists := ec.GetEnvironmentVariable(variable); variable != "" && !exists {
+			ec.SetEnvironmentVariable(variable, selector.Name)
+		}
+	}
+	return pipeline, nil
+}
+
+// completeSelectors completes the selectors of the pipelines defined in the
+// current directory
+func completeSelectors(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	var options validation.Options
+	if runnerConfig, err := loadRunnerConfig(); err == nil {
+		options = validation.LintOptions(runnerConfig.Lint)
+	}
+	config, err := loadPipelineConfig(cmd.Context(), ".", "", options)
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	var selectors []string
+	for _, selector := range config.Selectors() {
+		if value := selector.String(); strings.HasPrefix(value, toComplete) {
+			selectors = append(selectors, value)
+		}
+	}
+	return selectors, cobra.ShellCompDirectiveNoFileComp
+}
+
+// completeSelectorArg completes a single selector argument
+func completeSelectorArg(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	return completeSelectors(cmd, args, toComplete)
+}
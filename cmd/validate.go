@@ -0,0 +1,214 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"bitbucket-runner/internal/models"
+	"bitbucket-runner/internal/validation"
+
+	"github.com/spf13/cobra"
+)
+
+// Exit codes of the validate command
+const (
+	validateExitInvalid = 1
+	validateExitFailure = 2
+)
+
+var (
+	validateStrict   bool
+	validateDisable  string
+	validateOutput   string
+	validatePipeline string
+)
+
+// validateCmd represents the validate command
+var validateCmd = &cobra.Command{
+	Use:   "validate [file]",
+	Short: "Validate a pipeline configuration",
+	Long: `Validate bitbucket-pipelines.yml, or the given file, and report every
+problem found as file:line:column: severity: message. The runner
+configuration, when one is found, is validated too.
+
+Unknown fields are errors with a suggestion of the intended field, fields
+Bitbucket supports but the runner ignores are warnings.
+
+References across the definition are checked by rules, shown in brackets
+after each message, which --disable turns off and the lint.rules section of
+the runner configuration sets to error, warning or off:
+` + ruleList(validation.Rules) + `
+
+--pipeline limits the diagnostics of the pipelines section to those of the
+selected pipeline, given as for run; the other sections are checked whole.
+
+Errors make the configuration unusable, warnings point at likely mistakes.
+--output json prints a report in a stable format and --output sarif a
+SARIF 2.1.0 log for code scanning and code review tools, both with the
+rules checked, the positions and the fixes of the diagnostics.
+
+The command exits with 0 when there are no errors, 1 when there are errors
+(or warnings with --strict) and 2 when the file cannot be read or the
+options are invalid.`,
+	Args:          cobra.MaximumNArgs(1),
+	SilenceUsage:  true,
+	SilenceErrors: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		options, err := validationOptions(validateDisable, validatePipeline)
+		if err != nil {
+			return &exitError{Code: validateExitFailure, Err: err}
+		}
+		return checkConfigs(cmd, args, options, validateStrict, false, validateOutput)
+	},
+}
+
+// checkConfigs validates the pipeline file, the first argument or
+// bitbucket-pipelines.yml, and the runner configuration when one is found,
+// whose lint.rules adjust the severities of the rules. With fix, the fixes
+// are first applied to the pipeline file.
+func checkConfigs(cmd *cobra.Command, args []string, options validation.Options, strict, fix bool, output string) error {
+	if output != "text" && output != "json" && output != "sarif" {
+		return &exitError{Code: validateExitFailure, Err: fmt.Errorf("unsupported output format %q (expected text, json or sarif)", output)}
+	}
+	file := pipelineFile
+	if len(args) > 0 {
+		file = args[0]
+	}
+
+	var runnerPath string
+	var runnerDiagnostics validation.Diagnostics
+	if path, ok := models.RunnerConfigPath(); ok {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return &exitError{Code: validateExitFailure, Err: fmt.Errorf("failed to read runner config: %w", err)}
+		}
+		runnerPath, runnerDiagnostics = path, validation.ValidateRunnerConfig(path, data)
+		if !runnerDiagnostics.HasErrors() {
+			config, err := models.LoadRunnerConfigFromFile(path)
+			if err != nil {
+				return &exitError{Code: validateExitFailure, Err: err}
+			}
+			options.Severities = validation.LintOptions(config.Lint).Severities
+		}
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return &exitError{Code: validateExitFailure, Err: fmt.Errorf("failed to read pipeline config: %w", err)}
+	}
+	if fix {
+		fixed, count := validation.FixPipelineConfig(file, data, options)
+		if count > 0 {
+			if err := os.WriteFile(file, fixed, 0644); err != nil {
+				return &exitError{Code: validateExitFailure, Err: fmt.Errorf("failed to write pipeline config: %w", err)}
+			}
+			// Keep the reports machine readable
+			out := cmd.OutOrStdout()
+			if output != "text" {
+				out = cmd.ErrOrStderr()
+			}
+			fmt.Fprintf(out, "%s: fixed %s\n", file, plural(count, "problem"))
+		}
+		data = fixed
+	}
+
+	diagnostics := validation.ValidatePipelineConfig(file, data, options)
+	files := []validation.FileReport{validation.NewFileReport(file, diagnostics)}
+	if runnerPath != "" {
+		files = append(files, validation.NewFileReport(runnerPath, runnerDiagnostics))
+		diagnostics = append(diagnostics, runnerDiagnostics...)
+	}
+	if err := printReport(cmd.OutOrStdout(), validation.NewReport(options.CheckedRules(), files...), output); err != nil {
+		return &exitError{Code: validateExitFailure, Err: err}
+	}
+
+	if diagnostics.HasErrors() || (strict && len(diagnostics) > 0) {
+		return &exitError{Code: validateExitInvalid}
+	}
+	return nil
+}
+
+// printReport prints the report in the output format, the text format
+// listing the diagnostics of each file followed by a summary
+func printReport(out io.Writer, report validation.Report, output string) error {
+	switch output {
+	case "json":
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report)
+	case "sarif":
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(report.SARIF())
+	}
+
+	for _, file := range report.Files {
+		printDiagnostics(out, file.Path, file.Diagnostics)
+	}
+	return nil
+}
+
+// validationOptions parses the comma separated --disable rule list and the
+// --pipeline selector
+func validationOptions(disable, pipeline string) (validation.Options, error) {
+	var options validation.Options
+	for _, id := range strings.Split(disable, ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			options.Disabled = append(options.Disabled, id)
+		}
+	}
+	if pipeline != "" {
+		selector, err := models.ParseSelector(pipeline)
+		if err != nil {
+			return options, err
+		}
+		options.Pipeline = &selector
+	}
+	return options, validation.CheckRuleIDs(options.Disabled)
+}
+
+// ruleList describes the rules for the help
+func ruleList(rules []validation.Rule) string {
+	var lines []string
+	for _, rule := range rules {
+		lines = append(lines, fmt.Sprintf("  %-22s %s (%s)", rule.ID, rule.Description, rule.Severity))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// printDiagnostics prints the diagnostics followed by a summary
+func printDiagnostics(out io.Writer, file string, diagnostics validation.Diagnostics) {
+	for _, d := range diagnostics {
+		fmt.Fprintln(out, d)
+	}
+
+	errors, warnings := len(diagnostics.Errors()), len(diagnostics.Warnings())
+	switch {
+	case errors > 0:
+		fmt.Fprintf(out, "%s is invalid: %s, %s\n", file, plural(errors, "error"), plural(warnings, "warning"))
+	case warnings > 0:
+		fmt.Fprintf(out, "%s is valid with %s\n", file, plural(warnings, "warning"))
+	default:
+		fmt.Fprintf(out, "%s is valid\n", file)
+	}
+}
+
+func plural(count int, noun string) string {
+	if count == 1 {
+		return fmt.Sprintf("1 %s", noun)
+	}
+	return fmt.Sprintf("%d %ss", count, noun)
+}
+
+func init() {
+	rootCmd.AddCommand(validateCmd)
+
+	validateCmd.Flags().BoolVar(&validateStrict, "strict", false, "exit with status 1 on warnings too")
+	validateCmd.Flags().StringVar(&validateDisable, "disable", "", "disable the rules with these comma separated IDs")
+	validateCmd.Flags().StringVarP(&validateOutput, "output", "o", "text", "output format: text, json or sarif")
+	validateCmd.Flags().StringVar(&validatePipeline, "pipeline", "", "only report the problems of this pipeline in the pipelines section")
+	validateCmd.RegisterFlagCompletionFunc("pipeline", completeSelectors)
+}
@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"bitbucket-runner/internal/models"
+)
+
+// parseAssignments parses NAME=VALUE assignments, later ones winning
+func parseAssignments(assignments []string, values map[string]string) error {
+	for _, assignment := range assignments {
+		name, value, ok := strings.Cut(assignment, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return fmt.Errorf("invalid variable assignment %q (expected NAME=VALUE)", assignment)
+		}
+		values[name] = value
+	}
+	return nil
+}
+
+// readVarsFile reads NAME=VALUE lines from a file. Blank lines and lines
+// starting with # are ignored.
+func readVarsFile(path string, values map[string]string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read variables file: %w", err)
+	}
+
+	var assignments []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		assignments = append(assignments, line)
+	}
+
+	if err := parseAssignments(assignments, values); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// resolveVariables determines the value of every variable declared by a
+// pipeline. Provided values win over prompted ones, which win over
+// defaults. Without a prompt, variables lacking a value are an error.
+func resolveVariables(pipeline string, declared []models.Variable, provided map[string]string, prompt *bufio.Reader, out io.Writer) (map[string]string, error) {
+	known := make(map[string]bool, len(declared))
+	for _, variable := range declared {
+		known[variable.Name] = true
+	}
+	for name := range provided {
+		if !known[name] {
+			return nil, fmt.Errorf("variable '%s' is not declared by pipeline '%s'", name, pipeline)
+		}
+	}
+
+	values := make(map[string]string, len(declared))
+	for _, variable := range declared {
+		value, ok := provided[variable.Name]
+		switch {
+		case ok:
+		case prompt != nil:
+			var err error
+			if value, err = promptVariable(variable, prompt, out); err != nil {
+				return nil, err
+			}
+		case variable.Default != "":
+			value = variable.Default
+		default:
+			return nil, fmt.Errorf("variable '%s' of pipeline '%s' has no value, pass it with --var %s=<value>", variable.Name, pipeline, variable.Name)
+		}
+
+		if err := variable.Check(value); err != nil {
+			return nil, err
+		}
+		values[variable.Name] = value
+	}
+	return values, nil
+}
+
+// promptVariable asks for the value of a variable until a valid one is
+// entered. An empty answer selects the default.
+func promptVariable(variable models.Variable, prompt *bufio.Reader, out io.Writer) (string, error) {
+	label := variable.Name
+	if variable.Description != "" {
+		label += " (" + variable.Description + ")"
+	}
+	if len(variable.AllowedValues) > 0 {
+		label += " {" + strings.Join(variable.AllowedValues, ", ") + "}"
+	}
+	if variable.Default != "" {
+		label += " [" + variable.Default + "]"
+	}
+
+	for {
+		fmt.Fprintf(out, "%s: ", label)
+		line, err := prompt.ReadString('\n')
+		if err != nil && line == "" {
+			return "", fmt.Errorf("no value entered for variable '%s'", variable.Name)
+		}
+
+		value := strings.TrimSpace(line)
+		if value == "" {
+			value = variable.Default
+		}
+		if value == "" {
+			fmt.Fprintf(out, "A value is required\n")
+			continue
+		}
+		if err := variable.Check(value); err != nil {
+			fmt.Fprintf(out, "%v\n", err)
+			continue
+		}
+		return value, nil
+	}
+}
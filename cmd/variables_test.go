@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"bitbucket-runner/internal/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveVariables(t *testing.T) {
+	declared := []models.Variable{
+		{Name: "Environment", Default: "staging", AllowedValues: []string{"staging", "production"}},
+		{Name: "Version"},
+	}
+
+	t.Run("provided values and defaults", func(t *testing.T) {
+		values, err := resolveVariables("custom:deploy", declared, map[string]string{"Version": "1.2"}, nil, &bytes.Buffer{})
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"Environment": "staging", "Version": "1.2"}, values)
+	})
+
+	t.Run("missing value without terminal", func(t *testing.T) {
+		_, err := resolveVariables("custom:deploy", declared, map[string]string{}, nil, &bytes.Buffer{})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "pass it with --var Version=<value>")
+	})
+
+	t.Run("value not allowed", func(t *testing.T) {
+		_, err := resolveVariables("custom:deploy", declared, map[string]string{"Environment": "qa", "Version": "1"}, nil, &bytes.Buffer{})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "not one of the allowed values: staging, production")
+	})
+
+	t.Run("undeclared variable", func(t *testing.T) {
+		_, err := resolveVariables("custom:deploy", declared, map[string]string{"Region": "eu"}, nil, &bytes.Buffer{})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "variable 'Region' is not declared by pipeline 'custom:deploy'")
+	})
+
+	t.Run("prompt until valid", func(t *testing.T) {
+		prompt := bufio.NewReader(strings.NewReader("qa\nproduction\n\n2.0\n"))
+		var out bytes.Buffer
+
+		values, err := resolveVariables("custom:deploy", declared, map[string]string{}, prompt, &out)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]string{"Environment": "production", "Version": "2.0"}, values)
+		assert.Contains(t, out.String(), "Environment {staging, production} [staging]: ")
+		assert.Contains(t, out.String(), "value 'qa' of variable 'Environment' is not one of the allowed values")
+		assert.Contains(t, out.String(), "A value is required")
+	})
+}
+
+func TestReadVarsFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deploy.env")
+	require.NoError(t, os.WriteFile(path, []byte("# deployment\nEnvironment=production\n\nTAGS=a=b\n"), 0644))
+
+	values := make(map[string]string)
+	require.NoError(t, readVarsFile(path, values))
+	assert.Equal(t, map[string]string{"Environment": "production", "TAGS": "a=b"}, values)
+
+	require.NoError(t, os.WriteFile(path, []byte("not an assignment\n"), 0644))
+	assert.Error(t, readVarsFile(path, values))
+}
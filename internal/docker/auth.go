@@ -0,0 +1,140 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"bitbucket-runner/internal/executor"
+	"bitbucket-runner/internal/models"
+)
+
+// dockerHubServer is the key of Docker Hub credentials in client
+// configurations
+const dockerHubServer = "https://index.docker.io/v1/"
+
+// credentials are the credentials a registry is logged in with, a user
+// and password or an identity token
+type credentials struct {
+	Username      string
+	Password      string
+	Email         string
+	IdentityToken string
+}
+
+// imageCredentials returns the credentials of an image with credentials,
+// exchanging AWS keys for an ECR password
+func imageCredentials(ctx context.Context, registry string, auth *executor.ImageAuth) (*credentials, error) {
+	if auth.AWSAccessKey == "" {
+		return &credentials{Username: auth.Username, Password: auth.Password, Email: auth.Email}, nil
+	}
+	token, err := ecrPassword(ctx, registry, auth)
+	if err != nil {
+		return nil, err
+	}
+	return &credentials{Username: "AWS", Password: token}, nil
+}
+
+// writeClientConfig writes a client configuration holding the credentials
+// of a registry to a new temporary directory, passed to docker with
+// --config rather than logging in, which leaves the configuration of the
+// user untouched. The current context of the user is kept, with the
+// contexts directory linked, as docker looks contexts up next to the
+// configuration. The directory must be removed by the caller.
+func writeClientConfig(registry string, creds credentials) (string, error) {
+	user, _, err := readUserConfig()
+	if err != nil {
+		return "", err
+	}
+	config, err := clientConfig(registry, creds, user.CurrentContext)
+	if err != nil {
+		return "", err
+	}
+	dir, err := os.MkdirTemp("", "bitbucket-runner-docker-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create docker configuration: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), config, 0600); err != nil {
+		os.RemoveAll(dir)
+		return "", fmt.Errorf("failed to write docker configuration: %w", err)
+	}
+	if userDir := userConfigDir(); userDir != "" {
+		contexts := filepath.Join(userDir, "contexts")
+		if info, err := os.Stat(contexts); err == nil && info.IsDir() {
+			if err := os.Symlink(contexts, filepath.Join(dir, "contexts")); err != nil {
+				os.RemoveAll(dir)
+				return "", fmt.Errorf("failed to link docker contexts: %w", err)
+			}
+		}
+	}
+	return dir, nil
+}
+
+// clientConfig returns a docker client configuration holding the
+// credentials of a registry and the current context, when not empty
+func clientConfig(registry string, creds credentials, currentContext string) ([]byte, error) {
+	entry := map[string]string{}
+	if creds.IdentityToken != "" {
+		entry["identitytoken"] = creds.IdentityToken
+	} else {
+		entry["auth"] = base64.StdEncoding.EncodeToString([]byte(creds.Username + ":" + creds.Password))
+	}
+	if creds.Email != "" {
+		entry["email"] = creds.Email
+	}
+	fields := map[string]interface{}{"auths": map[string]interface{}{serverAddress(registry): entry}}
+	if currentContext != "" {
+		fields["currentContext"] = currentContext
+	}
+	config, err := json.Marshal(fields)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal docker configuration: %w", err)
+	}
+	return config, nil
+}
+
+// serverAddress returns the address credentials of a registry are stored
+// under in client configurations and credential helpers
+func serverAddress(registry string) string {
+	if registry == models.DockerHub {
+		return dockerHubServer
+	}
+	return registry
+}
+
+// ecrPassword gets a registry password for Amazon ECR with the AWS CLI,
+// for the region of the registry host
+func ecrPassword(ctx context.Context, registry string, auth *executor.ImageAuth) (string, error) {
+	region, ok := ecrRegion(registry)
+	if !ok {
+		return "", fmt.Errorf("registry '%s' is not an Amazon ECR registry, expected <account>.dkr.ecr.<region>.amazonaws.com", registry)
+	}
+	cmd := exec.CommandContext(ctx, "aws", "ecr", "get-login-password", "--region", region)
+	cmd.Env = append(os.Environ(), "AWS_ACCESS_KEY_ID="+auth.AWSAccessKey, "AWS_SECRET_ACCESS_KEY="+auth.AWSSecretKey)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return "", fmt.Errorf("failed to get an ECR password: %s", message)
+		}
+		return "", fmt.Errorf("failed to get an ECR password: %w", err)
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// ecrRegion returns the region of an ECR registry host, such as eu-west-1
+// for 123456789012.dkr.ecr.eu-west-1.amazonaws.com
+func ecrRegion(registry string) (string, bool) {
+	parts := strings.Split(registry, ".")
+	if len(parts) < 6 || parts[1] != "dkr" || parts[2] != "ecr" || parts[4] != "amazonaws" {
+		return "", false
+	}
+	return parts[3], true
+}
@@ -0,0 +1,80 @@
+package docker
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"bitbucket-runner/internal/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientConfig(t *testing.T) {
+	type entry struct {
+		Auth  string `json:"auth"`
+		Email string `json:"email"`
+	}
+	decode := func(data []byte) map[string]entry {
+		var config struct {
+			Auths map[string]entry `json:"auths"`
+		}
+		require.NoError(t, json.Unmarshal(data, &config))
+		return config.Auths
+	}
+
+	data, err := clientConfig("registry.example.com", credentials{Username: "ci", Password: "hunter2"}, "")
+	require.NoError(t, err)
+	auth := base64.StdEncoding.EncodeToString([]byte("ci:hunter2"))
+	assert.Equal(t, map[string]entry{"registry.example.com": {Auth: auth}}, decode(data))
+
+	data, err = clientConfig(models.DockerHub, credentials{Username: "ci", Password: "hunter2", Email: "ci@example.com"}, "")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]entry{dockerHubServer: {Auth: auth, Email: "ci@example.com"}}, decode(data))
+
+	data, err = clientConfig("example.azurecr.io", credentials{IdentityToken: "refresh"}, "")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"auths": {"example.azurecr.io": {"identitytoken": "refresh"}}}`, string(data))
+
+	data, err = clientConfig("example.azurecr.io", credentials{IdentityToken: "refresh"}, "remote")
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"auths": {"example.azurecr.io": {"identitytoken": "refresh"}}, "currentContext": "remote"}`, string(data))
+}
+
+func TestWriteClientConfig(t *testing.T) {
+	user := t.TempDir()
+	t.Setenv("DOCKER_CONFIG", user)
+	require.NoError(t, os.WriteFile(filepath.Join(user, "config.json"), []byte(`{"currentContext": "remote"}`), 0600))
+	meta := filepath.Join(user, "contexts", "meta", "0123")
+	require.NoError(t, os.MkdirAll(meta, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(meta, "meta.json"), []byte(`{"Name": "remote"}`), 0600))
+
+	dir, err := writeClientConfig("registry.example.com", credentials{Username: "ci", Password: "hunter2"})
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	data, err := os.ReadFile(filepath.Join(dir, "config.json"))
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"currentContext":"remote"`)
+	data, err = os.ReadFile(filepath.Join(dir, "contexts", "meta", "0123", "meta.json"))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"Name": "remote"}`, string(data))
+}
+
+func TestECRRegion(t *testing.T) {
+	region, ok := ecrRegion("123456789012.dkr.ecr.eu-west-1.amazonaws.com")
+	assert.True(t, ok)
+	assert.Equal(t, "eu-west-1", region)
+
+	region, ok = ecrRegion("123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn")
+	assert.True(t, ok)
+	assert.Equal(t, "cn-north-1", region)
+
+	for _, registry := range []string{models.DockerHub, "registry.example.com", "public.ecr.aws"} {
+		_, ok := ecrRegion(registry)
+		assert.False(t, ok, registry)
+	}
+}
@@ -0,0 +1,355 @@
+package docker
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+
+	"bitbucket-runner/internal/executor"
+	"bitbucket-runner/internal/models"
+)
+
+// CLI is a container runtime driving the docker command line client. It
+// relies on the client for context and TLS handling, so it behaves exactly
+// like docker commands typed by the user. Registry credentials are resolved
+// by the runner, from the image or from the client configuration.
+type CLI struct {
+	binary string
+	host   string // daemon the user configured, the one of the client otherwise
+}
+
+// NewCLI creates a docker CLI runtime for the given configuration
+func NewCLI(config models.DockerConfig) *CLI {
+	return &CLI{
+		binary: "docker",
+		host:   config.Host,
+	}
+}
+
+// Ping verifies the docker daemon is reachable
+func (c *CLI) Ping(ctx context.Context) error {
+	if _, err := exec.LookPath(c.binary); err != nil {
+		return fmt.Errorf("docker client not found in PATH: %w", err)
+	}
+	if _, err := c.output(ctx, "version", "--format", "{{.Server.Version}}"); err != nil {
+		return fmt.Errorf("docker daemon not reachable: %w", err)
+	}
+	return nil
+}
+
+// ImageExists reports whether an image is present locally
+func (c *CLI) ImageExists(ctx context.Context, image string) (bool, error) {
+	_, err := c.output(ctx, "image", "inspect", "--format", "{{.Id}}", image)
+	if err != nil && strings.Contains(err.Error(), "No such image") {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Pull pulls an image with the given credentials, or else with those the
+// client configuration of the user holds for the registry of the image,
+// from its credential helpers too. The credentials are passed in a
+// temporary client configuration.
+func (c *CLI) Pull(ctx context.Context, image string, auth *executor.ImageAuth, progress func(line string)) (executor.PullResult, error) {
+	registry := models.Registry(image)
+	var creds *credentials
+	var err error
+	if auth != nil {
+		creds, err = imageCredentials(ctx, registry, auth)
+	} else {
+		creds, err = storedCredentials(ctx, registry)
+	}
+	if err != nil {
+		return executor.PullResult{}, err
+	}
+
+	args := []string{"pull", image}
+	if creds != nil {
+		dir, err := writeClientConfig(registry, *creds)
+		if err != nil {
+			return executor.PullResult{}, err
+		}
+		defer os.RemoveAll(dir)
+		args = append([]string{"--config", dir}, args...)
+	}
+	out, err := c.stream(ctx, progress, args...)
+	if err != nil {
+		return executor.PullResult{}, err
+	}
+	result := parsePull(out)
+
+	size, err := c.output(ctx, "image", "inspect", "--format", "{{.Size}}", image)
+	if err == nil {
+		result.Size, _ = strconv.ParseInt(strings.TrimSpace(size), 10, 64)
+	}
+	return result, nil
+}
+
+// parsePull reads the output of docker pull, a line per change of status
+// of each layer:
+//
+//	a1b2c3: Pulling fs layer
+//	d4e5f6: Already exists
+//	a1b2c3: Pull complete
+//	Status: Downloaded newer image for node:18
+func parsePull(output string) executor.PullResult {
+	var result executor.PullResult
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "Status: Image is up to date") {
+			result.UpToDate = true
+			continue
+		}
+		_, status, ok := strings.Cut(line, ": ")
+		if !ok || strings.HasPrefix(line, "Status:") || strings.HasPrefix(line, "Digest:") {
+			continue
+		}
+		switch status {
+		case "Pull complete":
+			result.Layers++
+		case "Already exists":
+			result.Layers++
+			result.Cached++
+		}
+	}
+	return result
+}
+
+// Start creates and starts a detached container
+func (c *CLI) Start(ctx context.Context, spec executor.ContainerSpec) (string, error) {
+	out, err := c.outputWith(ctx, spec.Environment, runArgs(spec)...)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// Exec runs a command inside a running container
+func (c *CLI) Exec(ctx context.Context, containerID string, opts executor.ExecOptions) (int, error) {
+	cmd := c.command(ctx, execArgs(containerID, opts)...)
+	cmd.Env = environ(opts.Environment)
+	cmd.Stdin = opts.Stdin
+	cmd.Stdout = opts.Stdout
+	cmd.Stderr = opts.Stderr
+
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && ctx.Err() == nil {
+		return exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	return 0, nil
+}
+
+// Run runs a container in the foreground and removes it once it exited
+func (c *CLI) Run(ctx context.Context, spec executor.ContainerSpec, stdout, stderr io.Writer) (int, error) {
+	cmd := c.command(ctx, append([]string{"run", "--rm"}, containerArgs(spec)...)...)
+	cmd.Env = environ(spec.Environment)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && ctx.Err() == nil {
+		return exitErr.ExitCode(), nil
+	}
+	if err != nil {
+		return -1, err
+	}
+	return 0, nil
+}
+
+// Remove forcefully removes a container together with its anonymous volumes
+func (c *CLI) Remove(ctx context.Context, containerID string) error {
+	_, err := c.output(ctx, "rm", "--force", "--volumes", containerID)
+	return err
+}
+
+func (c *CLI) command(ctx context.Context, args ...string) *exec.Cmd {
+	if c.host != "" {
+		args = append([]string{"--host", c.host}, args...)
+	}
+	return exec.CommandContext(ctx, c.binary, args...)
+}
+
+// output runs a docker command and returns its stdout. The stderr of a
+// failing command is used as error message.
+func (c *CLI) output(ctx context.Context, args ...string) (string, error) {
+	return c.outputWith(ctx, nil, args...)
+}
+
+// outputWith runs a docker command as output does, with the values of the
+// variables its --env options name
+func (c *CLI) outputWith(ctx context.Context, env map[string]string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := c.command(ctx, args...)
+	cmd.Env = environ(env)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return "", commandError(args, stderr.String(), err)
+	}
+	return stdout.String(), nil
+}
+
+// stream runs a docker command like output, passing each line of its stdout
+// to progress, when not nil, as it is written
+func (c *CLI) stream(ctx context.Context, progress func(line string), args ...string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := c.command(ctx, args...)
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return "", fmt.Errorf("docker %s: %w", args[0], err)
+	}
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("docker %s: %w", args[0], err)
+	}
+
+	var out strings.Builder
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		out.WriteString(scanner.Text() + "\n")
+		if progress != nil {
+			progress(scanner.Text())
+		}
+	}
+	// Drain what the scanner gave up on, so the command does not block
+	io.Copy(io.Discard, stdout)
+	if err := cmd.Wait(); err != nil {
+		return "", commandError(args, stderr.String(), err)
+	}
+	return out.String(), nil
+}
+
+// commandError builds the error of a failing docker command, its stderr as
+// message when it wrote any
+func commandError(args []string, stderr string, err error) error {
+	if message := strings.TrimSpace(stderr); message != "" {
+		return fmt.Errorf("docker %s: %s", args[0], message)
+	}
+	return fmt.Errorf("docker %s: %w", args[0], err)
+}
+
+func runArgs(spec executor.ContainerSpec) []string {
+	return append([]string{"run", "--detach"}, containerArgs(spec)...)
+}
+
+// containerArgs returns the options of docker run creating the container
+// of spec, followed by its image and command
+func containerArgs(spec executor.ContainerSpec) []string {
+	var args []string
+	if spec.Name != "" {
+		args = append(args, "--name", spec.Name)
+	}
+	if spec.Entrypoint != "" {
+		args = append(args, "--entrypoint", spec.Entrypoint)
+	}
+	if spec.WorkingDir != "" {
+		args = append(args, "--workdir", spec.WorkingDir)
+	}
+	if spec.NetworkMode != "" {
+		args = append(args, "--network", spec.NetworkMode)
+	}
+	if spec.User != "" {
+		args = append(args, "--user", spec.User)
+	}
+	args = append(args, envArgs(spec.Environment)...)
+	for _, volume := range spec.Volumes {
+		mount := volume.Host + ":" + volume.Container
+		if volume.ReadOnly {
+			mount += ":ro"
+		}
+		args = append(args, "--volume", mount)
+	}
+	for _, port := range spec.Ports {
+		mapping := strconv.Itoa(port.Host) + ":" + strconv.Itoa(port.Container)
+		if port.Protocol != "" {
+			mapping += "/" + port.Protocol
+		}
+		args = append(args, "--publish", mapping)
+	}
+
+	args = append(args, spec.Image)
+	return append(args, spec.Command...)
+}
+
+func execArgs(containerID string, opts executor.ExecOptions) []string {
+	args := []string{"exec"}
+	if opts.Stdin != nil {
+		args = append(args, "--interactive")
+	}
+	if opts.TTY {
+		args = append(args, "--tty")
+	}
+	if opts.WorkingDir != "" {
+		args = append(args, "--workdir", opts.WorkingDir)
+	}
+	args = append(args, envArgs(opts.Environment)...)
+
+	args = append(args, containerID)
+	return append(args, opts.Command...)
+}
+
+// clientVariables are the variables the docker client reads itself, which
+// would change how it runs if set in its environment
+var clientVariables = map[string]bool{
+	"DOCKER_HOST": true, "DOCKER_CONTEXT": true, "DOCKER_CONFIG": true, "DOCKER_API_VERSION": true,
+	"DOCKER_CERT_PATH": true, "DOCKER_TLS": true, "DOCKER_TLS_VERIFY": true,
+	"HOME": true, "PATH": true, "HTTP_PROXY": true, "HTTPS_PROXY": true, "NO_PROXY": true,
+	"http_proxy": true, "https_proxy": true, "no_proxy": true,
+}
+
+// envArgs returns the --env options passing variables to a container. Only
+// their names are written, the client reading the values from its
+// environment, as command lines are readable by every local user and
+// variables hold secrets. Variables the client reads itself are written
+// with their value.
+func envArgs(env map[string]string) []string {
+	var args []string
+	for _, key := range sortedKeys(env) {
+		if clientVariables[key] {
+			args = append(args, "--env", key+"="+env[key])
+		} else {
+			args = append(args, "--env", key)
+		}
+	}
+	return args
+}
+
+// environ returns the environment of a docker command passing the
+// variables of envArgs, nil to inherit the environment of the runner when
+// there are none
+func environ(env map[string]string) []string {
+	if len(env) == 0 {
+		return nil
+	}
+	variables := os.Environ()
+	for _, key := range sortedKeys(env) {
+		if !clientVariables[key] {
+			variables = append(variables, key+"="+env[key])
+		}
+	}
+	return variables
+}
+
+// sortedKeys returns the keys of a string map in lexical order
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,131 @@
+package docker
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"bitbucket-runner/internal/executor"
+	"bitbucket-runner/internal/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCLI_Command(t *testing.T) {
+	cmd := NewCLI(models.NewDefaultRunnerConfig().Docker).command(context.Background(), "ps")
+	assert.Equal(t, []string{"docker", "ps"}, cmd.Args, "the host of the client is used by default")
+
+	cmd = NewCLI(models.DockerConfig{Host: "tcp://build:2375"}).command(context.Background(), "ps")
+	assert.Equal(t, []string{"docker", "--host", "tcp://build:2375", "ps"}, cmd.Args)
+}
+
+func TestRunArgs(t *testing.T) {
+	args := runArgs(executor.ContainerSpec{
+		Name:        "bitbucket-runner-1-step-1",
+		Image:       "node:16",
+		Entrypoint:  "tail",
+		Command:     []string{"-f", "/dev/null"},
+		WorkingDir:  "/opt/atlassian/pipelines/agent/build",
+		Environment: map[string]string{"CI": "true", "BITBUCKET_BUILD_NUMBER": "1"},
+		Volumes: []models.VolumeMount{
+			{Host: "/tmp/ws", Container: "/opt/atlassian/pipelines/agent/build"},
+			{Host: "/etc/ssl", Container: "/etc/ssl", ReadOnly: true},
+		},
+		Ports: []models.PortMapping{{Host: 8080, Container: 80, Protocol: "tcp"}},
+	})
+
+	assert.Equal(t, "run --detach --name bitbucket-runner-1-step-1 --entrypoint tail "+
+		"--workdir /opt/atlassian/pipelines/agent/build "+
+		"--env BITBUCKET_BUILD_NUMBER --env CI "+
+		"--volume /tmp/ws:/opt/atlassian/pipelines/agent/build --volume /etc/ssl:/etc/ssl:ro "+
+		"--publish 8080:80/tcp node:16 -f /dev/null", strings.Join(args, " "))
+}
+
+func TestRunArgs_User(t *testing.T) {
+	args := runArgs(executor.ContainerSpec{Image: "node:16", User: "1000"})
+
+	assert.Equal(t, []string{"run", "--detach", "--user", "1000", "node:16"}, args)
+}
+
+func TestRunArgs_Service(t *testing.T) {
+	args := runArgs(executor.ContainerSpec{
+		Image:       "postgres:13",
+		NetworkMode: "container:abc123",
+	})
+
+	assert.Equal(t, []string{"run", "--detach", "--network", "container:abc123", "postgres:13"}, args)
+}
+
+func TestExecArgs(t *testing.T) {
+	t.Run("script", func(t *testing.T) {
+		args := execArgs("abc123", executor.ExecOptions{
+			Command:     []string{"/bin/sh", "-c", "echo hi"},
+			Environment: map[string]string{"BITBUCKET_EXIT_CODE": "0"},
+		})
+
+		assert.Equal(t, []string{"exec", "--env", "BITBUCKET_EXIT_CODE", "abc123", "/bin/sh", "-c", "echo hi"}, args)
+	})
+
+	t.Run("interactive", func(t *testing.T) {
+		args := execArgs("abc123", executor.ExecOptions{
+			Command:    []string{"/bin/sh"},
+			Stdin:      strings.NewReader(""),
+			TTY:        true,
+			WorkingDir: "/build",
+		})
+
+		assert.Equal(t, []string{"exec", "--interactive", "--tty", "--workdir", "/build", "abc123", "/bin/sh"}, args)
+	})
+}
+
+func TestEnvironment(t *testing.T) {
+	env := map[string]string{"AWS_SECRET_ACCESS_KEY": "hunter2", "DOCKER_HOST": "tcp://localhost:2375"}
+
+	args := envArgs(env)
+	assert.Equal(t, []string{"--env", "AWS_SECRET_ACCESS_KEY", "--env", "DOCKER_HOST=tcp://localhost:2375"}, args)
+	assert.NotContains(t, strings.Join(args, " "), "hunter2", "secrets stay off the command line")
+
+	variables := environ(env)
+	assert.Contains(t, variables, "AWS_SECRET_ACCESS_KEY=hunter2")
+	assert.NotContains(t, variables, "DOCKER_HOST=tcp://localhost:2375", "the client keeps its own daemon")
+	assert.Nil(t, environ(nil))
+}
+
+func TestParsePull(t *testing.T) {
+	result := parsePull(`18: Pulling from library/node
+a1b2c3d4e5f6: Already exists
+b2c3d4e5f6a1: Pulling fs layer
+c3d4e5f6a1b2: Pulling fs layer
+b2c3d4e5f6a1: Verifying Checksum
+b2c3d4e5f6a1: Download complete
+b2c3d4e5f6a1: Pull complete
+c3d4e5f6a1b2: Pull complete
+Digest: sha256:0123456789abcdef
+Status: Downloaded newer image for node:18
+docker.io/library/node:18
+`)
+	assert.Equal(t, executor.PullResult{Layers: 3, Cached: 1}, result)
+
+	result = parsePull("18: Pulling from library/node\nDigest: sha256:0123456789abcdef\nStatus: Image is up to date for node:18\ndocker.io/library/node:18\n")
+	assert.Equal(t, executor.PullResult{UpToDate: true}, result)
+}
+
+func TestCLI_Stream(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh not available")
+	}
+	c := &CLI{binary: "sh"}
+
+	var lines []string
+	out, err := c.stream(context.Background(), func(line string) {
+		lines = append(lines, line)
+	}, "-c", "echo 'a1b2c3: Pulling fs layer'; echo 'a1b2c3: Pull complete'")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a1b2c3: Pulling fs layer", "a1b2c3: Pull complete"}, lines)
+	assert.Equal(t, "a1b2c3: Pulling fs layer\na1b2c3: Pull complete\n", out)
+
+	_, err = c.stream(context.Background(), nil, "-c", "echo 'manifest unknown' >&2; exit 1")
+	assert.EqualError(t, err, "docker -c: manifest unknown")
+}
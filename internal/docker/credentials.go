@@ -0,0 +1,161 @@
+package docker
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"bitbucket-runner/internal/models"
+)
+
+// userConfig is the part of the docker client configuration of the user
+// holding registry credentials and the current context
+type userConfig struct {
+	Auths          map[string]userAuth `json:"auths"`
+	CredsStore     string              `json:"credsStore"`
+	CredHelpers    map[string]string   `json:"credHelpers"`
+	CurrentContext string              `json:"currentContext"`
+}
+
+// userAuth is a registry entry of the client configuration
+type userAuth struct {
+	Auth          string `json:"auth"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	Email         string `json:"email"`
+	IdentityToken string `json:"identitytoken"`
+}
+
+// userConfigDir returns the directory of the docker client configuration,
+// $DOCKER_CONFIG or ~/.docker
+func userConfigDir() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return dir
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".docker")
+}
+
+// readUserConfig reads the docker client configuration of the user and
+// returns it with its path. The configuration is empty when there is none.
+func readUserConfig() (userConfig, string, error) {
+	var config userConfig
+	dir := userConfigDir()
+	if dir == "" {
+		return config, "", nil
+	}
+	path := filepath.Join(dir, "config.json")
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return config, path, nil
+	}
+	if err != nil {
+		return config, path, fmt.Errorf("failed to read docker configuration: %w", err)
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, path, fmt.Errorf("failed to parse docker configuration %s: %w", path, err)
+	}
+	return config, path, nil
+}
+
+// storedCredentials looks up the credentials of a registry in the docker
+// client configuration of the user like the docker client does: with the
+// credential helper of the registry, then with the credential store, then
+// in auths. It returns nil when the user is not logged in.
+func storedCredentials(ctx context.Context, registry string) (*credentials, error) {
+	config, path, err := readUserConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	for key, helper := range config.CredHelpers {
+		if registryOf(key) == registry {
+			return helperCredentials(ctx, helper, serverAddress(registry))
+		}
+	}
+	if config.CredsStore != "" {
+		return helperCredentials(ctx, config.CredsStore, serverAddress(registry))
+	}
+	for key, entry := range config.Auths {
+		if registryOf(key) != registry {
+			continue
+		}
+		creds := &credentials{Username: entry.Username, Password: entry.Password, Email: entry.Email, IdentityToken: entry.IdentityToken}
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("invalid auth of '%s' in docker configuration %s: %w", key, path, err)
+			}
+			creds.Username, creds.Password, _ = strings.Cut(string(decoded), ":")
+		}
+		if creds.Username == "" && creds.IdentityToken == "" {
+			continue
+		}
+		return creds, nil
+	}
+	return nil, nil
+}
+
+// helperCredentials gets the credentials of a server from a credential
+// helper, the docker-credential-<helper> executable found in PATH
+func helperCredentials(ctx context.Context, helper, server string) (*credentials, error) {
+	program := "docker-credential-" + helper
+	cmd := exec.CommandContext(ctx, program, "get")
+	cmd.Stdin = strings.NewReader(server)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		// Helpers report missing credentials on stdout
+		message := strings.TrimSpace(stdout.String() + " " + stderr.String())
+		if strings.Contains(message, "credentials not found") {
+			return nil, nil
+		}
+		if message != "" {
+			return nil, fmt.Errorf("credential helper %s failed: %s", program, message)
+		}
+		return nil, fmt.Errorf("credential helper %s failed: %w", program, err)
+	}
+
+	var reply struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &reply); err != nil {
+		return nil, fmt.Errorf("credential helper %s returned invalid credentials: %w", program, err)
+	}
+	// Helpers return identity tokens with this placeholder user
+	if reply.Username == "<token>" {
+		return &credentials{IdentityToken: reply.Secret}, nil
+	}
+	return &credentials{Username: reply.Username, Password: reply.Secret}, nil
+}
+
+// registryOf returns the registry of a key of the client configuration,
+// written as a host or as a URL such as https://index.docker.io/v1/
+func registryOf(key string) string {
+	host := key
+	if strings.Contains(key, "://") {
+		if u, err := url.Parse(key); err == nil {
+			host = u.Host
+		}
+	}
+	host, _, _ = strings.Cut(host, "/")
+	switch host {
+	case "index.docker.io", "registry-1.docker.io", models.DockerHub:
+		return models.DockerHub
+	}
+	return host
+}
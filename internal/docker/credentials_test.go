@@ -0,0 +1,107 @@
+package docker
+
+import (
+	"context"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"bitbucket-runner/internal/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// useDockerConfig points the docker client configuration to a temporary
+// directory holding config, and PATH to a directory holding a credential
+// helper named test, which answers with the server it was asked for
+func useDockerConfig(t *testing.T, config string) {
+	dir := t.TempDir()
+	t.Setenv("DOCKER_CONFIG", dir)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "config.json"), []byte(config), 0600))
+
+	helper := `#!/bin/sh
+read server
+case "$server" in
+  *.example.com) printf '{"ServerURL":"%s","Username":"helper","Secret":"for %s"}' "$server" "$server" ;;
+  token.azurecr.io) printf '{"ServerURL":"%s","Username":"<token>","Secret":"refresh"}' "$server" ;;
+  *) echo "credentials not found in native keychain"; exit 1 ;;
+esac
+`
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "docker-credential-test"), []byte(helper), 0755))
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestStoredCredentials(t *testing.T) {
+	auth := base64.StdEncoding.EncodeToString([]byte("ci:hunter2"))
+	ctx := context.Background()
+
+	t.Run("auths", func(t *testing.T) {
+		useDockerConfig(t, `{"auths": {
+  "https://index.docker.io/v1/": {"auth": "`+auth+`"},
+  "registry.example.com": {"username": "app", "password": "secret"},
+  "https://empty.example.com": {}
+}}`)
+		creds, err := storedCredentials(ctx, models.DockerHub)
+		require.NoError(t, err)
+		assert.Equal(t, &credentials{Username: "ci", Password: "hunter2"}, creds)
+
+		creds, err = storedCredentials(ctx, "registry.example.com")
+		require.NoError(t, err)
+		assert.Equal(t, &credentials{Username: "app", Password: "secret"}, creds)
+
+		for _, registry := range []string{"empty.example.com", "ghcr.io"} {
+			creds, err = storedCredentials(ctx, registry)
+			require.NoError(t, err)
+			assert.Nil(t, creds, registry)
+		}
+	})
+
+	t.Run("credential helpers", func(t *testing.T) {
+		useDockerConfig(t, `{
+  "auths": {"registry.example.com": {"auth": "`+auth+`"}},
+  "credHelpers": {"registry.example.com": "test", "token.azurecr.io": "test", "ghcr.io": "missing"}
+}`)
+		creds, err := storedCredentials(ctx, "registry.example.com")
+		require.NoError(t, err)
+		assert.Equal(t, &credentials{Username: "helper", Password: "for registry.example.com"}, creds)
+
+		creds, err = storedCredentials(ctx, "token.azurecr.io")
+		require.NoError(t, err)
+		assert.Equal(t, &credentials{IdentityToken: "refresh"}, creds)
+
+		_, err = storedCredentials(ctx, "ghcr.io")
+		assert.ErrorContains(t, err, "credential helper docker-credential-missing failed")
+	})
+
+	t.Run("credential store", func(t *testing.T) {
+		useDockerConfig(t, `{"auths": {"https://index.docker.io/v1/": {}}, "credsStore": "test"}`)
+		creds, err := storedCredentials(ctx, "hub.example.com")
+		require.NoError(t, err)
+		assert.Equal(t, &credentials{Username: "helper", Password: "for hub.example.com"}, creds)
+
+		creds, err = storedCredentials(ctx, models.DockerHub)
+		require.NoError(t, err)
+		assert.Nil(t, creds)
+	})
+
+	t.Run("no configuration", func(t *testing.T) {
+		t.Setenv("DOCKER_CONFIG", t.TempDir())
+		creds, err := storedCredentials(ctx, models.DockerHub)
+		require.NoError(t, err)
+		assert.Nil(t, creds)
+	})
+}
+
+func TestRegistryOf(t *testing.T) {
+	for key, expected := range map[string]string{
+		"https://index.docker.io/v1/": models.DockerHub,
+		"registry-1.docker.io":        models.DockerHub,
+		"registry.example.com":        "registry.example.com",
+		"https://localhost:5000/v2/":  "localhost:5000",
+		"ghcr.io/team":                "ghcr.io",
+	} {
+		assert.Equal(t, expected, registryOf(key), key)
+	}
+}
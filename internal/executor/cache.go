@@ -0,0 +1,54 @@
+package executor
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"bitbucket-runner/internal/models"
+)
+
+// cacheHome is the directory ~ stands for in cache paths, the home of root
+const cacheHome = "/root"
+
+// SetCacheDir sets the directory caches are kept in between runs. Caches
+// are not mounted without one.
+func (e *Engine) SetCacheDir(dir string) {
+	e.cacheDir = dir
+}
+
+// cacheVolumes returns the mounts of the caches of a step, a directory of
+// the cache directory per cache path, created when missing
+func (e *Engine) cacheVolumes(caches []PlannedCache, cloneDir string) ([]models.VolumeMount, error) {
+	if e.cacheDir == "" {
+		return nil, nil
+	}
+	var volumes []models.VolumeMount
+	for _, cache := range caches {
+		for i, p := range cache.Paths {
+			host := filepath.Join(e.cacheDir, cache.Name, strconv.Itoa(i))
+			if err := os.MkdirAll(host, 0755); err != nil {
+				return nil, fmt.Errorf("failed to create cache '%s': %w", cache.Name, err)
+			}
+			volumes = append(volumes, models.VolumeMount{Host: host, Container: cachePath(p, cloneDir)})
+		}
+	}
+	return volumes, nil
+}
+
+// cachePath returns the directory a cache path is mounted at in the step
+// container: paths starting with ~ are in the home of root and relative
+// paths in the clone directory
+func cachePath(p, cloneDir string) string {
+	switch {
+	case p == "~" || strings.HasPrefix(p, "~/"):
+		return path.Join(cacheHome, strings.TrimPrefix(p, "~"))
+	case path.IsAbs(p):
+		return path.Clean(p)
+	default:
+		return path.Join(cloneDir, p)
+	}
+}
@@ -0,0 +1,85 @@
+package executor
+
+import (
+	"fmt"
+
+	"bitbucket-runner/internal/glob"
+	"bitbucket-runner/internal/models"
+)
+
+// ConditionResult is the decision taken for the condition of a step
+type ConditionResult struct {
+	Run          bool     `json:"run"`
+	Reason       string   `json:"reason"`
+	MatchedFiles []string `json:"matched_files,omitempty"`
+}
+
+// EvaluateCondition decides whether a step with the given condition runs
+// for a changeset. A file matches when it matches one of includePaths, or
+// includePaths is empty, and none of excludePaths. The step runs when at
+// least one changed file matches.
+//
+// Without a changeset, for example outside a git repository or on the first
+// commit, the condition cannot be evaluated and the step runs, as it does on
+// Bitbucket. It returns nil when the step has no changeset condition.
+func EvaluateCondition(condition *models.Condition, changeset *models.Changeset) *ConditionResult {
+	if condition == nil || condition.Changesets == nil {
+		return nil
+	}
+	if changeset == nil {
+		return &ConditionResult{Run: true, Reason: "no changeset available, condition not evaluated"}
+	}
+
+	include := condition.Changesets.IncludePaths
+	exclude := condition.Changesets.ExcludePaths
+
+	result := &ConditionResult{}
+	for _, file := range changeset.Files {
+		if len(include) > 0 && !glob.MatchAny(include, file) {
+			continue
+		}
+		if glob.MatchAny(exclude, file) {
+			continue
+		}
+		result.MatchedFiles = append(result.MatchedFiles, file)
+	}
+
+	result.Run = len(result.MatchedFiles) > 0
+	if result.Run {
+		result.Reason = fmt.Sprintf("%d of %d changed files since %s match", len(result.MatchedFiles), len(changeset.Files), shortRevision(changeset.Base))
+	} else {
+		result.Reason = fmt.Sprintf("none of %d changed files since %s match", len(changeset.Files), shortRevision(changeset.Base))
+	}
+	return result
+}
+
+// evaluateConditions combines the condition of a stage with the condition
+// of one of its steps. A stage whose condition is not met skips all of its
+// steps.
+func evaluateConditions(stage *models.Stage, condition *models.Condition, changeset *models.Changeset) *ConditionResult {
+	stepResult := EvaluateCondition(condition, changeset)
+	if stage == nil {
+		return stepResult
+	}
+
+	stageResult := EvaluateCondition(stage.Condition, changeset)
+	if stageResult != nil && (!stageResult.Run || stepResult == nil) {
+		stageResult.Reason = fmt.Sprintf("stage '%s': %s", stageName(stage), stageResult.Reason)
+		return stageResult
+	}
+	return stepResult
+}
+
+func stageName(stage *models.Stage) string {
+	if stage.Name != "" {
+		return stage.Name
+	}
+	return "unnamed"
+}
+
+func shortRevision(rev string) string {
+	if len(rev) > 12 {
+		return rev[:12]
+	}
+	return rev
+}
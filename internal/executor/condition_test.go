@@ -0,0 +1,99 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"bitbucket-runner/internal/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEvaluateCondition(t *testing.T) {
+	changeset := &models.Changeset{
+		Base:  "0123456789abcdef",
+		Files: []string{"api/main.go", "api/docs/intro.md", "web/index.ts", "README.md"},
+	}
+
+	tests := []struct {
+		name    string
+		include []string
+		exclude []string
+		run     bool
+		matched []string
+	}{
+		{"include matches", []string{"api/**"}, nil, true, []string{"api/main.go", "api/docs/intro.md"}},
+		{"include without match", []string{"infra/**"}, nil, false, nil},
+		{"exclude removes matches", []string{"api/**"}, []string{"**/*.md"}, true, []string{"api/main.go"}},
+		{"everything excluded", []string{"**/*.md"}, []string{"**.md"}, false, nil},
+		{"exclude only", nil, []string{"api/**", "**.md"}, true, []string{"web/index.ts"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			condition := &models.Condition{Changesets: &models.Changesets{IncludePaths: tt.include, ExcludePaths: tt.exclude}}
+
+			result := EvaluateCondition(condition, changeset)
+			require.NotNil(t, result)
+			assert.Equal(t, tt.run, result.Run)
+			assert.Equal(t, tt.matched, result.MatchedFiles)
+			assert.Contains(t, result.Reason, "0123456789ab")
+		})
+	}
+
+	t.Run("without condition", func(t *testing.T) {
+		assert.Nil(t, EvaluateCondition(nil, changeset))
+		assert.Nil(t, EvaluateCondition(&models.Condition{}, changeset))
+	})
+
+	t.Run("without changeset the step runs", func(t *testing.T) {
+		condition := &models.Condition{Changesets: &models.Changesets{IncludePaths: []string{"infra/**"}}}
+
+		result := EvaluateCondition(condition, nil)
+		require.NotNil(t, result)
+		assert.True(t, result.Run)
+	})
+}
+
+func TestEngine_ExecuteSkipsUnmatchedConditions(t *testing.T) {
+	docsOnly := &models.Condition{Changesets: &models.Changesets{IncludePaths: []string{"docs/**"}}}
+	pipeline := models.Pipeline{
+		{Step: models.Step{Name: "Docs", Condition: docsOnly, Script: []string{"make docs"}}},
+		{Stage: &models.Stage{
+			Name:      "Backend",
+			Condition: &models.Condition{Changesets: &models.Changesets{IncludePaths: []string{"api/**"}}},
+			Steps: []models.StepWrapper{
+				{Step: models.Step{Name: "Test", Script: []string{"make test"}}},
+				{Step: models.Step{Name: "Docs of API", Condition: docsOnly, Script: []string{"make api-docs"}}},
+			},
+		}},
+		{Stage: &models.Stage{
+			Name:      "Frontend",
+			Condition: &models.Condition{Changesets: &models.Changesets{IncludePaths: []string{"web/**"}}},
+			Steps: []models.StepWrapper{
+				{Step: models.Step{Name: "Web", Script: []string{"npm test"}}},
+			},
+		}},
+	}
+
+	runtime := &fakeRuntime{}
+	var out bytes.Buffer
+	engine := NewEngine(runtime, models.NewDefaultRunnerConfig(), nil, t.TempDir(), &out)
+	ec := models.NewExecutionContext(&models.PipelineConfig{Image: models.Image{Name: "alpine"}}, "")
+	ec.Changeset = &models.Changeset{Base: "abc", Files: []string{"api/server.go"}}
+
+	require.NoError(t, engine.Execute(context.Background(), pipeline, ec))
+
+	require.Len(t, ec.StepResults, 4)
+	assert.Equal(t, models.StepStatusSkipped, ec.StepResults[0].Status)
+	assert.Equal(t, models.StepStatusCompleted, ec.StepResults[1].Status)
+	assert.Equal(t, models.StepStatusSkipped, ec.StepResults[2].Status, "the step condition applies inside a matching stage")
+	assert.Equal(t, models.StepStatusSkipped, ec.StepResults[3].Status)
+	assert.Len(t, runtime.commands, 1)
+
+	assert.Contains(t, out.String(), "--> Skipping Web: stage 'Frontend': none of 1 changed files since abc match")
+	assert.Contains(t, out.String(), "--> Running Test: stage 'Backend': 1 of 1 changed files since abc match")
+	assert.Contains(t, out.String(), "    api/server.go")
+}
@@ -0,0 +1,88 @@
+package executor
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ErrAborted is returned when the user aborts a run while it is paused
+var ErrAborted = errors.New("run aborted by user")
+
+// debugShell prefers bash and falls back to sh for minimal images
+var debugShell = []string{"/bin/sh", "-c", "if command -v bash >/dev/null 2>&1; then exec bash; else exec sh; fi"}
+
+// DebugOptions controls interactive debugging of a run
+type DebugOptions struct {
+	// ShellOnFailure keeps the container of a failed step and its services
+	// running and attaches an interactive shell before cleaning up
+	ShellOnFailure bool
+	// StepThrough pauses before the script of every step runs
+	StepThrough bool
+	// In is the terminal input shells are attached to
+	In io.Reader
+	// Prompt reads the answers to prompts, a reader of In when nil. It is
+	// shared with the other prompts of a run so that input buffered by one
+	// is not lost to the next.
+	Prompt *bufio.Reader
+	// TTY allocates a pseudo terminal for shells, which requires In to be a
+	// terminal
+	TTY bool
+}
+
+// SetDebugOptions enables interactive debugging for subsequent executions
+func (e *Engine) SetDebugOptions(opts DebugOptions) {
+	e.debug = opts
+	e.prompt = opts.Prompt
+	if e.prompt == nil && opts.In != nil {
+		e.prompt = bufio.NewReader(opts.In)
+	}
+}
+
+// pause waits for the user before the script of a step runs. The step
+// container and its services are already running, so the workspace can be
+// inspected from a shell.
+func (e *Engine) pause(ctx context.Context, containerID, name string) error {
+	if e.prompt == nil {
+		return nil
+	}
+
+	for {
+		fmt.Fprintf(e.out, "Paused before %s. [Enter] run, [s] shell, [q] abort: ", name)
+		line, err := e.prompt.ReadString('\n')
+		if err != nil && line == "" {
+			return ErrAborted
+		}
+
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "":
+			return nil
+		case "s", "shell":
+			if err := e.openShell(ctx, containerID, nil); err != nil {
+				fmt.Fprintf(e.out, "Debug shell failed: %v\n", err)
+			}
+		case "q", "quit", "abort":
+			return ErrAborted
+		}
+	}
+}
+
+// openShell attaches an interactive shell to a running container. The shell
+// inherits the environment and working directory of the step container.
+func (e *Engine) openShell(ctx context.Context, containerID string, env map[string]string) error {
+	fmt.Fprintf(e.out, "Opening debug shell in %s, exit the shell to continue\n", containerID)
+
+	// The step timeout must not end an interactive session
+	_, err := e.runtime.Exec(context.WithoutCancel(ctx), containerID, ExecOptions{
+		Command:     debugShell,
+		Environment: env,
+		Stdin:       e.debug.In,
+		Stdout:      e.out,
+		Stderr:      e.out,
+		TTY:         e.debug.TTY,
+	})
+	return err
+}
@@ -0,0 +1,229 @@
+package executor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"bitbucket-runner/internal/models"
+	"bitbucket-runner/internal/runstore"
+)
+
+// Engine executes pipeline steps sequentially in containers. Every step gets
+// a fresh copy of the project sources with the artifacts of the previous
+// steps restored, and the execution context is persisted after each step so
+// failed runs can be resumed.
+type Engine struct {
+	runtime      ContainerRuntime
+	runnerConfig *models.RunnerConfig
+	store        *runstore.Store
+	sourceDir    string
+	out          io.Writer
+	debug        DebugOptions
+	prompt       *bufio.Reader
+	cacheDir     string
+}
+
+// NewEngine creates a new execution engine. sourceDir is the project
+// directory copied into each step's workspace.
+func NewEngine(runtime ContainerRuntime, runnerConfig *models.RunnerConfig, store *runstore.Store, sourceDir string, out io.Writer) *Engine {
+	return &Engine{
+		runtime:      runtime,
+		runnerConfig: runnerConfig,
+		store:        store,
+		sourceDir:    sourceDir,
+		out:          out,
+	}
+}
+
+// InitVariables sets the Bitbucket default variables of a new run. Values
+// already present in the context, such as those of a resumed run, are kept.
+func (e *Engine) InitVariables(ec *models.ExecutionContext) {
+	defaults := map[string]string{
+		"CI":                     "true",
+		"BITBUCKET_BUILD_NUMBER": strconv.Itoa(ec.BuildNumber),
+		"BITBUCKET_CLONE_DIR":    e.runnerConfig.Defaults.WorkingDir,
+		"BITBUCKET_REPO_SLUG":    filepath.Base(e.sourceDir),
+	}
+
+	for key, value := range defaults {
+		if _, exists := ec.GetEnvironmentVariable(key); !exists {
+			ec.SetEnvironmentVariable(key, value)
+		}
+	}
+}
+
+// Execute runs the pipeline starting at ec.CurrentStep and stops at the
+// first failing step. Steps of a parallel group run one after another; the
+// remaining steps of a group still run after a failure unless the group is
+// fail-fast.
+func (e *Engine) Execute(ctx context.Context, pipeline models.Pipeline, ec *models.ExecutionContext) error {
+	plan, err := e.Plan(pipeline, ec)
+	if err != nil {
+		return fmt.Errorf("failed to resolve pipeline: %w", err)
+	}
+
+	if err := e.runtime.Ping(ctx); err != nil {
+		return fmt.Errorf("container runtime unavailable: %w", err)
+	}
+	for _, image := range plan.RewrittenImages() {
+		fmt.Fprintf(e.out, "--> Using %s for %s\n", image.Image, image.Original)
+	}
+	if err := e.pullImages(ctx, plan.Steps[ec.CurrentStep:]); err != nil {
+		return err
+	}
+
+	ec.StartExecution()
+	if err := e.save(ec); err != nil {
+		return err
+	}
+
+	var failure string
+	for ; ec.CurrentStep < len(plan.Steps); ec.NextStep() {
+		step := plan.Steps[ec.CurrentStep]
+		if failure != "" && (step.ParallelGroup == 0 || step.ParallelGroup != plan.Steps[ec.CurrentStep-1].ParallelGroup) {
+			break
+		}
+
+		result, err := e.executeStep(ctx, ec, step)
+		ec.AddStepResult(result)
+
+		if result.Status == models.StepStatusFailed && failure == "" {
+			failure = fmt.Sprintf("step '%s' failed with exit code %d", result.StepName, result.ExitCode)
+			if result.ErrorOutput != "" {
+				failure = fmt.Sprintf("step '%s' failed: %s", result.StepName, result.ErrorOutput)
+			}
+			if ctx.Err() != nil || errors.Is(err, ErrAborted) {
+				return e.cancel(ec, failure)
+			}
+			if step.ParallelGroup == 0 || step.FailFast {
+				break
+			}
+		}
+
+		if err := e.save(ec); err != nil {
+			return err
+		}
+	}
+
+	if failure != "" {
+		ec.FailExecution(failure)
+		if err := e.save(ec); err != nil {
+			return err
+		}
+		return errors.New(failure)
+	}
+
+	ec.CompleteExecution()
+	return e.save(ec)
+}
+
+// cancel marks the execution as cancelled after an interrupt or abort
+func (e *Engine) cancel(ec *models.ExecutionContext, message string) error {
+	now := time.Now()
+	ec.EndTime = &now
+	ec.Status = models.ExecutionStatusCancelled
+	ec.ErrorMessage = message
+	if err := e.save(ec); err != nil {
+		return err
+	}
+	return errors.New(message)
+}
+
+func (e *Engine) save(ec *models.ExecutionContext) error {
+	if e.store == nil {
+		return nil
+	}
+	if err := e.store.Save(ec); err != nil {
+		return fmt.Errorf("failed to persist run state: %w", err)
+	}
+	return nil
+}
+
+// stepName returns the display name of a step
+func stepName(step models.Step, index int) string {
+	if step.Name != "" {
+		return step.Name
+	}
+	return fmt.Sprintf("Step %d", index+1)
+}
+
+// effectiveImage resolves the image a step runs in: the step image, then a
+// step type configured for the step name, then the pipeline image and
+// finally the default step type. The credentials and user of the image
+// come along with it.
+func (e *Engine) effectiveImage(ec *models.ExecutionContext, step models.Step, stepType *models.StepType, named bool) models.Image {
+	switch {
+	case step.Image.Name != "":
+		return step.Image
+	case named && stepType.Image != "":
+		return models.Image{Name: stepType.Image}
+	case ec.PipelineConfig != nil && ec.PipelineConfig.Image.Name != "":
+		return ec.PipelineConfig.Image
+	case stepType.Image != "":
+		return models.Image{Name: stepType.Image}
+	default:
+		return models.Image{Name: e.runnerConfig.Defaults.Image}
+	}
+}
+
+// executeStep runs a step and records its result. The returned error is
+// only set when the user aborted the run.
+func (e *Engine) executeStep(ctx context.Context, ec *models.ExecutionContext, step PlannedStep) (models.StepResult, error) {
+	result := models.StepResult{
+		StepIndex: step.Index,
+		StepName:  step.Name,
+		Status:    models.StepStatusRunning,
+		StartTime: time.Now(),
+	}
+
+	if decision := step.Decision; decision != nil {
+		if !decision.Run {
+			now := time.Now()
+			result.EndTime = &now
+			result.Status = models.StepStatusSkipped
+			fmt.Fprintf(e.out, "--> Skipping %s: %s\n", step.Name, decision.Reason)
+			return result, nil
+		}
+		fmt.Fprintf(e.out, "--> Running %s: %s\n", step.Name, decision.Reason)
+		for _, file := range decision.MatchedFiles {
+			fmt.Fprintf(e.out, "    %s\n", file)
+		}
+	}
+
+	fmt.Fprintf(e.out, "==> %s (%s)\n", step.Name, step.Image)
+
+	var output bytes.Buffer
+	exitCode, artifacts, err := e.runStep(ctx, ec, step, io.MultiWriter(e.out, &output))
+
+	now := time.Now()
+	result.EndTime = &now
+	result.Duration = now.Sub(result.StartTime)
+	result.ExitCode = exitCode
+	result.Output = output.String()
+	result.Artifacts = artifacts
+
+	switch {
+	case err != nil:
+		result.Status = models.StepStatusFailed
+		result.ErrorOutput = err.Error()
+		fmt.Fprintf(e.out, "<== %s failed: %v\n", result.StepName, err)
+	case exitCode != 0:
+		result.Status = models.StepStatusFailed
+		fmt.Fprintf(e.out, "<== %s failed with exit code %d (%s)\n", result.StepName, exitCode, result.Duration.Round(time.Millisecond))
+	default:
+		result.Status = models.StepStatusCompleted
+		fmt.Fprintf(e.out, "<== %s completed (%s)\n", result.StepName, result.Duration.Round(time.Millisecond))
+	}
+
+	if errors.Is(err, ErrAborted) {
+		return result, err
+	}
+	return result, nil
+}
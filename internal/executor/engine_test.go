@@ -0,0 +1,527 @@
+package executor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"bitbucket-runner/internal/models"
+	"bitbucket-runner/internal/runstore"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeRuntime records container operations. Images are present unless
+// listed in missing. The exec hook receives the workspace directory mounted
+// into the step container.
+type fakeRuntime struct {
+	pingErr  error
+	missing  map[string]bool
+	pulled   map[string]*ImageAuth
+	step     ContainerSpec
+	started  []ContainerSpec
+	removed  []string
+	commands [][]string
+	exec     func(workspace string, opts ExecOptions) int
+	execErr  error // returned by the commands other than debug shells
+	runs     []ContainerSpec
+	run      func(spec ContainerSpec) int
+}
+
+func (f *fakeRuntime) Ping(ctx context.Context) error {
+	return f.pingErr
+}
+
+func (f *fakeRuntime) ImageExists(ctx context.Context, image string) (bool, error) {
+	return !f.missing[image], nil
+}
+
+func (f *fakeRuntime) Pull(ctx context.Context, image string, auth *ImageAuth, progress func(string)) (PullResult, error) {
+	if f.pulled == nil {
+		f.pulled = make(map[string]*ImageAuth)
+	}
+	f.pulled[image] = auth
+	if progress != nil {
+		progress("a1b2c3: Pull complete")
+	}
+	return PullResult{Layers: 3, Cached: 1, Size: 3 << 20}, nil
+}
+
+func (f *fakeRuntime) Start(ctx context.Context, spec ContainerSpec) (string, error) {
+	f.started = append(f.started, spec)
+	if spec.NetworkMode == "" {
+		f.step = spec
+	}
+	return fmt.Sprintf("container-%d", len(f.started)), nil
+}
+
+func (f *fakeRuntime) Exec(ctx context.Context, containerID string, opts ExecOptions) (int, error) {
+	f.commands = append(f.commands, opts.Command)
+	if f.execErr != nil && !opts.TTY {
+		return -1, f.execErr
+	}
+	if f.exec == nil {
+		return 0, nil
+	}
+	return f.exec(f.step.Volumes[0].Host, opts), nil
+}
+
+func (f *fakeRuntime) Run(ctx context.Context, spec ContainerSpec, stdout, stderr io.Writer) (int, error) {
+	f.runs = append(f.runs, spec)
+	if f.run == nil {
+		return 0, nil
+	}
+	return f.run(spec), nil
+}
+
+func (f *fakeRuntime) Remove(ctx context.Context, containerID string) error {
+	f.removed = append(f.removed, containerID)
+	return nil
+}
+
+func testPipeline() (*models.PipelineConfig, models.Pipeline) {
+	pipeline := models.Pipeline{
+		{Step: models.Step{
+			Name:      "Build",
+			Script:    []string{"make build"},
+			Artifacts: &models.Artifacts{Paths: []string{"dist/**"}},
+		}},
+		{Step: models.Step{Name: "Test", Image: models.Image{Name: "golang:1.21"}, Script: []string{"make test"}}},
+		{Step: models.Step{Name: "Package", Script: []string{"make package"}}},
+	}
+	config := &models.PipelineConfig{
+		Image:     models.Image{Name: "node:16"},
+		Pipelines: &models.Pipelines{Default: pipeline},
+	}
+	return config, pipeline
+}
+
+func scriptOf(opts ExecOptions) string {
+	return opts.Command[len(opts.Command)-1]
+}
+
+func TestEngine_Execute(t *testing.T) {
+	config, pipeline := testPipeline()
+	store := runstore.NewStore(t.TempDir())
+	runtime := &fakeRuntime{}
+	var out bytes.Buffer
+
+	engine := NewEngine(runtime, models.NewDefaultRunnerConfig(), store, t.TempDir(), &out)
+	ec := models.NewExecutionContext(config, "")
+	ec.ID = "run-1"
+	ec.BuildNumber = 3
+	engine.InitVariables(ec)
+
+	err := engine.Execute(context.Background(), pipeline, ec)
+	require.NoError(t, err)
+
+	assert.Equal(t, models.ExecutionStatusCompleted, ec.Status)
+	assert.Len(t, ec.StepResults, 3)
+	assert.Len(t, runtime.started, 3)
+	assert.Len(t, runtime.removed, 3)
+
+	assert.Equal(t, "node:16", runtime.started[0].Image)
+	assert.Equal(t, "golang:1.21", runtime.started[1].Image)
+	assert.Equal(t, "3", runtime.started[0].Environment["BITBUCKET_BUILD_NUMBER"])
+	assert.Equal(t, "/opt/atlassian/pipelines/agent/build", runtime.started[0].WorkingDir)
+	assert.Contains(t, strings.Join(runtime.commands[0], " "), "make build")
+	assert.Contains(t, out.String(), "Build completed")
+
+	persisted, err := store.Load("run-1")
+	require.NoError(t, err)
+	assert.Equal(t, models.ExecutionStatusCompleted, persisted.Status)
+	assert.Len(t, persisted.StepResults, 3)
+}
+
+func TestEngine_ResumeFromFailedStep(t *testing.T) {
+	config, pipeline := testPipeline()
+	store := runstore.NewStore(t.TempDir())
+	testFails := true
+
+	runtime := &fakeRuntime{exec: func(workspace string, opts ExecOptions) int {
+		script := scriptOf(opts)
+		switch {
+		case strings.Contains(script, "make build"):
+			os.MkdirAll(filepath.Join(workspace, "dist"), 0755)
+			os.WriteFile(filepath.Join(workspace, "dist", "app.bin"), []byte("binary"), 0644)
+		case strings.Contains(script, "make test"):
+			if _, err := os.Stat(filepath.Join(workspace, "dist", "app.bin")); err != nil {
+				return 2
+			}
+			if testFails {
+				return 1
+			}
+		}
+		return 0
+	}}
+
+	engine := NewEngine(runtime, models.NewDefaultRunnerConfig(), store, t.TempDir(), &bytes.Buffer{})
+	ec := models.NewExecutionContext(config, "")
+	ec.ID = "run-1"
+	ec.BuildNumber = 9
+	engine.InitVariables(ec)
+	ec.SetEnvironmentVariable("DEPLOY_TARGET", "staging")
+
+	err := engine.Execute(context.Background(), pipeline, ec)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "step 'Test' failed with exit code 1")
+
+	failed, err := store.Load("run-1")
+	require.NoError(t, err)
+	assert.Equal(t, models.ExecutionStatusFailed, failed.Status)
+	require.Len(t, failed.StepResults, 2)
+	assert.Equal(t, []string{"dist/app.bin"}, failed.StepResults[0].Artifacts)
+	assert.FileExists(t, filepath.Join(store.ArtifactsDir("run-1"), "dist", "app.bin"))
+
+	// Resume the persisted run after fixing the test
+	testFails = false
+	runtime.commands = nil
+	failed.PipelineConfig = config
+	assert.Equal(t, 1, failed.ResumeFromFailure())
+
+	err = engine.Execute(context.Background(), pipeline, failed)
+	require.NoError(t, err)
+
+	assert.Len(t, runtime.commands, 2)
+	assert.Contains(t, scriptOf(ExecOptions{Command: runtime.commands[0]}), "make test")
+	require.Len(t, failed.StepResults, 3)
+	assert.Equal(t, "Build", failed.StepResults[0].StepName)
+	assert.Equal(t, models.StepStatusCompleted, failed.StepResults[1].Status)
+	assert.Equal(t, "9", runtime.started[len(runtime.started)-1].Environment["BITBUCKET_BUILD_NUMBER"])
+	assert.Equal(t, "staging", runtime.started[len(runtime.started)-1].Environment["DEPLOY_TARGET"])
+}
+
+func TestEngine_AfterScriptAndServices(t *testing.T) {
+	config := &models.PipelineConfig{
+		Definitions: &models.Definitions{
+			Services: map[string]models.Service{"postgres": {Image: "postgres:13"}},
+		},
+	}
+	pipeline := models.Pipeline{{Step: models.Step{
+		Script:      []string{"exit 3"},
+		AfterScript: []string{"echo cleanup"},
+		Services:    []string{"postgres", "docker"},
+	}}}
+	runtime := &fakeRuntime{exec: func(workspace string, opts ExecOptions) int {
+		if strings.Contains(scriptOf(opts), "exit 3") {
+			return 3
+		}
+		return 0
+	}}
+
+	engine := NewEngine(runtime, models.NewDefaultRunnerConfig(), nil, t.TempDir(), &bytes.Buffer{})
+	ec := models.NewExecutionContext(config, "")
+
+	err := engine.Execute(context.Background(), pipeline, ec)
+	require.Error(t, err)
+
+	require.Len(t, runtime.started, 2)
+	assert.Equal(t, "postgres:13", runtime.started[1].Image)
+	assert.Equal(t, "container:container-1", runtime.started[1].NetworkMode)
+	assert.Contains(t, runtime.started[0].Volumes, models.VolumeMount{Host: dockerSocket, Container: dockerSocket})
+	require.Len(t, runtime.commands, 2)
+	assert.Contains(t, scriptOf(ExecOptions{Command: runtime.commands[1]}), "echo cleanup")
+	assert.Equal(t, "Step 1", ec.StepResults[0].StepName)
+	assert.Equal(t, 3, ec.StepResults[0].ExitCode)
+	assert.ElementsMatch(t, []string{"container-1", "container-2"}, runtime.removed)
+}
+
+func TestEngine_Pipes(t *testing.T) {
+	config := &models.PipelineConfig{Image: models.Image{Name: "node:16"}}
+	deploy := models.Pipe{
+		Name:      "atlassian/aws-s3-deploy:1.1.0",
+		Variables: map[string]interface{}{"S3_BUCKET": "my-bucket-$REGION", "EXTRA_ARGS": []interface{}{"--delete", "--quiet"}},
+	}
+	pipeline := models.Pipeline{{Step: models.Step{
+		Script:      []string{"make build", deploy.String(), "echo deployed"},
+		AfterScript: []string{"echo cleanup"},
+		Environment: map[string]string{"REGION": "eu-west-1"},
+	}}}
+
+	t.Run("run between commands", func(t *testing.T) {
+		runtime := &fakeRuntime{}
+		var out bytes.Buffer
+		engine := NewEngine(runtime, models.NewDefaultRunnerConfig(), nil, t.TempDir(), &out)
+		require.NoError(t, engine.Execute(context.Background(), pipeline, models.NewExecutionContext(config, "")))
+
+		require.Len(t, runtime.commands, 3)
+		assert.Contains(t, scriptOf(ExecOptions{Command: runtime.commands[0]}), "make build")
+		assert.Contains(t, scriptOf(ExecOptions{Command: runtime.commands[1]}), "echo deployed")
+		assert.Contains(t, scriptOf(ExecOptions{Command: runtime.commands[2]}), "echo cleanup")
+
+		require.Len(t, runtime.runs, 1)
+		pipe := runtime.runs[0]
+		assert.Equal(t, "bitbucketpipelines/aws-s3-deploy:1.1.0", pipe.Image)
+		assert.Equal(t, "container:container-1", pipe.NetworkMode)
+		assert.Equal(t, runtime.step.Volumes, pipe.Volumes)
+		assert.Equal(t, runtime.step.WorkingDir, pipe.WorkingDir)
+		assert.Equal(t, "my-bucket-eu-west-1", pipe.Environment["S3_BUCKET"])
+		assert.Equal(t, "2", pipe.Environment["EXTRA_ARGS_COUNT"])
+		assert.Equal(t, "--quiet", pipe.Environment["EXTRA_ARGS_1"])
+		assert.Equal(t, "eu-west-1", pipe.Environment["REGION"])
+		assert.Contains(t, out.String(), "+ pipe: atlassian/aws-s3-deploy:1.1.0\n")
+	})
+
+	t.Run("failing pipe stops the script", func(t *testing.T) {
+		runtime := &fakeRuntime{run: func(spec ContainerSpec) int { return 2 }}
+		engine := NewEngine(runtime, models.NewDefaultRunnerConfig(), nil, t.TempDir(), &bytes.Buffer{})
+		ec := models.NewExecutionContext(config, "")
+		require.Error(t, engine.Execute(context.Background(), pipeline, ec))
+
+		require.Len(t, runtime.commands, 2)
+		assert.Contains(t, scriptOf(ExecOptions{Command: runtime.commands[1]}), "echo cleanup")
+		assert.Equal(t, 2, ec.StepResults[0].ExitCode)
+	})
+}
+
+func TestEngine_Caches(t *testing.T) {
+	config := &models.PipelineConfig{
+		Image: models.Image{Name: "maven:3"},
+		Definitions: &models.Definitions{Caches: map[string]models.Cache{
+			"build": {Paths: []string{"target/classes", "/opt/tools"}},
+		}},
+	}
+	pipeline := models.Pipeline{{Step: models.Step{Name: "Build", Caches: []string{"maven", "build"}, Script: []string{"mvn package"}}}}
+	runtime := &fakeRuntime{}
+	runnerConfig := models.NewDefaultRunnerConfig()
+	engine := NewEngine(runtime, runnerConfig, nil, t.TempDir(), &bytes.Buffer{})
+	cacheDir := t.TempDir()
+	engine.SetCacheDir(cacheDir)
+
+	require.NoError(t, engine.Execute(context.Background(), pipeline, models.NewExecutionContext(config, "")))
+	cloneDir := runnerConfig.Defaults.WorkingDir
+	assert.Equal(t, []models.VolumeMount{
+		{Host: filepath.Join(cacheDir, "maven", "0"), Container: "/root/.m2/repository"},
+		{Host: filepath.Join(cacheDir, "build", "0"), Container: cloneDir + "/target/classes"},
+		{Host: filepath.Join(cacheDir, "build", "1"), Container: "/opt/tools"},
+	}, runtime.step.Volumes[1:])
+	assert.DirExists(t, filepath.Join(cacheDir, "build", "1"))
+}
+
+func TestEngine_ImageCredentials(t *testing.T) {
+	user := 0
+	config := &models.PipelineConfig{Image: models.Image{
+		Name:      "registry.example.com/build:1.4",
+		Username:  "ci",
+		Password:  "$REGISTRY_PASSWORD",
+		RunAsUser: &user,
+	}}
+	pipeline := models.Pipeline{{Step: models.Step{Name: "Build", Script: []string{"make"}}}}
+	runtime := &fakeRuntime{missing: map[string]bool{"registry.example.com/build:1.4": true}}
+	engine := NewEngine(runtime, models.NewDefaultRunnerConfig(), nil, t.TempDir(), &bytes.Buffer{})
+	ec := models.NewExecutionContext(config, "")
+	ec.SetEnvironmentVariable("REGISTRY_PASSWORD", "hunter2")
+
+	require.NoError(t, engine.Execute(context.Background(), pipeline, ec))
+	assert.Equal(t, "registry.example.com/build:1.4", runtime.step.Image)
+	assert.Equal(t, map[string]*ImageAuth{"registry.example.com/build:1.4": {Username: "ci", Password: "hunter2"}}, runtime.pulled)
+	assert.Equal(t, "0", runtime.step.User)
+}
+
+func TestEngine_PullPolicy(t *testing.T) {
+	config := &models.PipelineConfig{
+		Image: models.Image{Name: "node:18"},
+		Definitions: &models.Definitions{Services: map[string]models.Service{
+			"postgres": {Image: "postgres:15"},
+		}},
+	}
+	pipeline := models.Pipeline{
+		{Step: models.Step{Name: "Build", Script: []string{"make"}}},
+		{Step: models.Step{Name: "Test", Services: []string{"postgres", "docker"}, Script: []string{"make test"}}},
+	}
+	execute := func(policy string, missing ...string) (*fakeRuntime, string, error) {
+		runtime := &fakeRuntime{missing: make(map[string]bool)}
+		for _, image := range missing {
+			runtime.missing[image] = true
+		}
+		runnerConfig := models.NewDefaultRunnerConfig()
+		runnerConfig.Docker.PullPolicy = policy
+		var out bytes.Buffer
+		engine := NewEngine(runtime, runnerConfig, nil, t.TempDir(), &out)
+		err := engine.Execute(context.Background(), pipeline, models.NewExecutionContext(config, ""))
+		return runtime, out.String(), err
+	}
+
+	t.Run("missing", func(t *testing.T) {
+		runtime, out, err := execute(models.PullPolicyMissing, "postgres:15")
+		require.NoError(t, err)
+		assert.Equal(t, map[string]*ImageAuth{"postgres:15": nil}, runtime.pulled)
+		assert.Contains(t, out, "--> Pulling postgres:15\n    a1b2c3: Pull complete\n    2 of 3 layers downloaded, image size 3.0 MiB (")
+		assert.NotContains(t, out, "Pulling node:18")
+	})
+
+	t.Run("always", func(t *testing.T) {
+		runtime, _, err := execute(models.PullPolicyAlways)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]*ImageAuth{"node:18": nil, "postgres:15": nil}, runtime.pulled)
+	})
+
+	t.Run("never", func(t *testing.T) {
+		runtime, _, err := execute(models.PullPolicyNever, "postgres:15")
+		require.EqualError(t, err, "image 'postgres:15' is not available locally and the pull policy is never")
+		assert.Empty(t, runtime.pulled)
+		assert.Empty(t, runtime.started)
+	})
+}
+
+func TestEngine_ImageName(t *testing.T) {
+	runnerConfig := models.NewDefaultRunnerConfig()
+	engine := NewEngine(&fakeRuntime{}, runnerConfig, nil, t.TempDir(), &bytes.Buffer{})
+	assert.Equal(t, "node:18", engine.imageName("node:18"))
+
+	runnerConfig.Docker.Registry = "mirror.local/hub/"
+	for name, expected := range map[string]string{
+		"node:18":                       "mirror.local/hub/library/node:18",
+		"bitnami/redis":                 "mirror.local/hub/bitnami/redis",
+		"docker.io/library/golang:1.21": "mirror.local/hub/library/golang:1.21",
+		"registry.example.com/build":    "registry.example.com/build",
+		"":                              "",
+	} {
+		assert.Equal(t, expected, engine.imageName(name), name)
+	}
+}
+
+func TestEngine_RuntimeUnavailable(t *testing.T) {
+	_, pipeline := testPipeline()
+	runtime := &fakeRuntime{pingErr: errors.New("connection refused")}
+
+	engine := NewEngine(runtime, models.NewDefaultRunnerConfig(), nil, t.TempDir(), &bytes.Buffer{})
+	err := engine.Execute(context.Background(), pipeline, models.NewExecutionContext(nil, ""))
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "container runtime unavailable")
+	assert.Empty(t, runtime.started)
+}
+
+func TestEngine_ShellCommand(t *testing.T) {
+	engine := NewEngine(&fakeRuntime{}, models.NewDefaultRunnerConfig(), nil, "", &bytes.Buffer{})
+
+	command := engine.shellCommand([]string{"echo 'it''s'", "make"})
+
+	assert.Equal(t, "/bin/bash", command[0])
+	assert.Equal(t, "-c", command[1])
+	assert.True(t, strings.HasPrefix(command[2], "set -e\n"))
+	assert.Contains(t, command[2], "make\n")
+}
+
+func TestEngine_DebugShellOnFailure(t *testing.T) {
+	config, _ := testPipeline()
+	pipeline := models.Pipeline{{Step: models.Step{
+		Name:        "Test",
+		Script:      []string{"make test"},
+		AfterScript: []string{"echo cleanup"},
+	}}}
+	var shellOpts *ExecOptions
+	runtime := &fakeRuntime{exec: func(workspace string, opts ExecOptions) int {
+		if opts.TTY {
+			shellOpts = &opts
+			return 0
+		}
+		if strings.Contains(scriptOf(opts), "make test") {
+			return 1
+		}
+		return 0
+	}}
+
+	engine := NewEngine(runtime, models.NewDefaultRunnerConfig(), nil, t.TempDir(), &bytes.Buffer{})
+	engine.SetDebugOptions(DebugOptions{ShellOnFailure: true, In: strings.NewReader(""), TTY: true})
+
+	err := engine.Execute(context.Background(), pipeline, models.NewExecutionContext(config, ""))
+	require.Error(t, err)
+
+	require.NotNil(t, shellOpts)
+	assert.Equal(t, debugShell, shellOpts.Command)
+	assert.Equal(t, "1", shellOpts.Environment["BITBUCKET_EXIT_CODE"])
+	// The shell runs before after-script and before the container is removed
+	require.Len(t, runtime.commands, 3)
+	assert.Equal(t, debugShell, runtime.commands[1])
+	assert.Contains(t, scriptOf(ExecOptions{Command: runtime.commands[2]}), "echo cleanup")
+	assert.Equal(t, []string{"container-1"}, runtime.removed)
+}
+
+func TestEngine_DebugShellOnExecError(t *testing.T) {
+	config, pipeline := testPipeline()
+	runtime := &fakeRuntime{execErr: errors.New("container stopped")}
+
+	engine := NewEngine(runtime, models.NewDefaultRunnerConfig(), nil, t.TempDir(), &bytes.Buffer{})
+	engine.SetDebugOptions(DebugOptions{ShellOnFailure: true, In: strings.NewReader(""), TTY: true})
+
+	err := engine.Execute(context.Background(), pipeline, models.NewExecutionContext(config, ""))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to execute script: container stopped")
+	require.Len(t, runtime.commands, 2)
+	assert.Equal(t, debugShell, runtime.commands[1])
+}
+
+func TestEngine_AfterScriptOnExecError(t *testing.T) {
+	config := &models.PipelineConfig{Image: models.Image{Name: "node:16"}}
+	pipeline := models.Pipeline{{Step: models.Step{Script: []string{"make"}, AfterScript: []string{"echo cleanup"}}}}
+	runtime := &fakeRuntime{execErr: errors.New("container stopped")}
+
+	engine := NewEngine(runtime, models.NewDefaultRunnerConfig(), nil, t.TempDir(), &bytes.Buffer{})
+	err := engine.Execute(context.Background(), pipeline, models.NewExecutionContext(config, ""))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to execute script: container stopped")
+	require.Len(t, runtime.commands, 2)
+	assert.Contains(t, scriptOf(ExecOptions{Command: runtime.commands[1]}), "echo cleanup")
+}
+
+func TestEngine_StepThrough(t *testing.T) {
+	config, pipeline := testPipeline()
+
+	t.Run("shell then continue", func(t *testing.T) {
+		runtime := &fakeRuntime{}
+		var out bytes.Buffer
+		engine := NewEngine(runtime, models.NewDefaultRunnerConfig(), nil, t.TempDir(), &out)
+		engine.SetDebugOptions(DebugOptions{StepThrough: true, In: strings.NewReader("s\n\n\n\n")})
+
+		err := engine.Execute(context.Background(), pipeline, models.NewExecutionContext(config, ""))
+		require.NoError(t, err)
+
+		// The prompt is shown again after the shell exits
+		assert.Equal(t, 4, strings.Count(out.String(), "Paused before"))
+		require.Len(t, runtime.commands, 4)
+		assert.Equal(t, debugShell, runtime.commands[0])
+	})
+
+	t.Run("shell attached to the terminal", func(t *testing.T) {
+		in := strings.NewReader("s\n\n\n\n")
+		var stdin io.Reader
+		runtime := &fakeRuntime{exec: func(workspace string, opts ExecOptions) int {
+			if opts.TTY {
+				stdin = opts.Stdin
+			}
+			return 0
+		}}
+		engine := NewEngine(runtime, models.NewDefaultRunnerConfig(), nil, t.TempDir(), &bytes.Buffer{})
+		engine.SetDebugOptions(DebugOptions{StepThrough: true, In: in, Prompt: bufio.NewReader(in), TTY: true})
+
+		require.NoError(t, engine.Execute(context.Background(), pipeline, models.NewExecutionContext(config, "")))
+		// The shell reads the terminal itself, not the buffered prompt reader
+		assert.Same(t, in, stdin)
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		runtime := &fakeRuntime{}
+		engine := NewEngine(runtime, models.NewDefaultRunnerConfig(), nil, t.TempDir(), &bytes.Buffer{})
+		engine.SetDebugOptions(DebugOptions{StepThrough: true, In: strings.NewReader("\nq\n")})
+		ec := models.NewExecutionContext(config, "")
+
+		err := engine.Execute(context.Background(), pipeline, ec)
+		require.Error(t, err)
+
+		assert.Equal(t, models.ExecutionStatusCancelled, ec.Status)
+		require.Len(t, ec.StepResults, 2)
+		assert.Equal(t, models.StepStatusFailed, ec.StepResults[1].Status)
+		assert.Len(t, runtime.commands, 1)
+		assert.Len(t, runtime.removed, 2)
+	})
+}
@@ -0,0 +1,136 @@
+package executor
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"bitbucket-runner/internal/models"
+)
+
+// ImageAuth holds the credentials a step image is pulled with, with the
+// variables they reference expanded
+type ImageAuth struct {
+	Username     string `json:"username,omitempty"`
+	Password     string `json:"password,omitempty"`
+	Email        string `json:"email,omitempty"`
+	AWSAccessKey string `json:"aws_access_key,omitempty"`
+	AWSSecretKey string `json:"aws_secret_key,omitempty"`
+}
+
+// Masked returns a copy of the credentials with the secrets replaced
+func (a *ImageAuth) Masked() *ImageAuth {
+	if a == nil {
+		return nil
+	}
+	masked := *a
+	if masked.Password != "" {
+		masked.Password = maskedValue
+	}
+	if masked.AWSSecretKey != "" {
+		masked.AWSSecretKey = maskedValue
+	}
+	return &masked
+}
+
+// imageAuth expands the credentials of an image with the variables of the
+// step, falling back to the environment of the runner. It returns nil for
+// images pulled anonymously.
+func imageAuth(image models.Image, env map[string]string) (*ImageAuth, error) {
+	if !image.HasCredentials() {
+		return nil, nil
+	}
+	if image.AWS != nil && image.AWS.OIDCRole != "" && image.AWS.AccessKey == "" {
+		return nil, fmt.Errorf("image '%s' uses an OIDC role, which the runner cannot assume, set aws access-key and secret-key instead", image.Name)
+	}
+
+	undefined := make(map[string]bool)
+	expand := func(value string) string {
+		return os.Expand(value, func(name string) string {
+			if value, ok := env[name]; ok {
+				return value
+			}
+			if value, ok := os.LookupEnv(name); ok {
+				return value
+			}
+			undefined[name] = true
+			return ""
+		})
+	}
+
+	auth := &ImageAuth{
+		Username: expand(image.Username),
+		Password: expand(image.Password),
+		Email:    expand(image.Email),
+	}
+	if image.AWS != nil {
+		auth.AWSAccessKey = expand(image.AWS.AccessKey)
+		auth.AWSSecretKey = expand(image.AWS.SecretKey)
+	}
+
+	if len(undefined) > 0 {
+		names := make([]string, 0, len(undefined))
+		for name := range undefined {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("credentials of image '%s' use undefined variables: %s", image.Name, strings.Join(names, ", "))
+	}
+	return auth, nil
+}
+
+// imageName returns the name an image is pulled as: the name given by the
+// first image rewrite of the runner configuration matching it or, for
+// images of Docker Hub, their name in the registry of the runner
+// configuration when one is set, such as a pull-through mirror.
+func (e *Engine) imageName(name string) string {
+	if rewritten, ok := e.runnerConfig.Docker.RewriteImage(name); ok {
+		return rewritten
+	}
+	registry := strings.TrimSuffix(e.runnerConfig.Docker.Registry, "/")
+	if registry == "" || name == "" || models.Registry(name) != models.DockerHub {
+		return name
+	}
+	return registry + "/" + strings.TrimPrefix(models.CanonicalImage(name), models.DockerHub+"/")
+}
+
+// originalImage returns the name of an image as configured when it was
+// rewritten, empty otherwise
+func originalImage(name, rewritten string) string {
+	if name == rewritten {
+		return ""
+	}
+	return name
+}
+
+// RewrittenImage is an image pulled under another name than the one it is
+// configured with
+type RewrittenImage struct {
+	Original string `json:"original"`
+	Image    string `json:"image"`
+}
+
+// RewrittenImages lists the rewritten images of the steps, services and
+// pipes of the plan, each once, in order of first use
+func (p *Plan) RewrittenImages() []RewrittenImage {
+	var images []RewrittenImage
+	seen := make(map[string]bool)
+	add := func(original, image string) {
+		if original == "" || seen[original] {
+			return
+		}
+		seen[original] = true
+		images = append(images, RewrittenImage{Original: original, Image: image})
+	}
+	for _, step := range p.Steps {
+		add(step.OriginalImage, step.Image)
+		for _, service := range step.Services {
+			add(service.OriginalImage, service.Image)
+		}
+		for _, pipe := range step.Pipes {
+			add(pipe.OriginalImage, pipe.Image)
+		}
+	}
+	return images
+}
@@ -0,0 +1,256 @@
+package executor
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"bitbucket-runner/internal/models"
+)
+
+// maskedValue replaces the value of secret variables in plans
+const maskedValue = "********"
+
+// Plan is the fully resolved execution of a pipeline, used both to run it
+// and to show what a run would do
+type Plan struct {
+	Pipeline   string        `json:"pipeline"`
+	Override   string        `json:"override,omitempty"`   // local file merged onto the configuration
+	Transforms []string      `json:"transforms,omitempty"` // hooks that rewrote the configuration
+	Steps      []PlannedStep `json:"steps"`
+}
+
+// PlannedStep is a step with everything the engine needs to run it
+type PlannedStep struct {
+	Index         int               `json:"index"`
+	Name          string            `json:"name"`
+	ParallelGroup int               `json:"parallel_group,omitempty"`
+	FailFast      bool              `json:"fail_fast,omitempty"`
+	Stage         string            `json:"stage,omitempty"`
+	Definition    string            `json:"definition,omitempty"`
+	Trigger       string            `json:"trigger"`
+	Image         string            `json:"image"`
+	OriginalImage string            `json:"original_image,omitempty"` // configured image, when rewritten
+	ImageAuth     *ImageAuth        `json:"image_auth,omitempty"`
+	RunAsUser     *int              `json:"run_as_user,omitempty"`
+	StepType      string            `json:"step_type"`
+	Services      []PlannedService  `json:"services,omitempty"`
+	Caches        []PlannedCache    `json:"caches,omitempty"`
+	Artifacts     []string          `json:"artifacts,omitempty"`
+	Environment   map[string]string `json:"environment"`
+	Timeout       int               `json:"timeout_seconds"`
+	Condition     *models.Condition `json:"condition,omitempty"`
+	Decision      *ConditionResult  `json:"condition_result,omitempty"`
+	Script        []string          `json:"script"`
+	AfterScript   []string          `json:"after_script,omitempty"`
+	Pipes         []PlannedPipe     `json:"pipes,omitempty"`
+
+	step     models.Step
+	stepType *models.StepType
+}
+
+// PlannedService is a service container started next to a step
+type PlannedService struct {
+	Name          string `json:"name"`
+	Image         string `json:"image,omitempty"`
+	OriginalImage string `json:"original_image,omitempty"` // configured image, when rewritten
+}
+
+// PlannedPipe is a pipe of the script or after-script of a step, run in a
+// container of its own
+type PlannedPipe struct {
+	Pipe          string `json:"pipe"`
+	Image         string `json:"image"`
+	OriginalImage string `json:"original_image,omitempty"` // image of the pipe, when rewritten
+}
+
+// PlannedCache is a cache used by a step
+type PlannedCache struct {
+	Name       string   `json:"name"`
+	Paths      []string `json:"paths"`
+	Predefined bool     `json:"predefined,omitempty"`
+}
+
+// Plan resolves the pipeline for the given execution context without
+// contacting the container runtime. All resolution problems are reported
+// together.
+func (e *Engine) Plan(pipeline models.Pipeline, ec *models.ExecutionContext) (*Plan, error) {
+	plan := &Plan{Pipeline: ec.PipelineName}
+	var problems []string
+
+	addStep := func(step models.Step, group int, failFast bool, stage *models.Stage) {
+		planned, errs := e.planStep(ec, step, len(plan.Steps))
+		planned.ParallelGroup = group
+		planned.FailFast = failFast
+		planned.Decision = evaluateConditions(stage, step.Condition, ec.Changeset)
+		if stage != nil {
+			planned.Stage = stageName(stage)
+			if planned.Trigger == models.TriggerAutomatic && stage.Trigger != "" {
+				planned.Trigger = stage.Trigger
+			}
+		}
+		plan.Steps = append(plan.Steps, planned)
+		problems = append(problems, errs...)
+	}
+
+	group := 0
+	for _, wrapper := range pipeline {
+		switch {
+		case wrapper.Parallel != nil:
+			group++
+			for _, parallel := range wrapper.Parallel.Steps {
+				addStep(parallel.Step, group, wrapper.Parallel.FailFast, nil)
+			}
+		case wrapper.Stage != nil:
+			for _, staged := range wrapper.Stage.Steps {
+				addStep(staged.Step, 0, false, wrapper.Stage)
+			}
+		case wrapper.Variables != nil:
+			continue
+		default:
+			addStep(wrapper.Step, 0, false, nil)
+		}
+	}
+
+	if len(plan.Steps) == 0 {
+		problems = append(problems, "pipeline has no steps")
+	}
+	if len(problems) > 0 {
+		return plan, errors.New(strings.Join(problems, "; "))
+	}
+
+	return plan, nil
+}
+
+func (e *Engine) planStep(ec *models.ExecutionContext, step models.Step, index int) (PlannedStep, []string) {
+	stepType, named := e.runnerConfig.ResolveStepType(step.Name)
+	stepTypeName := "default"
+	if named {
+		stepTypeName = step.Name
+	}
+
+	timeout := stepType.Timeout
+	if timeout <= 0 {
+		timeout = e.runnerConfig.Defaults.Timeout
+	}
+
+	image := e.effectiveImage(ec, step, stepType, named)
+	planned := PlannedStep{
+		Index:       index,
+		Name:        stepName(step, index),
+		Definition:  step.Definition,
+		Image:       e.imageName(image.Name),
+		RunAsUser:   image.RunAsUser,
+		StepType:    stepTypeName,
+		Trigger:     models.TriggerAutomatic,
+		Environment: e.stepEnvironment(ec, step, stepType),
+		Timeout:     timeout,
+		Condition:   step.Condition,
+		Script:      step.Script,
+		AfterScript: step.AfterScript,
+		step:        step,
+		stepType:    stepType,
+	}
+	planned.OriginalImage = originalImage(image.Name, planned.Image)
+	if step.Trigger != "" {
+		planned.Trigger = step.Trigger
+	}
+	if step.Artifacts != nil {
+		planned.Artifacts = step.Artifacts.Paths
+	}
+
+	var problems []string
+	if planned.Image == "" {
+		problems = append(problems, fmt.Sprintf("%s: no image configured", planned.Name))
+	}
+	auth, err := imageAuth(image, planned.Environment)
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("%s: %v", planned.Name, err))
+	}
+	planned.ImageAuth = auth
+
+	for _, name := range step.Services {
+		if name == dockerService {
+			planned.Services = append(planned.Services, PlannedService{Name: name})
+			continue
+		}
+		service, ok := lookupService(ec, name)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s: service '%s' is not defined in definitions.services", planned.Name, name))
+			continue
+		}
+		serviceImage := e.imageName(service.Image)
+		planned.Services = append(planned.Services, PlannedService{Name: name, Image: serviceImage, OriginalImage: originalImage(service.Image, serviceImage)})
+	}
+
+	for _, entry := range append(append([]string(nil), step.Script...), step.AfterScript...) {
+		if pipe, ok := models.ParsePipe(entry); ok && planned.pipeImage(pipe.Name) == "" {
+			pipeImage := e.imageName(pipe.Image())
+			planned.Pipes = append(planned.Pipes, PlannedPipe{Pipe: pipe.Name, Image: pipeImage, OriginalImage: originalImage(pipe.Image(), pipeImage)})
+		}
+	}
+
+	for _, name := range step.Caches {
+		cache, ok := lookupCache(ec, name)
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s: cache '%s' is neither defined in definitions.caches nor predefined", planned.Name, name))
+			continue
+		}
+		planned.Caches = append(planned.Caches, cache)
+	}
+
+	return planned, problems
+}
+
+// pipeImage returns the image a pipe of the step runs, empty when the step
+// has no such pipe
+func (s PlannedStep) pipeImage(pipe string) string {
+	for _, planned := range s.Pipes {
+		if planned.Pipe == pipe {
+			return planned.Image
+		}
+	}
+	return ""
+}
+
+// Masked returns a copy of the plan with the values of secret variables
+// replaced, safe to be displayed or written to logs
+func (p *Plan) Masked() *Plan {
+	masked := &Plan{Pipeline: p.Pipeline, Override: p.Override, Transforms: p.Transforms, Steps: make([]PlannedStep, len(p.Steps))}
+	for i, step := range p.Steps {
+		step.Environment = MaskEnvironment(step.Environment)
+		step.ImageAuth = step.ImageAuth.Masked()
+		masked.Steps[i] = step
+	}
+	return masked
+}
+
+// MaskEnvironment returns a copy of env with the values of variables that
+// look like secrets masked
+func MaskEnvironment(env map[string]string) map[string]string {
+	masked := make(map[string]string, len(env))
+	for key, value := range env {
+		if models.IsSecretVariable(key) && value != "" {
+			value = maskedValue
+		}
+		masked[key] = value
+	}
+	return masked
+}
+
+func lookupCache(ec *models.ExecutionContext, name string) (PlannedCache, bool) {
+	if ec.PipelineConfig != nil && ec.PipelineConfig.Definitions != nil {
+		if cache, ok := ec.PipelineConfig.Definitions.Caches[name]; ok {
+			paths := cache.Paths
+			if cache.Path != "" {
+				paths = append([]string{cache.Path}, paths...)
+			}
+			return PlannedCache{Name: name, Paths: paths}, true
+		}
+	}
+
+	if path, ok := models.PredefinedCaches[name]; ok {
+		return PlannedCache{Name: name, Paths: []string{path}, Predefined: true}, true
+	}
+	return PlannedCache{}, false
+}
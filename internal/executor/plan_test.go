@@ -0,0 +1,230 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"bitbucket-runner/internal/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEngine_Plan(t *testing.T) {
+	config := &models.PipelineConfig{
+		Image: models.Image{Name: "node:16"},
+		Definitions: &models.Definitions{
+			Services: map[string]models.Service{"postgres": {Image: "postgres:13"}},
+			Caches:   map[string]models.Cache{"build": {Path: "build/cache"}},
+		},
+	}
+	pipeline := models.Pipeline{
+		{Step: models.Step{
+			Name:        "Build",
+			Script:      []string{"npm ci"},
+			Caches:      []string{"node", "build"},
+			Artifacts:   &models.Artifacts{Paths: []string{"dist/**"}},
+			Environment: map[string]string{"NPM_TOKEN": "secret", "NODE_ENV": "test"},
+		}},
+		{Parallel: &models.Parallel{FailFast: true, Steps: []models.StepWrapper{
+			{Step: models.Step{Name: "Unit", Services: []string{"postgres", "docker"}, Script: []string{"npm test"}}},
+			{Step: models.Step{Name: "Lint", Image: models.Image{Name: "node:18"}, Script: []string{"npm run lint"}}},
+		}}},
+		{Step: models.Step{Script: []string{"deploy"}}},
+	}
+
+	runnerConfig := models.NewDefaultRunnerConfig()
+	runnerConfig.StepTypes["Lint"] = models.StepType{Image: "golangci/golangci-lint", Timeout: 600}
+
+	engine := NewEngine(&fakeRuntime{}, runnerConfig, nil, t.TempDir(), &bytes.Buffer{})
+	ec := models.NewExecutionContext(config, "")
+	ec.PipelineName = "default"
+
+	plan, err := engine.Plan(pipeline, ec)
+	require.NoError(t, err)
+
+	assert.Equal(t, "default", plan.Pipeline)
+	require.Len(t, plan.Steps, 4)
+
+	build := plan.Steps[0]
+	assert.Equal(t, "node:16", build.Image)
+	assert.Equal(t, "default", build.StepType)
+	assert.Equal(t, 0, build.ParallelGroup)
+	assert.Equal(t, []PlannedCache{
+		{Name: "node", Paths: []string{"node_modules"}, Predefined: true},
+		{Name: "build", Paths: []string{"build/cache"}},
+	}, build.Caches)
+	assert.Equal(t, []string{"dist/**"}, build.Artifacts)
+	assert.Equal(t, 3600, build.Timeout)
+
+	unit := plan.Steps[1]
+	assert.Equal(t, 1, unit.ParallelGroup)
+	assert.True(t, unit.FailFast)
+	assert.Equal(t, []PlannedService{{Name: "postgres", Image: "postgres:13"}, {Name: "docker"}}, unit.Services)
+
+	lint := plan.Steps[2]
+	assert.Equal(t, 1, lint.ParallelGroup)
+	assert.Equal(t, "node:18", lint.Image, "step image wins over the step type")
+	assert.Equal(t, "Lint", lint.StepType)
+	assert.Equal(t, 600, lint.Timeout)
+
+	assert.Equal(t, "Step 4", plan.Steps[3].Name)
+	assert.Equal(t, 3, plan.Steps[3].Index)
+
+	masked := plan.Masked()
+	assert.Equal(t, maskedValue, masked.Steps[0].Environment["NPM_TOKEN"])
+	assert.Equal(t, "test", masked.Steps[0].Environment["NODE_ENV"])
+	assert.Equal(t, "secret", plan.Steps[0].Environment["NPM_TOKEN"], "masking must not modify the plan")
+}
+
+func TestEngine_PlanImageCredentials(t *testing.T) {
+	t.Setenv("REGISTRY_PASSWORD", "hunter2")
+	user := 1000
+	config := &models.PipelineConfig{Image: models.Image{
+		Name:      "registry.example.com/build:1.4",
+		Username:  "$REGISTRY_USER",
+		Password:  "${REGISTRY_PASSWORD}",
+		RunAsUser: &user,
+	}}
+	pipeline := models.Pipeline{
+		{Step: models.Step{Name: "Build", Environment: map[string]string{"REGISTRY_USER": "ci"}, Script: []string{"make"}}},
+		{Step: models.Step{Name: "Push", Image: models.Image{
+			Name: "123456789012.dkr.ecr.eu-west-1.amazonaws.com/app:2",
+			AWS:  &models.ImageAWS{AccessKey: "$AWS_KEY", SecretKey: "$AWS_SECRET"},
+		}, Script: []string{"make push"}}},
+	}
+
+	engine := NewEngine(&fakeRuntime{}, models.NewDefaultRunnerConfig(), nil, t.TempDir(), &bytes.Buffer{})
+	ec := models.NewExecutionContext(config, "")
+	_, err := engine.Plan(pipeline, ec)
+	require.Error(t, err)
+	assert.Equal(t, "Push: credentials of image '123456789012.dkr.ecr.eu-west-1.amazonaws.com/app:2' use undefined variables: AWS_KEY, AWS_SECRET", err.Error())
+
+	ec.SetEnvironmentVariable("AWS_KEY", "AKIAEXAMPLE")
+	ec.SetEnvironmentVariable("AWS_SECRET", "wJalrXUtnFEMI")
+	plan, err := engine.Plan(pipeline, ec)
+	require.NoError(t, err)
+	assert.Equal(t, &ImageAuth{Username: "ci", Password: "hunter2"}, plan.Steps[0].ImageAuth)
+	assert.Equal(t, &user, plan.Steps[0].RunAsUser)
+	assert.Equal(t, &ImageAuth{AWSAccessKey: "AKIAEXAMPLE", AWSSecretKey: "wJalrXUtnFEMI"}, plan.Steps[1].ImageAuth)
+	assert.Nil(t, plan.Steps[1].RunAsUser)
+
+	masked := plan.Masked()
+	assert.Equal(t, &ImageAuth{Username: "ci", Password: maskedValue}, masked.Steps[0].ImageAuth)
+	assert.Equal(t, &ImageAuth{AWSAccessKey: "AKIAEXAMPLE", AWSSecretKey: maskedValue}, masked.Steps[1].ImageAuth)
+	assert.Equal(t, "hunter2", plan.Steps[0].ImageAuth.Password, "masking must not modify the plan")
+
+	pipeline[1].Step.Image.AWS = &models.ImageAWS{OIDCRole: "arn:aws:iam::123456789012:role/ci"}
+	_, err = engine.Plan(pipeline, ec)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "uses an OIDC role, which the runner cannot assume")
+}
+
+func TestEngine_PlanImageRewrites(t *testing.T) {
+	config := &models.PipelineConfig{
+		Image: models.Image{Name: "node:16"},
+		Definitions: &models.Definitions{
+			Services: map[string]models.Service{"postgres": {Image: "postgres:15"}, "redis": {Image: "redis:7"}},
+		},
+	}
+	pipeline := models.Pipeline{
+		{Step: models.Step{Name: "Build", Services: []string{"postgres"}, Script: []string{"npm ci"}}},
+		{Step: models.Step{Name: "Test", Services: []string{"postgres", "redis"}, Script: []string{"npm test"}}},
+		{Step: models.Step{Name: "Package", Image: models.Image{Name: "registry.example.com/packer"}, Script: []string{
+			"pack",
+			models.Pipe{Name: "atlassian/aws-s3-deploy:1.1.0"}.String(),
+			models.Pipe{Name: "docker://registry.example.com/notify:1"}.String(),
+		}}},
+	}
+
+	runnerConfig := models.NewDefaultRunnerConfig()
+	runnerConfig.Docker.Registry = "hub.example.com"
+	runnerConfig.Docker.Rewrites = []models.ImageRewrite{
+		{Match: "node:16", Replace: "node:16-bullseye"},
+		{Regex: `postgres:(\d+)`, Replace: "mirror.local/postgres:$1-alpine"},
+	}
+	require.NoError(t, runnerConfig.Validate())
+	var out bytes.Buffer
+	engine := NewEngine(&fakeRuntime{}, runnerConfig, nil, t.TempDir(), &out)
+	ec := models.NewExecutionContext(config, "")
+
+	plan, err := engine.Plan(pipeline, ec)
+	require.NoError(t, err)
+	assert.Equal(t, "node:16-bullseye", plan.Steps[0].Image)
+	assert.Equal(t, "node:16", plan.Steps[0].OriginalImage)
+	assert.Equal(t, []PlannedService{
+		{Name: "postgres", Image: "mirror.local/postgres:15-alpine", OriginalImage: "postgres:15"},
+		{Name: "redis", Image: "hub.example.com/library/redis:7", OriginalImage: "redis:7"},
+	}, plan.Steps[1].Services)
+	assert.Equal(t, "registry.example.com/packer", plan.Steps[2].Image)
+	assert.Empty(t, plan.Steps[2].OriginalImage)
+	assert.Equal(t, []PlannedPipe{
+		{Pipe: "atlassian/aws-s3-deploy:1.1.0", Image: "hub.example.com/bitbucketpipelines/aws-s3-deploy:1.1.0", OriginalImage: "bitbucketpipelines/aws-s3-deploy:1.1.0"},
+		{Pipe: "docker://registry.example.com/notify:1", Image: "registry.example.com/notify:1"},
+	}, plan.Steps[2].Pipes)
+	assert.Equal(t, []RewrittenImage{
+		{Original: "node:16", Image: "node:16-bullseye"},
+		{Original: "postgres:15", Image: "mirror.local/postgres:15-alpine"},
+		{Original: "redis:7", Image: "hub.example.com/library/redis:7"},
+		{Original: "bitbucketpipelines/aws-s3-deploy:1.1.0", Image: "hub.example.com/bitbucketpipelines/aws-s3-deploy:1.1.0"},
+	}, plan.RewrittenImages())
+
+	require.NoError(t, engine.Execute(context.Background(), pipeline, ec))
+	assert.True(t, strings.HasPrefix(out.String(), "--> Using node:16-bullseye for node:16\n--> Using mirror.local/postgres:15-alpine for postgres:15\n--> Using hub.example.com/library/redis:7 for redis:7\n"), out.String())
+	assert.Contains(t, out.String(), "==> Build (node:16-bullseye)\n")
+}
+
+func TestEngine_PlanErrors(t *testing.T) {
+	pipeline := models.Pipeline{
+		{Step: models.Step{Name: "Test", Services: []string{"redis"}, Caches: []string{"gems"}, Script: []string{"rake"}}},
+	}
+
+	engine := NewEngine(&fakeRuntime{}, models.NewDefaultRunnerConfig(), nil, t.TempDir(), &bytes.Buffer{})
+	_, err := engine.Plan(pipeline, models.NewExecutionContext(&models.PipelineConfig{}, ""))
+
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "service 'redis' is not defined")
+	assert.Contains(t, err.Error(), "cache 'gems' is neither defined")
+}
+
+func TestEngine_ExecuteParallelGroup(t *testing.T) {
+	pipeline := func(failFast bool) models.Pipeline {
+		return models.Pipeline{
+			{Parallel: &models.Parallel{FailFast: failFast, Steps: []models.StepWrapper{
+				{Step: models.Step{Name: "A", Script: []string{"exit 1"}}},
+				{Step: models.Step{Name: "B", Script: []string{"true"}}},
+			}}},
+			{Step: models.Step{Name: "C", Script: []string{"true"}}},
+		}
+	}
+	failA := func(workspace string, opts ExecOptions) int {
+		if strings.Contains(scriptOf(opts), "exit 1") {
+			return 1
+		}
+		return 0
+	}
+
+	t.Run("remaining group steps run after a failure", func(t *testing.T) {
+		runtime := &fakeRuntime{exec: failA}
+		engine := NewEngine(runtime, models.NewDefaultRunnerConfig(), nil, t.TempDir(), &bytes.Buffer{})
+		ec := models.NewExecutionContext(&models.PipelineConfig{Image: models.Image{Name: "alpine"}}, "")
+
+		err := engine.Execute(context.Background(), pipeline(false), ec)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "step 'A' failed")
+		require.Len(t, ec.StepResults, 2)
+		assert.Equal(t, models.StepStatusCompleted, ec.StepResults[1].Status)
+	})
+
+	t.Run("fail-fast stops the group", func(t *testing.T) {
+		runtime := &fakeRuntime{exec: failA}
+		engine := NewEngine(runtime, models.NewDefaultRunnerConfig(), nil, t.TempDir(), &bytes.Buffer{})
+		ec := models.NewExecutionContext(&models.PipelineConfig{Image: models.Image{Name: "alpine"}}, "")
+
+		err := engine.Execute(context.Background(), pipeline(true), ec)
+		require.Error(t, err)
+		assert.Len(t, ec.StepResults, 1)
+	})
+}
@@ -0,0 +1,192 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"bitbucket-runner/internal/models"
+)
+
+// PlannedImage is an image steps, services or pipes of a plan run in, with the
+// credentials it is pulled with
+type PlannedImage struct {
+	Image    string
+	Original string // configured image, when rewritten
+	Auth     *ImageAuth
+}
+
+// ImagePull is the outcome of making an image available
+type ImagePull struct {
+	PlannedImage
+	Present  bool // found locally and not pulled
+	Result   PullResult
+	Duration time.Duration
+	Err      error
+}
+
+// Images lists the images of the steps of the plan, of their services and
+// of their pipes, each once in order of first use, with the credentials of
+// the first step giving some. Steps skipped by their condition are left
+// out.
+func (p *Plan) Images() []PlannedImage {
+	return plannedImages(p.Steps)
+}
+
+func plannedImages(steps []PlannedStep) []PlannedImage {
+	var images []PlannedImage
+	index := make(map[string]int)
+	add := func(image, original string, auth *ImageAuth) {
+		if image == "" {
+			return
+		}
+		i, ok := index[image]
+		if !ok {
+			index[image] = len(images)
+			images = append(images, PlannedImage{Image: image, Original: original, Auth: auth})
+			return
+		}
+		if images[i].Auth == nil {
+			images[i].Auth = auth
+		}
+	}
+	for _, step := range steps {
+		if step.Decision != nil && !step.Decision.Run {
+			continue
+		}
+		add(step.Image, step.OriginalImage, step.ImageAuth)
+		for _, service := range step.Services {
+			add(service.Image, service.OriginalImage, nil)
+		}
+		for _, pipe := range step.Pipes {
+			add(pipe.Image, pipe.OriginalImage, nil)
+		}
+	}
+	return images
+}
+
+// pullPolicy returns the pull policy of the runner configuration, missing
+// when unset
+func (e *Engine) pullPolicy() string {
+	if policy := e.runnerConfig.Docker.PullPolicy; policy != "" {
+		return policy
+	}
+	return models.PullPolicyMissing
+}
+
+// pullImages makes the images of the steps left to run, of their services
+// and of their pipes available before the run starts, following the pull
+// policy of the runner configuration: missing images are pulled by default,
+// every image with always and none with never.
+func (e *Engine) pullImages(ctx context.Context, steps []PlannedStep) error {
+	policy := e.pullPolicy()
+	for _, image := range plannedImages(steps) {
+		if policy != models.PullPolicyAlways {
+			exists, err := e.runtime.ImageExists(ctx, image.Image)
+			if err != nil {
+				return fmt.Errorf("failed to inspect image '%s': %w", image.Image, err)
+			}
+			if exists {
+				continue
+			}
+			if policy == models.PullPolicyNever {
+				return fmt.Errorf("image '%s' is not available locally and the pull policy is never", image.Image)
+			}
+		}
+
+		fmt.Fprintf(e.out, "--> Pulling %s\n", image.Image)
+		pull := e.pull(ctx, image, func(line string) {
+			fmt.Fprintf(e.out, "    %s\n", line)
+		})
+		if pull.Err != nil {
+			return fmt.Errorf("failed to pull image '%s': %w", image.Image, pull.Err)
+		}
+		fmt.Fprintf(e.out, "    %s (%s)\n", pull.Result.Summary(), pull.Duration.Round(time.Millisecond))
+	}
+	return nil
+}
+
+// PullImages pulls images with at most jobs pulls at a time and returns
+// their outcome in the order of images. Images found locally are pulled
+// again with the always pull policy only; the never policy does not apply,
+// pulling images beforehand being how runs that never pull get them.
+// progress is called with the lines of progress of the pulls as they are
+// made and report as each image is handled, neither concurrently.
+func (e *Engine) PullImages(ctx context.Context, images []PlannedImage, jobs int, progress func(image PlannedImage, line string), report func(ImagePull)) []ImagePull {
+	if jobs < 1 {
+		jobs = 1
+	}
+	always := e.pullPolicy() == models.PullPolicyAlways
+	pulls := make([]ImagePull, len(images))
+	indexes := make(chan int)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for worker := 0; worker < jobs && worker < len(images); worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				pull := ImagePull{PlannedImage: images[i]}
+				if !always {
+					pull.Present, pull.Err = e.runtime.ImageExists(ctx, images[i].Image)
+				}
+				if pull.Err == nil && !pull.Present {
+					pull = e.pull(ctx, images[i], func(line string) {
+						if progress != nil {
+							mu.Lock()
+							progress(images[i], line)
+							mu.Unlock()
+						}
+					})
+				}
+
+				mu.Lock()
+				pulls[i] = pull
+				if report != nil {
+					report(pull)
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := range images {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return pulls
+}
+
+// pull pulls an image with its credentials and times the pull
+func (e *Engine) pull(ctx context.Context, image PlannedImage, progress func(line string)) ImagePull {
+	start := time.Now()
+	result, err := e.runtime.Pull(ctx, image.Image, image.Auth, progress)
+	return ImagePull{PlannedImage: image, Result: result, Duration: time.Since(start), Err: err}
+}
+
+// Summary describes the result of a pull in a few words
+func (r PullResult) Summary() string {
+	if r.UpToDate {
+		return "up to date"
+	}
+	summary := fmt.Sprintf("%d of %d layers downloaded", r.Layers-r.Cached, r.Layers)
+	if r.Size > 0 {
+		summary += ", image size " + FormatSize(r.Size)
+	}
+	return summary
+}
+
+// FormatSize formats a size in bytes with a binary unit, such as 12.3 MiB
+func FormatSize(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	value, exponent := float64(size)/unit, 0
+	for value >= unit && exponent < 4 {
+		value /= unit
+		exponent++
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGTP"[exponent])
+}
@@ -0,0 +1,112 @@
+package executor
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"bitbucket-runner/internal/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// poolRuntime records how many pulls run at the same time
+type poolRuntime struct {
+	fakeRuntime
+	mu        sync.Mutex
+	active    int
+	maxActive int
+	pulls     []string
+}
+
+func (p *poolRuntime) Pull(ctx context.Context, image string, auth *ImageAuth, progress func(string)) (PullResult, error) {
+	p.mu.Lock()
+	p.active++
+	if p.active > p.maxActive {
+		p.maxActive = p.active
+	}
+	p.pulls = append(p.pulls, image)
+	p.mu.Unlock()
+	if progress != nil {
+		progress("Downloading")
+	}
+
+	time.Sleep(10 * time.Millisecond)
+
+	p.mu.Lock()
+	p.active--
+	p.mu.Unlock()
+	if image == "broken" {
+		return PullResult{}, errors.New("manifest unknown")
+	}
+	return PullResult{Layers: 2, Size: 1 << 20}, nil
+}
+
+func TestEngine_PullImages(t *testing.T) {
+	images := []PlannedImage{{Image: "a"}, {Image: "b"}, {Image: "c"}, {Image: "d"}, {Image: "e"}, {Image: "broken"}}
+
+	runtime := &poolRuntime{fakeRuntime: fakeRuntime{missing: map[string]bool{"a": true, "b": true, "c": true, "d": true, "broken": true}}}
+	engine := NewEngine(runtime, models.NewDefaultRunnerConfig(), nil, t.TempDir(), &bytes.Buffer{})
+	var reported, progress []string
+	pulls := engine.PullImages(context.Background(), images, 2, func(image PlannedImage, line string) {
+		progress = append(progress, image.Image+": "+line)
+	}, func(pull ImagePull) {
+		reported = append(reported, pull.Image)
+	})
+
+	assert.Equal(t, 2, runtime.maxActive)
+	assert.ElementsMatch(t, []string{"a", "b", "c", "d", "broken"}, runtime.pulls)
+	assert.ElementsMatch(t, []string{"a", "b", "c", "d", "e", "broken"}, reported)
+	assert.ElementsMatch(t, []string{"a: Downloading", "b: Downloading", "c: Downloading", "d: Downloading", "broken: Downloading"}, progress)
+	require.Len(t, pulls, 6)
+	assert.Equal(t, "a", pulls[0].Image)
+	assert.Equal(t, PullResult{Layers: 2, Size: 1 << 20}, pulls[0].Result)
+	assert.True(t, pulls[4].Present)
+	assert.Zero(t, pulls[4].Result)
+	assert.EqualError(t, pulls[5].Err, "manifest unknown")
+
+	t.Run("always", func(t *testing.T) {
+		runtime := &poolRuntime{}
+		runnerConfig := models.NewDefaultRunnerConfig()
+		runnerConfig.Docker.PullPolicy = models.PullPolicyAlways
+		engine := NewEngine(runtime, runnerConfig, nil, t.TempDir(), &bytes.Buffer{})
+		pulls := engine.PullImages(context.Background(), images[:2], 4, nil, nil)
+		assert.Equal(t, []string{"a", "b"}, []string{pulls[0].Image, pulls[1].Image})
+		assert.ElementsMatch(t, []string{"a", "b"}, runtime.pulls)
+	})
+
+	t.Run("never", func(t *testing.T) {
+		runtime := &poolRuntime{fakeRuntime: fakeRuntime{missing: map[string]bool{"a": true}}}
+		runnerConfig := models.NewDefaultRunnerConfig()
+		runnerConfig.Docker.PullPolicy = models.PullPolicyNever
+		engine := NewEngine(runtime, runnerConfig, nil, t.TempDir(), &bytes.Buffer{})
+		engine.PullImages(context.Background(), images[:2], 1, nil, nil)
+		assert.Equal(t, []string{"a"}, runtime.pulls)
+	})
+}
+
+func TestPlan_Images(t *testing.T) {
+	auth := &ImageAuth{Username: "ci", Password: "hunter2"}
+	plan := &Plan{Steps: []PlannedStep{
+		{Image: "node:18", Services: []PlannedService{{Name: "postgres", Image: "mirror.local/postgres:15", OriginalImage: "postgres:15"}, {Name: "docker"}}},
+		{Image: "registry.example.com/build", Decision: &ConditionResult{Run: false}},
+		{Image: "node:18", ImageAuth: auth},
+		{Image: "mirror.local/postgres:15", Pipes: []PlannedPipe{{Pipe: "atlassian/aws-s3-deploy:1.1.0", Image: "mirror.local/aws-s3-deploy:1.1.0", OriginalImage: "bitbucketpipelines/aws-s3-deploy:1.1.0"}}},
+	}}
+	assert.Equal(t, []PlannedImage{
+		{Image: "node:18", Auth: auth},
+		{Image: "mirror.local/postgres:15", Original: "postgres:15"},
+		{Image: "mirror.local/aws-s3-deploy:1.1.0", Original: "bitbucketpipelines/aws-s3-deploy:1.1.0"},
+	}, plan.Images())
+}
+
+func TestFormatSize(t *testing.T) {
+	assert.Equal(t, "512 B", FormatSize(512))
+	assert.Equal(t, "1.5 KiB", FormatSize(1536))
+	assert.Equal(t, "312.4 MiB", FormatSize(327576371))
+	assert.Equal(t, "2.0 GiB", FormatSize(2<<30))
+}
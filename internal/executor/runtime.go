@@ -0,0 +1,73 @@
+package executor
+
+import (
+	"context"
+	"io"
+
+	"bitbucket-runner/internal/models"
+)
+
+// ContainerSpec describes a container started for a step or a service
+type ContainerSpec struct {
+	Name        string
+	Image       string
+	Entrypoint  string
+	Command     []string
+	WorkingDir  string
+	Environment map[string]string
+	Volumes     []models.VolumeMount
+	Ports       []models.PortMapping
+	// NetworkMode is passed through to the runtime, e.g. "container:<id>"
+	// to share the network namespace of the step container
+	NetworkMode string
+	// User is the user the container runs as, the user of the image when
+	// empty
+	User string
+}
+
+// PullResult describes the pull of an image
+type PullResult struct {
+	// Layers is the number of layers of the image and Cached the number of
+	// them already present, which were not downloaded
+	Layers int
+	Cached int
+	// UpToDate is set when the local image was already the latest
+	UpToDate bool
+	// Size is the size of the image in bytes, the layers already present
+	// included: the output of docker pull gives no count of the bytes
+	// downloaded when not written to a terminal
+	Size int64
+}
+
+// ExecOptions describes a command executed inside a running container
+type ExecOptions struct {
+	Command     []string
+	Environment map[string]string
+	WorkingDir  string
+	Stdin       io.Reader
+	Stdout      io.Writer
+	Stderr      io.Writer
+	// TTY allocates a pseudo terminal, used for interactive sessions
+	TTY bool
+}
+
+// ContainerRuntime abstracts the container engine steps are executed with
+type ContainerRuntime interface {
+	// Ping verifies the container engine is reachable
+	Ping(ctx context.Context) error
+	// ImageExists reports whether an image is present locally
+	ImageExists(ctx context.Context, image string) (bool, error)
+	// Pull pulls an image, with the given credentials when not nil, passing
+	// the progress of the pull to progress a line at a time as it is made
+	Pull(ctx context.Context, image string, auth *ImageAuth, progress func(line string)) (PullResult, error)
+	// Start creates and starts a detached container and returns its ID
+	Start(ctx context.Context, spec ContainerSpec) (string, error)
+	// Exec runs a command in a running container and returns its exit code
+	Exec(ctx context.Context, containerID string, opts ExecOptions) (int, error)
+	// Run runs a container in the foreground with its own entrypoint,
+	// writing its output to stdout and stderr, removes it once it exited
+	// and returns its exit code
+	Run(ctx context.Context, spec ContainerSpec, stdout, stderr io.Writer) (int, error)
+	// Remove forcefully stops and removes a container
+	Remove(ctx context.Context, containerID string) error
+}
@@ -0,0 +1,289 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"bitbucket-runner/internal/models"
+	"bitbucket-runner/internal/workspace"
+)
+
+const (
+	// dockerService is the built-in service giving steps access to Docker
+	dockerService = "docker"
+	dockerSocket  = "/var/run/docker.sock"
+)
+
+// runStep executes a single step in a fresh workspace and returns the exit
+// code of its script together with the artifacts it produced. A non-nil
+// error means the step could not be run at all. The timeout applies to the
+// scripts only, not to interactive debugging.
+func (e *Engine) runStep(ctx context.Context, ec *models.ExecutionContext, planned PlannedStep, out io.Writer) (int, []string, error) {
+	step, stepType := planned.step, planned.stepType
+
+	ws, err := workspace.Create(e.sourceDir, e.runnerConfig.Defaults.StateDir)
+	if err != nil {
+		return -1, nil, err
+	}
+	defer ws.Remove()
+
+	if e.store != nil && ec.ID != "" {
+		if err := ws.RestoreArtifacts(e.store.ArtifactsDir(ec.ID)); err != nil {
+			return -1, nil, err
+		}
+	}
+
+	cloneDir := e.runnerConfig.Defaults.WorkingDir
+	volumes := append([]models.VolumeMount{{Host: ws.Dir, Container: cloneDir}}, stepType.Volumes...)
+	if usesService(ec, step, dockerService) {
+		volumes = append(volumes, models.VolumeMount{Host: dockerSocket, Container: dockerSocket})
+	}
+	caches, err := e.cacheVolumes(planned.Caches, cloneDir)
+	if err != nil {
+		return -1, nil, err
+	}
+	volumes = append(volumes, caches...)
+
+	user := ""
+	if planned.RunAsUser != nil {
+		user = strconv.Itoa(*planned.RunAsUser)
+	}
+
+	containerName := e.containerName(ec, "step", strconv.Itoa(planned.Index+1))
+	containerID, err := e.runtime.Start(ctx, ContainerSpec{
+		Name:        containerName,
+		Image:       planned.Image,
+		Entrypoint:  "tail",
+		Command:     []string{"-f", "/dev/null"},
+		WorkingDir:  cloneDir,
+		Environment: planned.Environment,
+		Volumes:     volumes,
+		Ports:       stepType.Ports,
+		User:        user,
+	})
+	if err != nil {
+		return -1, nil, fmt.Errorf("failed to start step container: %w", err)
+	}
+	defer e.runtime.Remove(context.Background(), containerID)
+
+	serviceIDs, err := e.startServices(ctx, ec, step, containerID, containerName)
+	for _, id := range serviceIDs {
+		defer e.runtime.Remove(context.Background(), id)
+	}
+	if err != nil {
+		return -1, nil, err
+	}
+
+	if e.debug.StepThrough {
+		if err := e.pause(ctx, containerID, planned.Name); err != nil {
+			return -1, nil, err
+		}
+	}
+
+	timeout := time.Duration(planned.Timeout) * time.Second
+	scriptCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// Pipes run next to the step container, in its network and with its
+	// volumes and variables
+	pipeSpec := ContainerSpec{
+		WorkingDir:  cloneDir,
+		Environment: planned.Environment,
+		Volumes:     volumes,
+		NetworkMode: "container:" + containerID,
+	}
+	exitCode, err := e.runScript(scriptCtx, containerID, planned, step.Script, nil, pipeSpec, out)
+	if errors.Is(scriptCtx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+
+	// Steps that timed out or could not run get a shell too, which must
+	// outlive the cancelled script context
+	if (err != nil || exitCode != 0) && e.debug.ShellOnFailure {
+		env := map[string]string{"BITBUCKET_EXIT_CODE": strconv.Itoa(exitCode)}
+		if err := e.openShell(context.WithoutCancel(ctx), containerID, env); err != nil {
+			fmt.Fprintf(e.out, "Debug shell failed: %v\n", err)
+		}
+	}
+
+	if len(step.AfterScript) > 0 {
+		// The after-script runs whatever happened to the script, and its
+		// result never changes the result of the step
+		env := map[string]string{"BITBUCKET_EXIT_CODE": strconv.Itoa(exitCode)}
+		e.runScript(ctx, containerID, planned, step.AfterScript, env, pipeSpec, out)
+	}
+	if err != nil {
+		return exitCode, nil, fmt.Errorf("failed to execute script: %w", err)
+	}
+
+	var artifacts []string
+	if exitCode == 0 && step.Artifacts != nil && len(step.Artifacts.Paths) > 0 && e.store != nil && ec.ID != "" {
+		artifacts, err = ws.CollectArtifacts(step.Artifacts.Paths, e.store.ArtifactsDir(ec.ID))
+		if err != nil {
+			return exitCode, nil, err
+		}
+	}
+
+	return exitCode, artifacts, nil
+}
+
+// runScript runs the entries of a script in order, the commands in the step
+// container and each pipe in a container of its own created from pipeSpec,
+// and stops at the first entry failing, whose exit code it returns. env is
+// added to the environment of the step.
+func (e *Engine) runScript(ctx context.Context, containerID string, planned PlannedStep, script []string, env map[string]string, pipeSpec ContainerSpec, out io.Writer) (int, error) {
+	for start := 0; start < len(script); {
+		if pipe, ok := models.ParsePipe(script[start]); ok {
+			exitCode, err := e.runPipe(ctx, planned, pipe, env, pipeSpec, out)
+			if err != nil || exitCode != 0 {
+				return exitCode, err
+			}
+			start++
+			continue
+		}
+
+		end := start
+		for end < len(script) {
+			if _, ok := models.ParsePipe(script[end]); ok {
+				break
+			}
+			end++
+		}
+		exitCode, err := e.runtime.Exec(ctx, containerID, ExecOptions{
+			Command:     e.shellCommand(script[start:end]),
+			Environment: env,
+			Stdout:      out,
+			Stderr:      out,
+		})
+		if err != nil || exitCode != 0 {
+			return exitCode, err
+		}
+		start = end
+	}
+	return 0, nil
+}
+
+// runPipe runs a pipe as Bitbucket does, with the variables of the step,
+// env and the variables of the pipe, which may reference the others
+func (e *Engine) runPipe(ctx context.Context, planned PlannedStep, pipe models.Pipe, env map[string]string, spec ContainerSpec, out io.Writer) (int, error) {
+	fmt.Fprintf(out, "+ pipe: %s\n", pipe.Name)
+	environment := make(map[string]string)
+	for _, variables := range []map[string]string{spec.Environment, env} {
+		for name, value := range variables {
+			environment[name] = value
+		}
+	}
+	for name, value := range pipe.Environment(environment) {
+		environment[name] = value
+	}
+	spec.Image = planned.pipeImage(pipe.Name)
+	spec.Environment = environment
+
+	exitCode, err := e.runtime.Run(ctx, spec, out, out)
+	if err != nil {
+		return exitCode, fmt.Errorf("failed to run pipe '%s': %w", pipe.Name, err)
+	}
+	return exitCode, nil
+}
+
+// startServices starts the services of a step sharing the network
+// namespace of the step container, so they are reachable on localhost like
+// in Bitbucket. The IDs of all started containers are returned even when a
+// later service fails to start.
+func (e *Engine) startServices(ctx context.Context, ec *models.ExecutionContext, step models.Step, stepContainerID, stepContainerName string) ([]string, error) {
+	var ids []string
+	for _, name := range step.Services {
+		if name == dockerService {
+			continue
+		}
+
+		service, ok := lookupService(ec, name)
+		if !ok {
+			return ids, fmt.Errorf("service '%s' is not defined in definitions.services", name)
+		}
+
+		serviceContainerName := ""
+		if stepContainerName != "" {
+			serviceContainerName = stepContainerName + "-" + name
+		}
+
+		id, err := e.runtime.Start(ctx, ContainerSpec{
+			Name:        serviceContainerName,
+			Image:       e.imageName(service.Image),
+			Environment: service.Environment,
+			NetworkMode: "container:" + stepContainerID,
+		})
+		if err != nil {
+			return ids, fmt.Errorf("failed to start service '%s': %w", name, err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// stepEnvironment merges, in increasing order of precedence, the runner
+// environment, the step type environment, the run variables and the step
+// environment.
+func (e *Engine) stepEnvironment(ec *models.ExecutionContext, step models.Step, stepType *models.StepType) map[string]string {
+	env := make(map[string]string)
+	for _, source := range []map[string]string{e.runnerConfig.Environment, stepType.Environment, ec.Environment, step.Environment} {
+		for key, value := range source {
+			env[key] = value
+		}
+	}
+	return env
+}
+
+// shellCommand builds the command running script lines one by one, echoing
+// each line before it runs and stopping at the first failing line.
+func (e *Engine) shellCommand(lines []string) []string {
+	shell := e.runnerConfig.Defaults.Shell
+	if shell == "" {
+		shell = "/bin/sh"
+	}
+
+	var script strings.Builder
+	script.WriteString("set -e\n")
+	for _, line := range lines {
+		fmt.Fprintf(&script, "printf '%%s\\n' %s\n", shellQuote("+ "+line))
+		script.WriteString(line)
+		script.WriteString("\n")
+	}
+
+	return []string{shell, "-c", script.String()}
+}
+
+// containerName builds a container name unique to the run
+func (e *Engine) containerName(ec *models.ExecutionContext, parts ...string) string {
+	if ec.ID == "" {
+		return ""
+	}
+	return "bitbucket-runner-" + ec.ID + "-" + strings.Join(parts, "-")
+}
+
+func lookupService(ec *models.ExecutionContext, name string) (models.Service, bool) {
+	if ec.PipelineConfig == nil || ec.PipelineConfig.Definitions == nil {
+		return models.Service{}, false
+	}
+	service, ok := ec.PipelineConfig.Definitions.Services[name]
+	return service, ok
+}
+
+func usesService(ec *models.ExecutionContext, step models.Step, name string) bool {
+	for _, service := range step.Services {
+		if service == name {
+			return true
+		}
+	}
+	return name == dockerService && ec.PipelineConfig != nil && ec.PipelineConfig.Options != nil && ec.PipelineConfig.Options.Docker
+}
+
+// shellQuote quotes a string for safe use as a single POSIX shell word
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'"'"'`) + "'"
+}
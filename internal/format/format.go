@@ -0,0 +1,237 @@
+// Package format rewrites pipeline files in a canonical layout. It works on
+// the YAML nodes rather than on the models, so comments, anchors and keys
+// the runner does not know survive formatting.
+package format
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// indent is the number of spaces of each nesting level
+const indent = 2
+
+// stepKeys is the order of the keys of a step. The merge key comes first so
+// that the keys of the step visibly override the merged ones, unknown keys
+// come last in their original order.
+var stepKeys = []string{
+	"<<",
+	"name",
+	"image",
+	"runs-on",
+	"size",
+	"max-time",
+	"trigger",
+	"deployment",
+	"clone",
+	"oidc",
+	"services",
+	"caches",
+	"environment",
+	"condition",
+	"script",
+	"after-script",
+	"artifacts",
+}
+
+// Pipeline formats a pipeline file: two spaces of indentation, the keys of
+// steps in a fixed order and quotes only where a value needs them. Comments,
+// anchors, aliases and single blank lines between entries are kept.
+func Pipeline(data []byte) ([]byte, error) {
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, fmt.Errorf("failed to parse pipeline config: %w", err)
+	}
+	if len(document.Content) == 0 {
+		return data, nil
+	}
+	source := strings.Split(string(data), "\n")
+	blanks := make(map[*yaml.Node]bool)
+	markBlankLines(&document, source, blanks)
+
+	normalize(&document, source)
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(indent)
+	if err := encoder.Encode(&document); err != nil {
+		return nil, fmt.Errorf("failed to encode pipeline config: %w", err)
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, fmt.Errorf("failed to encode pipeline config: %w", err)
+	}
+	return restoreBlankLines(&document, buf.Bytes(), blanks)
+}
+
+// yaml11Scalar matches the plain scalars YAML 1.1 resolves to another type
+// than string: booleans such as on and yes, nulls, integers such as 0777 and
+// 1_000, floats, sexagesimal numbers and timestamps. The YAML library reads
+// most of them as strings, the encoder writes them without quotes, but
+// Bitbucket and other YAML 1.1 parsers would not read them back as strings.
+var yaml11Scalar = regexp.MustCompile(`^(?:` +
+	`[yYnN]|yes|Yes|YES|no|No|NO|true|True|TRUE|false|False|FALSE|on|On|ON|off|Off|OFF|` +
+	`~|null|Null|NULL|` +
+	`[-+]?0b[0-1_]+|[-+]?0[0-7_]+|[-+]?(?:0|[1-9][0-9_]*)|[-+]?0x[0-9a-fA-F_]+|[-+]?[1-9][0-9_]*(?::[0-5]?[0-9])+|` +
+	`[-+]?[0-9][0-9_]*\.[0-9_]*(?:[eE][-+][0-9]+)?|\.[0-9][0-9_]*(?:[eE][-+][0-9]+)?|` +
+	`[-+]?[0-9][0-9_]*(?::[0-5]?[0-9])+\.[0-9_]*|[-+]?\.(?:inf|Inf|INF)|\.(?:nan|NaN|NAN)|` +
+	`[0-9]{4}-[0-9]{1,2}-[0-9]{1,2}(?:(?:[Tt]|[ \t]+)[0-9]{1,2}:[0-9]{2}:[0-9]{2}(?:\.[0-9]*)?(?:[ \t]*(?:Z|[-+][0-9]{1,2}(?::[0-9]{2})?))?)?` +
+	`)$`)
+
+// normalize sorts the keys of steps and drops the quotes of scalars, which
+// the encoder adds back to the values that need them. Strings YAML 1.1 reads
+// as another type keep quotes, double ones as the encoder writes.
+func normalize(node *yaml.Node, source []string) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		quoted := node.Style&(yaml.SingleQuotedStyle|yaml.DoubleQuotedStyle) != 0
+		node.Style &^= yaml.SingleQuotedStyle | yaml.DoubleQuotedStyle
+		if quoted && yaml11Scalar.MatchString(node.Value) {
+			node.Style |= yaml.DoubleQuotedStyle
+		}
+		if node.Tag == "!!merge" {
+			// Encoded as "!!merge <<" unless resolved implicitly
+			node.Tag = ""
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if key.Value == "step" && value.Kind == yaml.MappingNode && len(value.Content) > 0 {
+				first := value.Content[0]
+				sortKeys(value, stepKeys)
+				keepAnchorComment(value, first, source)
+			}
+		}
+	}
+	for _, child := range node.Content {
+		normalize(child, source)
+	}
+}
+
+// keepAnchorComment keeps at the top of a mapping the comment following its
+// anchor, which the parser attaches to the first key, when sorting the keys
+// changed the first key. The encoder writes it after that key.
+func keepAnchorComment(mapping, first *yaml.Node, source []string) {
+	moved := mapping.Content[0]
+	if moved == first || first.LineComment == "" || moved.LineComment != "" {
+		return
+	}
+	if mapping.Line < first.Line && mapping.Line <= len(source) && strings.Contains(source[mapping.Line-1], first.LineComment) {
+		moved.LineComment, first.LineComment = first.LineComment, ""
+	}
+}
+
+// sortKeys orders the pairs of a mapping as the keys are listed, keeping
+// the order of the other keys after them
+func sortKeys(mapping *yaml.Node, keys []string) {
+	rank := func(key string) int {
+		for i, k := range keys {
+			if k == key {
+				return i
+			}
+		}
+		return len(keys)
+	}
+
+	pairs := make([][2]*yaml.Node, 0, len(mapping.Content)/2)
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		pairs = append(pairs, [2]*yaml.Node{mapping.Content[i], mapping.Content[i+1]})
+	}
+	sort.SliceStable(pairs, func(i, j int) bool {
+		return rank(pairs[i][0].Value) < rank(pairs[j][0].Value)
+	})
+	for i, pair := range pairs {
+		mapping.Content[2*i], mapping.Content[2*i+1] = pair[0], pair[1]
+	}
+}
+
+// entries returns the nodes starting a line of a collection: the keys of a
+// mapping or the items of a sequence
+func entries(node *yaml.Node) []*yaml.Node {
+	switch node.Kind {
+	case yaml.MappingNode:
+		var keys []*yaml.Node
+		for i := 0; i < len(node.Content); i += 2 {
+			keys = append(keys, node.Content[i])
+		}
+		return keys
+	case yaml.SequenceNode:
+		return node.Content
+	}
+	return nil
+}
+
+// firstLine returns the line where an entry starts, its head comment
+// included
+func firstLine(node *yaml.Node) int {
+	line := node.Line
+	if node.HeadComment != "" {
+		line -= strings.Count(node.HeadComment, "\n") + 1
+	}
+	if node.Kind == yaml.MappingNode && len(node.Content) > 0 {
+		line = min(line, firstLine(node.Content[0]))
+	}
+	return line
+}
+
+// markBlankLines records the entries of block collections preceded by a
+// blank line in the source
+func markBlankLines(node *yaml.Node, source []string, blanks map[*yaml.Node]bool) {
+	if node.Style&yaml.FlowStyle == 0 {
+		for _, entry := range entries(node) {
+			// Lines are 1-based: the line before the entry is at index line-2
+			if line := firstLine(entry); line >= 2 && strings.TrimSpace(source[line-2]) == "" {
+				blanks[entry] = true
+			}
+		}
+	}
+	for _, child := range node.Content {
+		markBlankLines(child, source, blanks)
+	}
+}
+
+// restoreBlankLines inserts the blank lines the encoder drops. The formatted
+// file is parsed again to find where the marked entries start, as the tree
+// has the same shape.
+func restoreBlankLines(document *yaml.Node, formatted []byte, blanks map[*yaml.Node]bool) ([]byte, error) {
+	if len(blanks) == 0 {
+		return formatted, nil
+	}
+	var reparsed yaml.Node
+	if err := yaml.Unmarshal(formatted, &reparsed); err != nil {
+		return nil, fmt.Errorf("failed to parse formatted pipeline config: %w", err)
+	}
+
+	before := make(map[int]bool)
+	var walk func(original, node *yaml.Node)
+	walk = func(original, node *yaml.Node) {
+		if len(original.Content) != len(node.Content) {
+			return
+		}
+		originals, nodes := entries(original), entries(node)
+		for i := range originals {
+			if blanks[originals[i]] && i < len(nodes) {
+				before[firstLine(nodes[i])] = true
+			}
+		}
+		for i := range original.Content {
+			walk(original.Content[i], node.Content[i])
+		}
+	}
+	walk(document, &reparsed)
+
+	lines := strings.SplitAfter(string(formatted), "\n")
+	var out strings.Builder
+	for i, line := range lines {
+		// The first line never follows a blank line
+		if before[i+1] && i > 0 && strings.TrimSpace(lines[i-1]) != "" {
+			out.WriteString("\n")
+		}
+		out.WriteString(line)
+	}
+	return []byte(out.String()), nil
+}
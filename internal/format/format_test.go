@@ -0,0 +1,222 @@
+package format
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPipeline(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		expected string
+	}{
+		{
+			name:     "formatted",
+			input:    "image: node:18\npipelines:\n  default:\n    - step:\n        script:\n          - npm test\n",
+			expected: "image: node:18\npipelines:\n  default:\n    - step:\n        script:\n          - npm test\n",
+		},
+		{
+			name:     "indentation",
+			input:    "pipelines:\n    default:\n        -   step:\n                script:\n                -   npm test\n",
+			expected: "pipelines:\n  default:\n    - step:\n        script:\n          - npm test\n",
+		},
+		{
+			name: "step key order",
+			input: `pipelines:
+  default:
+    - step:
+        script: [make]
+        custom: kept
+        caches: [node]
+        name: Build
+        image: node:18
+`,
+			expected: `pipelines:
+  default:
+    - step:
+        name: Build
+        image: node:18
+        caches: [node]
+        script: [make]
+        custom: kept
+`,
+		},
+		{
+			name:     "quoting",
+			input:    "image: \"node:18\"\nclone:\n  depth: '50'\npipelines:\n  default:\n    - step:\n        name: 'Build: app'\n        script:\n          - \"echo it's\"\n          - \"echo\\tdone\"\n          - 'true'\n",
+			expected: "image: node:18\nclone:\n  depth: \"50\"\npipelines:\n  default:\n    - step:\n        name: 'Build: app'\n        script:\n          - echo it's\n          - \"echo\\tdone\"\n          - \"true\"\n",
+		},
+		{
+			name:     "YAML 1.1 scalars",
+			input:    "pipelines:\n  custom:\n    'on':\n      - step:\n          name: 'on'\n          deployment: 'yes'\n          script:\n            - 'n'\n            - '0755'\n            - '1_000'\n            - '2024-01-31'\n            - '1:30'\n            - '~'\n            - '1.2.3'\n            - 'yesterday'\n",
+			expected: "pipelines:\n  custom:\n    \"on\":\n      - step:\n          name: \"on\"\n          deployment: \"yes\"\n          script:\n            - \"n\"\n            - \"0755\"\n            - \"1_000\"\n            - \"2024-01-31\"\n            - \"1:30\"\n            - \"~\"\n            - 1.2.3\n            - yesterday\n",
+		},
+		{
+			name: "comments, anchors and blank lines",
+			input: `# Shared steps
+definitions:
+  steps:
+    - step: &build   # reused below
+        script:
+          - make
+        name: Build
+
+
+pipelines:
+  default:
+    - step: *build
+
+    # Override the name
+    - step:
+        <<: *build
+        name: Again
+# trailing
+`,
+			expected: `# Shared steps
+definitions:
+  steps:
+    - step: &build
+        name: Build # reused below
+        script:
+          - make
+
+pipelines:
+  default:
+    - step: *build
+
+    # Override the name
+    - step:
+        <<: *build
+        name: Again
+# trailing
+`,
+		},
+		{
+			name: "literal scripts",
+			input: `pipelines:
+  default:
+    - step:
+        script:
+          - |
+              echo one
+              echo two
+`,
+			expected: `pipelines:
+  default:
+    - step:
+        script:
+          - |
+            echo one
+            echo two
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			formatted, err := Pipeline([]byte(tt.input))
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, string(formatted))
+
+			again, err := Pipeline(formatted)
+			require.NoError(t, err)
+			assert.Equal(t, string(formatted), string(again), "formatting is not idempotent")
+		})
+	}
+
+	t.Run("invalid YAML", func(t *testing.T) {
+		_, err := Pipeline([]byte("pipelines: [\n"))
+		assert.ErrorContains(t, err, "failed to parse pipeline config")
+	})
+
+	t.Run("comments only", func(t *testing.T) {
+		formatted, err := Pipeline([]byte("# nothing yet\n"))
+		require.NoError(t, err)
+		assert.Equal(t, "# nothing yet\n", string(formatted))
+	})
+}
+
+func TestDiff(t *testing.T) {
+	assert.Empty(t, Diff("a.yml", []byte("a\nb\n"), []byte("a\nb\n")))
+
+	before := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n14\n15\n16\n"
+	after := "0\n1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\nfourteen\n15\n16\n"
+	assert.Equal(t, `--- a.yml
++++ a.yml
+@@ -1,3 +1,4 @@
++0
+ 1
+ 2
+ 3
+@@ -11,6 +12,6 @@
+ 11
+ 12
+ 13
+-14
++fourteen
+ 15
+ 16
+`, Diff("a.yml", []byte(before), []byte(after)))
+}
+
+func TestSection(t *testing.T) {
+	input := `pipelines:
+    default:
+        -   step:
+                script: ['make']
+                name: Build
+
+    # Releases
+    branches:
+        main:
+            -   step:
+                    script: ['make release']
+                    name: Release
+    # Deployments
+    custom:
+      deploy:
+      - step:
+          script: ['./deploy.sh']
+          name: Deploy
+# trailing
+`
+
+	formatted, err := Section([]byte(input), "pipelines", "branches", "main")
+	require.NoError(t, err)
+	assert.Equal(t, `pipelines:
+    default:
+        -   step:
+                script: ['make']
+                name: Build
+
+    # Releases
+    branches:
+        main:
+          - step:
+              name: Release
+              script: [make release]
+    # Deployments
+    custom:
+      deploy:
+      - step:
+          script: ['./deploy.sh']
+          name: Deploy
+# trailing
+`, string(formatted))
+
+	formatted, err = Section([]byte(input), "pipelines", "custom", "deploy")
+	require.NoError(t, err)
+	assert.Contains(t, string(formatted), `    custom:
+      deploy:
+        - step:
+            name: Deploy
+            script: [./deploy.sh]
+# trailing
+`)
+
+	_, err = Section([]byte(input), "pipelines", "tags")
+	assert.EqualError(t, err, "pipelines.tags is not defined")
+}
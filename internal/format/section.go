@@ -0,0 +1,96 @@
+package format
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Section formats the entry of a pipeline file found by following path, a
+// key per mapping from the top, and leaves the rest of the file as it is.
+// The lines of the entry are taken from the formatted file and indented as
+// the entry was.
+func Section(data []byte, path ...string) ([]byte, error) {
+	formatted, err := Pipeline(data)
+	if err != nil {
+		return nil, err
+	}
+	source, start, end, column, err := sectionLines(data, path)
+	if err != nil {
+		return nil, err
+	}
+	lines, formattedStart, formattedEnd, formattedColumn, err := sectionLines(formatted, path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse formatted pipeline config: %w", err)
+	}
+
+	shift := column - formattedColumn
+	var section []string
+	for _, line := range lines[formattedStart:formattedEnd] {
+		switch {
+		case line == "":
+		case shift > 0:
+			line = strings.Repeat(" ", shift) + line
+		case shift < 0:
+			line = line[min(-shift, len(line)-len(strings.TrimLeft(line, " "))):]
+		}
+		section = append(section, line)
+	}
+
+	result := append(append(append([]string{}, source[:start]...), section...), source[end:]...)
+	return []byte(strings.Join(result, "\n")), nil
+}
+
+// sectionLines splits data into lines and locates the entry at path: the
+// index of its first line, the index after its last line and the column of
+// its key. The entry ends where the next key of it or of its parents starts,
+// the blank and comment lines before that key excluded.
+func sectionLines(data []byte, path []string) (lines []string, start, end, column int, err error) {
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, 0, 0, 0, fmt.Errorf("failed to parse pipeline config: %w", err)
+	}
+	lines = strings.Split(string(data), "\n")
+	end = len(lines)
+	if lines[end-1] == "" {
+		end--
+	}
+	if len(document.Content) == 0 {
+		return nil, 0, 0, 0, fmt.Errorf("%s is not defined", strings.Join(path, "."))
+	}
+
+	node := document.Content[0]
+	var key *yaml.Node
+	for depth, name := range path {
+		found := false
+		if node.Kind == yaml.MappingNode {
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value != name {
+					continue
+				}
+				if i+2 < len(node.Content) {
+					end = min(end, firstLine(node.Content[i+2])-1)
+				}
+				key, node, found = node.Content[i], node.Content[i+1], true
+				break
+			}
+		}
+		if !found {
+			return nil, 0, 0, 0, fmt.Errorf("%s is not defined", strings.Join(path[:depth+1], "."))
+		}
+	}
+	if key == nil {
+		return nil, 0, 0, 0, fmt.Errorf("no entry to format")
+	}
+
+	start = key.Line - 1
+	for end > start+1 {
+		line := strings.TrimSpace(lines[end-1])
+		if line != "" && !strings.HasPrefix(line, "#") {
+			break
+		}
+		end--
+	}
+	return lines, start, end, key.Column, nil
+}
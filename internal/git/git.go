@@ -0,0 +1,201 @@
+package git
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// ErrNotRepository is returned when a directory is not inside a git work tree
+var ErrNotRepository = errors.New("not a git repository")
+
+// Repository is a git work tree, or a bare repository, driven through the
+// git command line client
+type Repository struct {
+	Dir string
+}
+
+// Open returns the repository containing dir
+func Open(ctx context.Context, dir string) (*Repository, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return nil, fmt.Errorf("git client not found in PATH: %w", err)
+	}
+
+	repo := &Repository{Dir: dir}
+	top, err := repo.output(ctx, "rev-parse", "--show-toplevel")
+	if err != nil {
+		// Bare repositories, such as mirrors of remotes, have no work tree
+		if bare, _ := repo.output(ctx, "rev-parse", "--is-bare-repository"); bare == "true" {
+			return repo, nil
+		}
+		return nil, ErrNotRepository
+	}
+	repo.Dir = top
+	return repo, nil
+}
+
+// ResolveRevision returns the commit hash a revision points to
+func (r *Repository) ResolveRevision(ctx context.Context, rev string) (string, error) {
+	hash, err := r.output(ctx, "rev-parse", "--verify", "--quiet", rev+"^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("unknown revision '%s'", rev)
+	}
+	return hash, nil
+}
+
+// Ref is a revision resolved to its commit. Branch or Tag is set when the
+// revision names a branch or a tag.
+type Ref struct {
+	Commit string
+	Branch string
+	Tag    string
+}
+
+// ResolveRef resolves a commit, branch or tag name
+func (r *Repository) ResolveRef(ctx context.Context, rev string) (*Ref, error) {
+	commit, err := r.ResolveRevision(ctx, rev)
+	if err != nil {
+		return nil, err
+	}
+	ref := &Ref{Commit: commit}
+
+	// Abbreviated hashes and expressions like HEAD~2 have no symbolic name
+	name, _ := r.output(ctx, "rev-parse", "--symbolic-full-name", rev)
+	switch {
+	case strings.HasPrefix(name, "refs/heads/"):
+		ref.Branch = strings.TrimPrefix(name, "refs/heads/")
+	case strings.HasPrefix(name, "refs/remotes/"):
+		// refs/remotes/<remote>/<branch>
+		if parts := strings.SplitN(strings.TrimPrefix(name, "refs/remotes/"), "/", 2); len(parts) == 2 {
+			ref.Branch = parts[1]
+		}
+	case strings.HasPrefix(name, "refs/tags/"):
+		ref.Tag = strings.TrimPrefix(name, "refs/tags/")
+	}
+	return ref, nil
+}
+
+// ReadFile returns the content of a file at a revision, without touching
+// the work tree
+func (r *Repository) ReadFile(ctx context.Context, rev, path string) ([]byte, error) {
+	data, err := r.run(ctx, "cat-file", "blob", rev+":"+path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read '%s' at '%s': %w", path, rev, err)
+	}
+	return data, nil
+}
+
+// MergeBase returns the best common ancestor of two revisions
+func (r *Repository) MergeBase(ctx context.Context, a, b string) (string, error) {
+	hash, err := r.output(ctx, "merge-base", a, b)
+	if err != nil {
+		return "", fmt.Errorf("failed to find merge base of '%s' and '%s': %w", a, b, err)
+	}
+	return hash, nil
+}
+
+// CurrentBranch returns the name of the checked out branch
+func (r *Repository) CurrentBranch(ctx context.Context) (string, error) {
+	branch, err := r.output(ctx, "symbolic-ref", "--quiet", "--short", "HEAD")
+	if err != nil {
+		return "", errors.New("HEAD is detached, no branch is checked out")
+	}
+	return branch, nil
+}
+
+// AddWorktree checks out rev with a detached HEAD into dir, which must not
+// exist or be empty, and returns the new work tree
+func (r *Repository) AddWorktree(ctx context.Context, dir, rev string) (*Repository, error) {
+	if _, err := r.output(ctx, "worktree", "add", "--detach", "--force", dir, rev); err != nil {
+		return nil, fmt.Errorf("failed to check out '%s': %w", rev, err)
+	}
+	return &Repository{Dir: dir}, nil
+}
+
+// RemoveWorktree removes a work tree created with AddWorktree together with
+// its administrative files
+func (r *Repository) RemoveWorktree(ctx context.Context, dir string) error {
+	if _, err := r.output(ctx, "worktree", "remove", "--force", dir); err != nil {
+		return fmt.Errorf("failed to remove work tree '%s': %w", dir, err)
+	}
+	return nil
+}
+
+// ConflictError is returned when a merge stops because of conflicts
+type ConflictError struct {
+	Files []string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("merge conflict in %s", strings.Join(e.Files, ", "))
+}
+
+// Merge merges rev into the checked out revision with a merge commit. On
+// conflicts the merge is aborted and a *ConflictError is returned.
+func (r *Repository) Merge(ctx context.Context, rev, message string) error {
+	_, err := r.output(ctx, "-c", "user.name=bitbucket-runner", "-c", "user.email=bitbucket-runner@localhost",
+		"merge", "--no-ff", "--no-edit", "--message", message, rev)
+	if err == nil {
+		return nil
+	}
+
+	conflicts, diffErr := r.output(ctx, "diff", "--name-only", "--diff-filter=U")
+	if diffErr != nil || conflicts == "" {
+		return fmt.Errorf("failed to merge '%s': %w", rev, err)
+	}
+	_, _ = r.output(ctx, "merge", "--abort")
+	return &ConflictError{Files: strings.Split(conflicts, "\n")}
+}
+
+// ChangedFiles returns the paths of the files that differ between two
+// revisions, relative to the repository root
+func (r *Repository) ChangedFiles(ctx context.Context, base, head string) ([]string, error) {
+	out, err := r.output(ctx, "diff", "--name-only", "--no-renames", "-z", base, head)
+	if err != nil {
+		return nil, fmt.Errorf("failed to diff '%s' and '%s': %w", base, head, err)
+	}
+
+	var files []string
+	for _, file := range strings.Split(out, "\x00") {
+		if file != "" {
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+func (r *Repository) output(ctx context.Context, args ...string) (string, error) {
+	out, err := r.run(ctx, args...)
+	return strings.TrimSpace(string(out)), err
+}
+
+func (r *Repository) run(ctx context.Context, args ...string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = r.Dir
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return nil, fmt.Errorf("git %s: %s", subcommand(args), message)
+		}
+		return nil, fmt.Errorf("git %s: %w", subcommand(args), err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// subcommand returns the git subcommand of args, skipping "-c" options
+func subcommand(args []string) string {
+	for i := 0; i < len(args); i++ {
+		if args[i] == "-c" {
+			i++
+			continue
+		}
+		return args[i]
+	}
+	return ""
+}
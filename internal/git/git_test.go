@@ -0,0 +1,158 @@
+package git
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// initRepository creates a repository with one commit per file set
+func initRepository(t *testing.T, commits ...map[string]string) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+
+	dir := t.TempDir()
+	gitCmd := func(args ...string) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+
+	gitCmd("init", "--quiet", "--initial-branch=main")
+	for i, files := range commits {
+		for name, content := range files {
+			path := filepath.Join(dir, name)
+			require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+			require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+		}
+		gitCmd("add", "--all")
+		gitCmd("commit", "--quiet", "--message", "commit "+string(rune('1'+i)))
+	}
+	return dir
+}
+
+func TestRepository_ChangedFiles(t *testing.T) {
+	ctx := context.Background()
+	dir := initRepository(t,
+		map[string]string{"README.md": "hello", "api/main.go": "package main"},
+		map[string]string{"api/main.go": "package main\n", "web/index.ts": "export {}"},
+	)
+
+	repo, err := Open(ctx, filepath.Join(dir, "api"))
+	require.NoError(t, err)
+
+	head, err := repo.ResolveRevision(ctx, "HEAD")
+	require.NoError(t, err)
+	base, err := repo.ResolveRevision(ctx, "HEAD~1")
+	require.NoError(t, err)
+
+	files, err := repo.ChangedFiles(ctx, base, head)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"api/main.go", "web/index.ts"}, files)
+
+	mergeBase, err := repo.MergeBase(ctx, "HEAD", "HEAD~1")
+	require.NoError(t, err)
+	assert.Equal(t, base, mergeBase)
+
+	_, err = repo.ResolveRevision(ctx, "HEAD~5")
+	assert.Error(t, err)
+}
+
+func TestOpen_NotRepository(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+
+	_, err := Open(context.Background(), t.TempDir())
+	assert.ErrorIs(t, err, ErrNotRepository)
+}
+
+func TestOpen_Bare(t *testing.T) {
+	ctx := context.Background()
+	dir := initRepository(t, map[string]string{"bitbucket-pipelines.yml": "export: true\n"})
+	bare := filepath.Join(t.TempDir(), "shared.git")
+	out, err := exec.Command("git", "clone", "--quiet", "--bare", dir, bare).CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	repo, err := Open(ctx, bare)
+	require.NoError(t, err)
+	assert.Equal(t, bare, repo.Dir)
+
+	data, err := repo.ReadFile(ctx, "main", "bitbucket-pipelines.yml")
+	require.NoError(t, err)
+	assert.Equal(t, "export: true\n", string(data))
+}
+
+func TestRepository_MergeInWorktree(t *testing.T) {
+	ctx := context.Background()
+	dir := initRepository(t, map[string]string{"a.txt": "a"})
+	repo, err := Open(ctx, dir)
+	require.NoError(t, err)
+
+	branch, err := repo.CurrentBranch(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, "main", branch)
+
+	worktreeDir := filepath.Join(t.TempDir(), "merge")
+	worktree, err := repo.AddWorktree(ctx, worktreeDir, "HEAD")
+	require.NoError(t, err)
+	assert.FileExists(t, filepath.Join(worktreeDir, "a.txt"))
+
+	_, err = worktree.CurrentBranch(ctx)
+	assert.Error(t, err, "work trees are checked out with a detached HEAD")
+
+	require.NoError(t, repo.RemoveWorktree(ctx, worktreeDir))
+	assert.NoDirExists(t, worktreeDir)
+}
+
+func TestConflictError(t *testing.T) {
+	err := &ConflictError{Files: []string{"a.txt", "b.txt"}}
+	assert.Equal(t, "merge conflict in a.txt, b.txt", err.Error())
+}
+
+func TestRepository_ResolveRef(t *testing.T) {
+	ctx := context.Background()
+	dir := initRepository(t,
+		map[string]string{"bitbucket-pipelines.yml": "pipelines: {}\n"},
+		map[string]string{"bitbucket-pipelines.yml": "image: alpine\n"},
+	)
+	repo, err := Open(ctx, dir)
+	require.NoError(t, err)
+
+	cmd := exec.Command("git", "tag", "v1", "HEAD~1")
+	cmd.Dir = dir
+	require.NoError(t, cmd.Run())
+
+	branch, err := repo.ResolveRef(ctx, "main")
+	require.NoError(t, err)
+	assert.Equal(t, "main", branch.Branch)
+	assert.Empty(t, branch.Tag)
+
+	tag, err := repo.ResolveRef(ctx, "v1")
+	require.NoError(t, err)
+	assert.Equal(t, "v1", tag.Tag)
+	assert.NotEqual(t, branch.Commit, tag.Commit)
+
+	commit, err := repo.ResolveRef(ctx, tag.Commit[:8])
+	require.NoError(t, err)
+	assert.Equal(t, tag.Commit, commit.Commit)
+	assert.Empty(t, commit.Branch)
+	assert.Empty(t, commit.Tag)
+
+	data, err := repo.ReadFile(ctx, "v1", "bitbucket-pipelines.yml")
+	require.NoError(t, err)
+	assert.Equal(t, "pipelines: {}\n", string(data))
+
+	_, err = repo.ReadFile(ctx, "v1", "missing.yml")
+	assert.Error(t, err)
+}
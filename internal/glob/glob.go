@@ -0,0 +1,106 @@
+package glob
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var (
+	cacheMu sync.Mutex
+	cache   = make(map[string]*regexp.Regexp)
+)
+
+// Match reports whether name matches the Bitbucket glob pattern.
+//
+// Patterns are matched against slash-separated paths relative to the clone
+// directory and are always anchored at the repository root. The syntax
+// follows Bitbucket Pipelines: "*" matches any sequence of characters except
+// "/", "**" matches any sequence including "/" and, as a full path segment as
+// in "src/**/*.go", also zero directories. "?" matches a single character
+// except "/", "[abc]" is a character class negated with "[!abc]" and "{a,b}"
+// matches one of the comma separated alternatives.
+func Match(pattern, name string) bool {
+	name = strings.TrimPrefix(name, "./")
+	name = strings.TrimPrefix(name, "/")
+
+	return compile(pattern).MatchString(name)
+}
+
+// MatchAny reports whether name matches at least one of the patterns.
+func MatchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if Match(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func compile(pattern string) *regexp.Regexp {
+	cacheMu.Lock()
+	defer cacheMu.Unlock()
+
+	if re, ok := cache[pattern]; ok {
+		return re
+	}
+
+	re, err := regexp.Compile("^" + translate(pattern) + "$")
+	if err != nil {
+		// Malformed patterns only match themselves literally
+		re = regexp.MustCompile("^" + regexp.QuoteMeta(pattern) + "$")
+	}
+	cache[pattern] = re
+	return re
+}
+
+// translate converts a glob pattern into the body of a regular expression
+func translate(pattern string) string {
+	pattern = strings.TrimPrefix(pattern, "./")
+	pattern = strings.TrimPrefix(pattern, "/")
+
+	var re strings.Builder
+	inGroup := false
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '*' && strings.HasPrefix(pattern[i:], "**/") && (i == 0 || pattern[i-1] == '/'):
+			re.WriteString("(?:.*/)?")
+			i += 2
+		case c == '*' && strings.HasPrefix(pattern[i:], "**"):
+			re.WriteString(".*")
+			i++
+		case c == '*':
+			re.WriteString("[^/]*")
+		case c == '?':
+			re.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				re.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			re.WriteString("[" + class + "]")
+			i += end + 1
+		case c == '{':
+			inGroup = true
+			re.WriteString("(?:")
+		case c == '}' && inGroup:
+			inGroup = false
+			re.WriteString(")")
+		case c == ',' && inGroup:
+			re.WriteString("|")
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			re.WriteString(regexp.QuoteMeta(string(pattern[i])))
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	return re.String()
+}
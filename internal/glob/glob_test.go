@@ -0,0 +1,50 @@
+package glob
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"dist/**", "dist/app.js", true},
+		{"dist/**", "dist/assets/logo.png", true},
+		{"dist/**", "src/app.js", false},
+		{"target/*.jar", "target/app.jar", true},
+		{"target/*.jar", "target/lib/dep.jar", false},
+		{"**/*.go", "main.go", true},
+		{"**/*.go", "internal/models/config.go", true},
+		{"src/**/*.ts", "src/index.ts", true},
+		{"src/**/*.ts", "src/app/util/index.ts", true},
+		{"src/**/*.ts", "test/index.ts", false},
+		{"./README.md", "README.md", true},
+		{"docs/*", "docs/guide/intro.md", false},
+		{"**", "anything/at/all", true},
+		{"**.md", "docs/guide/intro.md", true},
+		{"src/{api,web}/**", "src/web/index.ts", true},
+		{"src/{api,web}/**", "src/cli/main.go", false},
+		{"v?.txt", "v1.txt", true},
+		{"[!a]*.go", "main.go", true},
+		{"[!a]*.go", "app.go", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" "+tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, Match(tt.pattern, tt.name))
+		})
+	}
+}
+
+func TestMatchAny(t *testing.T) {
+	patterns := []string{"docs/**", "*.md"}
+
+	assert.True(t, MatchAny(patterns, "README.md"))
+	assert.True(t, MatchAny(patterns, "docs/stories/1.1.md"))
+	assert.False(t, MatchAny(patterns, "cmd/run.go"))
+	assert.False(t, MatchAny(nil, "README.md"))
+}
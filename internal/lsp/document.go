@@ -0,0 +1,306 @@
+package lsp
+
+import (
+	"path"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+
+	"bitbucket-runner/internal/validation"
+)
+
+// document is an open file. Completion, hover and definitions work on its
+// lines rather than on a YAML tree, so they keep working while the file is
+// being typed and does not parse.
+type document struct {
+	uri    string
+	text   string
+	lines  []line
+	schema *validation.Schema
+}
+
+// line is a line of a document split into its YAML parts. Columns count
+// characters from 0.
+type line struct {
+	text     []rune
+	comment  bool // blank or comment only
+	dash     int  // column of the first list marker, -1 without
+	items    int  // number of list markers before the content
+	content  int  // column of the key or item value
+	key      string
+	value    string
+	valueCol int
+}
+
+// keyPattern matches a mapping key at the start of the content of a line
+var keyPattern = regexp.MustCompile(`^("[^"]*"|'[^']*'|[^\s#'"\[{][^:#]*?)\s*:(\s|$)`)
+
+func newDocument(uri, text string) *document {
+	d := &document{uri: uri, text: text, schema: validation.PipelineSchema()}
+	if isRunnerConfig(uri) {
+		d.schema = validation.RunnerSchema()
+	}
+	for _, text := range strings.Split(text, "\n") {
+		d.lines = append(d.lines, parseLine([]rune(strings.TrimSuffix(text, "\r"))))
+	}
+	return d
+}
+
+// isRunnerConfig tells runner configurations from pipeline files by name
+func isRunnerConfig(uri string) bool {
+	name := path.Base(uri)
+	return strings.Contains(name, "bitbucket-runner") || name == "config.yml" && strings.Contains(uri, "/bitbucket-runner/")
+}
+
+func parseLine(text []rune) line {
+	l := line{text: text, dash: -1}
+	col := skipSpaces(text, 0)
+	for col < len(text) && text[col] == '-' && (col+1 == len(text) || text[col+1] == ' ') {
+		if l.dash < 0 {
+			l.dash = col
+		}
+		l.items++
+		col = skipSpaces(text, col+1)
+	}
+	l.content = col
+	rest := string(text[col:])
+	if l.items == 0 && (strings.TrimSpace(rest) == "" || strings.HasPrefix(rest, "#")) {
+		l.comment = true
+		return l
+	}
+
+	l.valueCol = col
+	if match := keyPattern.FindStringSubmatchIndex(rest); match != nil {
+		l.key = strings.Trim(rest[match[2]:match[3]], `"'`)
+		col += len([]rune(rest[:match[1]]))
+		col = skipSpaces(text, col)
+		l.valueCol = col
+	}
+	l.value = stripComment(string(text[l.valueCol:]))
+	return l
+}
+
+func skipSpaces(text []rune, col int) int {
+	for col < len(text) && (text[col] == ' ' || text[col] == '\t') {
+		col++
+	}
+	return col
+}
+
+// stripComment removes a trailing comment from a plain value
+func stripComment(value string) string {
+	if i := strings.Index(value, " #"); i >= 0 {
+		value = value[:i]
+	}
+	if strings.HasPrefix(value, "#") {
+		return ""
+	}
+	return strings.TrimSpace(value)
+}
+
+// segment is a step of the path from the root to a line: the list items
+// entered, then the key
+type segment struct {
+	items int
+	key   string
+}
+
+// ancestors returns the path to the mapping holding the content at column
+// col of line i, found from the indentation of the lines above, and the
+// number of list items entered between that mapping and the content
+func (d *document) ancestors(i, col int) ([]segment, int) {
+	var path []segment
+	own, items := 0, 0
+	for j := i - 1; j >= 0 && col > 0; j-- {
+		l := d.lines[j]
+		switch {
+		case l.comment:
+		case l.dash >= 0 && l.dash < col && l.content == col:
+			// A key following the first key of a list item
+			items += l.items
+			col = l.dash + 1
+		case l.key != "" && l.content < col:
+			if len(path) > 0 {
+				path[0].items += items
+			} else {
+				own = items
+			}
+			path = append([]segment{{items: l.items, key: l.key}}, path...)
+			col = l.content
+			if l.dash >= 0 {
+				// The key owning a list may be indented like its items
+				col = l.dash + 1
+			}
+			items = 0
+		}
+	}
+	if len(path) > 0 {
+		path[0].items += items
+	} else {
+		own = items
+	}
+	return path, own
+}
+
+// path returns the path to the key or item of line i
+func (d *document) path(i int) []segment {
+	l := d.lines[i]
+	col := l.content
+	if l.dash >= 0 {
+		col = l.dash + 1
+	}
+	path, items := d.ancestors(i, col)
+	return append(path, segment{items: items + l.items, key: l.key})
+}
+
+// definitions returns the lines defining the children of the path, such
+// as the services of definitions.services
+func (d *document) definitions(keys ...string) map[string]int {
+	found := make(map[string]int)
+	for i, l := range d.lines {
+		if l.comment || l.key == "" || l.items > 0 {
+			continue
+		}
+		path := d.path(i)
+		if len(path) != len(keys)+1 {
+			continue
+		}
+		matches := true
+		for n, key := range keys {
+			if path[n].key != key || path[n].items > 0 {
+				matches = false
+				break
+			}
+		}
+		if _, ok := found[l.key]; matches && !ok {
+			found[l.key] = i
+		}
+	}
+	return found
+}
+
+// resolve returns the schema of the value at the end of the path, or nil
+func (d *document) resolve(path []segment) *validation.Schema {
+	return d.deref(d.lookup(path), "")
+}
+
+// lookup returns the property at the end of the path, which holds its
+// description, before following references
+func (d *document) lookup(path []segment) *validation.Schema {
+	schema := d.schema
+	for _, s := range path {
+		for n := 0; n < s.items && schema != nil; n++ {
+			schema = d.items(schema)
+		}
+		if s.key != "" && schema != nil {
+			schema = d.property(schema, s.key)
+		}
+	}
+	return schema
+}
+
+// parent returns the schema of the mapping holding the last key of the path
+func (d *document) parent(path []segment) *validation.Schema {
+	if len(path) == 0 {
+		return nil
+	}
+	last := path[len(path)-1]
+	schema := d.resolve(append(path[:len(path)-1:len(path)-1], segment{items: last.items}))
+	return d.deref(schema, "object")
+}
+
+func (d *document) items(schema *validation.Schema) *validation.Schema {
+	if schema = d.deref(schema, "array"); schema == nil {
+		return nil
+	}
+	return schema.Items
+}
+
+func (d *document) property(schema *validation.Schema, key string) *validation.Schema {
+	if schema = d.deref(schema, "object"); schema == nil {
+		return nil
+	}
+	if property, ok := schema.Properties[key]; ok {
+		return property
+	}
+	if additional, ok := schema.AdditionalProperties.(*validation.Schema); ok {
+		return additional
+	}
+	return nil
+}
+
+// deref follows references and picks the alternative of the given type,
+// if any, among the forms of a schema
+func (d *document) deref(schema *validation.Schema, kind string) *validation.Schema {
+	for schema != nil {
+		switch {
+		case schema.Ref != "":
+			schema = d.schema.Definitions[strings.TrimPrefix(schema.Ref, "#/definitions/")]
+		case len(schema.AllOf) == 1 && schema.Type == "":
+			// A described reference
+			schema = schema.AllOf[0]
+		case len(schema.OneOf) > 0:
+			var picked *validation.Schema
+			for _, form := range schema.OneOf {
+				if picked == nil || form.Type == kind {
+					picked = form
+				}
+			}
+			if kind == "" {
+				// Keep the last form, the object, for descriptions
+				picked = schema.OneOf[len(schema.OneOf)-1]
+			}
+			schema = picked
+		default:
+			return schema
+		}
+	}
+	return nil
+}
+
+// position converts an LSP position, whose character counts UTF-16 code
+// units, to a line index and a character column
+func (d *document) position(p Position) (int, int, bool) {
+	if p.Line < 0 || p.Line >= len(d.lines) {
+		return 0, 0, false
+	}
+	text := d.lines[p.Line].text
+	units := 0
+	for col, r := range text {
+		if units >= p.Character {
+			return p.Line, col, true
+		}
+		units += len(utf16.Encode([]rune{r}))
+	}
+	return p.Line, len(text), true
+}
+
+// lspPosition converts a line index and character column to an LSP
+// position
+func (d *document) lspPosition(i, col int) Position {
+	if i < 0 || i >= len(d.lines) {
+		return Position{Line: i, Character: col}
+	}
+	text := d.lines[i].text
+	if col > len(text) {
+		col = len(text)
+	}
+	return Position{Line: i, Character: len(utf16.Encode(text[:col]))}
+}
+
+// word returns the bounds of the word at column col of line i, made of the
+// characters of names, images and variables
+func (d *document) word(i, col int) (int, int) {
+	text := d.lines[i].text
+	isWord := func(r rune) bool {
+		return r != ' ' && r != '\t' && r != ',' && r != '[' && r != ']' && r != '{' && r != '}' && r != ':' && r != '"' && r != '\''
+	}
+	start, end := col, col
+	for start > 0 && isWord(text[start-1]) {
+		start--
+	}
+	for end < len(text) && isWord(text[end]) {
+		end++
+	}
+	return start, end
+}
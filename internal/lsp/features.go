@@ -0,0 +1,263 @@
+package lsp
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"bitbucket-runner/internal/models"
+	"bitbucket-runner/internal/validation"
+)
+
+// variablePrefix matches a variable being typed before the cursor
+var variablePrefix = regexp.MustCompile(`\$\{?[A-Za-z0-9_]*$`)
+
+// complete returns the completions at column col of line i: variables in
+// values, the keys of the enclosing mapping, and the values of fields with
+// a fixed set of values, services or caches
+func (d *document) complete(i, col int) []CompletionItem {
+	text := d.lines[i].text
+	if col > len(text) {
+		col = len(text)
+	}
+	prefix := text[:col]
+	if variablePrefix.MatchString(string(prefix)) {
+		return variableCompletions()
+	}
+
+	typed := parseLine(prefix)
+	threshold := typed.content
+	if typed.dash >= 0 {
+		threshold = typed.dash + 1
+	}
+	path, items := d.ancestors(i, threshold)
+	path = append(path, segment{items: items + typed.items, key: typed.key})
+
+	if typed.key == "" {
+		// A key, or an item of a list
+		if mapping := d.deref(d.resolve(path), "object"); mapping != nil && len(mapping.Properties) > 0 {
+			return keyCompletions(mapping)
+		}
+		return d.valueCompletions(path[:len(path)-1], d.resolve(path))
+	}
+
+	schema := d.resolve(path)
+	if strings.HasPrefix(strings.TrimSpace(string(text[typed.valueCol:col])), "[") {
+		schema = d.deref(d.items(schema), "")
+	}
+	return d.valueCompletions(path, schema)
+}
+
+func keyCompletions(mapping *validation.Schema) []CompletionItem {
+	var items []CompletionItem
+	for _, key := range sortedKeys(mapping.Properties) {
+		property := mapping.Properties[key]
+		item := CompletionItem{Label: key, Kind: completionProperty, InsertText: key + ": "}
+		if property.Description != "" {
+			item.Documentation = markdown(property.Description)
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+// valueCompletions returns the values of the field at the end of owner,
+// whose schema is given
+func (d *document) valueCompletions(owner []segment, schema *validation.Schema) []CompletionItem {
+	if names, kind := d.names(owner); names != nil {
+		var items []CompletionItem
+		for _, name := range names {
+			items = append(items, CompletionItem{Label: name, Kind: completionModule, Detail: kind})
+		}
+		return items
+	}
+
+	schema = d.deref(schema, "")
+	if schema == nil {
+		return nil
+	}
+	values := schema.Enum
+	if schema.Type == "boolean" {
+		values = []string{"true", "false"}
+	}
+	var items []CompletionItem
+	for _, value := range values {
+		items = append(items, CompletionItem{Label: value, Kind: completionValue})
+	}
+	return items
+}
+
+// names returns the services or caches a step may use when owner is the
+// services or caches field of a step
+func (d *document) names(owner []segment) ([]string, string) {
+	if len(owner) == 0 || d.parent(owner) != d.schema.Definitions["Step"] || d.schema.Definitions["Step"] == nil {
+		return nil, ""
+	}
+	switch owner[len(owner)-1].key {
+	case "services":
+		names := []string{"docker"}
+		for name := range d.definitions("definitions", "services") {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names, "service"
+	case "caches":
+		var names []string
+		for name := range d.definitions("definitions", "caches") {
+			names = append(names, name)
+		}
+		for name := range models.PredefinedCaches {
+			if _, ok := d.definitions("definitions", "caches")[name]; !ok {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		return names, "cache"
+	}
+	return nil, ""
+}
+
+func variableCompletions() []CompletionItem {
+	var names []string
+	for name := range models.PredefinedVariables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var items []CompletionItem
+	for _, name := range names {
+		items = append(items, CompletionItem{
+			Label:         name,
+			Kind:          completionVariable,
+			Documentation: markdown(models.PredefinedVariables[name]),
+		})
+	}
+	return items
+}
+
+// hover documents the key or the predefined variable at column col of
+// line i
+func (d *document) hover(i, col int) *Hover {
+	l := d.lines[i]
+	start, end := d.word(i, col)
+	word := string(l.text[start:end])
+	if name := variableName(word); name != "" {
+		if description, ok := models.PredefinedVariables[name]; ok {
+			return &Hover{
+				Contents: *markdown(fmt.Sprintf("**$%s**\n\n%s", name, description)),
+				Range:    d.lspRange(i, start, end),
+			}
+		}
+		return nil
+	}
+
+	keyEnd := l.content + len([]rune(l.key))
+	if l.key == "" || col < l.content || col > keyEnd {
+		return nil
+	}
+	property := d.lookup(d.path(i))
+	schema := d.deref(property, "")
+	if schema == nil {
+		return nil
+	}
+
+	var doc strings.Builder
+	fmt.Fprintf(&doc, "**%s**", l.key)
+	if kind := d.kind(schema); kind != "" {
+		fmt.Fprintf(&doc, ": %s", kind)
+	}
+	if property.Description != "" {
+		fmt.Fprintf(&doc, "\n\n%s", property.Description)
+	}
+	if len(schema.Enum) > 0 {
+		fmt.Fprintf(&doc, "\n\nOne of `%s`.", strings.Join(schema.Enum, "`, `"))
+	}
+	return &Hover{Contents: *markdown(doc.String()), Range: d.lspRange(i, l.content, keyEnd)}
+}
+
+// kind describes the type of a field
+func (d *document) kind(schema *validation.Schema) string {
+	switch {
+	case d.deref(schema, "array") != nil && d.deref(schema, "array").Type == "array":
+		items := d.deref(d.items(schema), "")
+		if items != nil && items.Type != "" && items.Type != "object" {
+			return "list of " + items.Type + "s"
+		}
+		return "list"
+	case schema.Type == "object" && len(schema.Properties) == 0:
+		return "mapping"
+	}
+	return schema.Type
+}
+
+// variableName returns the name of a variable reference such as $NAME or
+// ${NAME}
+func variableName(word string) string {
+	if i := strings.Index(word, "$"); i >= 0 {
+		word = word[i+1:]
+		name := strings.TrimPrefix(word, "{")
+		if end := strings.IndexFunc(name, func(r rune) bool {
+			return !(r == '_' || r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z' || r >= '0' && r <= '9')
+		}); end >= 0 {
+			name = name[:end]
+		}
+		return name
+	}
+	return ""
+}
+
+// definition returns the definition of the service or cache of a step at
+// column col of line i
+func (d *document) definition(i, col int) *Location {
+	l := d.lines[i]
+	start, end := d.word(i, col)
+	if start == end {
+		return nil
+	}
+	name := string(l.text[start:end])
+
+	var owner []segment
+	switch {
+	case l.key != "" && col >= l.valueCol:
+		owner = d.path(i)
+	case l.key == "" && l.items > 0:
+		path := d.path(i)
+		owner = path[:len(path)-1]
+		if len(owner) == 0 {
+			return nil
+		}
+		// The list markers of the item belong to the owner
+		last := path[len(path)-1]
+		if last.items > 1 {
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	names, kind := d.names(owner)
+	if names == nil {
+		return nil
+	}
+	defined := d.definitions("definitions", kind+"s")
+	line, ok := defined[name]
+	if !ok {
+		return nil
+	}
+	definition := d.lines[line]
+	return &Location{URI: d.uri, Range: *d.lspRange(line, definition.content, definition.content+len([]rune(definition.key)))}
+}
+
+func (d *document) lspRange(i, start, end int) *Range {
+	return &Range{Start: d.lspPosition(i, start), End: d.lspPosition(i, end)}
+}
+
+func sortedKeys(properties map[string]*validation.Schema) []string {
+	keys := make([]string, 0, len(properties))
+	for key := range properties {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,251 @@
+// Package lsp implements a Language Server Protocol server for pipeline
+// files and runner configurations: diagnostics from the validators,
+// completion, hover documentation and go-to-definition of services and
+// caches.
+package lsp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+
+	"bitbucket-runner/internal/validation"
+)
+
+// serverName identifies the server and the source of its diagnostics
+const serverName = "bitbucket-runner"
+
+// ErrExitWithoutShutdown is returned by Serve when the client asks the
+// server to exit without shutting it down first
+var ErrExitWithoutShutdown = errors.New("exit requested before shutdown")
+
+// Server is a language server for a single client
+type Server struct {
+	conn      *conn
+	options   validation.Options
+	documents map[string]*document
+	shutdown  bool
+}
+
+// NewServer returns a server reading requests from in and writing responses
+// to out. Pipeline files are validated with the given options, lint rules
+// included.
+func NewServer(in io.Reader, out io.Writer, options validation.Options) *Server {
+	options.Lint = true
+	return &Server{conn: newConn(in, out), options: options, documents: make(map[string]*document)}
+}
+
+// Serve handles messages until the client exits or closes the input
+func (s *Server) Serve() error {
+	for {
+		content, err := s.conn.read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read message: %w", err)
+		}
+
+		var req request
+		if err := json.Unmarshal(content, &req); err != nil {
+			if err := s.conn.write(errorResponse{JSONRPC: "2.0", Error: responseError{Code: codeParseError, Message: err.Error()}}); err != nil {
+				return err
+			}
+			continue
+		}
+		if req.Method == "exit" {
+			if !s.shutdown {
+				return ErrExitWithoutShutdown
+			}
+			return nil
+		}
+		if err := s.handle(req); err != nil {
+			return err
+		}
+	}
+}
+
+// handle answers a request or processes a notification
+func (s *Server) handle(req request) error {
+	result, err := s.dispatch(req)
+	if req.ID == nil {
+		// Notifications get no response, even when they fail
+		return nil
+	}
+	var rpcErr *responseError
+	if errors.As(err, &rpcErr) {
+		return s.conn.write(errorResponse{JSONRPC: "2.0", ID: req.ID, Error: *rpcErr})
+	}
+	if err != nil {
+		return err
+	}
+	return s.conn.write(response{JSONRPC: "2.0", ID: req.ID, Result: result})
+}
+
+func (e *responseError) Error() string {
+	return e.Message
+}
+
+func (s *Server) dispatch(req request) (interface{}, error) {
+	switch req.Method {
+	case "initialize":
+		return InitializeResult{
+			Capabilities: ServerCapabilities{
+				TextDocumentSync:   syncFull,
+				CompletionProvider: CompletionOptions{TriggerCharacters: []string{"$", "{", ":", "-", " ", "["}},
+				HoverProvider:      true,
+				DefinitionProvider: true,
+			},
+			ServerInfo: ServerInfo{Name: serverName},
+		}, nil
+	case "initialized":
+		return nil, nil
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+
+	case "textDocument/didOpen":
+		var params DidOpenTextDocumentParams
+		if err := decodeParams(req, &params); err != nil {
+			return nil, err
+		}
+		return nil, s.update(params.TextDocument.URI, params.TextDocument.Text)
+	case "textDocument/didChange":
+		var params DidChangeTextDocumentParams
+		if err := decodeParams(req, &params); err != nil {
+			return nil, err
+		}
+		if len(params.ContentChanges) == 0 {
+			return nil, nil
+		}
+		return nil, s.update(params.TextDocument.URI, params.ContentChanges[len(params.ContentChanges)-1].Text)
+	case "textDocument/didClose":
+		var params DidCloseTextDocumentParams
+		if err := decodeParams(req, &params); err != nil {
+			return nil, err
+		}
+		delete(s.documents, params.TextDocument.URI)
+		return nil, s.publish(params.TextDocument.URI, []Diagnostic{})
+
+	case "textDocument/completion":
+		d, line, col, err := s.locate(req)
+		if d == nil || err != nil {
+			return nil, err
+		}
+		items := d.complete(line, col)
+		if items == nil {
+			items = []CompletionItem{}
+		}
+		return CompletionList{Items: items}, nil
+	case "textDocument/hover":
+		d, line, col, err := s.locate(req)
+		if d == nil || err != nil {
+			return nil, err
+		}
+		if hover := d.hover(line, col); hover != nil {
+			return hover, nil
+		}
+		return nil, nil
+	case "textDocument/definition":
+		d, line, col, err := s.locate(req)
+		if d == nil || err != nil {
+			return nil, err
+		}
+		if location := d.definition(line, col); location != nil {
+			return location, nil
+		}
+		return nil, nil
+	}
+
+	if req.ID == nil {
+		// Optional notifications such as $/cancelRequest
+		return nil, nil
+	}
+	return nil, &responseError{Code: codeMethodNotFound, Message: fmt.Sprintf("method '%s' not supported", req.Method)}
+}
+
+func decodeParams(req request, params interface{}) error {
+	if err := json.Unmarshal(req.Params, params); err != nil {
+		return &responseError{Code: codeInvalidParams, Message: fmt.Sprintf("invalid parameters of '%s': %v", req.Method, err)}
+	}
+	return nil
+}
+
+// locate returns the open document and the position of a request, or a nil
+// document when it is not open or the position is outside of it
+func (s *Server) locate(req request) (*document, int, int, error) {
+	var params TextDocumentPositionParams
+	if err := decodeParams(req, &params); err != nil {
+		return nil, 0, 0, err
+	}
+	d, ok := s.documents[params.TextDocument.URI]
+	if !ok {
+		return nil, 0, 0, nil
+	}
+	line, col, ok := d.position(params.Position)
+	if !ok {
+		return nil, 0, 0, nil
+	}
+	return d, line, col, nil
+}
+
+// update stores the new text of a document and publishes its diagnostics
+func (s *Server) update(uri, text string) error {
+	d := newDocument(uri, text)
+	s.documents[uri] = d
+
+	file := uri
+	if u, err := url.Parse(uri); err == nil && u.Path != "" {
+		file = u.Path
+	}
+	var diagnostics validation.Diagnostics
+	if isRunnerConfig(uri) {
+		diagnostics = validation.ValidateRunnerConfig(file, []byte(text))
+	} else {
+		diagnostics = validation.ValidatePipelineConfig(file, []byte(text), s.options)
+	}
+
+	published := make([]Diagnostic, 0, len(diagnostics))
+	for _, diagnostic := range diagnostics {
+		published = append(published, d.diagnostic(diagnostic))
+	}
+	return s.publish(uri, published)
+}
+
+func (s *Server) publish(uri string, diagnostics []Diagnostic) error {
+	return s.conn.write(notification{
+		JSONRPC: "2.0",
+		Method:  "textDocument/publishDiagnostics",
+		Params:  PublishDiagnosticsParams{URI: uri, Diagnostics: diagnostics},
+	})
+}
+
+// diagnostic converts a diagnostic of the validators, whose position is
+// 1-based, to a diagnostic spanning the word at that position
+func (d *document) diagnostic(diagnostic validation.Diagnostic) Diagnostic {
+	published := Diagnostic{
+		Severity: diagnosticError,
+		Code:     diagnostic.Rule,
+		Source:   serverName,
+		Message:  diagnostic.Message,
+	}
+	if diagnostic.Severity == validation.SeverityWarning {
+		published.Severity = diagnosticWarning
+	}
+
+	i, col := diagnostic.Line-1, diagnostic.Column-1
+	if i < 0 || i >= len(d.lines) {
+		return published
+	}
+	if col < 0 {
+		col = 0
+	}
+	start, end := col, col
+	if col < len(d.lines[i].text) {
+		_, end = d.word(i, col)
+	}
+	published.Range = *d.lspRange(i, start, end)
+	return published
+}
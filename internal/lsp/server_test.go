@@ -0,0 +1,330 @@
+package lsp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"bitbucket-runner/internal/validation"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const pipelineURI = "file:///repo/bitbucket-pipelines.yml"
+
+const pipelineText = `definitions:
+  services:
+    postgres:
+      image: postgres:15
+  caches:
+    deps: vendor
+pipelines:
+  default:
+    - step:
+        name: Test
+        image: golang:1.21
+        services:
+          - postgres
+        caches: [deps]
+        script:
+          - echo $BITBUCKET_COMMIT
+`
+
+// message is a message written by the server
+type message struct {
+	ID     *int            `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+	Error  *responseError  `json:"error"`
+}
+
+// session sends the messages to a server and returns what it writes
+func session(t *testing.T, messages ...interface{}) ([]message, error) {
+	var in bytes.Buffer
+	for _, m := range messages {
+		content, err := json.Marshal(m)
+		require.NoError(t, err)
+		fmt.Fprintf(&in, "Content-Length: %d\r\n\r\n%s", len(content), content)
+	}
+
+	var out bytes.Buffer
+	err := NewServer(&in, &out, validation.Options{}).Serve()
+
+	var written []message
+	c := newConn(&out, nil)
+	for {
+		content, err := c.read()
+		if err != nil {
+			break
+		}
+		var m message
+		require.NoError(t, json.Unmarshal(content, &m))
+		written = append(written, m)
+	}
+	return written, err
+}
+
+func call(id int, method string, params interface{}) map[string]interface{} {
+	return map[string]interface{}{"jsonrpc": "2.0", "id": id, "method": method, "params": params}
+}
+
+func notify(method string, params interface{}) map[string]interface{} {
+	return map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params}
+}
+
+func open(uri, text string) map[string]interface{} {
+	return notify("textDocument/didOpen", DidOpenTextDocumentParams{TextDocument: TextDocumentItem{URI: uri, LanguageID: "yaml", Text: text}})
+}
+
+func at(id int, method string, line, character int) map[string]interface{} {
+	return call(id, method, TextDocumentPositionParams{
+		TextDocument: TextDocumentIdentifier{URI: pipelineURI},
+		Position:     Position{Line: line, Character: character},
+	})
+}
+
+// result decodes the result of the request with the given ID
+func result(t *testing.T, messages []message, id int, v interface{}) {
+	for _, m := range messages {
+		if m.ID != nil && *m.ID == id {
+			require.Nil(t, m.Error)
+			require.NoError(t, json.Unmarshal(m.Result, v))
+			return
+		}
+	}
+	t.Fatalf("no response to request %d", id)
+}
+
+func labels(list CompletionList) []string {
+	var labels []string
+	for _, item := range list.Items {
+		labels = append(labels, item.Label)
+	}
+	return labels
+}
+
+func TestServer_Lifecycle(t *testing.T) {
+	messages, err := session(t,
+		call(1, "initialize", map[string]interface{}{}),
+		notify("initialized", map[string]interface{}{}),
+		call(2, "workspace/symbol", map[string]interface{}{}),
+		notify("$/cancelRequest", map[string]interface{}{"id": 1}),
+		call(3, "shutdown", nil),
+		notify("exit", nil),
+	)
+	require.NoError(t, err)
+	require.Len(t, messages, 3)
+
+	var initialized InitializeResult
+	result(t, messages, 1, &initialized)
+	assert.Equal(t, syncFull, initialized.Capabilities.TextDocumentSync)
+	assert.True(t, initialized.Capabilities.HoverProvider)
+	assert.True(t, initialized.Capabilities.DefinitionProvider)
+	assert.Contains(t, initialized.Capabilities.CompletionProvider.TriggerCharacters, "$")
+	assert.Equal(t, "bitbucket-runner", initialized.ServerInfo.Name)
+
+	require.NotNil(t, messages[1].Error)
+	assert.Equal(t, codeMethodNotFound, messages[1].Error.Code)
+	assert.Equal(t, "null", string(messages[2].Result))
+
+	_, err = session(t, notify("exit", nil))
+	assert.ErrorIs(t, err, ErrExitWithoutShutdown)
+}
+
+func TestServer_Diagnostics(t *testing.T) {
+	text := "pipelines:\n  default:\n    - step:\n        scirpt:\n          - make\n"
+	messages, err := session(t,
+		open(pipelineURI, text),
+		notify("textDocument/didChange", map[string]interface{}{
+			"textDocument":   map[string]interface{}{"uri": pipelineURI, "version": 2},
+			"contentChanges": []map[string]interface{}{{"text": pipelineText}},
+		}),
+		notify("textDocument/didClose", DidCloseTextDocumentParams{TextDocument: TextDocumentIdentifier{URI: pipelineURI}}),
+	)
+	require.NoError(t, err)
+	require.Len(t, messages, 3)
+
+	var params []PublishDiagnosticsParams
+	for _, m := range messages {
+		assert.Equal(t, "textDocument/publishDiagnostics", m.Method)
+		var p PublishDiagnosticsParams
+		require.NoError(t, json.Unmarshal(m.Params, &p))
+		assert.Equal(t, pipelineURI, p.URI)
+		params = append(params, p)
+	}
+
+	var unknown *Diagnostic
+	for i, diagnostic := range params[0].Diagnostics {
+		if strings.Contains(diagnostic.Message, "scirpt") {
+			unknown = &params[0].Diagnostics[i]
+		}
+	}
+	require.NotNil(t, unknown, "diagnostics: %+v", params[0].Diagnostics)
+	assert.Equal(t, diagnosticError, unknown.Severity)
+	assert.Equal(t, "bitbucket-runner", unknown.Source)
+	assert.Equal(t, Range{Start: Position{Line: 3, Character: 8}, End: Position{Line: 3, Character: 14}}, unknown.Range)
+
+	// The valid file only gets lint warnings
+	for _, diagnostic := range params[1].Diagnostics {
+		assert.Equal(t, diagnosticWarning, diagnostic.Severity, diagnostic.Message)
+		assert.NotEmpty(t, diagnostic.Code)
+	}
+	assert.Empty(t, params[2].Diagnostics)
+}
+
+func TestServer_Completion(t *testing.T) {
+	tests := []struct {
+		name      string
+		text      string
+		line, col int
+		contains  []string
+		excludes  []string
+	}{
+		{
+			name:     "root keys",
+			text:     "pi",
+			line:     0,
+			col:      2,
+			contains: []string{"pipelines", "definitions", "image", "options"},
+		},
+		{
+			name:     "step keys",
+			text:     "pipelines:\n  default:\n    - step:\n        na\n",
+			line:     3,
+			col:      10,
+			contains: []string{"name", "script", "services", "caches", "size"},
+			excludes: []string{"pipelines", "step"},
+		},
+		{
+			name:     "entry keys",
+			text:     "pipelines:\n  default:\n    - \n",
+			line:     2,
+			col:      6,
+			contains: []string{"step", "parallel", "stage"},
+		},
+		{
+			name:     "service names",
+			text:     "definitions:\n  services:\n    postgres:\n      image: postgres\npipelines:\n  default:\n    - step:\n        services:\n          - \n",
+			line:     8,
+			col:      12,
+			contains: []string{"docker", "postgres"},
+		},
+		{
+			name:     "cache names in flow list",
+			text:     "definitions:\n  caches:\n    deps: vendor\npipelines:\n  default:\n    - step:\n        caches: [\n",
+			line:     6,
+			col:      17,
+			contains: []string{"deps", "node", "maven"},
+		},
+		{
+			name:     "enum values",
+			text:     "pipelines:\n  default:\n    - step:\n        size: \n",
+			line:     3,
+			col:      14,
+			contains: []string{"1x", "2x"},
+		},
+		{
+			name:     "predefined variables",
+			text:     "pipelines:\n  default:\n    - step:\n        script:\n          - echo $BITBUCKET_\n",
+			line:     4,
+			col:      27,
+			contains: []string{"BITBUCKET_COMMIT", "BITBUCKET_BRANCH", "CI"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			messages, err := session(t, open(pipelineURI, tt.text), at(1, "textDocument/completion", tt.line, tt.col))
+			require.NoError(t, err)
+
+			var list CompletionList
+			result(t, messages, 1, &list)
+			for _, label := range tt.contains {
+				assert.Contains(t, labels(list), label)
+			}
+			for _, label := range tt.excludes {
+				assert.NotContains(t, labels(list), label)
+			}
+		})
+	}
+}
+
+func TestServer_Hover(t *testing.T) {
+	messages, err := session(t,
+		open(pipelineURI, pipelineText),
+		at(1, "textDocument/hover", 11, 10),
+		at(2, "textDocument/hover", 15, 20),
+		at(3, "textDocument/hover", 12, 14),
+	)
+	require.NoError(t, err)
+
+	var services Hover
+	result(t, messages, 1, &services)
+	assert.Equal(t, "markdown", services.Contents.Kind)
+	assert.Contains(t, services.Contents.Value, "**services**: list of strings")
+	assert.Equal(t, &Range{Start: Position{Line: 11, Character: 8}, End: Position{Line: 11, Character: 16}}, services.Range)
+
+	var variable Hover
+	result(t, messages, 2, &variable)
+	assert.Contains(t, variable.Contents.Value, "**$BITBUCKET_COMMIT**")
+
+	var none *Hover
+	result(t, messages, 3, &none)
+	assert.Nil(t, none)
+}
+
+func TestServer_Definition(t *testing.T) {
+	messages, err := session(t,
+		open(pipelineURI, pipelineText),
+		at(1, "textDocument/definition", 12, 14),
+		at(2, "textDocument/definition", 13, 18),
+		at(3, "textDocument/definition", 10, 17),
+	)
+	require.NoError(t, err)
+
+	var service Location
+	result(t, messages, 1, &service)
+	assert.Equal(t, Location{URI: pipelineURI, Range: Range{Start: Position{Line: 2, Character: 4}, End: Position{Line: 2, Character: 12}}}, service)
+
+	var cache Location
+	result(t, messages, 2, &cache)
+	assert.Equal(t, Location{URI: pipelineURI, Range: Range{Start: Position{Line: 5, Character: 4}, End: Position{Line: 5, Character: 8}}}, cache)
+
+	var none *Location
+	result(t, messages, 3, &none)
+	assert.Nil(t, none)
+}
+
+func TestServer_RunnerConfig(t *testing.T) {
+	uri := "file:///home/user/.config/bitbucket-runner/config.yml"
+	messages, err := session(t,
+		open(uri, "version: 1\ndefaults:\n  image: alpine\n  timeout: 60\n"),
+		call(1, "textDocument/completion", TextDocumentPositionParams{
+			TextDocument: TextDocumentIdentifier{URI: uri},
+			Position:     Position{Line: 2, Character: 2},
+		}),
+	)
+	require.NoError(t, err)
+
+	var list CompletionList
+	result(t, messages, 1, &list)
+	assert.Contains(t, labels(list), "image")
+	assert.Contains(t, labels(list), "timeout")
+	assert.NotContains(t, labels(list), "pipelines")
+}
+
+func TestDocument_Position(t *testing.T) {
+	d := newDocument(pipelineURI, "image: \"🙂\" # é\n")
+	line, col, ok := d.position(Position{Line: 0, Character: 10})
+	require.True(t, ok)
+	assert.Equal(t, 0, line)
+	assert.Equal(t, 9, col)
+	assert.Equal(t, Position{Line: 0, Character: 10}, d.lspPosition(0, 9))
+
+	_, _, ok = d.position(Position{Line: 5})
+	assert.False(t, ok)
+}
@@ -5,18 +5,24 @@
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
+	"regexp/syntax"
+	"strings"
 
 	"gopkg.in/yaml.v3"
 )
 
 // RunnerConfig represents tool configuration and step type mappings
 type RunnerConfig struct {
-	Version     string                 `yaml:"version"`
-	StepTypes   map[string]StepType   `yaml:"stepTypes"`
-	Environment map[string]string     `yaml:"environment"`
-	Defaults    DefaultConfig         `yaml:"defaults"`
-	Logging     LoggingConfig         `yaml:"logging"`
-	Docker      DockerConfig          `yaml:"docker"`
+	Version     string              `yaml:"version"`
+	StepTypes   map[string]StepType `yaml:"stepTypes"`
+	Environment map[string]string   `yaml:"environment"`
+	Defaults    DefaultConfig       `yaml:"defaults"`
+	Logging     LoggingConfig       `yaml:"logging"`
+	Docker      DockerConfig        `yaml:"docker"`
+	Lint        LintConfig          `yaml:"lint"`
+	Imports     map[string]string   `yaml:"imports"` // clone directory by repository pipelines are imported from
+	Transforms  []TransformHook     `yaml:"transforms"`
 }
 
 // StepType represents configuration for a specific step type
@@ -44,12 +50,16 @@ type PortMapping struct {
 
 // DefaultConfig represents default configuration values
 type DefaultConfig struct {
-	Image       string `yaml:"image"`
-	WorkingDir  string `yaml:"workingDir"`
-	Timeout     int    `yaml:"timeout"`
-	Shell       string `yaml:"shell"`
+	Image      string `yaml:"image"`
+	WorkingDir string `yaml:"workingDir"`
+	Timeout    int    `yaml:"timeout"`
+	Shell      string `yaml:"shell"`
+	StateDir   string `yaml:"stateDir"` // runs and artifacts, relative to the project
 }
 
+// DefaultStateDir is the state directory of configurations without one
+const DefaultStateDir = ".bitbucket-runner"
+
 // LoggingConfig represents logging configuration
 type LoggingConfig struct {
 	Level      string `yaml:"level"`
@@ -59,10 +69,122 @@ type LoggingConfig struct {
 
 // DockerConfig represents Docker-specific configuration
 type DockerConfig struct {
-	Host       string `yaml:"host"`
-	APIVersion string `yaml:"apiVersion"`
-	Registry   string `yaml:"registry"`
-	PullPolicy string `yaml:"pullPolicy"`
+	Host       string         `yaml:"host"`
+	APIVersion string         `yaml:"apiVersion"`
+	Registry   string         `yaml:"registry"`
+	PullPolicy string         `yaml:"pullPolicy"`
+	Rewrites   []ImageRewrite `yaml:"rewrites"`
+}
+
+// ImageRewrite replaces the name of the images it matches, such as to pull
+// them from a mirror. Match is an exact image name or, ending with *, a
+// prefix whose remainder replaces the * of Replace. Regex is a regular
+// expression matching the whole name, whose groups Replace references as
+// $1.
+type ImageRewrite struct {
+	Match   string `yaml:"match,omitempty"`
+	Regex   string `yaml:"regex,omitempty"`
+	Replace string `yaml:"replace"`
+
+	// regex is Regex anchored to the whole name, set by RunnerConfig.Validate
+	regex *regexp.Regexp
+}
+
+// RewriteImage returns the name of an image after the first rewrite
+// matching it, and whether one did. Rewrites match the name as written or
+// its canonical form, docker.io/library/node:18 for node:18. The regular
+// expressions of the rewrites are those compiled by RunnerConfig.Validate.
+func (c DockerConfig) RewriteImage(name string) (string, bool) {
+	if name == "" {
+		return name, false
+	}
+	for _, rewrite := range c.Rewrites {
+		for _, candidate := range []string{name, CanonicalImage(name)} {
+			if rewritten, ok := rewrite.apply(candidate); ok {
+				return rewritten, true
+			}
+		}
+	}
+	return name, false
+}
+
+// compile compiles the regular expression of the rewrite, anchored to the
+// whole name
+func (r *ImageRewrite) compile() error {
+	r.regex = nil
+	if r.Regex == "" {
+		return nil
+	}
+	// Checked on its own first, so that errors quote the expression as
+	// written and a valid one cannot close the group anchoring it
+	if _, err := syntax.Parse(r.Regex, syntax.Perl); err != nil {
+		return err
+	}
+	re, err := regexp.Compile("^(?:" + r.Regex + ")$")
+	if err != nil {
+		return err
+	}
+	r.regex = re
+	return nil
+}
+
+func (r ImageRewrite) apply(name string) (string, bool) {
+	switch {
+	case r.Regex != "":
+		if r.regex == nil || !r.regex.MatchString(name) {
+			return "", false
+		}
+		return r.regex.ReplaceAllString(name, r.Replace), true
+	case strings.HasSuffix(r.Match, "*"):
+		rest, ok := strings.CutPrefix(name, strings.TrimSuffix(r.Match, "*"))
+		if !ok {
+			return "", false
+		}
+		if strings.Contains(r.Replace, "*") {
+			return strings.Replace(r.Replace, "*", rest, 1), true
+		}
+		return r.Replace + rest, true
+	default:
+		return r.Replace, name == r.Match
+	}
+}
+
+// Pull policies of images, which tell when images are pulled before a run
+const (
+	PullPolicyAlways  = "always"
+	PullPolicyMissing = "missing"
+	PullPolicyNever   = "never"
+)
+
+// PullPolicies lists the valid pull policies
+var PullPolicies = []string{PullPolicyAlways, PullPolicyMissing, PullPolicyNever}
+
+// TransformHook is an executable rewriting the pipeline configuration
+// before a run, like the dynamic pipelines of Bitbucket. It reads the
+// configuration as JSON on its standard input and writes the modified
+// configuration, as JSON or YAML, on its standard output.
+type TransformHook struct {
+	Name    string   `yaml:"name"`
+	Command string   `yaml:"command"` // relative to the project
+	Args    []string `yaml:"args"`
+	Timeout int      `yaml:"timeout"` // in seconds
+}
+
+// DefaultTransformTimeout is the timeout of transform hooks without one, in
+// seconds
+const DefaultTransformTimeout = 60
+
+// Label returns the name of the hook, or its command when it has none
+func (h TransformHook) Label() string {
+	if h.Name != "" {
+		return h.Name
+	}
+	return h.Command
+}
+
+// LintConfig represents the configuration of validation and lint rules
+type LintConfig struct {
+	Rules map[string]string `yaml:"rules"` // severity by rule ID: error, warning or off
 }
 
 // NewDefaultRunnerConfig creates a new RunnerConfig with default values
@@ -81,15 +203,15 @@ func NewDefaultRunnerConfig() *RunnerConfig {
 			WorkingDir: "/opt/atlassian/pipelines/agent/build",
 			Timeout:    3600,
 			Shell:      "/bin/bash",
+			StateDir:   DefaultStateDir,
 		},
 		Logging: LoggingConfig{
 			Level:  "info",
 			Format: "text",
 		},
 		Docker: DockerConfig{
-			Host:       "unix:///var/run/docker.sock",
 			APIVersion: "1.41",
-			PullPolicy: "missing",
+			PullPolicy: PullPolicyMissing,
 		},
 	}
 }
@@ -106,6 +228,9 @@ func LoadRunnerConfigFromFile(filename string) (*RunnerConfig, error) {
 	if err != nil {
 		return nil, fmt.Errorf("failed to unmarshal config YAML: %w", err)
 	}
+	if config.Defaults.StateDir == "" {
+		config.Defaults.StateDir = DefaultStateDir
+	}
 
 	if err := config.Validate(); err != nil {
 		return nil, fmt.Errorf("invalid runner configuration: %w", err)
@@ -116,6 +241,17 @@ func LoadRunnerConfigFromFile(filename string) (*RunnerConfig, error) {
 
 // LoadFromDefaultLocations attempts to load configuration from default locations
 func LoadRunnerConfigFromDefaultLocations() (*RunnerConfig, error) {
+	if path, ok := RunnerConfigPath(); ok {
+		return LoadRunnerConfigFromFile(path)
+	}
+
+	// Return default configuration if no file found
+	return NewDefaultRunnerConfig(), nil
+}
+
+// RunnerConfigPath returns the first runner configuration file found in the
+// default locations
+func RunnerConfigPath() (string, bool) {
 	defaultPaths := []string{
 		"bitbucket-runner.yml",
 		"bitbucket-runner.yaml",
@@ -127,12 +263,10 @@ func LoadRunnerConfigFromDefaultLocations() (*RunnerConfig, error) {
 
 	for _, path := range defaultPaths {
 		if _, err := os.Stat(path); err == nil {
-			return LoadRunnerConfigFromFile(path)
+			return path, true
 		}
 	}
-
-	// Return default configuration if no file found
-	return NewDefaultRunnerConfig(), nil
+	return "", false
 }
 
 // Validate validates the runner configuration
@@ -149,6 +283,34 @@ func (rc *RunnerConfig) Validate() error {
 		return errors.New("default timeout must be positive")
 	}
 
+	// The state directory is left out of the workspaces of steps, which
+	// copy the project, so it must be inside the project
+	if dir := rc.Defaults.StateDir; dir != "" && (!filepath.IsLocal(dir) || filepath.Clean(dir) == ".") {
+		return fmt.Errorf("state directory '%s' must be a directory inside the project", dir)
+	}
+
+	for i, hook := range rc.Transforms {
+		if hook.Command == "" {
+			return fmt.Errorf("transform %d must have a command", i+1)
+		}
+		if hook.Timeout < 0 {
+			return fmt.Errorf("transform '%s' timeout must be positive", hook.Label())
+		}
+	}
+
+	for i := range rc.Docker.Rewrites {
+		rewrite := &rc.Docker.Rewrites[i]
+		if (rewrite.Match == "") == (rewrite.Regex == "") {
+			return fmt.Errorf("image rewrite %d must have either a match or a regex", i+1)
+		}
+		if rewrite.Replace == "" {
+			return fmt.Errorf("image rewrite %d must have a replacement", i+1)
+		}
+		if err := rewrite.compile(); err != nil {
+			return fmt.Errorf("image rewrite %d has an invalid regex: %w", i+1, err)
+		}
+	}
+
 	for name, stepType := range rc.StepTypes {
 		if stepType.Image == "" {
 			return fmt.Errorf("step type '%s' must have an image", name)
@@ -178,6 +340,18 @@ func (rc *RunnerConfig) GetDefaultStepType() *StepType {
 	}
 }
 
+// ResolveStepType returns the step type configured for the named step,
+// falling back to the default step type. The second return value reports
+// whether a step type was configured for the name itself.
+func (rc *RunnerConfig) ResolveStepType(stepName string) (*StepType, bool) {
+	if stepName != "" {
+		if st, exists := rc.StepTypes[stepName]; exists {
+			return &st, true
+		}
+	}
+	return rc.GetDefaultStepType(), false
+}
+
 // SaveToFile saves the runner configuration to a YAML file
 func (rc *RunnerConfig) SaveToFile(filename string) error {
 	data, err := yaml.Marshal(rc)
@@ -191,4 +365,4 @@ func (rc *RunnerConfig) SaveToFile(filename string) error {
 	}
 
 	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,23 @@
+package models
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadRunnerConfigFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bitbucket-runner.yml")
+	require.NoError(t, os.WriteFile(path, []byte("version: \"1.0\"\ndefaults:\n  image: alpine\n  timeout: 600\n"), 0644))
+
+	config, err := LoadRunnerConfigFromFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, DefaultStateDir, config.Defaults.StateDir)
+
+	require.NoError(t, os.WriteFile(path, []byte("version: \"1.0\"\ndefaults:\n  image: alpine\n  timeout: 600\n  stateDir: ../state\n"), 0644))
+	_, err = LoadRunnerConfigFromFile(path)
+	assert.EqualError(t, err, "invalid runner configuration: state directory '../state' must be a directory inside the project")
+}
@@ -1,44 +1,59 @@
 package models
 
 import (
+	"regexp"
 	"time"
 )
 
 // ExecutionContext tracks execution state and runtime information
 type ExecutionContext struct {
-	PipelineConfig *PipelineConfig
-	CurrentStep    int
-	StepResults    []StepResult
-	Environment    map[string]string
-	WorkingDir     string
-	StartTime      time.Time
-	EndTime        *time.Time
-	Status         ExecutionStatus
-	ErrorMessage   string
+	ID             string            `json:"id"`
+	PipelineName   string            `json:"pipeline_name"`
+	BuildNumber    int               `json:"build_number"`
+	PipelineConfig *PipelineConfig   `json:"-"`
+	CurrentStep    int               `json:"current_step"`
+	StepResults    []StepResult      `json:"steps"`
+	Environment    map[string]string `json:"environment"`
+	WorkingDir     string            `json:"working_dir"`
+	StartTime      time.Time         `json:"start_time"`
+	EndTime        *time.Time        `json:"end_time,omitempty"`
+	Status         ExecutionStatus   `json:"status"`
+	ErrorMessage   string            `json:"error_message,omitempty"`
+	Changeset      *Changeset        `json:"changeset,omitempty"`
+	Revision       string            `json:"revision,omitempty"`
+}
+
+// Changeset is the list of files changed between a base revision and the
+// revision being built. It is used to evaluate changeset conditions.
+type Changeset struct {
+	Base  string   `json:"base"`
+	Head  string   `json:"head"`
+	Files []string `json:"files"`
 }
 
 // StepResult represents the result of a single step execution
 type StepResult struct {
-	StepIndex    int
-	StepName     string
-	Status       StepStatus
-	StartTime    time.Time
-	EndTime      *time.Time
-	ExitCode     int
-	Output       string
-	ErrorOutput  string
-	Duration     time.Duration
+	StepIndex   int           `json:"step_index"`
+	StepName    string        `json:"step_name"`
+	Status      StepStatus    `json:"status"`
+	StartTime   time.Time     `json:"start_time"`
+	EndTime     *time.Time    `json:"end_time,omitempty"`
+	ExitCode    int           `json:"exit_code"`
+	Output      string        `json:"output,omitempty"`
+	ErrorOutput string        `json:"error_output,omitempty"`
+	Duration    time.Duration `json:"duration"`
+	Artifacts   []string      `json:"artifacts,omitempty"`
 }
 
 // ExecutionStatus represents the overall execution status
 type ExecutionStatus string
 
 const (
-	ExecutionStatusPending    ExecutionStatus = "pending"
-	ExecutionStatusRunning    ExecutionStatus = "running"
-	ExecutionStatusCompleted  ExecutionStatus = "completed"
-	ExecutionStatusFailed     ExecutionStatus = "failed"
-	ExecutionStatusCancelled  ExecutionStatus = "cancelled"
+	ExecutionStatusPending   ExecutionStatus = "pending"
+	ExecutionStatusRunning   ExecutionStatus = "running"
+	ExecutionStatusCompleted ExecutionStatus = "completed"
+	ExecutionStatusFailed    ExecutionStatus = "failed"
+	ExecutionStatusCancelled ExecutionStatus = "cancelled"
 )
 
 // StepStatus represents the status of a single step
@@ -99,11 +114,16 @@ func (ec *ExecutionContext) GetCurrentStep() *Step {
 
 	// Get default pipeline for now
 	pipeline, exists := ec.PipelineConfig.GetDefaultPipeline()
-	if !exists || ec.CurrentStep >= len(*pipeline) {
+	if !exists {
 		return nil
 	}
 
-	return &(*pipeline)[ec.CurrentStep].Step
+	steps := pipeline.Steps()
+	if ec.CurrentStep >= len(steps) {
+		return nil
+	}
+
+	return &steps[ec.CurrentStep]
 }
 
 // NextStep advances to the next step
@@ -122,7 +142,7 @@ func (ec *ExecutionContext) IsCompleted() bool {
 		return true
 	}
 
-	return ec.CurrentStep >= len(*pipeline)
+	return ec.CurrentStep >= len(pipeline.Steps())
 }
 
 // GetTotalDuration returns the total execution duration
@@ -142,4 +162,62 @@ func (ec *ExecutionContext) SetEnvironmentVariable(key, value string) {
 func (ec *ExecutionContext) GetEnvironmentVariable(key string) (string, bool) {
 	value, exists := ec.Environment[key]
 	return value, exists
-}
\ No newline at end of file
+}
+
+// ResumeFromFailure prepares a finished execution to be run again. Results
+// of steps that completed (or were skipped) before the first failure are
+// kept, everything from the first failed step onwards is discarded, and
+// CurrentStep is moved to that step. It returns the index of the step the
+// execution resumes from.
+func (ec *ExecutionContext) ResumeFromFailure() int {
+	kept := make([]StepResult, 0, len(ec.StepResults))
+	resumeAt := 0
+	for _, result := range ec.StepResults {
+		if result.Status != StepStatusCompleted && result.Status != StepStatusSkipped {
+			break
+		}
+		kept = append(kept, result)
+		resumeAt = result.StepIndex + 1
+	}
+
+	ec.StepResults = kept
+	ec.CurrentStep = resumeAt
+	ec.Status = ExecutionStatusPending
+	ec.EndTime = nil
+	ec.ErrorMessage = ""
+
+	return resumeAt
+}
+
+// secretVariable matches variable names whose values must never be displayed
+var secretVariable = regexp.MustCompile(`(?i)(SECRET|PASSWORD|PASSWD|TOKEN|CREDENTIAL|PRIVATE|API_?KEY|ACCESS_?KEY|AUTH)`)
+
+// IsSecretVariable reports whether the name of a variable suggests that its
+// value is a secret
+func IsSecretVariable(name string) bool {
+	return secretVariable.MatchString(name)
+}
+
+// PredefinedVariables describes the variables Bitbucket sets for every
+// step. The runner sets those it can derive from the local repository.
+var PredefinedVariables = map[string]string{
+	"CI":                               "Always true in pipelines.",
+	"BITBUCKET_BRANCH":                 "Branch the pipeline runs for, unset for tags.",
+	"BITBUCKET_BUILD_NUMBER":           "Number of the pipeline run.",
+	"BITBUCKET_CLONE_DIR":              "Directory of the clone in the container.",
+	"BITBUCKET_COMMIT":                 "Hash of the commit the pipeline runs for.",
+	"BITBUCKET_DEPLOYMENT_ENVIRONMENT": "Deployment environment of the step.",
+	"BITBUCKET_EXIT_CODE":              "Exit code of the script, set in after-script.",
+	"BITBUCKET_PARALLEL_STEP":          "Index of the step in its parallel group, from 0.",
+	"BITBUCKET_PARALLEL_STEP_COUNT":    "Number of steps of the parallel group.",
+	"BITBUCKET_PIPELINE_UUID":          "Identifier of the pipeline run.",
+	"BITBUCKET_PR_DESTINATION_BRANCH":  "Destination branch of the pull request.",
+	"BITBUCKET_PR_DESTINATION_COMMIT":  "Commit of the destination branch of the pull request.",
+	"BITBUCKET_PR_ID":                  "Number of the pull request.",
+	"BITBUCKET_PROJECT_KEY":            "Key of the project of the repository.",
+	"BITBUCKET_REPO_FULL_NAME":         "Workspace and name of the repository, such as team/repo.",
+	"BITBUCKET_REPO_SLUG":              "Name of the repository in URLs.",
+	"BITBUCKET_STEP_UUID":              "Identifier of the step.",
+	"BITBUCKET_TAG":                    "Tag the pipeline runs for.",
+	"BITBUCKET_WORKSPACE":              "Workspace of the repository.",
+}
@@ -223,4 +223,32 @@ func TestStepResult(t *testing.T) {
 	assert.Equal(t, 0, result.ExitCode)
 	assert.Equal(t, "Success output", result.Output)
 	assert.Equal(t, 30*time.Second, result.Duration)
-}
\ No newline at end of file
+}
+func TestExecutionContext_ResumeFromFailure(t *testing.T) {
+	t.Run("resumes at first failed step", func(t *testing.T) {
+		ec := NewExecutionContext(nil, "")
+		ec.AddStepResult(StepResult{StepIndex: 0, StepName: "Build", Status: StepStatusCompleted})
+		ec.AddStepResult(StepResult{StepIndex: 1, StepName: "Lint", Status: StepStatusSkipped})
+		ec.AddStepResult(StepResult{StepIndex: 2, StepName: "Test", Status: StepStatusFailed, ExitCode: 1})
+		ec.CurrentStep = 2
+		ec.FailExecution("step 'Test' failed")
+
+		resumeAt := ec.ResumeFromFailure()
+
+		assert.Equal(t, 2, resumeAt)
+		assert.Equal(t, 2, ec.CurrentStep)
+		assert.Len(t, ec.StepResults, 2)
+		assert.Equal(t, "Lint", ec.StepResults[1].StepName)
+		assert.Equal(t, ExecutionStatusPending, ec.Status)
+		assert.Nil(t, ec.EndTime)
+		assert.Empty(t, ec.ErrorMessage)
+	})
+
+	t.Run("no results resumes from the start", func(t *testing.T) {
+		ec := NewExecutionContext(nil, "")
+		ec.FailExecution("docker unavailable")
+
+		assert.Equal(t, 0, ec.ResumeFromFailure())
+		assert.Empty(t, ec.StepResults)
+	})
+}
@@ -0,0 +1,101 @@
+package models
+
+import (
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DockerHub is the registry of images whose name has no registry host
+const DockerHub = "docker.io"
+
+// Image is the Docker image of a pipeline or a step, written as its name or
+// as an object carrying the credentials of a private registry:
+//
+//	image:
+//	  name: registry.example.com/team/build:1.4
+//	  username: $REGISTRY_USER
+//	  password: $REGISTRY_PASSWORD
+//	  run-as-user: 1000
+//
+// Credentials may reference variables, expanded when the step runs.
+type Image struct {
+	Name      string    `yaml:"name"`
+	Username  string    `yaml:"username,omitempty"`
+	Password  string    `yaml:"password,omitempty"`
+	Email     string    `yaml:"email,omitempty"`
+	RunAsUser *int      `yaml:"run-as-user,omitempty"`
+	AWS       *ImageAWS `yaml:"aws,omitempty"`
+}
+
+// ImageAWS holds the credentials of an image stored in Amazon ECR
+type ImageAWS struct {
+	AccessKey string `yaml:"access-key,omitempty"`
+	SecretKey string `yaml:"secret-key,omitempty"`
+	OIDCRole  string `yaml:"oidc-role,omitempty"`
+}
+
+// UnmarshalYAML implements custom unmarshaling for Image, which is either
+// a name or an object
+func (i *Image) UnmarshalYAML(node *yaml.Node) error {
+	var name string
+	if err := node.Decode(&name); err == nil {
+		*i = Image{Name: name}
+		return nil
+	}
+
+	type imageAlias Image
+	var image imageAlias
+	if err := node.Decode(&image); err != nil {
+		return err
+	}
+	*i = Image(image)
+	return nil
+}
+
+// MarshalYAML implements custom marshaling for Image, writing images
+// without credentials or user as their name
+func (i Image) MarshalYAML() (interface{}, error) {
+	if i.plain() {
+		return i.Name, nil
+	}
+	type imageAlias Image
+	return imageAlias(i), nil
+}
+
+// IsZero reports whether the image is unset, which omits it when marshaled
+func (i Image) IsZero() bool {
+	return i.plain() && i.Name == ""
+}
+
+// HasCredentials reports whether the image is pulled with credentials
+func (i Image) HasCredentials() bool {
+	return i.Username != "" || i.Password != "" || i.AWS != nil
+}
+
+func (i Image) plain() bool {
+	return !i.HasCredentials() && i.Email == "" && i.RunAsUser == nil
+}
+
+// Registry returns the host of the registry of an image name, docker.io
+// for images of Docker Hub such as node:18 or bitnami/redis
+func Registry(name string) string {
+	host, _, ok := strings.Cut(name, "/")
+	if !ok || (!strings.ContainsAny(host, ".:") && host != "localhost") {
+		return DockerHub
+	}
+	return host
+}
+
+// CanonicalImage returns the full name of an image, with the registry and
+// the library namespace of Docker Hub, such as docker.io/library/node:18
+// for node:18
+func CanonicalImage(name string) string {
+	if name == "" || Registry(name) != DockerHub || strings.HasPrefix(name, DockerHub+"/") {
+		return name
+	}
+	if !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	return DockerHub + "/" + name
+}
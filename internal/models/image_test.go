@@ -0,0 +1,108 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestImage_YAML(t *testing.T) {
+	var step Step
+	require.NoError(t, yaml.Unmarshal([]byte("image: node:18\nscript: [npm ci]\n"), &step))
+	assert.Equal(t, Image{Name: "node:18"}, step.Image)
+
+	content := `image:
+  name: 123456789012.dkr.ecr.eu-west-1.amazonaws.com/app:2
+  email: ci@example.com
+  run-as-user: 1000
+  aws:
+    access-key: $AWS_ACCESS_KEY_ID
+    secret-key: $AWS_SECRET_ACCESS_KEY
+script: [make]
+`
+	step = Step{}
+	require.NoError(t, yaml.Unmarshal([]byte(content), &step))
+	user := 1000
+	assert.Equal(t, Image{
+		Name:      "123456789012.dkr.ecr.eu-west-1.amazonaws.com/app:2",
+		Email:     "ci@example.com",
+		RunAsUser: &user,
+		AWS:       &ImageAWS{AccessKey: "$AWS_ACCESS_KEY_ID", SecretKey: "$AWS_SECRET_ACCESS_KEY"},
+	}, step.Image)
+	assert.True(t, step.Image.HasCredentials())
+
+	// Images are written back in the form they were read in
+	data, err := yaml.Marshal(step)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "image:\n    name: 123456789012.dkr.ecr.eu-west-1.amazonaws.com/app:2\n")
+	var again Step
+	require.NoError(t, yaml.Unmarshal(data, &again))
+	assert.Equal(t, step, again)
+	data, err = yaml.Marshal(Step{Image: Image{Name: "node:18"}, Script: []string{"npm ci"}})
+	require.NoError(t, err)
+	assert.Equal(t, "image: node:18\nscript:\n    - npm ci\n", string(data))
+	data, err = yaml.Marshal(Step{Script: []string{"npm ci"}})
+	require.NoError(t, err)
+	assert.Equal(t, "script:\n    - npm ci\n", string(data))
+}
+
+func TestRegistry(t *testing.T) {
+	for name, registry := range map[string]string{
+		"node:18":                         DockerHub,
+		"bitnami/redis:7":                 DockerHub,
+		"docker.io/library/node":          "docker.io",
+		"registry.example.com/team/app:1": "registry.example.com",
+		"localhost:5000/app":              "localhost:5000",
+		"localhost/app":                   "localhost",
+		"ghcr.io/org/app@sha256:0123abcd": "ghcr.io",
+	} {
+		assert.Equal(t, registry, Registry(name), name)
+	}
+}
+
+func TestCanonicalImage(t *testing.T) {
+	for name, expected := range map[string]string{
+		"node:18":                    "docker.io/library/node:18",
+		"bitnami/redis":              "docker.io/bitnami/redis",
+		"docker.io/library/node:18":  "docker.io/library/node:18",
+		"registry.example.com/build": "registry.example.com/build",
+		"":                           "",
+	} {
+		assert.Equal(t, expected, CanonicalImage(name), name)
+	}
+}
+
+func TestDockerConfig_RewriteImage(t *testing.T) {
+	config := DockerConfig{Rewrites: []ImageRewrite{
+		{Match: "node:16", Replace: "node:16-bullseye"},
+		{Match: "docker.io/*", Replace: "mirror.local/*"},
+		{Regex: `ghcr\.io/(.+)`, Replace: "mirror.local/ghcr/$1"},
+		{Match: "registry.example.com/", Replace: "unused"},
+	}}
+	for i := range config.Rewrites {
+		require.NoError(t, config.Rewrites[i].compile())
+	}
+	for name, expected := range map[string]string{
+		"node:16":                     "node:16-bullseye",
+		"node:18":                     "mirror.local/library/node:18",
+		"bitnami/redis:7":             "mirror.local/bitnami/redis:7",
+		"docker.io/library/node:20":   "mirror.local/library/node:20",
+		"ghcr.io/team/build:1.4":      "mirror.local/ghcr/team/build:1.4",
+		"registry.example.com/build":  "registry.example.com/build",
+		"quay.io/ghcr.io/not-matched": "quay.io/ghcr.io/not-matched",
+	} {
+		rewritten, ok := config.RewriteImage(name)
+		assert.Equal(t, expected, rewritten, name)
+		assert.Equal(t, expected != name, ok, name)
+	}
+
+	rewritten, ok := DockerConfig{}.RewriteImage("node:18")
+	assert.False(t, ok)
+	assert.Equal(t, "node:18", rewritten)
+
+	// A prefix replacement without * is prepended to the remainder
+	rewritten, _ = DockerConfig{Rewrites: []ImageRewrite{{Match: "docker.io/library/*", Replace: "mirror.local/"}}}.RewriteImage("node:18")
+	assert.Equal(t, "mirror.local/node:18", rewritten)
+}
@@ -0,0 +1,35 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PipelineImport is the form of a pipeline imported from a shared
+// repository, as in "import: shared-pipelines:master:build"
+type PipelineImport struct {
+	Import string `yaml:"import"`
+}
+
+// Import identifies a pipeline exported by a shared repository, written
+// <repository>:<ref>:<pipeline>. The pipeline is one of the definitions
+// pipelines of the bitbucket-pipelines.yml of the repository at the ref.
+type Import struct {
+	Repository string
+	Ref        string
+	Pipeline   string
+}
+
+// ParseImport parses the value of an import
+func ParseImport(value string) (Import, error) {
+	parts := strings.SplitN(value, ":", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return Import{}, fmt.Errorf("invalid import '%s', expected <repository>:<ref>:<pipeline>", value)
+	}
+	return Import{Repository: parts[0], Ref: parts[1], Pipeline: parts[2]}, nil
+}
+
+// String returns the import in its textual form
+func (i Import) String() string {
+	return i.Repository + ":" + i.Ref + ":" + i.Pipeline
+}
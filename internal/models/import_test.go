@@ -0,0 +1,23 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseImport(t *testing.T) {
+	imported, err := ParseImport("shared-pipelines:release/1.x:build:java")
+	require.NoError(t, err)
+	assert.Equal(t, Import{Repository: "shared-pipelines", Ref: "release/1.x", Pipeline: "build:java"}, imported)
+	assert.Equal(t, "shared-pipelines:release/1.x:build:java", imported.String())
+
+	for _, value := range []string{"build", "shared-pipelines:build", "shared-pipelines::build", ":master:build", "shared-pipelines:master:"} {
+		t.Run(value, func(t *testing.T) {
+			_, err := ParseImport(value)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "expected <repository>:<ref>:<pipeline>")
+		})
+	}
+}
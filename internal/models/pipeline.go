@@ -3,58 +3,329 @@
 import (
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
+
+	"bitbucket-runner/internal/glob"
+
+	"gopkg.in/yaml.v3"
 )
 
 // PipelineConfig represents the parsed bitbucket-pipelines.yml structure
 type PipelineConfig struct {
-	Image    string                 `yaml:"image,omitempty"`
-	Clone    *CloneConfig          `yaml:"clone,omitempty"`
-	Pipelines *Pipelines           `yaml:"pipelines"`
-	Definitions *Definitions       `yaml:"definitions,omitempty"`
-	Options  *Options              `yaml:"options,omitempty"`
+	Image       Image        `yaml:"image,omitempty"`
+	Clone       *CloneConfig `yaml:"clone,omitempty"`
+	Pipelines   *Pipelines   `yaml:"pipelines"`
+	Definitions *Definitions `yaml:"definitions,omitempty"`
+	Options     *Options     `yaml:"options,omitempty"`
+
+	// Export makes the pipelines of definitions importable by other
+	// repositories
+	Export bool `yaml:"export,omitempty"`
 }
 
 // Pipelines represents the pipelines section
 type Pipelines struct {
-	Default      Pipeline                    `yaml:"default,omitempty"`
-	Branches     map[string]Pipeline         `yaml:"branches,omitempty"`
-	PullRequests map[string]Pipeline         `yaml:"pull-requests,omitempty"`
-	Custom       map[string]Pipeline         `yaml:"custom,omitempty"`
-	Tags         map[string]Pipeline         `yaml:"tags,omitempty"`
+	Default      Pipeline            `yaml:"default,omitempty"`
+	Branches     map[string]Pipeline `yaml:"branches,omitempty"`
+	PullRequests map[string]Pipeline `yaml:"pull-requests,omitempty"`
+	Custom       map[string]Pipeline `yaml:"custom,omitempty"`
+	Tags         map[string]Pipeline `yaml:"tags,omitempty"`
 }
 
-// Pipeline represents a single pipeline configuration
+// Pipeline represents a single pipeline configuration. A pipeline imported
+// from a shared repository holds a single entry naming the import until the
+// import is resolved.
 type Pipeline []StepWrapper
 
-// StepWrapper wraps a Step to handle the YAML structure
+// UnmarshalYAML implements custom unmarshaling for Pipeline, which is
+// either a list of entries or an import of a shared pipeline
+func (p *Pipeline) UnmarshalYAML(node *yaml.Node) error {
+	resolved := node
+	if resolved.Kind == yaml.AliasNode {
+		resolved = resolved.Alias
+	}
+	if resolved.Kind == yaml.MappingNode {
+		var imported PipelineImport
+		if err := resolved.Decode(&imported); err != nil {
+			return err
+		}
+		*p = Pipeline{{Import: imported.Import}}
+		return nil
+	}
+
+	var entries []StepWrapper
+	if err := node.Decode(&entries); err != nil {
+		return err
+	}
+	*p = entries
+	return nil
+}
+
+// MarshalYAML implements custom marshaling for Pipeline, writing imports
+// back in their own form
+func (p Pipeline) MarshalYAML() (interface{}, error) {
+	if imported := p.Import(); imported != "" {
+		return PipelineImport{Import: imported}, nil
+	}
+	return []StepWrapper(p), nil
+}
+
+// Import returns the shared pipeline the pipeline imports, written
+// <repository>:<ref>:<pipeline>, or "" when it defines its own steps
+func (p Pipeline) Import() string {
+	if len(p) != 1 {
+		return ""
+	}
+	return p[0].Import
+}
+
+// StepWrapper wraps a Step to handle the YAML structure. An entry of a
+// pipeline holds either a single step, a group of parallel steps or a stage.
+// The first entry of a custom pipeline may declare its variables instead.
 type StepWrapper struct {
-	Step Step `yaml:"step"`
+	Step      Step       `yaml:"step,omitempty"`
+	Parallel  *Parallel  `yaml:"parallel,omitempty"`
+	Stage     *Stage     `yaml:"stage,omitempty"`
+	Variables []Variable `yaml:"variables,omitempty"`
+
+	// Import is the shared pipeline an imported pipeline names
+	Import string `yaml:"-"`
+}
+
+// UnmarshalYAML implements custom unmarshaling for StepWrapper, recording
+// the step definition a step expands with an alias or a merge key
+func (w *StepWrapper) UnmarshalYAML(node *yaml.Node) error {
+	type wrapperAlias StepWrapper
+	var wrapper wrapperAlias
+	if err := node.Decode(&wrapper); err != nil {
+		return err
+	}
+
+	*w = StepWrapper(wrapper)
+	w.Step.Definition = definitionOf(node)
+	return nil
+}
+
+// definitionOf returns the anchor of the step definition an entry uses:
+// build for "step: *build" or for a step merging "<<: *build"
+func definitionOf(entry *yaml.Node) string {
+	if entry.Kind == yaml.AliasNode {
+		return entry.Value
+	}
+	if entry.Kind != yaml.MappingNode {
+		return ""
+	}
+
+	for i := 0; i+1 < len(entry.Content); i += 2 {
+		if entry.Content[i].Value != "step" {
+			continue
+		}
+		step := entry.Content[i+1]
+		if step.Kind == yaml.AliasNode {
+			return step.Value
+		}
+		if step.Kind != yaml.MappingNode {
+			return ""
+		}
+		for j := 0; j+1 < len(step.Content); j += 2 {
+			if step.Content[j].Tag != "!!merge" {
+				continue
+			}
+			merged := step.Content[j+1]
+			if merged.Kind == yaml.SequenceNode && len(merged.Content) > 0 {
+				// The first mapping merged wins
+				merged = merged.Content[0]
+			}
+			if merged.Kind == yaml.AliasNode {
+				return merged.Value
+			}
+		}
+	}
+	return ""
+}
+
+// Variable is a variable of a custom pipeline whose value is provided when
+// the pipeline is run
+type Variable struct {
+	Name          string   `yaml:"name" json:"name"`
+	Default       string   `yaml:"default,omitempty" json:"default,omitempty"`
+	AllowedValues []string `yaml:"allowed-values,omitempty" json:"allowed_values,omitempty"`
+	Description   string   `yaml:"description,omitempty" json:"description,omitempty"`
+}
+
+// Check verifies value is one of the allowed values of the variable
+func (v Variable) Check(value string) error {
+	if len(v.AllowedValues) == 0 {
+		return nil
+	}
+	for _, allowed := range v.AllowedValues {
+		if value == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("value '%s' of variable '%s' is not one of the allowed values: %s", value, v.Name, strings.Join(v.AllowedValues, ", "))
+}
+
+// Stage represents a group of sequential steps sharing a condition
+type Stage struct {
+	Name       string        `yaml:"name,omitempty"`
+	Trigger    string        `yaml:"trigger,omitempty"`
+	Deployment string        `yaml:"deployment,omitempty"`
+	Condition  *Condition    `yaml:"condition,omitempty"`
+	Steps      []StepWrapper `yaml:"steps"`
+}
+
+// Parallel represents a group of steps that run in parallel
+type Parallel struct {
+	FailFast bool          `yaml:"fail-fast,omitempty"`
+	Steps    []StepWrapper `yaml:"steps"`
+}
+
+// UnmarshalYAML implements custom unmarshaling for Parallel, which is
+// either a plain list of steps or an object with fail-fast and steps
+func (p *Parallel) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var steps []StepWrapper
+	if err := unmarshal(&steps); err == nil {
+		p.Steps = steps
+		return nil
+	}
+
+	type parallelAlias Parallel
+	var parallel parallelAlias
+	if err := unmarshal(&parallel); err != nil {
+		return err
+	}
+
+	*p = Parallel(parallel)
+	return nil
 }
 
+// Steps returns the steps of the pipeline in execution order, with the
+// steps of parallel groups and stages flattened in place
+func (p Pipeline) Steps() []Step {
+	var steps []Step
+	for _, wrapper := range p {
+		switch {
+		case wrapper.Parallel != nil:
+			for _, parallel := range wrapper.Parallel.Steps {
+				steps = append(steps, parallel.Step)
+			}
+		case wrapper.Stage != nil:
+			for _, staged := range wrapper.Stage.Steps {
+				steps = append(steps, staged.Step)
+			}
+		case wrapper.Variables != nil, wrapper.Import != "":
+			continue
+		default:
+			steps = append(steps, wrapper.Step)
+		}
+	}
+	return steps
+}
+
+// Variables returns the variables declared by the pipeline
+func (p Pipeline) Variables() []Variable {
+	if len(p) == 0 {
+		return nil
+	}
+	return p[0].Variables
+}
+
+// Trigger values of steps and stages. Steps are triggered automatically
+// unless configured otherwise.
+const (
+	TriggerAutomatic = "automatic"
+	TriggerManual    = "manual"
+)
+
 // Step represents a single step in a pipeline
 type Step struct {
-	Name         string            `yaml:"name,omitempty"`
-	Image        string            `yaml:"image,omitempty"`
-	Script       []string          `yaml:"script"`
-	Services     []string          `yaml:"services,omitempty"`
-	Artifacts    *Artifacts        `yaml:"artifacts,omitempty"`
-	Caches       []string          `yaml:"caches,omitempty"`
-	AfterScript  []string          `yaml:"after-script,omitempty"`
-	Condition    *Condition        `yaml:"condition,omitempty"`
-	Environment  map[string]string `yaml:"environment,omitempty"`
+	Name        string            `yaml:"name,omitempty"`
+	Image       Image             `yaml:"image,omitempty"`
+	Trigger     string            `yaml:"trigger,omitempty"`
+	Deployment  string            `yaml:"deployment,omitempty"`
+	Script      []string          `yaml:"script"`
+	Services    []string          `yaml:"services,omitempty"`
+	Artifacts   *Artifacts        `yaml:"artifacts,omitempty"`
+	Caches      []string          `yaml:"caches,omitempty"`
+	AfterScript []string          `yaml:"after-script,omitempty"`
+	Condition   *Condition        `yaml:"condition,omitempty"`
+	Environment map[string]string `yaml:"environment,omitempty"`
+
+	// Definition is the anchor of the step definition the step expands or
+	// merges, such as build for "step: *build"
+	Definition string `yaml:"-"`
 }
 
 // CloneConfig represents clone configuration
 type CloneConfig struct {
-	Enabled bool   `yaml:"enabled,omitempty"`
-	Depth   int    `yaml:"depth,omitempty"`
-	Lfs     bool   `yaml:"lfs,omitempty"`
+	Enabled bool `yaml:"enabled,omitempty"`
+	Depth   int  `yaml:"depth,omitempty"` // CloneDepthFull for depth: full
+	Lfs     bool `yaml:"lfs,omitempty"`
+}
+
+// CloneDepthFull is the depth of clones of the whole history, written
+// depth: full
+const CloneDepthFull = -1
+
+// cloneDepthFull is the value of depth for clones of the whole history
+const cloneDepthFull = "full"
+
+// UnmarshalYAML implements custom unmarshaling for CloneConfig, whose depth
+// is a number of commits or full. Fields are decoded onto the existing
+// value, so overrides merge.
+func (c *CloneConfig) UnmarshalYAML(node *yaml.Node) error {
+	full := false
+	fields := *node
+	if node.Kind == yaml.MappingNode {
+		fields.Content = nil
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == "depth" && node.Content[i+1].Value == cloneDepthFull {
+				full = true
+				continue
+			}
+			fields.Content = append(fields.Content, node.Content[i], node.Content[i+1])
+		}
+	}
+
+	type cloneAlias CloneConfig
+	clone := cloneAlias(*c)
+	if err := fields.Decode(&clone); err != nil {
+		return err
+	}
+	*c = CloneConfig(clone)
+	if full {
+		c.Depth = CloneDepthFull
+	}
+	return nil
+}
+
+// MarshalYAML implements custom marshaling for CloneConfig, writing the
+// depth of full clones as full
+func (c CloneConfig) MarshalYAML() (interface{}, error) {
+	type cloneAlias CloneConfig
+	if c.Depth != CloneDepthFull {
+		return cloneAlias(c), nil
+	}
+	clone := cloneAlias(c)
+	clone.Depth = 0
+	var node yaml.Node
+	if err := node.Encode(clone); err != nil {
+		return nil, err
+	}
+	node.Content = append(node.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Value: "depth"},
+		&yaml.Node{Kind: yaml.ScalarNode, Value: cloneDepthFull})
+	return &node, nil
 }
 
 // Definitions represents pipeline definitions
 type Definitions struct {
-	Services map[string]Service `yaml:"services,omitempty"`
-	Caches   map[string]Cache   `yaml:"caches,omitempty"`
+	Steps     []StepWrapper       `yaml:"steps,omitempty"`
+	Services  map[string]Service  `yaml:"services,omitempty"`
+	Caches    map[string]Cache    `yaml:"caches,omitempty"`
+	Pipelines map[string]Pipeline `yaml:"pipelines,omitempty"`
 }
 
 // Service represents a service definition
@@ -64,6 +335,20 @@ type Service struct {
 	Ports       []string          `yaml:"ports,omitempty"`
 }
 
+// PredefinedCaches maps the caches Bitbucket provides without a definition
+// to the directory they cache
+var PredefinedCaches = map[string]string{
+	"composer":   "~/.composer/cache",
+	"dotnetcore": "~/.nuget/packages",
+	"gradle":     "~/.gradle/caches",
+	"ivy2":       "~/.ivy2/cache",
+	"maven":      "~/.m2/repository",
+	"node":       "node_modules",
+	"pip":        "~/.cache/pip",
+	"sbt":        "~/.sbt",
+	"docker":     "/var/lib/docker",
+}
+
 // Cache represents a cache definition
 type Cache struct {
 	Key   string   `yaml:"key,omitempty"`
@@ -79,38 +364,70 @@ func (c *Cache) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		c.Path = str
 		return nil
 	}
-	
+
 	// If that fails, try to unmarshal as a struct
 	type cacheAlias Cache
 	var cache cacheAlias
 	if err := unmarshal(&cache); err != nil {
 		return err
 	}
-	
+
 	c.Key = cache.Key
 	c.Paths = cache.Paths
 	c.Path = cache.Path
 	return nil
 }
 
-// Artifacts represents artifacts configuration
+// MarshalYAML implements custom marshaling for Cache, writing simple
+// caches as their directory
+func (c Cache) MarshalYAML() (interface{}, error) {
+	if c.Key == "" && len(c.Paths) == 0 {
+		return c.Path, nil
+	}
+	type cacheAlias Cache
+	return cacheAlias(c), nil
+}
+
+// Artifacts represents artifacts configuration, written as a mapping or as
+// the list of its paths
 type Artifacts struct {
 	Paths []string `yaml:"paths"`
 }
 
+// UnmarshalYAML implements custom unmarshaling for Artifacts, which is
+// either a list of paths or a mapping
+func (a *Artifacts) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.SequenceNode {
+		return node.Decode(&a.Paths)
+	}
+	type artifactsAlias Artifacts
+	artifacts := artifactsAlias(*a)
+	if err := node.Decode(&artifacts); err != nil {
+		return err
+	}
+	*a = Artifacts(artifacts)
+	return nil
+}
+
 // Condition represents step execution condition
 type Condition struct {
-	Changesets *Changesets `yaml:"changesets,omitempty"`
+	Changesets *Changesets `yaml:"changesets,omitempty" json:"changesets,omitempty"`
 }
 
-// Changesets represents changeset conditions
+// Changesets represents changeset conditions. A step runs when at least one
+// changed file matches includePaths and none of excludePaths.
 type Changesets struct {
-	IncludePaths []string `yaml:"includePaths,omitempty"`
+	IncludePaths []string `yaml:"includePaths,omitempty" json:"include_paths,omitempty"`
+	ExcludePaths []string `yaml:"excludePaths,omitempty" json:"exclude_paths,omitempty"`
 }
 
+// StepSizes lists the sizes of steps, multiples of the memory and CPU of a
+// regular step
+var StepSizes = []string{"1x", "2x", "4x", "8x", "16x"}
+
 // Options represents pipeline options
 type Options struct {
-	Docker bool `yaml:"docker,omitempty"`
+	Docker bool   `yaml:"docker,omitempty"`
 	Size   string `yaml:"size,omitempty"`
 }
 
@@ -159,9 +476,9 @@ func (pc *PipelineConfig) Validate() error {
 	}
 
 	// Check if at least one pipeline is defined
-	if len(pc.Pipelines.Default) == 0 && len(pc.Pipelines.Branches) == 0 && 
-	   len(pc.Pipelines.PullRequests) == 0 && len(pc.Pipelines.Custom) == 0 && 
-	   len(pc.Pipelines.Tags) == 0 {
+	if len(pc.Pipelines.Default) == 0 && len(pc.Pipelines.Branches) == 0 &&
+		len(pc.Pipelines.PullRequests) == 0 && len(pc.Pipelines.Custom) == 0 &&
+		len(pc.Pipelines.Tags) == 0 {
 		return errors.New("no pipelines defined")
 	}
 
@@ -169,12 +486,37 @@ func (pc *PipelineConfig) Validate() error {
 }
 
 func (pc *PipelineConfig) validatePipeline(name string, pipeline Pipeline) error {
+	if pipeline.Import() != "" {
+		// Imported pipelines are validated with the file they come from
+		return nil
+	}
 	if len(pipeline) == 0 {
 		return fmt.Errorf("pipeline '%s' has no steps defined", name)
 	}
 
 	for i, stepWrapper := range pipeline {
-		if len(stepWrapper.Step.Script) == 0 {
+		if stepWrapper.Parallel != nil && len(stepWrapper.Parallel.Steps) == 0 {
+			return fmt.Errorf("parallel group %d in pipeline '%s' has no steps defined", i+1, name)
+		}
+		if stepWrapper.Stage != nil && len(stepWrapper.Stage.Steps) == 0 {
+			return fmt.Errorf("stage %d in pipeline '%s' has no steps defined", i+1, name)
+		}
+		if stepWrapper.Variables != nil {
+			if i > 0 || !strings.HasPrefix(name, "custom.") {
+				return fmt.Errorf("variables in pipeline '%s' must be the first entry of a custom pipeline", name)
+			}
+			if err := validateVariables(name, stepWrapper.Variables); err != nil {
+				return err
+			}
+		}
+	}
+
+	if len(pipeline.Steps()) == 0 {
+		return fmt.Errorf("pipeline '%s' has no steps defined", name)
+	}
+
+	for i, step := range pipeline.Steps() {
+		if len(step.Script) == 0 {
 			return fmt.Errorf("step %d in pipeline '%s' has no script defined", i+1, name)
 		}
 	}
@@ -182,6 +524,26 @@ func (pc *PipelineConfig) validatePipeline(name string, pipeline Pipeline) error
 	return nil
 }
 
+func validateVariables(pipeline string, variables []Variable) error {
+	seen := make(map[string]bool)
+	for i, variable := range variables {
+		if variable.Name == "" {
+			return fmt.Errorf("variable %d in pipeline '%s' has no name", i+1, pipeline)
+		}
+		if seen[variable.Name] {
+			return fmt.Errorf("variable '%s' is declared twice in pipeline '%s'", variable.Name, pipeline)
+		}
+		seen[variable.Name] = true
+
+		if variable.Default != "" {
+			if err := variable.Check(variable.Default); err != nil {
+				return fmt.Errorf("default of variable '%s' in pipeline '%s': %w", variable.Name, pipeline, err)
+			}
+		}
+	}
+	return nil
+}
+
 // GetDefaultPipeline returns the default pipeline if it exists
 func (pc *PipelineConfig) GetDefaultPipeline() (*Pipeline, bool) {
 	if pc.Pipelines == nil || len(pc.Pipelines.Default) == 0 {
@@ -200,4 +562,47 @@ func (pc *PipelineConfig) GetBranchPipeline(branch string) (*Pipeline, bool) {
 		return nil, false
 	}
 	return &pipeline, true
-}
\ No newline at end of file
+}
+
+// GetPullRequestPipeline returns the pull-requests pipeline for a source
+// branch together with the pattern that selected it. An exact branch name
+// wins over glob patterns, and the catch-all "**" is only used when no other
+// pattern matches.
+func (pc *PipelineConfig) GetPullRequestPipeline(sourceBranch string) (*Pipeline, string, bool) {
+	if pc.Pipelines == nil {
+		return nil, "", false
+	}
+	pattern, ok := matchBranchPattern(pc.Pipelines.PullRequests, sourceBranch)
+	if !ok {
+		return nil, "", false
+	}
+	pipeline := pc.Pipelines.PullRequests[pattern]
+	return &pipeline, pattern, true
+}
+
+// matchBranchPattern returns the most specific pattern of pipelines that
+// matches branch
+func matchBranchPattern(pipelines map[string]Pipeline, branch string) (string, bool) {
+	if _, ok := pipelines[branch]; ok {
+		return branch, true
+	}
+
+	patterns := make([]string, 0, len(pipelines))
+	for pattern := range pipelines {
+		if pattern != "**" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	sort.Strings(patterns)
+
+	for _, pattern := range patterns {
+		if glob.Match(pattern, branch) {
+			return pattern, true
+		}
+	}
+
+	if _, ok := pipelines["**"]; ok {
+		return "**", true
+	}
+	return "", false
+}
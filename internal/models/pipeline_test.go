@@ -4,6 +4,8 @@
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
 )
 
 func TestPipelineConfig_Validate(t *testing.T) {
@@ -148,11 +150,53 @@ func TestPipelineConfig_GetBranchPipeline(t *testing.T) {
 	})
 }
 
+func TestPipelineConfig_GetPullRequestPipeline(t *testing.T) {
+	step := func(script string) Pipeline {
+		return Pipeline{{Step: Step{Script: []string{script}}}}
+	}
+	config := &PipelineConfig{
+		Pipelines: &Pipelines{
+			PullRequests: map[string]Pipeline{
+				"**":                 step("any"),
+				"feature/*":          step("feature"),
+				"feature/login":      step("login"),
+				"{bugfix,hotfix}/**": step("fix"),
+			},
+		},
+	}
+
+	tests := []struct {
+		branch  string
+		pattern string
+	}{
+		{"feature/login", "feature/login"},
+		{"feature/signup", "feature/*"},
+		{"hotfix/api/timeout", "{bugfix,hotfix}/**"},
+		{"feature/nested/branch", "**"},
+		{"main", "**"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.branch, func(t *testing.T) {
+			pipeline, pattern, exists := config.GetPullRequestPipeline(tt.branch)
+			assert.True(t, exists)
+			assert.Equal(t, tt.pattern, pattern)
+			assert.Equal(t, config.Pipelines.PullRequests[tt.pattern], *pipeline)
+		})
+	}
+
+	t.Run("no matching pattern", func(t *testing.T) {
+		delete(config.Pipelines.PullRequests, "**")
+		_, _, exists := config.GetPullRequestPipeline("main")
+		assert.False(t, exists)
+	})
+}
+
 func TestStep_Validation(t *testing.T) {
 	t.Run("step with all fields", func(t *testing.T) {
 		step := Step{
 			Name:   "Complete step",
-			Image:  "ubuntu:20.04",
+			Image:  Image{Name: "ubuntu:20.04"},
 			Script: []string{"echo 'test'", "ls -la"},
 			Services: []string{"postgres", "redis"},
 			Caches: []string{"node", "pip"},
@@ -163,7 +207,7 @@ func TestStep_Validation(t *testing.T) {
 		}
 
 		assert.Equal(t, "Complete step", step.Name)
-		assert.Equal(t, "ubuntu:20.04", step.Image)
+		assert.Equal(t, "ubuntu:20.04", step.Image.Name)
 		assert.Len(t, step.Script, 2)
 		assert.Contains(t, step.Services, "postgres")
 		assert.Contains(t, step.Caches, "node")
@@ -180,4 +224,95 @@ func TestStep_Validation(t *testing.T) {
 		assert.Len(t, step.Script, 1)
 		assert.Empty(t, step.Services)
 	})
-}
\ No newline at end of file
+}
+func TestStepWrapper_Definitions(t *testing.T) {
+	content := `definitions:
+  steps:
+    - step: &build
+        name: Build
+        image: golang:1.21
+        script: [go build ./...]
+pipelines:
+  default:
+    - step: *build
+    - step:
+        <<: *build
+        name: Test
+        script: [go test ./...]
+    - parallel:
+        - step:
+            <<: [*build]
+        - step:
+            script: [make lint]
+`
+	var config PipelineConfig
+	require.NoError(t, yaml.Unmarshal([]byte(content), &config))
+
+	require.Len(t, config.Definitions.Steps, 1)
+	assert.Equal(t, "Build", config.Definitions.Steps[0].Step.Name)
+	assert.Empty(t, config.Definitions.Steps[0].Step.Definition)
+
+	steps := config.Pipelines.Default.Steps()
+	require.Len(t, steps, 4)
+	assert.Equal(t, Step{Name: "Build", Image: Image{Name: "golang:1.21"}, Script: []string{"go build ./..."}, Definition: "build"}, steps[0])
+	assert.Equal(t, Step{Name: "Test", Image: Image{Name: "golang:1.21"}, Script: []string{"go test ./..."}, Definition: "build"}, steps[1])
+	assert.Equal(t, "build", steps[2].Definition)
+	assert.Equal(t, "Build", steps[2].Name)
+	assert.Empty(t, steps[3].Definition)
+}
+
+func TestPipeline_Import(t *testing.T) {
+	content := `export: true
+definitions:
+  pipelines:
+    build:
+      - step:
+          script: [mvn verify]
+pipelines:
+  default:
+    - step:
+        script: [make]
+  custom:
+    shared:
+      import: shared-pipelines:master:build
+`
+	var config PipelineConfig
+	require.NoError(t, yaml.Unmarshal([]byte(content), &config))
+
+	assert.True(t, config.Export)
+	assert.Empty(t, config.Pipelines.Default.Import())
+	assert.Empty(t, config.Definitions.Pipelines["build"].Import())
+	assert.Len(t, config.Definitions.Pipelines["build"].Steps(), 1)
+
+	shared := config.Pipelines.Custom["shared"]
+	assert.Equal(t, "shared-pipelines:master:build", shared.Import())
+	assert.Empty(t, shared.Steps())
+	assert.NoError(t, config.Validate())
+}
+
+func TestCloneConfig_YAML(t *testing.T) {
+	var config PipelineConfig
+	require.NoError(t, yaml.Unmarshal([]byte("clone:\n  depth: full\n  lfs: true\n"), &config))
+	assert.Equal(t, &CloneConfig{Depth: CloneDepthFull, Lfs: true}, config.Clone)
+
+	data, err := yaml.Marshal(config.Clone)
+	require.NoError(t, err)
+	assert.Equal(t, "lfs: true\ndepth: full\n", string(data))
+
+	// Overrides keep the fields they do not set
+	clone := CloneConfig{Depth: 50, Lfs: true}
+	require.NoError(t, yaml.Unmarshal([]byte("enabled: true\n"), &clone))
+	assert.Equal(t, CloneConfig{Enabled: true, Depth: 50, Lfs: true}, clone)
+	require.NoError(t, yaml.Unmarshal([]byte("depth: full\n"), &clone))
+	assert.Equal(t, CloneConfig{Enabled: true, Depth: CloneDepthFull, Lfs: true}, clone)
+}
+
+func TestArtifacts_YAML(t *testing.T) {
+	var step Step
+	require.NoError(t, yaml.Unmarshal([]byte("script: [make]\nartifacts: [dist/**]\n"), &step))
+	assert.Equal(t, &Artifacts{Paths: []string{"dist/**"}}, step.Artifacts)
+
+	step = Step{}
+	require.NoError(t, yaml.Unmarshal([]byte("script: [make]\nartifacts:\n  paths: [dist/**]\n"), &step))
+	assert.Equal(t, &Artifacts{Paths: []string{"dist/**"}}, step.Artifacts)
+}
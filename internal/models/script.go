@@ -0,0 +1,187 @@
+package models
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Pipe is a script entry running a pipe: a container image performing a
+// task configured by variables. Scripts hold their pipes as entries written
+// as the flow mapping of the pipe, such as
+// {pipe: 'atlassian/aws-s3-deploy:1.1.0', variables: {S3_BUCKET: my-bucket}}.
+type Pipe struct {
+	Name      string                 `yaml:"pipe"`
+	Variables map[string]interface{} `yaml:"variables,omitempty"`
+}
+
+// pipePrefix starts the script entries of pipes
+const pipePrefix = "{pipe: "
+
+// ParsePipe returns the pipe a script entry runs, and whether it runs one
+func ParsePipe(entry string) (Pipe, bool) {
+	if !strings.HasPrefix(entry, pipePrefix) {
+		return Pipe{}, false
+	}
+	var pipe Pipe
+	if err := yaml.Unmarshal([]byte(entry), &pipe); err != nil || pipe.Name == "" {
+		return Pipe{}, false
+	}
+	return pipe, true
+}
+
+// String returns the script entry of the pipe
+func (p Pipe) String() string {
+	node, err := p.node()
+	if err == nil {
+		node.Style = yaml.FlowStyle
+		var data []byte
+		if data, err = yaml.Marshal(node); err == nil {
+			return strings.TrimSpace(string(data))
+		}
+	}
+	return pipePrefix + p.Name + "}"
+}
+
+// node returns the mapping of the pipe
+func (p Pipe) node() (*yaml.Node, error) {
+	var node yaml.Node
+	if err := node.Encode(p); err != nil {
+		return nil, err
+	}
+	return &node, nil
+}
+
+// Image returns the image the pipe runs: the image of docker://<image>,
+// bitbucketpipelines/<name> for the pipes of Atlassian, atlassian/<name>,
+// and the name of the pipe itself for the others, which publish their
+// image under the same name
+func (p Pipe) Image() string {
+	if image, ok := strings.CutPrefix(p.Name, "docker://"); ok {
+		return image
+	}
+	if name, ok := strings.CutPrefix(p.Name, "atlassian/"); ok {
+		return "bitbucketpipelines/" + name
+	}
+	return p.Name
+}
+
+// Environment returns the variables of the pipe as environment variables,
+// expanding the variables of env they reference. Lists are passed as
+// Bitbucket does, as <NAME>_COUNT and <NAME>_<index>.
+func (p Pipe) Environment(env map[string]string) map[string]string {
+	expand := func(value interface{}) string {
+		return os.Expand(fmt.Sprint(value), func(name string) string { return env[name] })
+	}
+	variables := make(map[string]string, len(p.Variables))
+	for name, value := range p.Variables {
+		switch value := value.(type) {
+		case nil:
+		case []interface{}:
+			variables[name+"_COUNT"] = strconv.Itoa(len(value))
+			for i, item := range value {
+				variables[name+"_"+strconv.Itoa(i)] = expand(item)
+			}
+		default:
+			variables[name] = expand(value)
+		}
+	}
+	return variables
+}
+
+// UnmarshalYAML implements custom unmarshaling for Step, turning the pipes
+// of its script and after-script into their entries
+func (s *Step) UnmarshalYAML(node *yaml.Node) error {
+	type stepAlias Step
+	return scriptsAsText(node).Decode((*stepAlias)(s))
+}
+
+// MarshalYAML implements custom marshaling for Step, writing the pipes of
+// its script and after-script as mappings
+func (s Step) MarshalYAML() (interface{}, error) {
+	type stepAlias Step
+	var node yaml.Node
+	if err := node.Encode(stepAlias(s)); err != nil {
+		return nil, err
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if key := node.Content[i].Value; key != "script" && key != "after-script" {
+			continue
+		}
+		for j, entry := range node.Content[i+1].Content {
+			if pipe, ok := ParsePipe(entry.Value); ok {
+				mapping, err := pipe.node()
+				if err != nil {
+					return nil, err
+				}
+				node.Content[i+1].Content[j] = mapping
+			}
+		}
+	}
+	return &node, nil
+}
+
+// scriptsAsText returns a step mapping whose script and after-script hold
+// their pipes as entries, copying the nodes it changes. The steps it merges
+// with << are converted too.
+func scriptsAsText(node *yaml.Node) *yaml.Node {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if node.Kind != yaml.MappingNode {
+		return node
+	}
+
+	copied := *node
+	copied.Content = append([]*yaml.Node(nil), node.Content...)
+	for i := 0; i+1 < len(copied.Content); i += 2 {
+		switch value := copied.Content[i+1]; copied.Content[i].Value {
+		case "script", "after-script":
+			copied.Content[i+1] = pipesAsText(value)
+		case "<<":
+			if value.Kind != yaml.SequenceNode {
+				copied.Content[i+1] = scriptsAsText(value)
+				continue
+			}
+			merged := *value
+			merged.Content = make([]*yaml.Node, len(value.Content))
+			for j, item := range value.Content {
+				merged.Content[j] = scriptsAsText(item)
+			}
+			copied.Content[i+1] = &merged
+		}
+	}
+	return &copied
+}
+
+// pipesAsText returns a copy of a script whose pipes are replaced by their
+// entries. Mappings that are not pipes are left to fail decoding.
+func pipesAsText(node *yaml.Node) *yaml.Node {
+	if node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if node.Kind != yaml.SequenceNode {
+		return node
+	}
+
+	copied := *node
+	copied.Content = make([]*yaml.Node, len(node.Content))
+	for i, item := range node.Content {
+		copied.Content[i] = item
+		if item.Kind == yaml.AliasNode {
+			item = item.Alias
+		}
+		if item.Kind != yaml.MappingNode {
+			continue
+		}
+		var pipe Pipe
+		if err := item.Decode(&pipe); err != nil || pipe.Name == "" {
+			continue
+		}
+		copied.Content[i] = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: pipe.String(), Line: item.Line, Column: item.Column}
+	}
+	return &copied
+}
@@ -0,0 +1,73 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestStep_Pipes(t *testing.T) {
+	content := `definitions:
+  steps:
+    - step: &deploy
+        name: Deploy
+        script:
+          - make
+          - pipe: atlassian/aws-s3-deploy:1.1.0
+            variables:
+              S3_BUCKET: my-bucket
+              EXTRA_ARGS: [--delete]
+        after-script:
+          - pipe: docker://alpine:3.19
+pipelines:
+  default:
+    - step:
+        <<: *deploy
+        name: Deploy again
+`
+	var config PipelineConfig
+	require.NoError(t, yaml.Unmarshal([]byte(content), &config))
+	step := config.Pipelines.Default.Steps()[0]
+	assert.Equal(t, "Deploy again", step.Name)
+	require.Len(t, step.Script, 2)
+	assert.Equal(t, "make", step.Script[0])
+
+	pipe, ok := ParsePipe(step.Script[1])
+	require.True(t, ok, step.Script[1])
+	assert.Equal(t, Pipe{
+		Name:      "atlassian/aws-s3-deploy:1.1.0",
+		Variables: map[string]interface{}{"S3_BUCKET": "my-bucket", "EXTRA_ARGS": []interface{}{"--delete"}},
+	}, pipe)
+	assert.Equal(t, "bitbucketpipelines/aws-s3-deploy:1.1.0", pipe.Image())
+	assert.Equal(t, map[string]string{"S3_BUCKET": "my-bucket", "EXTRA_ARGS_COUNT": "1", "EXTRA_ARGS_0": "--delete"}, pipe.Environment(nil))
+
+	pipe, ok = ParsePipe(step.AfterScript[0])
+	require.True(t, ok, step.AfterScript[0])
+	assert.Equal(t, "alpine:3.19", pipe.Image())
+
+	// Pipes are written back as mappings
+	data, err := yaml.Marshal(step)
+	require.NoError(t, err)
+	var again map[string]interface{}
+	require.NoError(t, yaml.Unmarshal(data, &again))
+	assert.Equal(t, []interface{}{"make", map[string]interface{}{
+		"pipe":      "atlassian/aws-s3-deploy:1.1.0",
+		"variables": map[string]interface{}{"S3_BUCKET": "my-bucket", "EXTRA_ARGS": []interface{}{"--delete"}},
+	}}, again["script"])
+}
+
+func TestParsePipe(t *testing.T) {
+	pipe := Pipe{Name: "sonarsource/sonarcloud-scan:2.0.0", Variables: map[string]interface{}{"SONAR_TOKEN": "$SONAR_TOKEN"}}
+	parsed, ok := ParsePipe(pipe.String())
+	require.True(t, ok, pipe.String())
+	assert.Equal(t, pipe, parsed)
+	assert.Equal(t, "sonarsource/sonarcloud-scan:2.0.0", parsed.Image())
+	assert.Equal(t, map[string]string{"SONAR_TOKEN": "s3cr3t"}, parsed.Environment(map[string]string{"SONAR_TOKEN": "s3cr3t"}))
+
+	for _, entry := range []string{"make", "echo {pipe: x}", "{pipe: }"} {
+		_, ok := ParsePipe(entry)
+		assert.False(t, ok, entry)
+	}
+}
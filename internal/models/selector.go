@@ -0,0 +1,178 @@
+package models
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"bitbucket-runner/internal/suggest"
+)
+
+// PipelineKind is a section of the pipelines configuration
+type PipelineKind string
+
+const (
+	PipelineKindDefault      PipelineKind = "default"
+	PipelineKindBranches     PipelineKind = "branches"
+	PipelineKindTags         PipelineKind = "tags"
+	PipelineKindPullRequests PipelineKind = "pull-requests"
+	PipelineKindCustom       PipelineKind = "custom"
+)
+
+// PipelineKinds lists the pipeline kinds in display order
+var PipelineKinds = []PipelineKind{
+	PipelineKindDefault,
+	PipelineKindBranches,
+	PipelineKindTags,
+	PipelineKindPullRequests,
+	PipelineKindCustom,
+}
+
+// Selector identifies a pipeline, written "default" or "<kind>:<name>" as in
+// "branches:main", "tags:v*", "pull-requests:feature/*" or "custom:deploy"
+type Selector struct {
+	Kind PipelineKind
+	Name string
+}
+
+// ParseSelector parses a pipeline selector
+func ParseSelector(value string) (Selector, error) {
+	if value == string(PipelineKindDefault) {
+		return Selector{Kind: PipelineKindDefault}, nil
+	}
+
+	kind, name, ok := strings.Cut(value, ":")
+	if !ok || name == "" {
+		if isKind(kind) {
+			return Selector{}, fmt.Errorf("pipeline selector '%s' has no name, expected %s:<name>", value, kind)
+		}
+		return Selector{}, fmt.Errorf("invalid pipeline selector '%s', expected default or <kind>:<name> with kind one of %s%s",
+			value, kindList(), kindHint(kind))
+	}
+	if !isKind(kind) || kind == string(PipelineKindDefault) {
+		return Selector{}, fmt.Errorf("unknown pipeline kind '%s' in selector '%s', expected one of %s%s",
+			kind, value, kindList(), kindHint(kind))
+	}
+
+	return Selector{Kind: PipelineKind(kind), Name: name}, nil
+}
+
+// String returns the selector in its textual form
+func (s Selector) String() string {
+	if s.Kind == PipelineKindDefault {
+		return string(PipelineKindDefault)
+	}
+	return string(s.Kind) + ":" + s.Name
+}
+
+// Selectors returns the selectors of all defined pipelines, grouped by kind
+// in display order and sorted by name within a kind
+func (pc *PipelineConfig) Selectors() []Selector {
+	if pc.Pipelines == nil {
+		return nil
+	}
+
+	var selectors []Selector
+	if len(pc.Pipelines.Default) > 0 {
+		selectors = append(selectors, Selector{Kind: PipelineKindDefault})
+	}
+	for _, kind := range PipelineKinds[1:] {
+		pipelines := pc.pipelinesOf(kind)
+		names := make([]string, 0, len(pipelines))
+		for name := range pipelines {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			selectors = append(selectors, Selector{Kind: kind, Name: name})
+		}
+	}
+	return selectors
+}
+
+// Select returns the pipeline identified by a selector, together with the
+// selector of the pipeline definition. Branch and tag selectors name either
+// a pattern of the configuration or a concrete branch or tag, which is
+// matched against the patterns as Bitbucket does.
+func (pc *PipelineConfig) Select(selector Selector) (Pipeline, Selector, error) {
+	if selector.Kind == PipelineKindDefault {
+		if pc.Pipelines == nil || len(pc.Pipelines.Default) == 0 {
+			return nil, selector, pc.notDefined(selector)
+		}
+		return pc.Pipelines.Default, selector, nil
+	}
+
+	pipelines := pc.pipelinesOf(selector.Kind)
+	if pipeline, ok := pipelines[selector.Name]; ok {
+		return pipeline, selector, nil
+	}
+
+	if selector.Kind != PipelineKindCustom {
+		if pattern, ok := matchBranchPattern(pipelines, selector.Name); ok {
+			return pipelines[pattern], Selector{Kind: selector.Kind, Name: pattern}, nil
+		}
+	}
+	return nil, selector, pc.notDefined(selector)
+}
+
+// notDefined builds the error for a selector without pipeline, suggesting
+// the closest defined pipeline
+func (pc *PipelineConfig) notDefined(selector Selector) error {
+	var available []string
+	for _, defined := range pc.Selectors() {
+		available = append(available, defined.String())
+	}
+
+	if match, ok := suggest.Closest(selector.String(), available); ok {
+		return fmt.Errorf("pipeline '%s' is not defined, did you mean '%s'?", selector, match)
+	}
+	if len(available) == 0 {
+		return fmt.Errorf("pipeline '%s' is not defined, no pipelines are defined", selector)
+	}
+	return fmt.Errorf("pipeline '%s' is not defined, available pipelines: %s", selector, strings.Join(available, ", "))
+}
+
+func (pc *PipelineConfig) pipelinesOf(kind PipelineKind) map[string]Pipeline {
+	if pc.Pipelines == nil {
+		return nil
+	}
+	switch kind {
+	case PipelineKindBranches:
+		return pc.Pipelines.Branches
+	case PipelineKindTags:
+		return pc.Pipelines.Tags
+	case PipelineKindPullRequests:
+		return pc.Pipelines.PullRequests
+	case PipelineKindCustom:
+		return pc.Pipelines.Custom
+	}
+	return nil
+}
+
+func isKind(value string) bool {
+	for _, kind := range PipelineKinds {
+		if value == string(kind) {
+			return true
+		}
+	}
+	return false
+}
+
+func kindNames() []string {
+	kinds := make([]string, len(PipelineKinds))
+	for i, kind := range PipelineKinds {
+		kinds[i] = string(kind)
+	}
+	return kinds
+}
+
+func kindList() string {
+	return strings.Join(kindNames(), ", ")
+}
+
+func kindHint(value string) string {
+	if match, ok := suggest.Closest(value, kindNames()); ok {
+		return fmt.Sprintf(", did you mean '%s'?", match)
+	}
+	return ""
+}
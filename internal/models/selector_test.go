@@ -0,0 +1,104 @@
+package models
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSelector(t *testing.T) {
+	valid := map[string]Selector{
+		"default":                 {Kind: PipelineKindDefault},
+		"branches:main":           {Kind: PipelineKindBranches, Name: "main"},
+		"tags:v*":                 {Kind: PipelineKindTags, Name: "v*"},
+		"pull-requests:feature/*": {Kind: PipelineKindPullRequests, Name: "feature/*"},
+		"custom:deploy:prod":      {Kind: PipelineKindCustom, Name: "deploy:prod"},
+	}
+	for value, want := range valid {
+		t.Run(value, func(t *testing.T) {
+			selector, err := ParseSelector(value)
+			require.NoError(t, err)
+			assert.Equal(t, want, selector)
+			assert.Equal(t, value, selector.String())
+		})
+	}
+
+	invalid := map[string]string{
+		"branch:main": "unknown pipeline kind 'branch' in selector 'branch:main', expected one of default, branches, tags, pull-requests, custom, did you mean 'branches'?",
+		"custom:":     "pipeline selector 'custom:' has no name, expected custom:<name>",
+		"deploy":      "invalid pipeline selector 'deploy', expected default or <kind>:<name>",
+		"defualt":     "did you mean 'default'?",
+		"default:x":   "unknown pipeline kind 'default'",
+	}
+	for value, message := range invalid {
+		t.Run(value, func(t *testing.T) {
+			_, err := ParseSelector(value)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), message)
+		})
+	}
+}
+
+func TestPipelineConfig_Select(t *testing.T) {
+	pipeline := func(script string) Pipeline {
+		return Pipeline{{Step: Step{Script: []string{script}}}}
+	}
+	config := &PipelineConfig{
+		Pipelines: &Pipelines{
+			Default:  pipeline("default"),
+			Branches: map[string]Pipeline{"main": pipeline("main"), "release/*": pipeline("release")},
+			Tags:     map[string]Pipeline{"v*": pipeline("tag")},
+			Custom:   map[string]Pipeline{"deploy": pipeline("deploy"), "backup": pipeline("backup")},
+		},
+	}
+
+	t.Run("selectors in display order", func(t *testing.T) {
+		var selectors []string
+		for _, selector := range config.Selectors() {
+			selectors = append(selectors, selector.String())
+		}
+		assert.Equal(t, []string{"default", "branches:main", "branches:release/*", "tags:v*", "custom:backup", "custom:deploy"}, selectors)
+	})
+
+	tests := []struct {
+		selector string
+		selected string
+		script   string
+	}{
+		{"default", "default", "default"},
+		{"branches:release/*", "branches:release/*", "release"},
+		{"branches:release/1.0", "branches:release/*", "release"},
+		{"tags:v2.1.0", "tags:v*", "tag"},
+		{"custom:deploy", "custom:deploy", "deploy"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.selector, func(t *testing.T) {
+			selector, err := ParseSelector(tt.selector)
+			require.NoError(t, err)
+
+			selected, actual, err := config.Select(selector)
+			require.NoError(t, err)
+			assert.Equal(t, tt.selected, actual.String())
+			assert.Equal(t, []string{tt.script}, selected.Steps()[0].Script)
+		})
+	}
+
+	t.Run("did you mean", func(t *testing.T) {
+		_, _, err := config.Select(Selector{Kind: PipelineKindCustom, Name: "deplyo"})
+		require.Error(t, err)
+		assert.Equal(t, "pipeline 'custom:deplyo' is not defined, did you mean 'custom:deploy'?", err.Error())
+	})
+
+	t.Run("no similar pipeline", func(t *testing.T) {
+		_, _, err := config.Select(Selector{Kind: PipelineKindBranches, Name: "develop"})
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "available pipelines: default, branches:main")
+	})
+
+	t.Run("patterns of custom pipelines are not matched", func(t *testing.T) {
+		config.Pipelines.Custom["deploy-*"] = pipeline("glob")
+		_, _, err := config.Select(Selector{Kind: PipelineKindCustom, Name: "deploy-prod"})
+		assert.Error(t, err)
+	})
+}
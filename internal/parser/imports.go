@@ -0,0 +1,288 @@
+package parser
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"bitbucket-runner/internal/git"
+	"bitbucket-runner/internal/models"
+	"bitbucket-runner/internal/suggest"
+	"bitbucket-runner/internal/validation"
+	"gopkg.in/yaml.v3"
+)
+
+// sharedPipelineFile is the configuration read from shared repositories
+const sharedPipelineFile = "bitbucket-pipelines.yml"
+
+// Importer resolves the pipelines a configuration imports from shared
+// repositories. Repositories are mapped by name to a clone on disk, a work
+// tree or a bare repository, read at the ref of the import without touching
+// the clone. A directory outside git is read as it is, whatever the ref.
+// Configurations are cached by repository and ref, so each is read once
+// however many pipelines import from it.
+type Importer struct {
+	repositories map[string]string
+	options      validation.Options
+	configs      map[string]*models.PipelineConfig
+}
+
+// NewImporter creates an Importer reading the repositories from the given
+// clone directories, and validating their configurations with options
+func NewImporter(repositories map[string]string, options validation.Options) *Importer {
+	return &Importer{
+		repositories: repositories,
+		options:      options,
+		configs:      make(map[string]*models.PipelineConfig),
+	}
+}
+
+// Resolve replaces the imported pipelines of config with the pipelines they
+// import. The services and caches of the shared configurations that config
+// does not define are added to its definitions.
+func (im *Importer) Resolve(ctx context.Context, config *models.PipelineConfig) error {
+	for _, selector := range config.Selectors() {
+		pipeline, _, err := config.Select(selector)
+		if err != nil || pipeline.Import() == "" {
+			continue
+		}
+
+		resolved, err := im.resolve(ctx, config, pipeline.Import(), nil)
+		if err != nil {
+			return fmt.Errorf("failed to import pipeline '%s': %w", selector, err)
+		}
+		setPipeline(config, selector, resolved)
+	}
+	return nil
+}
+
+// setPipeline replaces the pipeline a selector names, which config defines
+func setPipeline(config *models.PipelineConfig, selector models.Selector, pipeline models.Pipeline) {
+	switch selector.Kind {
+	case models.PipelineKindDefault:
+		config.Pipelines.Default = pipeline
+	case models.PipelineKindBranches:
+		config.Pipelines.Branches[selector.Name] = pipeline
+	case models.PipelineKindTags:
+		config.Pipelines.Tags[selector.Name] = pipeline
+	case models.PipelineKindPullRequests:
+		config.Pipelines.PullRequests[selector.Name] = pipeline
+	case models.PipelineKindCustom:
+		config.Pipelines.Custom[selector.Name] = pipeline
+	}
+}
+
+// resolve returns the pipeline an import names, following the imports of
+// shared pipelines. chain lists the imports being resolved, which an import
+// cannot name again.
+func (im *Importer) resolve(ctx context.Context, config *models.PipelineConfig, value string, chain []string) (models.Pipeline, error) {
+	imported, err := models.ParseImport(value)
+	if err != nil {
+		return nil, err
+	}
+	for i, previous := range chain {
+		if previous == imported.String() {
+			cycle := append(chain[i:len(chain):len(chain)], imported.String())
+			return nil, fmt.Errorf("import cycle: %s", strings.Join(cycle, " -> "))
+		}
+	}
+	chain = append(chain, imported.String())
+
+	shared, err := im.load(ctx, imported.Repository, imported.Ref)
+	if err != nil {
+		return nil, err
+	}
+	var exported map[string]models.Pipeline
+	if shared.Definitions != nil {
+		exported = shared.Definitions.Pipelines
+	}
+	pipeline, ok := exported[imported.Pipeline]
+	if !ok {
+		return nil, notExported(imported, exported)
+	}
+	if pipeline.Import() != "" {
+		return im.resolve(ctx, config, pipeline.Import(), chain)
+	}
+
+	addDefinitions(config, shared.Definitions)
+	return pipeline, nil
+}
+
+// load returns the configuration of a repository at a ref, which must
+// export its pipelines
+func (im *Importer) load(ctx context.Context, repository, ref string) (*models.PipelineConfig, error) {
+	key := repository + ":" + ref
+	if config, ok := im.configs[key]; ok {
+		return config, nil
+	}
+
+	dir, ok := im.repositories[repository]
+	if !ok {
+		return nil, im.notMapped(repository)
+	}
+	data, file, err := readShared(ctx, dir, ref)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read repository '%s': %w", repository, err)
+	}
+	if err := validation.ValidatePipelineConfig(file, data, im.options).Err(); err != nil {
+		return nil, err
+	}
+
+	var config models.PipelineConfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal %s: %w", file, err)
+	}
+	if !config.Export {
+		return nil, fmt.Errorf("repository '%s' does not export its pipelines, %s needs 'export: true'", repository, file)
+	}
+	if config.Image.Name != "" && config.Definitions != nil {
+		// Shared steps run in the image of their own configuration
+		for _, pipeline := range config.Definitions.Pipelines {
+			for _, step := range stepsOf(pipeline) {
+				if step.Image.Name == "" {
+					step.Image = config.Image
+				}
+			}
+		}
+	}
+
+	im.configs[key] = &config
+	return &config, nil
+}
+
+// readShared reads the pipeline configuration of a clone at a ref, falling
+// back to the branch of the origin remote for clones that never checked out
+// the branch. It returns the content and the name of the file.
+func readShared(ctx context.Context, dir, ref string) ([]byte, string, error) {
+	repo, err := git.Open(ctx, dir)
+	if err != nil && !errors.Is(err, git.ErrNotRepository) {
+		return nil, "", err
+	}
+	if err != nil || !isRoot(repo, dir) {
+		file := filepath.Join(dir, sharedPipelineFile)
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, "", fmt.Errorf("failed to read %s: %w", file, err)
+		}
+		return data, file, nil
+	}
+
+	revision := ref
+	if _, err := repo.ResolveRevision(ctx, revision); err != nil {
+		revision = "origin/" + ref
+		if _, err := repo.ResolveRevision(ctx, revision); err != nil {
+			return nil, "", fmt.Errorf("ref '%s' not found in %s", ref, dir)
+		}
+	}
+	data, err := repo.ReadFile(ctx, revision, sharedPipelineFile)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, ref + ":" + filepath.Join(dir, sharedPipelineFile), nil
+}
+
+// isRoot reports whether dir is the root of repo rather than a directory
+// within it
+func isRoot(repo *git.Repository, dir string) bool {
+	if repo.Dir == dir {
+		// Bare repositories keep the directory they are opened with
+		return true
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		abs = resolved
+	}
+	top, err := filepath.EvalSymlinks(repo.Dir)
+	if err != nil {
+		top = repo.Dir
+	}
+	return abs == top
+}
+
+// stepsOf returns pointers to the steps of a pipeline, with the steps of
+// parallel groups and stages
+func stepsOf(pipeline models.Pipeline) []*models.Step {
+	var steps []*models.Step
+	for i := range pipeline {
+		entry := &pipeline[i]
+		switch {
+		case entry.Parallel != nil:
+			for j := range entry.Parallel.Steps {
+				steps = append(steps, &entry.Parallel.Steps[j].Step)
+			}
+		case entry.Stage != nil:
+			for j := range entry.Stage.Steps {
+				steps = append(steps, &entry.Stage.Steps[j].Step)
+			}
+		case entry.Variables == nil && entry.Import == "":
+			steps = append(steps, &entry.Step)
+		}
+	}
+	return steps
+}
+
+// addDefinitions adds the services and caches of shared definitions that
+// config does not define, which the imported steps may use
+func addDefinitions(config *models.PipelineConfig, shared *models.Definitions) {
+	if len(shared.Services) == 0 && len(shared.Caches) == 0 {
+		return
+	}
+	if config.Definitions == nil {
+		config.Definitions = &models.Definitions{}
+	}
+	for name, service := range shared.Services {
+		if config.Definitions.Services == nil {
+			config.Definitions.Services = make(map[string]models.Service)
+		}
+		if _, ok := config.Definitions.Services[name]; !ok {
+			config.Definitions.Services[name] = service
+		}
+	}
+	for name, cache := range shared.Caches {
+		if config.Definitions.Caches == nil {
+			config.Definitions.Caches = make(map[string]models.Cache)
+		}
+		if _, ok := config.Definitions.Caches[name]; !ok {
+			config.Definitions.Caches[name] = cache
+		}
+	}
+}
+
+// notMapped builds the error for a repository without clone, suggesting
+// the closest mapped repository
+func (im *Importer) notMapped(repository string) error {
+	names := make([]string, 0, len(im.repositories))
+	for name := range im.repositories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if match, ok := suggest.Closest(repository, names); ok {
+		return fmt.Errorf("repository '%s' is not in the imports of the runner configuration, did you mean '%s'?", repository, match)
+	}
+	return fmt.Errorf("repository '%s' is not in the imports of the runner configuration, map it to the directory of a clone", repository)
+}
+
+// notExported builds the error for a pipeline missing from the definitions
+// of a shared configuration
+func notExported(imported models.Import, exported map[string]models.Pipeline) error {
+	names := make([]string, 0, len(exported))
+	for name := range exported {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	where := imported.Repository + ":" + imported.Ref
+	if match, ok := suggest.Closest(imported.Pipeline, names); ok {
+		return fmt.Errorf("pipeline '%s' is not exported by %s, did you mean '%s'?", imported.Pipeline, where, match)
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("pipeline '%s' is not exported by %s, it defines no pipelines in definitions", imported.Pipeline, where)
+	}
+	return fmt.Errorf("pipeline '%s' is not exported by %s, exported pipelines: %s", imported.Pipeline, where, strings.Join(names, ", "))
+}
@@ -0,0 +1,203 @@
+package parser
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"bitbucket-runner/internal/models"
+	"bitbucket-runner/internal/validation"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+// sharedConfig writes a shared pipeline configuration into a new directory
+func sharedConfig(t *testing.T, content string) string {
+	t.Helper()
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "bitbucket-pipelines.yml"), []byte(content), 0644))
+	return dir
+}
+
+func importingConfig(t *testing.T, content string) *models.PipelineConfig {
+	t.Helper()
+	var config models.PipelineConfig
+	require.NoError(t, yaml.Unmarshal([]byte(content), &config))
+	return &config
+}
+
+func TestImporter_Resolve(t *testing.T) {
+	ctx := context.Background()
+	shared := sharedConfig(t, `export: true
+image: maven:3.9
+definitions:
+  services:
+    postgres:
+      image: postgres:15
+  caches:
+    wrapper: ~/.m2/wrapper
+  pipelines:
+    build:
+      - variables:
+          - name: Goal
+            default: verify
+      - step:
+          name: Build
+          caches: [maven, wrapper]
+          services: [postgres]
+          script: [mvn $Goal]
+      - parallel:
+          - step:
+              image: alpine
+              script: [./lint.sh]
+          - step:
+              script: [mvn site]
+    release:
+      import: shared-pipelines:main:build
+`)
+
+	config := importingConfig(t, `definitions:
+  services:
+    postgres:
+      image: postgres:16
+pipelines:
+  default:
+    - step:
+        script: [make]
+  branches:
+    main:
+      import: shared-pipelines:main:release
+  custom:
+    build:
+      import: shared-pipelines:v2:build
+`)
+	importer := NewImporter(map[string]string{"shared-pipelines": shared}, validation.Options{})
+	require.NoError(t, importer.Resolve(ctx, config))
+
+	build := config.Pipelines.Custom["build"]
+	assert.Empty(t, build.Import())
+	assert.Equal(t, []models.Variable{{Name: "Goal", Default: "verify"}}, build.Variables())
+	steps := build.Steps()
+	require.Len(t, steps, 3)
+	assert.Equal(t, "maven:3.9", steps[0].Image.Name)
+	assert.Equal(t, "alpine", steps[1].Image.Name)
+	assert.Equal(t, "maven:3.9", steps[2].Image.Name)
+
+	// Imports of shared pipelines are followed
+	assert.Equal(t, steps, config.Pipelines.Branches["main"].Steps())
+
+	// The definitions of the importing configuration win
+	assert.Equal(t, "postgres:16", config.Definitions.Services["postgres"].Image)
+	assert.Equal(t, "~/.m2/wrapper", config.Definitions.Caches["wrapper"].Path)
+
+	// Configurations are read once per repository and ref
+	require.NoError(t, os.Remove(filepath.Join(shared, "bitbucket-pipelines.yml")))
+	again := importingConfig(t, "pipelines:\n  custom:\n    build:\n      import: shared-pipelines:v2:build\n")
+	require.NoError(t, importer.Resolve(ctx, again))
+	assert.Len(t, again.Pipelines.Custom["build"].Steps(), 3)
+}
+
+func TestImporter_ResolveRef(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	ctx := context.Background()
+	dir := sharedConfig(t, "export: true\ndefinitions:\n  pipelines:\n    build:\n      - step:\n          script: [make v1]\n")
+	gitCmd := func(args ...string) {
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GIT_AUTHOR_NAME=test", "GIT_AUTHOR_EMAIL=test@example.com",
+			"GIT_COMMITTER_NAME=test", "GIT_COMMITTER_EMAIL=test@example.com")
+		out, err := cmd.CombinedOutput()
+		require.NoError(t, err, string(out))
+	}
+	gitCmd("init", "--quiet", "--initial-branch=main")
+	gitCmd("add", "--all")
+	gitCmd("commit", "--quiet", "--message", "v1")
+	gitCmd("tag", "v1")
+	gitCmd("branch", "release")
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "bitbucket-pipelines.yml"),
+		[]byte("export: true\ndefinitions:\n  pipelines:\n    build:\n      - step:\n          script: [make v2]\n"), 0644))
+	gitCmd("commit", "--quiet", "--all", "--message", "v2")
+
+	bare := filepath.Join(t.TempDir(), "shared.git")
+	out, err := exec.Command("git", "clone", "--quiet", "--bare", dir, bare).CombinedOutput()
+	require.NoError(t, err, string(out))
+	// A regular clone has the release branch of the origin as a remote
+	// branch only
+	clone := filepath.Join(t.TempDir(), "shared")
+	out, err = exec.Command("git", "clone", "--quiet", dir, clone).CombinedOutput()
+	require.NoError(t, err, string(out))
+
+	for name, path := range map[string]string{"work tree": dir, "bare": bare, "clone": clone} {
+		t.Run(name, func(t *testing.T) {
+			config := importingConfig(t, `pipelines:
+  tags:
+    v*:
+      import: shared:v1:build
+  branches:
+    main:
+      import: shared:main:build
+    release/*:
+      import: shared:release:build
+`)
+			require.NoError(t, NewImporter(map[string]string{"shared": path}, validation.Options{}).Resolve(ctx, config))
+			assert.Equal(t, []string{"make v1"}, config.Pipelines.Tags["v*"].Steps()[0].Script)
+			assert.Equal(t, []string{"make v2"}, config.Pipelines.Branches["main"].Steps()[0].Script)
+			assert.Equal(t, []string{"make v1"}, config.Pipelines.Branches["release/*"].Steps()[0].Script)
+
+			config = importingConfig(t, "pipelines:\n  default:\n    import: shared:v3:build\n")
+			err := NewImporter(map[string]string{"shared": path}, validation.Options{}).Resolve(ctx, config)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "ref 'v3' not found in "+path)
+		})
+	}
+}
+
+func TestImporter_Errors(t *testing.T) {
+	ctx := context.Background()
+	exported := sharedConfig(t, "export: true\ndefinitions:\n  pipelines:\n    build:\n      - step:\n          script: [make]\n    deploy:\n      - step:\n          script: [./deploy.sh]\n")
+	private := sharedConfig(t, "definitions:\n  pipelines:\n    build:\n      - step:\n          script: [make]\npipelines:\n  default:\n    - step:\n        script: [make]\n")
+	invalid := sharedConfig(t, "export: true\ndefinitions:\n  pipelines:\n    build:\n      - step:\n          name: Build\n")
+	cycleA := sharedConfig(t, "export: true\ndefinitions:\n  pipelines:\n    a:\n      import: cycle-b:main:b\n")
+	cycleB := sharedConfig(t, "export: true\ndefinitions:\n  pipelines:\n    b:\n      import: cycle-a:main:a\n")
+	repositories := map[string]string{
+		"shared-pipelines": exported,
+		"private":          private,
+		"invalid":          invalid,
+		"missing":          t.TempDir(),
+		"cycle-a":          cycleA,
+		"cycle-b":          cycleB,
+	}
+
+	tests := []struct {
+		name     string
+		value    string
+		expected string
+	}{
+		{"unknown repository", "shared-pipeline:main:build",
+			"failed to import pipeline 'custom:imported': repository 'shared-pipeline' is not in the imports of the runner configuration, did you mean 'shared-pipelines'?"},
+		{"unknown pipeline", "shared-pipelines:main:biuld",
+			"failed to import pipeline 'custom:imported': pipeline 'biuld' is not exported by shared-pipelines:main, did you mean 'build'?"},
+		{"other pipeline", "shared-pipelines:main:test",
+			"pipeline 'test' is not exported by shared-pipelines:main, exported pipelines: build, deploy"},
+		{"not exported", "private:main:build",
+			"repository 'private' does not export its pipelines, " + filepath.Join(private, "bitbucket-pipelines.yml") + " needs 'export: true'"},
+		{"invalid configuration", "invalid:main:build",
+			filepath.Join(invalid, "bitbucket-pipelines.yml") + ":5:9: error: step 'Build' has no script"},
+		{"missing configuration", "missing:main:build", "failed to read repository 'missing': failed to read "},
+		{"cycle", "cycle-a:main:a", "import cycle: cycle-a:main:a -> cycle-b:main:b -> cycle-a:main:a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := importingConfig(t, "pipelines:\n  custom:\n    imported:\n      import: "+tt.value+"\n")
+			err := NewImporter(repositories, validation.Options{}).Resolve(ctx, config)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.expected)
+		})
+	}
+}
@@ -0,0 +1,463 @@
+package parser
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"bitbucket-runner/internal/models"
+	"bitbucket-runner/internal/suggest"
+	"bitbucket-runner/internal/validation"
+	"gopkg.in/yaml.v3"
+)
+
+// LocalPipelineFile is the override of bitbucket-pipelines.yml a developer
+// keeps out of version control
+const LocalPipelineFile = "bitbucket-pipelines.local.yml"
+
+// skipKey is the key of a step override removing the step
+const skipKey = "skip"
+
+// ApplyOverrideFile applies the override file at path onto config. A
+// missing file leaves config untouched and is reported by ok.
+func ApplyOverrideFile(path string, config *models.PipelineConfig) (ok bool, err error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return true, ApplyOverride(path, data, config)
+}
+
+// ApplyOverride deep-merges an override file onto config. The file has the
+// top-level keys of bitbucket-pipelines.yml: image, clone and options are
+// merged onto the configuration, the services and caches of definitions
+// onto the ones defined, and steps are overridden by pipeline and step name:
+//
+//	pipelines:
+//	  branches:
+//	    main:
+//	      Build:
+//	        image: mirror.local/node:18
+//	        environment:
+//	          DEBUG: "true"
+//	      Deploy:
+//	        skip: true
+//
+// Mappings such as environment are merged, other values replaced, and
+// skip: true removes a step, from its parallel group or stage too.
+// Overrides that match nothing or that conflict with the configuration are
+// returned as a *validation.Error positioned in the override file.
+func ApplyOverride(file string, data []byte, config *models.PipelineConfig) error {
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", file, err)
+	}
+	if len(document.Content) == 0 {
+		return nil
+	}
+
+	o := &overrider{file: file, config: config}
+	root := deref(document.Content[0])
+	if root.Kind != yaml.MappingNode {
+		o.errorf(root, "the override must be a mapping")
+		return o.diagnostics.Err()
+	}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, value := root.Content[i], deref(root.Content[i+1])
+		switch key.Value {
+		case "image":
+			o.merge(&config.Image, value, value, "image")
+		case "clone":
+			if config.Clone == nil {
+				config.Clone = &models.CloneConfig{}
+			}
+			o.mergeFields(config.Clone, value, "clone", nil)
+		case "options":
+			if config.Options == nil {
+				config.Options = &models.Options{}
+			}
+			o.mergeFields(config.Options, value, "options", nil)
+		case "definitions":
+			o.definitions(value)
+		case "pipelines":
+			o.pipelines(value)
+		default:
+			o.unknown(key, "the override", []string{"image", "clone", "options", "definitions", "pipelines"})
+		}
+	}
+	return o.diagnostics.Err()
+}
+
+// overrider collects the problems of an override file while applying it
+type overrider struct {
+	file        string
+	config      *models.PipelineConfig
+	diagnostics validation.Diagnostics
+}
+
+func (o *overrider) errorf(node *yaml.Node, format string, args ...interface{}) {
+	o.diagnostics = append(o.diagnostics, validation.Diagnostic{
+		File:     o.file,
+		Line:     node.Line,
+		Column:   node.Column,
+		Severity: validation.SeverityError,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// unknown reports a key that is none of the known ones
+func (o *overrider) unknown(key *yaml.Node, where string, known []string) {
+	if match, ok := suggest.Closest(key.Value, known); ok {
+		o.errorf(key, "unknown field %q in %s, did you mean %q?", key.Value, where, match)
+		return
+	}
+	o.errorf(key, "unknown field %q in %s", key.Value, where)
+}
+
+// mapping reports whether node is a mapping, reporting it otherwise
+func (o *overrider) mapping(node *yaml.Node, what string) bool {
+	if node.Kind != yaml.MappingNode {
+		o.errorf(node, "%s must be a mapping", what)
+		return false
+	}
+	return true
+}
+
+// merge decodes value onto target, which keeps the entries of maps and the
+// fields of structs the value does not set. Errors are reported at node.
+func (o *overrider) merge(target interface{}, value, node *yaml.Node, what string) {
+	if err := value.Decode(target); err != nil {
+		o.errorf(node, "invalid override of %s: %s", what, typeError(err))
+	}
+}
+
+// mergeFields merges the fields of a mapping onto the struct target points
+// to. Keys in extra are left to the caller.
+func (o *overrider) mergeFields(target interface{}, node *yaml.Node, what string, extra []string) {
+	if !o.mapping(node, what) {
+		return
+	}
+	known := append(yamlFields(reflect.TypeOf(target).Elem()), extra...)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		if !contains(known, key.Value) {
+			o.unknown(key, what, known)
+			continue
+		}
+		if contains(extra, key.Value) {
+			continue
+		}
+		field := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Content: []*yaml.Node{key, value}}
+		o.merge(target, field, value, fmt.Sprintf("%s in %s", key.Value, what))
+	}
+}
+
+// definitions merges the services and caches the configuration defines
+func (o *overrider) definitions(node *yaml.Node) {
+	if !o.mapping(node, "definitions") {
+		return
+	}
+	var defined models.Definitions
+	if o.config.Definitions != nil {
+		defined = *o.config.Definitions
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], deref(node.Content[i+1])
+		switch key.Value {
+		case "services":
+			if !o.mapping(value, "services") {
+				continue
+			}
+			for j := 0; j+1 < len(value.Content); j += 2 {
+				name := value.Content[j]
+				service, ok := defined.Services[name.Value]
+				if !ok {
+					o.notDefined(name, "service", sortedKeys(defined.Services))
+					continue
+				}
+				o.mergeFields(&service, deref(value.Content[j+1]), fmt.Sprintf("service '%s'", name.Value), nil)
+				defined.Services[name.Value] = service
+			}
+		case "caches":
+			if !o.mapping(value, "caches") {
+				continue
+			}
+			for j := 0; j+1 < len(value.Content); j += 2 {
+				name := value.Content[j]
+				cache, ok := defined.Caches[name.Value]
+				if !ok {
+					o.notDefined(name, "cache", sortedKeys(defined.Caches))
+					continue
+				}
+				o.merge(&cache, value.Content[j+1], value.Content[j+1], fmt.Sprintf("cache '%s'", name.Value))
+				defined.Caches[name.Value] = cache
+			}
+		default:
+			o.unknown(key, "definitions", []string{"services", "caches"})
+		}
+	}
+}
+
+// notDefined reports a service or cache the configuration does not define
+func (o *overrider) notDefined(name *yaml.Node, what string, defined []string) {
+	if match, ok := suggest.Closest(name.Value, defined); ok {
+		o.errorf(name, "%s '%s' is not defined in bitbucket-pipelines.yml, did you mean '%s'?", what, name.Value, match)
+		return
+	}
+	o.errorf(name, "%s '%s' is not defined in bitbucket-pipelines.yml", what, name.Value)
+}
+
+// pipelines overrides the steps of the pipelines, keyed by kind then name
+// as in bitbucket-pipelines.yml
+func (o *overrider) pipelines(node *yaml.Node) {
+	if !o.mapping(node, "pipelines") {
+		return
+	}
+	kinds := make([]string, len(models.PipelineKinds))
+	for i, kind := range models.PipelineKinds {
+		kinds[i] = string(kind)
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], deref(node.Content[i+1])
+		kind := models.PipelineKind(key.Value)
+		switch {
+		case kind == models.PipelineKindDefault:
+			o.pipeline(models.Selector{Kind: kind}, key, value)
+		case contains(kinds, key.Value):
+			if !o.mapping(value, fmt.Sprintf("pipelines.%s", kind)) {
+				continue
+			}
+			for j := 0; j+1 < len(value.Content); j += 2 {
+				name := value.Content[j]
+				o.pipeline(models.Selector{Kind: kind, Name: name.Value}, name, deref(value.Content[j+1]))
+			}
+		default:
+			o.unknown(key, "pipelines", kinds)
+		}
+	}
+}
+
+// pipeline overrides the steps of a pipeline by name
+func (o *overrider) pipeline(selector models.Selector, key, node *yaml.Node) {
+	pipeline, selected, err := o.config.Select(selector)
+	if err != nil {
+		o.errorf(key, "%v", err)
+		return
+	}
+	if selected != selector {
+		o.errorf(key, "pipeline '%s' is not defined, it runs pipeline '%s' which overrides must name", selector, selected)
+		return
+	}
+	if !o.mapping(node, fmt.Sprintf("pipeline '%s'", selector)) {
+		return
+	}
+	// The steps of imported pipelines are shared by every pipeline importing
+	// them, so overrides apply to a copy
+	pipeline = clonePipeline(pipeline)
+
+	named := make(map[string][]*models.Step)
+	var names []string
+	for _, step := range stepsOf(pipeline) {
+		if step.Name != "" {
+			if len(named[step.Name]) == 0 {
+				names = append(names, step.Name)
+			}
+			named[step.Name] = append(named[step.Name], step)
+		}
+	}
+
+	skipped := make(map[*models.Step]bool)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		name, value := node.Content[i], deref(node.Content[i+1])
+		steps := named[name.Value]
+		switch {
+		case len(steps) == 0:
+			if match, ok := suggest.Closest(name.Value, names); ok {
+				o.errorf(name, "step '%s' is not defined in pipeline '%s', did you mean '%s'?", name.Value, selector, match)
+			} else {
+				o.errorf(name, "step '%s' is not defined in pipeline '%s', named steps: %s", name.Value, selector, strings.Join(names, ", "))
+			}
+			continue
+		case len(steps) > 1:
+			o.errorf(name, "step name '%s' matches %d steps of pipeline '%s', which cannot be told apart", name.Value, len(steps), selector)
+			continue
+		}
+		if o.step(steps[0], name, value, selector) {
+			skipped[steps[0]] = true
+		}
+	}
+	if len(skipped) > 0 {
+		if pipeline = withoutSteps(pipeline, skipped); len(pipeline.Steps()) == 0 {
+			o.errorf(key, "every step of pipeline '%s' is skipped", selector)
+			return
+		}
+	}
+	setPipeline(o.config, selector, pipeline)
+}
+
+// step merges an override onto a step and reports whether it skips the
+// step
+func (o *overrider) step(step *models.Step, name, node *yaml.Node, selector models.Selector) bool {
+	what := fmt.Sprintf("step '%s'", name.Value)
+	if !o.mapping(node, what) {
+		return false
+	}
+	skip := false
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if key := node.Content[i]; key.Value == skipKey {
+			o.merge(&skip, node.Content[i+1], node.Content[i+1], fmt.Sprintf("skip in %s", what))
+		}
+	}
+	if skip && len(node.Content) > 2 {
+		o.errorf(name, "step '%s' of pipeline '%s' is skipped and overridden, remove its other overrides", name.Value, selector)
+		return false
+	}
+	merged := *step
+	o.mergeFields(&merged, node, what, []string{skipKey})
+	*step = merged
+	return skip
+}
+
+// clonePipeline returns a copy of pipeline which shares no step with it
+func clonePipeline(pipeline models.Pipeline) models.Pipeline {
+	cloneSteps := func(steps []models.StepWrapper) []models.StepWrapper {
+		cloned := make([]models.StepWrapper, len(steps))
+		for i, wrapper := range steps {
+			cloned[i] = wrapper
+			cloned[i].Step = cloneStep(wrapper.Step)
+		}
+		return cloned
+	}
+
+	cloned := cloneSteps(pipeline)
+	for i := range cloned {
+		if parallel := cloned[i].Parallel; parallel != nil {
+			cloned[i].Parallel = &models.Parallel{FailFast: parallel.FailFast, Steps: cloneSteps(parallel.Steps)}
+		}
+		if stage := cloned[i].Stage; stage != nil {
+			copied := *stage
+			copied.Steps = cloneSteps(stage.Steps)
+			cloned[i].Stage = &copied
+		}
+	}
+	return cloned
+}
+
+// cloneStep copies the maps and pointers of a step, which overrides merge
+// into
+func cloneStep(step models.Step) models.Step {
+	if step.Environment != nil {
+		environment := make(map[string]string, len(step.Environment))
+		for name, value := range step.Environment {
+			environment[name] = value
+		}
+		step.Environment = environment
+	}
+	if step.Artifacts != nil {
+		artifacts := *step.Artifacts
+		step.Artifacts = &artifacts
+	}
+	if step.Condition != nil {
+		condition := *step.Condition
+		step.Condition = &condition
+	}
+	return step
+}
+
+// withoutSteps returns a copy of pipeline without the skipped steps.
+// Parallel groups and stages left without steps are removed.
+func withoutSteps(pipeline models.Pipeline, skipped map[*models.Step]bool) models.Pipeline {
+	keep := func(steps []models.StepWrapper) []models.StepWrapper {
+		var kept []models.StepWrapper
+		for i := range steps {
+			if !skipped[&steps[i].Step] {
+				kept = append(kept, steps[i])
+			}
+		}
+		return kept
+	}
+
+	var remaining models.Pipeline
+	for i := range pipeline {
+		entry := pipeline[i]
+		switch {
+		case entry.Parallel != nil:
+			parallel := *entry.Parallel
+			if parallel.Steps = keep(parallel.Steps); len(parallel.Steps) == 0 {
+				continue
+			}
+			entry.Parallel = &parallel
+		case entry.Stage != nil:
+			stage := *entry.Stage
+			if stage.Steps = keep(stage.Steps); len(stage.Steps) == 0 {
+				continue
+			}
+			entry.Stage = &stage
+		case skipped[&pipeline[i].Step]:
+			continue
+		}
+		remaining = append(remaining, entry)
+	}
+	return remaining
+}
+
+// typeError returns the message of a decoding error without the line
+// number, which diagnostics carry
+func typeError(err error) string {
+	var typeErr *yaml.TypeError
+	if !errors.As(err, &typeErr) {
+		return err.Error()
+	}
+	messages := make([]string, len(typeErr.Errors))
+	for i, message := range typeErr.Errors {
+		if _, rest, ok := strings.Cut(message, ": "); ok && strings.HasPrefix(message, "line ") {
+			message = rest
+		}
+		messages[i] = message
+	}
+	return strings.Join(messages, ", ")
+}
+
+// yamlFields returns the YAML keys of the fields of a struct type
+func yamlFields(t reflect.Type) []string {
+	var fields []string
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("yaml"), ",")
+		if name != "" && name != "-" {
+			fields = append(fields, name)
+		}
+	}
+	return fields
+}
+
+// deref follows an alias to the node it references
+func deref(node *yaml.Node) *yaml.Node {
+	for node.Kind == yaml.AliasNode && node.Alias != nil {
+		node = node.Alias
+	}
+	return node
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,195 @@
+package parser
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"bitbucket-runner/internal/models"
+	"bitbucket-runner/internal/validation"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const overriddenConfig = `image: node:18
+definitions:
+  services:
+    postgres:
+      image: postgres:15
+      environment:
+        POSTGRES_USER: app
+  caches:
+    build: dist
+pipelines:
+  default:
+    - step:
+        name: Build
+        environment:
+          CI: "true"
+        script: [npm ci]
+    - parallel:
+        - step:
+            name: Shard 1
+            script: [npm test -- --shard 1]
+        - step:
+            name: Shard 2
+            script: [npm test -- --shard 2]
+    - stage:
+        name: Release
+        steps:
+          - step:
+              name: Deploy
+              deployment: production
+              script: [./deploy.sh]
+  branches:
+    release/*:
+      - step:
+          name: Build
+          script: [npm ci]
+`
+
+func TestApplyOverride(t *testing.T) {
+	config := importingConfig(t, overriddenConfig)
+	err := ApplyOverride(LocalPipelineFile, []byte(`image: mirror.local/node:18
+clone:
+  depth: 1
+definitions:
+  services:
+    postgres:
+      image: mirror.local/postgres:15
+  caches:
+    build: out
+pipelines:
+  default:
+    Build:
+      image: mirror.local/node:20
+      environment:
+        DEBUG: "true"
+    Shard 2:
+      skip: true
+    Deploy:
+      skip: true
+`), config)
+	require.NoError(t, err)
+
+	assert.Equal(t, "mirror.local/node:18", config.Image.Name)
+	assert.Equal(t, &models.CloneConfig{Depth: 1}, config.Clone)
+	assert.Equal(t, models.Service{
+		Image:       "mirror.local/postgres:15",
+		Environment: map[string]string{"POSTGRES_USER": "app"},
+	}, config.Definitions.Services["postgres"])
+	assert.Equal(t, models.Cache{Path: "out"}, config.Definitions.Caches["build"])
+
+	pipeline := config.Pipelines.Default
+	require.Len(t, pipeline, 2)
+	steps := pipeline.Steps()
+	require.Len(t, steps, 2)
+	assert.Equal(t, "mirror.local/node:20", steps[0].Image.Name)
+	assert.Equal(t, map[string]string{"CI": "true", "DEBUG": "true"}, steps[0].Environment)
+	assert.Equal(t, []string{"npm ci"}, steps[0].Script)
+	require.NotNil(t, pipeline[1].Parallel)
+	assert.Equal(t, "Shard 1", steps[1].Name)
+
+	// Other pipelines keep their steps
+	assert.Empty(t, config.Pipelines.Branches["release/*"].Steps()[0].Image)
+
+	t.Run("empty file", func(t *testing.T) {
+		config := importingConfig(t, overriddenConfig)
+		require.NoError(t, ApplyOverride(LocalPipelineFile, []byte("# nothing yet\n"), config))
+		assert.Equal(t, importingConfig(t, overriddenConfig), config)
+	})
+
+	t.Run("imported steps are copied", func(t *testing.T) {
+		shared := importingConfig(t, "pipelines:\n  default:\n    - step:\n        name: Build\n        environment: {CI: \"true\"}\n        script: [make]\n")
+		config := &models.PipelineConfig{Pipelines: &models.Pipelines{
+			Default: shared.Pipelines.Default,
+			Custom:  map[string]models.Pipeline{"build": shared.Pipelines.Default},
+		}}
+		require.NoError(t, ApplyOverride(LocalPipelineFile, []byte("pipelines:\n  default:\n    Build:\n      environment: {DEBUG: \"true\"}\n"), config))
+		assert.Equal(t, map[string]string{"CI": "true", "DEBUG": "true"}, config.Pipelines.Default.Steps()[0].Environment)
+		assert.Equal(t, map[string]string{"CI": "true"}, config.Pipelines.Custom["build"].Steps()[0].Environment)
+	})
+}
+
+func TestApplyOverride_Errors(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{"unknown pipeline", "pipelines:\n  branches:\n    mian:\n      Build: {image: alpine}\n",
+			"bitbucket-pipelines.local.yml:3:5: error: pipeline 'branches:mian' is not defined, did you mean 'branches:main'?"},
+		{"pattern", "pipelines:\n  branches:\n    release/1.2:\n      Build: {image: alpine}\n",
+			"bitbucket-pipelines.local.yml:3:5: error: pipeline 'branches:release/1.2' is not defined, it runs pipeline 'branches:release/*' which overrides must name"},
+		{"unknown step", "pipelines:\n  default:\n    Biuld:\n      image: alpine\n",
+			"bitbucket-pipelines.local.yml:3:5: error: step 'Biuld' is not defined in pipeline 'default', did you mean 'Build'?"},
+		{"ambiguous step", "pipelines:\n  default:\n    Test:\n      image: alpine\n",
+			"bitbucket-pipelines.local.yml:3:5: error: step name 'Test' matches 2 steps of pipeline 'default', which cannot be told apart"},
+		{"unknown field", "pipelines:\n  default:\n    Build:\n      imgae: alpine\n",
+			"bitbucket-pipelines.local.yml:4:7: error: unknown field \"imgae\" in step 'Build', did you mean \"image\"?"},
+		{"type conflict", "pipelines:\n  default:\n    Build:\n      script: make\n",
+			"bitbucket-pipelines.local.yml:4:15: error: invalid override of script in step 'Build': cannot unmarshal !!str `make` into []string"},
+		{"skipped and overridden", "pipelines:\n  default:\n    Build:\n      skip: true\n      image: alpine\n",
+			"bitbucket-pipelines.local.yml:3:5: error: step 'Build' of pipeline 'default' is skipped and overridden, remove its other overrides"},
+		{"every step skipped", "pipelines:\n  branches:\n    main:\n      Build: {skip: true}\n",
+			"bitbucket-pipelines.local.yml:3:5: error: every step of pipeline 'branches:main' is skipped"},
+		{"unknown service", "definitions:\n  services:\n    postgre:\n      image: postgres:16\n",
+			"bitbucket-pipelines.local.yml:3:5: error: service 'postgre' is not defined in bitbucket-pipelines.yml, did you mean 'postgres'?"},
+		{"unknown kind", "pipelines:\n  branch:\n    main: {}\n",
+			"bitbucket-pipelines.local.yml:2:3: error: unknown field \"branch\" in pipelines, did you mean \"branches\"?"},
+		{"not a mapping", "- image: alpine\n",
+			"bitbucket-pipelines.local.yml:1:1: error: the override must be a mapping"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := importingConfig(t, `definitions:
+  services:
+    postgres:
+      image: postgres:15
+pipelines:
+  default:
+    - step:
+        name: Build
+        script: [make]
+    - step:
+        name: Test
+        script: [make test]
+    - step:
+        name: Test
+        script: [make e2e]
+  branches:
+    main:
+      - step:
+          name: Build
+          script: [make]
+    release/*:
+      - step:
+          name: Build
+          script: [make]
+`)
+			err := ApplyOverride(LocalPipelineFile, []byte(tt.content), config)
+			require.Error(t, err)
+			var validationErr *validation.Error
+			require.ErrorAs(t, err, &validationErr)
+			assert.Equal(t, tt.expected, err.Error())
+		})
+	}
+}
+
+func TestApplyOverrideFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, LocalPipelineFile)
+	config := importingConfig(t, overriddenConfig)
+
+	ok, err := ApplyOverrideFile(path, config)
+	require.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, "node:18", config.Image.Name)
+
+	require.NoError(t, os.WriteFile(path, []byte("image: mirror.local/node:18\n"), 0644))
+	ok, err = ApplyOverrideFile(path, config)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "mirror.local/node:18", config.Image.Name)
+}
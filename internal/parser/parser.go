@@ -4,16 +4,28 @@
 	"io/ioutil"
 
 	"bitbucket-runner/internal/models"
+	"bitbucket-runner/internal/validation"
 	"gopkg.in/yaml.v3"
 )
 
-// ParsePipelineConfig reads a bitbucket-pipelines.yml file and unmarshals it into a PipelineConfig struct.
+// ParsePipelineConfig reads a bitbucket-pipelines.yml file, validates it and unmarshals it into a PipelineConfig struct.
+// Validation errors are returned as a *validation.Error listing every problem with its position.
 func ParsePipelineConfig(filePath string) (*models.PipelineConfig, error) {
+	return ParsePipelineConfigWithOptions(filePath, validation.Options{})
+}
+
+// ParsePipelineConfigWithOptions is ParsePipelineConfig validating the file with the given options,
+// such as the rule severities of the runner configuration.
+func ParsePipelineConfigWithOptions(filePath string, options validation.Options) (*models.PipelineConfig, error) {
 	data, err := ioutil.ReadFile(filePath)
 	if err != nil {
 		return nil, err
 	}
 
+	if err := validation.ValidatePipelineConfig(filePath, data, options).Err(); err != nil {
+		return nil, err
+	}
+
 	var config models.PipelineConfig
 	err = yaml.Unmarshal(data, &config)
 	if err != nil {
@@ -21,4 +33,4 @@ func ParsePipelineConfig(filePath string) (*models.PipelineConfig, error) {
 	}
 
 	return &config, nil
-}
\ No newline at end of file
+}
@@ -5,6 +5,8 @@
 	"path/filepath"
 	"testing"
 
+	"bitbucket-runner/internal/models"
+
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -27,7 +29,7 @@ func TestPipelineParser_ParseYAML(t *testing.T) {
 		require.NoError(t, err)
 		require.NotNil(t, config)
 
-		assert.Equal(t, "ubuntu:20.04", config.Image)
+		assert.Equal(t, "ubuntu:20.04", config.Image.Name)
 		assert.NotNil(t, config.Pipelines)
 		assert.Greater(t, len(config.Pipelines.Default), 0)
 		assert.Len(t, config.Pipelines.Default, 1)
@@ -89,6 +91,116 @@ func TestPipelineParser_ParseYAML(t *testing.T) {
 		assert.Contains(t, config.Definitions.Caches, "node")
 	})
 
+	t.Run("pipeline with parallel steps", func(t *testing.T) {
+		yamlData := `
+pipelines:
+  default:
+    - parallel:
+        - step:
+            name: Unit
+            script:
+              - make unit
+        - step:
+            name: Lint
+            script:
+              - make lint
+    - parallel:
+        fail-fast: true
+        steps:
+          - step:
+              name: Integration
+              script:
+                - make integration
+`
+		config, err := parser.ParseYAML([]byte(yamlData))
+		require.NoError(t, err)
+
+		require.Len(t, config.Pipelines.Default, 2)
+		require.NotNil(t, config.Pipelines.Default[0].Parallel)
+		assert.False(t, config.Pipelines.Default[0].Parallel.FailFast)
+		assert.Len(t, config.Pipelines.Default[0].Parallel.Steps, 2)
+		assert.True(t, config.Pipelines.Default[1].Parallel.FailFast)
+
+		steps := config.Pipelines.Default.Steps()
+		require.Len(t, steps, 3)
+		assert.Equal(t, "Lint", steps[1].Name)
+		assert.Equal(t, "Integration", steps[2].Name)
+	})
+
+	t.Run("pipeline with stage and changeset conditions", func(t *testing.T) {
+		yamlData := `
+pipelines:
+  default:
+    - stage:
+        name: Backend
+        condition:
+          changesets:
+            includePaths:
+              - "api/**"
+            excludePaths:
+              - "api/docs/**"
+        steps:
+          - step:
+              script:
+                - make api
+          - step:
+              script:
+                - make deploy
+`
+		config, err := parser.ParseYAML([]byte(yamlData))
+		require.NoError(t, err)
+
+		stage := config.Pipelines.Default[0].Stage
+		require.NotNil(t, stage)
+		assert.Equal(t, "Backend", stage.Name)
+		assert.Equal(t, []string{"api/**"}, stage.Condition.Changesets.IncludePaths)
+		assert.Equal(t, []string{"api/docs/**"}, stage.Condition.Changesets.ExcludePaths)
+		assert.Len(t, config.Pipelines.Default.Steps(), 2)
+	})
+
+	t.Run("custom pipeline with variables", func(t *testing.T) {
+		yamlData := `
+pipelines:
+  custom:
+    deploy:
+      - variables:
+          - name: Environment
+            default: staging
+            allowed-values:
+              - staging
+              - production
+            description: Target environment
+      - step:
+          script:
+            - ./deploy.sh $Environment
+`
+		config, err := parser.ParseYAML([]byte(yamlData))
+		require.NoError(t, err)
+
+		pipeline := config.Pipelines.Custom["deploy"]
+		assert.Equal(t, []models.Variable{{
+			Name:          "Environment",
+			Default:       "staging",
+			AllowedValues: []string{"staging", "production"},
+			Description:   "Target environment",
+		}}, pipeline.Variables())
+		assert.Len(t, pipeline.Steps(), 1)
+	})
+
+	t.Run("invalid variables", func(t *testing.T) {
+		tests := map[string]string{
+			"default not allowed": "pipelines:\n  custom:\n    deploy:\n      - variables:\n          - name: Env\n            default: qa\n            allowed-values: [staging]\n      - step:\n          script: [make]\n",
+			"outside custom":      "pipelines:\n  default:\n    - variables:\n        - name: Env\n    - step:\n        script: [make]\n",
+			"without steps":       "pipelines:\n  custom:\n    deploy:\n      - variables:\n          - name: Env\n",
+		}
+		for name, yamlData := range tests {
+			t.Run(name, func(t *testing.T) {
+				_, err := parser.ParseYAML([]byte(yamlData))
+				assert.Error(t, err)
+			})
+		}
+	})
+
 	t.Run("invalid YAML", func(t *testing.T) {
 		invalidYAML := `
 pipelines:
@@ -147,7 +259,7 @@ func TestPipelineParser_ParseFile(t *testing.T) {
 		require.NoError(t, err)
 		require.NotNil(t, config)
 
-		assert.Equal(t, "ubuntu:20.04", config.Image)
+		assert.Equal(t, "ubuntu:20.04", config.Image.Name)
 		assert.NotNil(t, config.Pipelines)
 		assert.Greater(t, len(config.Pipelines.Default), 0)
 	})
@@ -192,7 +304,7 @@ func TestPipelineParser_ParseDefault(t *testing.T) {
 
 		assert.Len(t, config.Pipelines.Default, 1)
 		assert.Equal(t, "test", config.Pipelines.Default[0].Step.Name)
-		assert.Equal(t, "node:14", config.Pipelines.Default[0].Step.Image)
+		assert.Equal(t, "node:14", config.Pipelines.Default[0].Step.Image.Name)
 		assert.Len(t, config.Pipelines.Default[0].Step.Script, 1)
 	})
 
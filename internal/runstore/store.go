@@ -0,0 +1,199 @@
+package runstore
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"bitbucket-runner/internal/models"
+)
+
+// SchemaVersion is the version of the persisted run document. It must be
+// bumped whenever the on-disk layout of ExecutionContext changes in a way
+// older binaries cannot read.
+const SchemaVersion = 1
+
+const (
+	contextFile  = "context.json"
+	artifactsDir = "artifacts"
+)
+
+// ErrNoRuns is returned when the store does not contain any matching run
+var ErrNoRuns = errors.New("no previous runs found")
+
+// Store persists execution contexts and their artifacts on disk. Every run
+// lives in its own directory below the store root:
+//
+//	<root>/<run-id>/context.json
+//	<root>/<run-id>/artifacts/...
+type Store struct {
+	root string
+}
+
+// runDocument is the versioned envelope written to context.json
+type runDocument struct {
+	SchemaVersion int                      `json:"schema_version"`
+	Context       *models.ExecutionContext `json:"context"`
+}
+
+// NewStore creates a store rooted at the given directory
+func NewStore(root string) *Store {
+	return &Store{root: root}
+}
+
+// Root returns the directory runs are stored in
+func (s *Store) Root() string {
+	return s.root
+}
+
+// NewRunID generates a sortable, unique identifier for a new run
+func NewRunID() string {
+	suffix := make([]byte, 3)
+	if _, err := rand.Read(suffix); err != nil {
+		return time.Now().Format("20060102-150405.000000")
+	}
+	return time.Now().Format("20060102-150405") + "-" + hex.EncodeToString(suffix)
+}
+
+// RunDir returns the directory holding everything persisted for a run
+func (s *Store) RunDir(id string) string {
+	return filepath.Join(s.root, id)
+}
+
+// ArtifactsDir returns the directory artifacts of a run are collected into
+func (s *Store) ArtifactsDir(id string) string {
+	return filepath.Join(s.RunDir(id), artifactsDir)
+}
+
+// Save writes the execution context of a run to disk. The context holds the
+// variables of the run, secured ones included, so only the user can read
+// it.
+func (s *Store) Save(ec *models.ExecutionContext) error {
+	if ec.ID == "" {
+		return errors.New("execution context has no run ID")
+	}
+
+	if err := os.MkdirAll(s.RunDir(ec.ID), 0700); err != nil {
+		return fmt.Errorf("failed to create run directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(runDocument{SchemaVersion: SchemaVersion, Context: ec}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal run %s: %w", ec.ID, err)
+	}
+
+	// Write to a temporary file first so an interrupted run never leaves a
+	// truncated context behind
+	path := filepath.Join(s.RunDir(ec.ID), contextFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write run %s: %w", ec.ID, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write run %s: %w", ec.ID, err)
+	}
+
+	return nil
+}
+
+// Load reads the execution context of a run from disk
+func (s *Store) Load(id string) (*models.ExecutionContext, error) {
+	data, err := os.ReadFile(filepath.Join(s.RunDir(id), contextFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("run %s not found", id)
+		}
+		return nil, fmt.Errorf("failed to read run %s: %w", id, err)
+	}
+
+	var doc runDocument
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal run %s: %w", id, err)
+	}
+
+	if doc.SchemaVersion != SchemaVersion {
+		return nil, fmt.Errorf("run %s has unsupported schema version %d (expected %d)", id, doc.SchemaVersion, SchemaVersion)
+	}
+	if doc.Context == nil {
+		return nil, fmt.Errorf("run %s has no execution context", id)
+	}
+	if doc.Context.Environment == nil {
+		doc.Context.Environment = make(map[string]string)
+	}
+
+	return doc.Context, nil
+}
+
+// List returns the IDs of all stored runs, oldest first
+func (s *Store) List() ([]string, error) {
+	entries, err := os.ReadDir(s.root)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list runs: %w", err)
+	}
+
+	var ids []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(s.root, entry.Name(), contextFile)); err == nil {
+			ids = append(ids, entry.Name())
+		}
+	}
+
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// LatestFailed returns the most recent run that did not complete
+// successfully
+func (s *Store) LatestFailed() (*models.ExecutionContext, error) {
+	ids, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(ids) - 1; i >= 0; i-- {
+		ec, err := s.Load(ids[i])
+		if err != nil {
+			continue
+		}
+		if ec.Status == models.ExecutionStatusFailed || ec.Status == models.ExecutionStatusCancelled {
+			return ec, nil
+		}
+	}
+
+	return nil, ErrNoRuns
+}
+
+// NextBuildNumber returns the build number for a new run, one higher than
+// the highest build number stored so far
+func (s *Store) NextBuildNumber() (int, error) {
+	ids, err := s.List()
+	if err != nil {
+		return 0, err
+	}
+
+	highest := 0
+	for _, id := range ids {
+		ec, err := s.Load(id)
+		if err != nil {
+			// Runs written by other versions must not block new runs
+			continue
+		}
+		if ec.BuildNumber > highest {
+			highest = ec.BuildNumber
+		}
+	}
+
+	return highest + 1, nil
+}
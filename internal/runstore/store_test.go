@@ -0,0 +1,109 @@
+package runstore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"bitbucket-runner/internal/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStore_SaveAndLoad(t *testing.T) {
+	store := NewStore(t.TempDir())
+
+	ec := models.NewExecutionContext(nil, "/work")
+	ec.ID = "20261018-120000-abcdef"
+	ec.PipelineName = "default"
+	ec.BuildNumber = 7
+	ec.SetEnvironmentVariable("BITBUCKET_BUILD_NUMBER", "7")
+	ec.AddStepResult(models.StepResult{StepIndex: 0, StepName: "Build", Status: models.StepStatusCompleted, Artifacts: []string{"dist/app.js"}})
+	ec.FailExecution("step 'Test' failed")
+
+	require.NoError(t, store.Save(ec))
+	info, err := os.Stat(store.RunDir(ec.ID))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+	info, err = os.Stat(filepath.Join(store.RunDir(ec.ID), contextFile))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	loaded, err := store.Load(ec.ID)
+	require.NoError(t, err)
+	assert.Equal(t, ec.ID, loaded.ID)
+	assert.Equal(t, "default", loaded.PipelineName)
+	assert.Equal(t, 7, loaded.BuildNumber)
+	assert.Equal(t, "7", loaded.Environment["BITBUCKET_BUILD_NUMBER"])
+	assert.Equal(t, models.ExecutionStatusFailed, loaded.Status)
+	require.Len(t, loaded.StepResults, 1)
+	assert.Equal(t, []string{"dist/app.js"}, loaded.StepResults[0].Artifacts)
+	assert.Nil(t, loaded.PipelineConfig)
+}
+
+func TestStore_Load(t *testing.T) {
+	store := NewStore(t.TempDir())
+
+	t.Run("unknown run", func(t *testing.T) {
+		_, err := store.Load("missing")
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "run missing not found")
+	})
+
+	t.Run("unsupported schema version", func(t *testing.T) {
+		dir := store.RunDir("old")
+		require.NoError(t, os.MkdirAll(dir, 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, contextFile), []byte(`{"schema_version": 99, "context": {}}`), 0644))
+
+		_, err := store.Load("old")
+		assert.Error(t, err)
+		assert.Contains(t, err.Error(), "unsupported schema version 99")
+	})
+
+	t.Run("saving without an ID", func(t *testing.T) {
+		assert.Error(t, store.Save(models.NewExecutionContext(nil, "")))
+	})
+}
+
+func TestStore_LatestFailed(t *testing.T) {
+	store := NewStore(t.TempDir())
+
+	_, err := store.LatestFailed()
+	assert.ErrorIs(t, err, ErrNoRuns)
+
+	failed := models.NewExecutionContext(nil, "")
+	failed.ID = "20261018-100000-aaaaaa"
+	failed.FailExecution("boom")
+	require.NoError(t, store.Save(failed))
+
+	completed := models.NewExecutionContext(nil, "")
+	completed.ID = "20261018-110000-bbbbbb"
+	completed.CompleteExecution()
+	require.NoError(t, store.Save(completed))
+
+	latest, err := store.LatestFailed()
+	require.NoError(t, err)
+	assert.Equal(t, failed.ID, latest.ID)
+
+	ids, err := store.List()
+	require.NoError(t, err)
+	assert.Equal(t, []string{failed.ID, completed.ID}, ids)
+}
+
+func TestStore_NextBuildNumber(t *testing.T) {
+	store := NewStore(t.TempDir())
+
+	next, err := store.NextBuildNumber()
+	require.NoError(t, err)
+	assert.Equal(t, 1, next)
+
+	ec := models.NewExecutionContext(nil, "")
+	ec.ID = NewRunID()
+	ec.BuildNumber = 41
+	require.NoError(t, store.Save(ec))
+
+	next, err = store.NextBuildNumber()
+	require.NoError(t, err)
+	assert.Equal(t, 42, next)
+}
@@ -0,0 +1,45 @@
+package suggest
+
+import "strings"
+
+// Closest returns the candidate most similar to word, for "did you mean"
+// hints. Candidates further away than a third of the word length, with a
+// minimum of two edits, are not considered similar. Comparison ignores case.
+func Closest(word string, candidates []string) (string, bool) {
+	limit := len(word) / 3
+	if limit < 2 {
+		limit = 2
+	}
+
+	best, bestDistance := "", limit+1
+	for _, candidate := range candidates {
+		distance := Distance(strings.ToLower(word), strings.ToLower(candidate))
+		if distance < bestDistance {
+			best, bestDistance = candidate, distance
+		}
+	}
+	return best, best != ""
+}
+
+// Distance returns the Levenshtein edit distance between two strings
+func Distance(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(rb)]
+}
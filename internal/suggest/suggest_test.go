@@ -0,0 +1,33 @@
+package suggest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDistance(t *testing.T) {
+	assert.Equal(t, 0, Distance("deploy", "deploy"))
+	assert.Equal(t, 1, Distance("deploy", "deplo"))
+	assert.Equal(t, 2, Distance("branch", "branches"))
+	assert.Equal(t, 3, Distance("kitten", "sitting"))
+	assert.Equal(t, 4, Distance("", "main"))
+}
+
+func TestClosest(t *testing.T) {
+	candidates := []string{"default", "branches", "tags", "pull-requests", "custom"}
+
+	match, ok := Closest("branch", candidates)
+	assert.True(t, ok)
+	assert.Equal(t, "branches", match)
+
+	match, ok = Closest("Pull-Request", candidates)
+	assert.True(t, ok)
+	assert.Equal(t, "pull-requests", match)
+
+	_, ok = Closest("release", candidates)
+	assert.False(t, ok)
+
+	_, ok = Closest("main", nil)
+	assert.False(t, ok)
+}
@@ -0,0 +1,103 @@
+// Package transform applies the transform hooks of the runner
+// configuration, executables rewriting the pipeline configuration between
+// parsing and execution like the dynamic pipelines of Bitbucket.
+package transform
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"time"
+
+	"bitbucket-runner/internal/models"
+	"bitbucket-runner/internal/validation"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Apply runs the hooks in order from dir, each one receiving the
+// configuration the previous one returned. The standard error of the hooks
+// is written to stderr. The configuration a hook returns is validated like
+// bitbucket-pipelines.yml, with options, before the next hook runs.
+func Apply(ctx context.Context, config *models.PipelineConfig, hooks []models.TransformHook, dir string, options validation.Options, stderr io.Writer) (*models.PipelineConfig, error) {
+	for _, hook := range hooks {
+		input, err := Encode(config)
+		if err != nil {
+			return nil, err
+		}
+		output, err := run(ctx, hook, dir, input, stderr)
+		if err != nil {
+			return nil, err
+		}
+		if config, err = decode(hook, output, options); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// Encode returns the JSON form of a configuration, with the keys of
+// bitbucket-pipelines.yml. The configuration is marshaled to YAML first, as
+// the models only name their keys for YAML.
+func Encode(config *models.PipelineConfig) ([]byte, error) {
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal pipeline config: %w", err)
+	}
+	var document interface{}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, fmt.Errorf("failed to marshal pipeline config: %w", err)
+	}
+	encoded, err := json.Marshal(document)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal pipeline config to JSON: %w", err)
+	}
+	return encoded, nil
+}
+
+// run runs a hook with input on its standard input and returns its
+// standard output
+func run(ctx context.Context, hook models.TransformHook, dir string, input []byte, stderr io.Writer) ([]byte, error) {
+	timeout := hook.Timeout
+	if timeout == 0 {
+		timeout = models.DefaultTransformTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(timeout)*time.Second)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, hook.Command, hook.Args...)
+	cmd.Dir = dir
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stderr = stderr
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+
+	if err := cmd.Run(); err != nil {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("transform '%s' timed out after %ds", hook.Label(), timeout)
+		}
+		return nil, fmt.Errorf("transform '%s' failed: %w", hook.Label(), err)
+	}
+	if len(bytes.TrimSpace(stdout.Bytes())) == 0 {
+		return nil, fmt.Errorf("transform '%s' returned no configuration", hook.Label())
+	}
+	return stdout.Bytes(), nil
+}
+
+// decode validates and parses the configuration a hook returned
+func decode(hook models.TransformHook, output []byte, options validation.Options) (*models.PipelineConfig, error) {
+	file := fmt.Sprintf("output of transform '%s'", hook.Label())
+	if err := validation.ValidatePipelineConfig(file, output, options).Err(); err != nil {
+		return nil, fmt.Errorf("transform '%s' returned an invalid configuration:\n%w", hook.Label(), err)
+	}
+
+	var config models.PipelineConfig
+	if err := yaml.Unmarshal(output, &config); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal %s: %w", file, err)
+	}
+	return &config, nil
+}
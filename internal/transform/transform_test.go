@@ -0,0 +1,122 @@
+package transform
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os/exec"
+	"testing"
+
+	"bitbucket-runner/internal/models"
+	"bitbucket-runner/internal/validation"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+const content = `image: node:18
+definitions:
+  caches:
+    npm: ~/.npm
+    build:
+      key: build
+      paths: [dist]
+pipelines:
+  default:
+    - step:
+        name: Test
+        caches: [npm]
+        script: [npm test]
+  custom:
+    shared:
+      import: shared-pipelines:master:build
+`
+
+func parse(t *testing.T, content string) *models.PipelineConfig {
+	t.Helper()
+	var config models.PipelineConfig
+	require.NoError(t, yaml.Unmarshal([]byte(content), &config))
+	return &config
+}
+
+func TestEncode(t *testing.T) {
+	data, err := Encode(parse(t, content))
+	require.NoError(t, err)
+
+	var document map[string]interface{}
+	require.NoError(t, json.Unmarshal(data, &document))
+	assert.Equal(t, "node:18", document["image"])
+	assert.Equal(t, map[string]interface{}{
+		"npm":   "~/.npm",
+		"build": map[string]interface{}{"key": "build", "paths": []interface{}{"dist"}},
+	}, document["definitions"].(map[string]interface{})["caches"])
+
+	pipelines := document["pipelines"].(map[string]interface{})
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"step": map[string]interface{}{"name": "Test", "caches": []interface{}{"npm"}, "script": []interface{}{"npm test"}}},
+	}, pipelines["default"])
+	assert.Equal(t, map[string]interface{}{"shared": map[string]interface{}{"import": "shared-pipelines:master:build"}}, pipelines["custom"])
+
+	// The JSON form parses back to the same configuration
+	assert.Equal(t, parse(t, content), parse(t, string(data)))
+}
+
+func TestApply(t *testing.T) {
+	for _, name := range []string{"cat", "sed", "sleep"} {
+		if _, err := exec.LookPath(name); err != nil {
+			t.Skipf("%s not available", name)
+		}
+	}
+	ctx := context.Background()
+
+	t.Run("hooks run in order", func(t *testing.T) {
+		hooks := []models.TransformHook{
+			{Command: "cat"},
+			{Name: "ci", Command: "sed", Args: []string{"s/npm test/npm run ci/"}},
+		}
+		var stderr bytes.Buffer
+		config, err := Apply(ctx, parse(t, content), hooks, t.TempDir(), validation.Options{}, &stderr)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"npm run ci"}, config.Pipelines.Default.Steps()[0].Script)
+		assert.Equal(t, "shared-pipelines:master:build", config.Pipelines.Custom["shared"].Import())
+		assert.Empty(t, stderr.String())
+	})
+
+	t.Run("hooks may return YAML", func(t *testing.T) {
+		hooks := []models.TransformHook{{Command: "echo", Args: []string{"pipelines:\n  default:\n    - step:\n        script: [make]\n"}}}
+		config, err := Apply(ctx, parse(t, content), hooks, t.TempDir(), validation.Options{}, &bytes.Buffer{})
+		require.NoError(t, err)
+		assert.Equal(t, []string{"make"}, config.Pipelines.Default.Steps()[0].Script)
+		assert.Empty(t, config.Image)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		tests := []struct {
+			name     string
+			hook     models.TransformHook
+			expected string
+			stderr   string
+		}{
+			{"failing hook", models.TransformHook{Name: "fail", Command: "sh", Args: []string{"-c", "echo broken >&2; exit 3"}},
+				"transform 'fail' failed: exit status 3", "broken\n"},
+			{"missing executable", models.TransformHook{Command: "./missing-transform"},
+				"transform './missing-transform' failed", ""},
+			{"no output", models.TransformHook{Command: "true"},
+				"transform 'true' returned no configuration", ""},
+			{"invalid output", models.TransformHook{Name: "invalid", Command: "echo", Args: []string{`{"pipelines": {"default": [{"step": {"name": "Build"}}]}}`}},
+				"transform 'invalid' returned an invalid configuration:\noutput of transform 'invalid':1:29: error: step 'Build' has no script", ""},
+			{"timeout", models.TransformHook{Name: "slow", Command: "sleep", Args: []string{"5"}, Timeout: 1},
+				"transform 'slow' timed out after 1s", ""},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				var stderr bytes.Buffer
+				_, err := Apply(ctx, parse(t, content), []models.TransformHook{tt.hook}, t.TempDir(), validation.Options{}, &stderr)
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.expected)
+				assert.Equal(t, tt.stderr, stderr.String())
+			})
+		}
+	})
+}
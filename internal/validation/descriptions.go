@@ -0,0 +1,191 @@
+package validation
+
+import (
+	"reflect"
+
+	"bitbucket-runner/internal/models"
+)
+
+// fieldDescriptions documents, by model type, the fields of the
+// configuration files. They end up in the JSON Schemas and in the hover
+// documentation of the language server.
+var fieldDescriptions = map[reflect.Type]map[string]string{
+	reflect.TypeOf(models.PipelineConfig{}): {
+		"image":       "Docker image the steps run in, unless a step sets its own.",
+		"clone":       "How the repository is cloned into the steps.",
+		"pipelines":   "The pipelines, run by default, for branches, tags and pull requests, or on demand.",
+		"definitions": "Steps, services and caches the pipelines reuse.",
+		"options":     "Settings applying to every step.",
+		"export":      "Lets other repositories import the pipelines of definitions.",
+	},
+	reflect.TypeOf(models.Pipelines{}): {
+		"default":       "Runs for branches and tags no other pipeline matches.",
+		"branches":      "Pipelines by branch name pattern, such as main or release/*.",
+		"pull-requests": "Pipelines by source branch pattern, run on the merge of a pull request.",
+		"custom":        "Pipelines run on demand, which may declare variables.",
+		"tags":          "Pipelines by tag name pattern.",
+	},
+	reflect.TypeOf(models.PipelineImport{}): {
+		"import": "Pipeline imported from a shared repository, as <repository>:<ref>:<pipeline>.",
+	},
+	reflect.TypeOf(models.StepWrapper{}): {
+		"step":      "A step, running a script in a container.",
+		"parallel":  "Steps running in parallel.",
+		"stage":     "Steps running in sequence, sharing a deployment and a condition.",
+		"variables": "Variables of a custom pipeline, provided when it is run. Must be its first entry.",
+	},
+	reflect.TypeOf(models.Variable{}): {
+		"name":           "Name of the variable.",
+		"default":        "Value used when none is provided.",
+		"allowed-values": "Values the variable is restricted to.",
+		"description":    "Description shown when the pipeline is run.",
+	},
+	reflect.TypeOf(models.Stage{}): {
+		"name":       "Name of the stage.",
+		"trigger":    "Whether the stage starts automatically or waits to be started manually.",
+		"deployment": "Deployment environment of the steps, such as test, staging or production.",
+		"condition":  "Condition under which the stage runs.",
+		"steps":      "Steps of the stage, run in sequence.",
+	},
+	reflect.TypeOf(models.Parallel{}): {
+		"fail-fast": "Stops the other steps of the group when one fails.",
+		"steps":     "Steps of the group.",
+	},
+	reflect.TypeOf(models.Step{}): {
+		"name":         "Name of the step, which also selects its runner step type.",
+		"image":        "Docker image the step runs in.",
+		"trigger":      "Whether the step starts automatically or waits to be started manually.",
+		"deployment":   "Deployment environment of the step, such as test, staging or production.",
+		"script":       "Commands and pipes run in sequence. The step fails at the first failing command or pipe.",
+		"services":     "Services started next to the step, from definitions.services or docker.",
+		"artifacts":    "Files passed on to the following steps.",
+		"caches":       "Caches restored before and saved after the step, predefined or from definitions.caches.",
+		"after-script": "Commands and pipes run after the script, even when it fails. BITBUCKET_EXIT_CODE holds its exit code.",
+		"condition":    "Condition under which the step runs.",
+		"environment":  "Variables set for the step.",
+		"size":         "Memory and CPU of the step, as a multiple of a regular step.",
+		"max-time":     "Maximum duration of the step, in minutes.",
+		"clone":        "How the repository is cloned into the step.",
+		"oidc":         "Whether the step receives an OpenID Connect token.",
+		"runs-on":      "Labels of the self-hosted runners the step runs on.",
+	},
+	reflect.TypeOf(models.Pipe{}): {
+		"pipe":      "Pipe run, such as atlassian/aws-s3-deploy:1.1.0, or a Docker image written docker://<image>.",
+		"variables": "Variables passed to the pipe, which may reference the variables of the step. Lists are passed as <NAME>_COUNT and <NAME>_<index>.",
+	},
+	reflect.TypeOf(models.Image{}): {
+		"name":        "Name of the image, with its registry when it is not on Docker Hub.",
+		"username":    "User name of the registry, usually a variable such as $REGISTRY_USER.",
+		"password":    "Password of the registry, usually a secured variable.",
+		"email":       "Email of the registry account.",
+		"run-as-user": "UID the step container runs as.",
+		"aws":         "Credentials of an image stored in Amazon ECR.",
+	},
+	reflect.TypeOf(models.ImageAWS{}): {
+		"access-key": "AWS access key ID, usually a variable.",
+		"secret-key": "AWS secret access key, usually a secured variable.",
+		"oidc-role":  "ARN of the role assumed with OpenID Connect in Bitbucket Cloud.",
+	},
+	reflect.TypeOf(models.CloneConfig{}): {
+		"enabled":         "Whether the repository is cloned.",
+		"depth":           "Number of commits cloned, or full for the whole history.",
+		"lfs":             "Whether Git LFS files are downloaded.",
+		"skip-ssl-verify": "Whether the certificate of the server is verified.",
+	},
+	reflect.TypeOf(models.Definitions{}): {
+		"steps":     "Steps reused by the pipelines through YAML anchors, as \"step: *name\" or merged with \"<<: *name\".",
+		"services":  "Services by name, such as databases, started next to the steps that use them.",
+		"caches":    "Caches by name, a directory or an object with a key and paths.",
+		"pipelines": "Pipelines by name, which other repositories import when the configuration is exported.",
+	},
+	reflect.TypeOf(models.Service{}): {
+		"image":       "Docker image of the service.",
+		"environment": "Variables set for the service.",
+		"ports":       "Ports the service listens on, shared with the step network.",
+		"memory":      "Memory of the service, in megabytes.",
+		"type":        "Type of the service, docker for the Docker service.",
+		"variables":   "Variables of the Docker service.",
+	},
+	reflect.TypeOf(models.Cache{}): {
+		"key":   "Key the cache is stored under.",
+		"paths": "Directories of the cache.",
+		"path":  "Directory of the cache.",
+	},
+	reflect.TypeOf(models.Artifacts{}): {
+		"paths": "Glob patterns of the files kept, relative to the clone directory.",
+	},
+	reflect.TypeOf(models.Condition{}): {
+		"changesets": "Runs only when the changed files match.",
+	},
+	reflect.TypeOf(models.Changesets{}): {
+		"includePaths": "Glob patterns of which at least one changed file must match.",
+		"excludePaths": "Glob patterns of which no changed file may match.",
+	},
+	reflect.TypeOf(models.Options{}): {
+		"docker":   "Whether the Docker service is available to every step.",
+		"size":     "Memory and CPU of every step, as a multiple of a regular step.",
+		"max-time": "Maximum duration of every step, in minutes.",
+		"runtime":  "Runtime of the steps in Bitbucket Cloud.",
+	},
+	reflect.TypeOf(models.RunnerConfig{}): {
+		"version":     "Version of the configuration format.",
+		"stepTypes":   "Images, volumes, ports and timeouts by step name, default applying to the other steps.",
+		"environment": "Variables set for every step.",
+		"defaults":    "Settings of steps without a step type.",
+		"logging":     "Logging of the runner.",
+		"docker":      "Connection to Docker and image pulling.",
+		"lint":        "Severities of the validation and lint rules.",
+		"imports":     "Clone directories, working copies or bare clones, by repository pipelines are imported from.",
+		"transforms":  "Executables rewriting the pipeline configuration before a run, in order.",
+	},
+	reflect.TypeOf(models.StepType{}): {
+		"image":       "Docker image of the steps, unless they set their own.",
+		"environment": "Variables set for the steps.",
+		"volumes":     "Host directories mounted into the steps.",
+		"ports":       "Ports of the steps published on the host.",
+		"timeout":     "Timeout of the steps, in seconds.",
+	},
+	reflect.TypeOf(models.VolumeMount{}): {
+		"host":      "Directory of the host.",
+		"container": "Directory of the container.",
+		"readOnly":  "Whether the volume is mounted read-only.",
+	},
+	reflect.TypeOf(models.PortMapping{}): {
+		"host":      "Port of the host.",
+		"container": "Port of the container.",
+		"protocol":  "Protocol of the port.",
+	},
+	reflect.TypeOf(models.DefaultConfig{}): {
+		"image":      "Docker image of steps when neither the step nor the configuration sets one.",
+		"workingDir": "Directory of the clone in the containers.",
+		"timeout":    "Timeout of the steps, in seconds.",
+		"shell":      "Shell running the scripts.",
+		"stateDir":   "Directory of the runs and artifacts, inside the project, .bitbucket-runner by default.",
+	},
+	reflect.TypeOf(models.LoggingConfig{}): {
+		"level":      "Minimum level of the messages logged.",
+		"format":     "Format of the messages logged.",
+		"outputFile": "File the messages are written to.",
+	},
+	reflect.TypeOf(models.DockerConfig{}): {
+		"host":       "Address of the Docker daemon, passed to the client as --host. Unset, the client uses DOCKER_HOST or the current docker context.",
+		"apiVersion": "Version of the Docker API.",
+		"registry":   "Registry images of Docker Hub are pulled from instead, such as a pull-through mirror.",
+		"pullPolicy": "When images are pulled before a run: always, when missing, or never.",
+		"rewrites":   "Replacements of image names, applied in order to the images of steps, services and pipes, the first matching one winning.",
+	},
+	reflect.TypeOf(models.ImageRewrite{}): {
+		"match":   "Image name replaced, or prefix when it ends with *, matched against the name as written and as docker.io/library/node:18 for node:18.",
+		"regex":   "Regular expression matching the whole image name replaced, instead of match.",
+		"replace": "New image name, where * stands for the remainder of a prefix and $1 for the groups of a regex.",
+	},
+	reflect.TypeOf(models.TransformHook{}): {
+		"name":    "Name of the transform, shown in the execution plan.",
+		"command": "Executable reading the configuration as JSON on its standard input and writing the new configuration on its standard output, relative to the project.",
+		"args":    "Arguments of the executable.",
+		"timeout": "Timeout of the transform, in seconds, 60 by default.",
+	},
+	reflect.TypeOf(models.LintConfig{}): {
+		"rules": "Severity by rule ID: error, warning or off.",
+	},
+}
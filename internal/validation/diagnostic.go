@@ -0,0 +1,147 @@
+// Package validation checks configuration files, reporting every problem
+// found together with its position in the file.
+package validation
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Severity tells whether a diagnostic makes a configuration unusable
+type Severity string
+
+const (
+	SeverityError   Severity = "error"
+	SeverityWarning Severity = "warning"
+	// SeverityOff disables a rule in configurations
+	SeverityOff Severity = "off"
+)
+
+// Diagnostic is a problem found in a configuration file. Line and Column
+// are 1-based and zero when the position is unknown.
+type Diagnostic struct {
+	File     string   `json:"file"`
+	Line     int      `json:"line"`
+	Column   int      `json:"column"`
+	Severity Severity `json:"severity"`
+	Message  string   `json:"message"`
+	Rule     string   `json:"rule,omitempty"`
+	Fix      *Fix     `json:"fix,omitempty"`
+}
+
+// Fix is an automatic correction of a diagnostic
+type Fix struct {
+	Description string `json:"description"`
+	Edits       []Edit `json:"edits"`
+}
+
+// Edit replaces the text from Line and Column up to EndLine and EndColumn,
+// excluded, with Text. Positions are 1-based, equal for insertions.
+type Edit struct {
+	Line      int    `json:"line"`
+	Column    int    `json:"column"`
+	EndLine   int    `json:"end_line"`
+	EndColumn int    `json:"end_column"`
+	Text      string `json:"text"`
+}
+
+// String formats the diagnostic as file:line:column: severity: message,
+// which editors and CI systems recognize, followed by the rule ID if any
+func (d Diagnostic) String() string {
+	position := d.File
+	if d.Line > 0 {
+		position += fmt.Sprintf(":%d", d.Line)
+		if d.Column > 0 {
+			position += fmt.Sprintf(":%d", d.Column)
+		}
+	}
+	if d.Rule != "" {
+		return fmt.Sprintf("%s: %s: %s [%s]", position, d.Severity, d.Message, d.Rule)
+	}
+	return fmt.Sprintf("%s: %s: %s", position, d.Severity, d.Message)
+}
+
+// Diagnostics is a list of diagnostics
+type Diagnostics []Diagnostic
+
+// Errors returns the diagnostics of severity error
+func (ds Diagnostics) Errors() Diagnostics {
+	return ds.filter(SeverityError)
+}
+
+// Warnings returns the diagnostics of severity warning
+func (ds Diagnostics) Warnings() Diagnostics {
+	return ds.filter(SeverityWarning)
+}
+
+// HasErrors reports whether any diagnostic is an error
+func (ds Diagnostics) HasErrors() bool {
+	return len(ds.Errors()) > 0
+}
+
+// Err returns an *Error holding the errors of the list, or nil when there
+// are none
+func (ds Diagnostics) Err() error {
+	errors := ds.Errors()
+	if len(errors) == 0 {
+		return nil
+	}
+	return &Error{Diagnostics: errors}
+}
+
+func (ds Diagnostics) filter(severity Severity) Diagnostics {
+	var filtered Diagnostics
+	for _, d := range ds {
+		if d.Severity == severity {
+			filtered = append(filtered, d)
+		}
+	}
+	return filtered
+}
+
+// normalize sorts the diagnostics by position and drops duplicates, which
+// arise when an anchored node is checked everywhere it is referenced
+func (ds Diagnostics) normalize() Diagnostics {
+	sort.SliceStable(ds, func(i, j int) bool {
+		a, b := ds[i], ds[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		if a.Column != b.Column {
+			return a.Column < b.Column
+		}
+		return a.Message < b.Message
+	})
+
+	var unique Diagnostics
+	for i, d := range ds {
+		if i > 0 && d.same(ds[i-1]) {
+			continue
+		}
+		unique = append(unique, d)
+	}
+	return unique
+}
+
+// same reports whether two diagnostics describe the same problem
+func (d Diagnostic) same(other Diagnostic) bool {
+	d.Fix, other.Fix = nil, nil
+	return d == other
+}
+
+// Error is the error of a configuration that has error diagnostics
+type Error struct {
+	Diagnostics Diagnostics
+}
+
+func (e *Error) Error() string {
+	lines := make([]string, len(e.Diagnostics))
+	for i, d := range e.Diagnostics {
+		lines[i] = d.String()
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,145 @@
+package validation
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"bitbucket-runner/internal/models"
+	"bitbucket-runner/internal/suggest"
+
+	"gopkg.in/yaml.v3"
+)
+
+// unsupportedFields lists, by model type, the fields Bitbucket accepts
+// that the runner ignores, which are reported as warnings
+var unsupportedFields = map[reflect.Type][]string{
+	reflect.TypeOf(models.Step{}):        {"size", "max-time", "clone", "oidc", "runs-on"},
+	reflect.TypeOf(models.Service{}):     {"memory", "type", "variables"},
+	reflect.TypeOf(models.Options{}):     {"max-time", "runtime"},
+	reflect.TypeOf(models.CloneConfig{}): {"skip-ssl-verify"},
+}
+
+// listForms maps the types that may also be written as a list to the type
+// of that list
+var listForms = map[reflect.Type]reflect.Type{
+	reflect.TypeOf(models.Parallel{}):  reflect.TypeOf([]models.StepWrapper{}),
+	reflect.TypeOf(models.Artifacts{}): reflect.TypeOf([]string{}),
+}
+
+// mappingForms maps the list types that may also be written as a mapping
+// to the type of that mapping
+var mappingForms = map[reflect.Type]reflect.Type{
+	reflect.TypeOf(models.Pipeline{}): reflect.TypeOf(models.PipelineImport{}),
+}
+
+// entryTypes are the types whose keys are checked by the structural
+// validation, which reports unexpected keys itself
+var entryTypes = map[reflect.Type]bool{
+	reflect.TypeOf(models.StepWrapper{}): true,
+}
+
+// checkFields reports the keys of node that t, the type node decodes into,
+// does not declare, suggesting the closest declared key. Nodes that do not
+// have the shape of t are left to the structural checks and decoding.
+func (v *validator) checkFields(node *yaml.Node, t reflect.Type, where string) {
+	node = resolve(node)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		if list, ok := listForms[t]; ok && node.Kind == yaml.SequenceNode {
+			v.checkFields(node, list, where)
+			return
+		}
+		if node.Kind != yaml.MappingNode {
+			return
+		}
+
+		fields := fieldsOf(t)
+		for _, p := range v.pairs(node) {
+			field, ok := fields[p.key.Value]
+			if ok {
+				v.checkFields(p.value, field, p.key.Value)
+				continue
+			}
+			switch {
+			case contains(unsupportedFields[t], p.key.Value):
+				v.warnf(p.key, "field \"%s\" in %s is not supported and is ignored", p.key.Value, where)
+			case entryTypes[t]:
+			default:
+				v.unknownField(p.key, where, fields)
+			}
+		}
+	case reflect.Slice:
+		if mapping, ok := mappingForms[t]; ok && node.Kind == yaml.MappingNode {
+			v.checkFields(node, mapping, where)
+			return
+		}
+		if node.Kind != yaml.SequenceNode {
+			return
+		}
+		for _, item := range node.Content {
+			v.checkFields(item, t.Elem(), where)
+		}
+	case reflect.Map:
+		if node.Kind != yaml.MappingNode {
+			return
+		}
+		for _, p := range v.pairs(node) {
+			v.checkFields(p.value, t.Elem(), fmt.Sprintf("%s '%s'", where, p.key.Value))
+		}
+	}
+}
+
+func (v *validator) unknownField(key *yaml.Node, where string, fields map[string]reflect.Type) {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	if match, ok := suggest.Closest(key.Value, names); ok {
+		v.errorf(key, "unknown field \"%s\" in %s, did you mean \"%s\"?", key.Value, where, match)
+		return
+	}
+	v.errorf(key, "unknown field \"%s\" in %s", key.Value, where)
+}
+
+// fieldsOf returns the YAML keys of a struct type with the types they
+// decode into, following the naming rules of the YAML library
+func fieldsOf(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+
+		tag := field.Tag.Get("yaml")
+		if tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		if strings.Contains(","+options+",", ",inline,") {
+			for inlined, inlinedType := range fieldsOf(field.Type) {
+				fields[inlined] = inlinedType
+			}
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(field.Name)
+		}
+		fields[name] = field.Type
+	}
+	return fields
+}
+
+func contains(values []string, value string) bool {
+	for _, candidate := range values {
+		if candidate == value {
+			return true
+		}
+	}
+	return false
+}
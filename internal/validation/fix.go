@@ -0,0 +1,105 @@
+package validation
+
+import "sort"
+
+// maxFixPasses bounds the passes of FixPipelineConfig, as a fix may reveal
+// another problem
+const maxFixPasses = 10
+
+// FixPipelineConfig applies the fixes of the diagnostics of a pipeline
+// configuration until none is left, returning the fixed content and the
+// number of fixes applied
+func FixPipelineConfig(file string, data []byte, options Options) ([]byte, int) {
+	total := 0
+	for pass := 0; pass < maxFixPasses; pass++ {
+		fixed, count := ApplyFixes(data, ValidatePipelineConfig(file, data, options))
+		if count == 0 {
+			break
+		}
+		data, total = fixed, total+count
+	}
+	return data, total
+}
+
+// ApplyFixes applies the fixes of the diagnostics to data and returns the
+// result with the number of fixes applied. A fix whose edits overlap those
+// of a fix already applied is skipped; the next validation reports it again.
+func ApplyFixes(data []byte, diagnostics Diagnostics) ([]byte, int) {
+	offsets := lineOffsets(data)
+
+	type span struct{ start, end int }
+	type edit struct {
+		span
+		text string
+	}
+	var edits []edit
+	var taken []span
+	count := 0
+
+fixes:
+	for _, d := range diagnostics {
+		if d.Fix == nil || len(d.Fix.Edits) == 0 {
+			continue
+		}
+		var fixEdits []edit
+		for _, e := range d.Fix.Edits {
+			start, ok := offsetOf(data, offsets, e.Line, e.Column)
+			if !ok {
+				continue fixes
+			}
+			end, ok := offsetOf(data, offsets, e.EndLine, e.EndColumn)
+			if !ok || end < start {
+				continue fixes
+			}
+			for _, other := range taken {
+				// Insertions at the same position would apply in any order
+				if start < other.end && other.start < end || start == other.start {
+					continue fixes
+				}
+			}
+			fixEdits = append(fixEdits, edit{span{start, end}, e.Text})
+		}
+		for _, e := range fixEdits {
+			taken = append(taken, e.span)
+		}
+		edits = append(edits, fixEdits...)
+		count++
+	}
+
+	// Applying the edits from the end keeps the offsets of the others valid
+	sort.Slice(edits, func(i, j int) bool { return edits[i].start > edits[j].start })
+	result := string(data)
+	for _, e := range edits {
+		result = result[:e.start] + e.text + result[e.end:]
+	}
+	return []byte(result), count
+}
+
+// lineOffsets returns the byte offset of the start of every line
+func lineOffsets(data []byte) []int {
+	offsets := []int{0}
+	for i, b := range data {
+		if b == '\n' {
+			offsets = append(offsets, i+1)
+		}
+	}
+	return offsets
+}
+
+// offsetOf converts a 1-based line and column, counted in characters as
+// the YAML library does, to a byte offset
+func offsetOf(data []byte, offsets []int, line, column int) (int, bool) {
+	if line < 1 || line > len(offsets) || column < 1 {
+		return 0, false
+	}
+	start := offsets[line-1]
+	end := len(data)
+	if line < len(offsets) {
+		end = offsets[line] - 1
+	}
+	text := string(data[start:end])
+	if column-1 > len([]rune(text)) {
+		return 0, false
+	}
+	return start + len(string([]rune(text)[:column-1])), true
+}
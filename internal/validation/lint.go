@@ -0,0 +1,242 @@
+package validation
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"bitbucket-runner/internal/models"
+
+	"gopkg.in/yaml.v3"
+)
+
+// IDs of the lint rules
+const (
+	RuleUnpinnedImage    = "unpinned-image"
+	RuleHardcodedSecret  = "hardcoded-secret"
+	RuleMissingCache     = "missing-cache"
+	RuleLongScriptLine   = "long-script-line"
+	RuleDeprecatedSyntax = "deprecated-syntax"
+)
+
+// LintRules lists the rules checking best practices, with their default
+// severity. They are only checked when Options.Lint is set.
+var LintRules = []Rule{
+	{RuleUnpinnedImage, SeverityWarning, "images are pinned to a version rather than the latest tag"},
+	{RuleHardcodedSecret, SeverityError, "scripts and variables do not contain secrets, which belong in secured variables"},
+	{RuleMissingCache, SeverityWarning, "steps running a package manager use its predefined cache"},
+	{RuleLongScriptLine, SeverityWarning, fmt.Sprintf("script lines are at most %d characters long", maxScriptLineLength)},
+	{RuleDeprecatedSyntax, SeverityWarning, "deprecated syntax and images are not used"},
+}
+
+// maxScriptLineLength is the length above which a script line should be
+// split or moved to a script file
+const maxScriptLineLength = 200
+
+// secretPatterns match secrets written in scripts
+var secretPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`AKIA[0-9A-Z]{16}`),                   // AWS access key
+	regexp.MustCompile(`gh[pousr]_[A-Za-z0-9]{36}`),          // GitHub token
+	regexp.MustCompile(`xox[abpors]-[A-Za-z0-9-]{10,}`),      // Slack token
+	regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----`), // private key
+	regexp.MustCompile(`[a-z][a-z0-9+.-]*://[^/\s:@$]+:[^/\s@$]+@`),
+	regexp.MustCompile(`(?i)\b[A-Z0-9_]*(PASSWORD|PASSWD|SECRET|TOKEN|API_?KEY)[A-Z0-9_]*=["']?[^\s"'$]{6,}`),
+	regexp.MustCompile(`(?i)--(password|token|api-key)[= ]["']?[^\s"'$-][^\s"']{3,}`),
+}
+
+// packageManagers maps commands to the predefined cache of the packages
+// they install
+var packageManagers = []struct {
+	cache   string
+	command *regexp.Regexp
+}{
+	{"node", regexp.MustCompile(`\b(npm (ci|install|i)|yarn)\b`)},
+	{"pip", regexp.MustCompile(`\bpip3? install\b`)},
+	{"maven", regexp.MustCompile(`(\bmvn|\./mvnw)\b`)},
+	{"gradle", regexp.MustCompile(`(\bgradle|\./gradlew)\b`)},
+	{"composer", regexp.MustCompile(`\bcomposer install\b`)},
+	{"dotnetcore", regexp.MustCompile(`\bdotnet (restore|build|test)\b`)},
+	{"sbt", regexp.MustCompile(`\bsbt\b`)},
+}
+
+// deprecatedImages maps deprecated images to their replacement
+var deprecatedImages = map[string]string{
+	"atlassian/default-image":   "atlassian/default-image:4",
+	"atlassian/default-image:1": "atlassian/default-image:4",
+	"atlassian/default-image:2": "atlassian/default-image:4",
+}
+
+// lint applies the lint rules to the references collected by the
+// structural checks
+func (v *validator) lint() {
+	for _, image := range v.images {
+		v.lintImage(image)
+	}
+	for _, secret := range v.secrets {
+		if value := secret.node.Value; value != "" && !strings.Contains(value, "$") {
+			v.violation(RuleHardcodedSecret, secret.node, "%s is hard-coded, use a secured variable instead", secret.what)
+		}
+	}
+	for _, boolean := range v.booleans {
+		value := "false"
+		if legacyBooleans[boolean.Value] {
+			value = "true"
+		}
+		if d := v.violation(RuleDeprecatedSyntax, boolean, "'%s' is a YAML 1.1 boolean, write %s", boolean.Value, value); d != nil {
+			d.Fix = &Fix{
+				Description: fmt.Sprintf("replace '%s' with %s", boolean.Value, value),
+				Edits:       []Edit{replaceScalar(boolean, value)},
+			}
+		}
+	}
+
+	for _, pipeline := range v.pipelines {
+		for _, step := range pipeline.steps {
+			v.lintStep(step)
+		}
+	}
+}
+
+func (v *validator) lintImage(image *yaml.Node) {
+	name := image.Value
+	if strings.Contains(name, "$") {
+		return
+	}
+	if replacement, ok := deprecatedImages[name]; ok {
+		v.violation(RuleDeprecatedSyntax, image, "image '%s' is deprecated, use %s", name, replacement)
+		return
+	}
+
+	if strings.Contains(name, "@") {
+		return
+	}
+	tag := ""
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		tag = name[i+1:]
+	}
+	switch tag {
+	case "":
+		v.violation(RuleUnpinnedImage, image, "image '%s' has no tag and runs the latest version, pin it to a version", name)
+	case "latest":
+		v.violation(RuleUnpinnedImage, image, "image '%s' uses the latest tag, pin it to a version", name)
+	}
+}
+
+func (v *validator) lintStep(step stepRefs) {
+	what := "step"
+	if step.name != nil {
+		what = fmt.Sprintf("step '%s'", step.name.Value)
+	}
+
+	for _, variable := range step.environment {
+		value := variable.value.Value
+		if models.IsSecretVariable(variable.key.Value) && value != "" && !strings.Contains(value, "$") {
+			v.violation(RuleHardcodedSecret, variable.value, "variable '%s' of %s looks like a hard-coded secret, use a secured variable instead",
+				variable.key.Value, what)
+		}
+	}
+
+	var commands []string
+	for _, line := range step.script {
+		commands = append(commands, line.Value)
+		for _, pattern := range secretPatterns {
+			if pattern.MatchString(line.Value) {
+				v.violation(RuleHardcodedSecret, line, "script of %s looks like it contains a hard-coded secret, use a secured variable instead", what)
+				break
+			}
+		}
+		for _, text := range strings.Split(line.Value, "\n") {
+			if length := len([]rune(text)); length > maxScriptLineLength {
+				v.violation(RuleLongScriptLine, line, "script line of %d characters, split it or move it to a script file", length)
+				break
+			}
+		}
+	}
+
+	script := strings.Join(commands, "\n")
+	for _, manager := range packageManagers {
+		command := manager.command.FindString(script)
+		if command == "" || containsValue(step.caches, manager.cache) {
+			continue
+		}
+		d := v.violation(RuleMissingCache, step.entry, "%s runs '%s' without the %s cache", what, command, manager.cache)
+		if d != nil {
+			d.Fix = v.addCacheFix(step, manager.cache)
+		}
+	}
+}
+
+// addCacheFix adds a cache to a step, or returns nil when the layout of
+// the step is not one the fix handles
+func (v *validator) addCacheFix(step stepRefs, cache string) *Fix {
+	fix := &Fix{Description: fmt.Sprintf("add the %s cache", cache)}
+	switch {
+	case step.cacheList == nil:
+		if step.node.Kind != yaml.MappingNode || step.node.Style&yaml.FlowStyle != 0 || len(step.node.Content) == 0 {
+			return nil
+		}
+		first := step.node.Content[0]
+		indent, ok := v.indentation(first)
+		if !ok {
+			return nil
+		}
+		fix.Edits = []Edit{insertAt(first.Line, 1, fmt.Sprintf("%scaches:\n%s  - %s\n", indent, indent, cache))}
+	case step.cacheList.Kind != yaml.SequenceNode:
+		return nil
+	case step.cacheList.Style&yaml.FlowStyle != 0:
+		text := cache
+		if len(step.cacheList.Content) > 0 {
+			text += ", "
+		}
+		fix.Edits = []Edit{insertAt(step.cacheList.Line, step.cacheList.Column+1, text)}
+	default:
+		if len(step.cacheList.Content) == 0 {
+			return nil
+		}
+		first := step.cacheList.Content[0]
+		line := v.lines[first.Line-1]
+		trimmed := strings.TrimLeft(line, " ")
+		if !strings.HasPrefix(trimmed, "- ") {
+			return nil
+		}
+		indent := line[:len(line)-len(trimmed)]
+		fix.Edits = []Edit{insertAt(first.Line, 1, fmt.Sprintf("%s- %s\n", indent, cache))}
+	}
+	return fix
+}
+
+// indentation returns the spaces before node when it starts its line
+func (v *validator) indentation(node *yaml.Node) (string, bool) {
+	if node.Line < 1 || node.Line > len(v.lines) {
+		return "", false
+	}
+	prefix := []rune(v.lines[node.Line-1])
+	if node.Column-1 > len(prefix) {
+		return "", false
+	}
+	indent := string(prefix[:node.Column-1])
+	return indent, strings.Trim(indent, " ") == ""
+}
+
+// replaceScalar replaces the text of a single line scalar, including its
+// quotes
+func replaceScalar(node *yaml.Node, text string) Edit {
+	length := len([]rune(node.Value))
+	if node.Style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle) != 0 {
+		length += 2
+	}
+	return Edit{Line: node.Line, Column: node.Column, EndLine: node.Line, EndColumn: node.Column + length, Text: text}
+}
+
+func insertAt(line, column int, text string) Edit {
+	return Edit{Line: line, Column: column, EndLine: line, EndColumn: column, Text: text}
+}
+
+func containsValue(nodes []*yaml.Node, value string) bool {
+	for _, node := range nodes {
+		if node.Value == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,191 @@
+package validation
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func lintMessages(content string, options Options) []string {
+	options.Lint = true
+	var lines []string
+	for _, d := range ValidatePipelineConfig("bitbucket-pipelines.yml", []byte(content), options) {
+		lines = append(lines, d.String())
+	}
+	return lines
+}
+
+func TestValidatePipelineConfig_Lint(t *testing.T) {
+	t.Run("rules", func(t *testing.T) {
+		content := `image: node
+options:
+  docker: yes
+definitions:
+  services:
+    postgres:
+      image: postgres:latest
+pipelines:
+  default:
+    - step:
+        name: Build
+        image: atlassian/default-image:2
+        script:
+          - npm ci
+          - export API_TOKEN=abcdef123456
+          - echo ` + strings.Repeat("x", 200) + `
+        environment:
+          DB_PASSWORD: hunter2
+          DB_USER: app
+    - step:
+        name: Test
+        image: $IMAGE
+        caches: [node]
+        script: [npm test, npm ci]
+        environment:
+          DB_PASSWORD: $DB_PASSWORD
+`
+		assert.Equal(t, []string{
+			"bitbucket-pipelines.yml:1:8: warning: image 'node' has no tag and runs the latest version, pin it to a version [unpinned-image]",
+			"bitbucket-pipelines.yml:3:11: warning: 'yes' is a YAML 1.1 boolean, write true [deprecated-syntax]",
+			"bitbucket-pipelines.yml:7:14: warning: image 'postgres:latest' uses the latest tag, pin it to a version [unpinned-image]",
+			"bitbucket-pipelines.yml:10:7: warning: step 'Build' runs 'npm ci' without the node cache [missing-cache]",
+			"bitbucket-pipelines.yml:12:16: warning: image 'atlassian/default-image:2' is deprecated, use atlassian/default-image:4 [deprecated-syntax]",
+			"bitbucket-pipelines.yml:15:13: error: script of step 'Build' looks like it contains a hard-coded secret, use a secured variable instead [hardcoded-secret]",
+			"bitbucket-pipelines.yml:16:13: warning: script line of 205 characters, split it or move it to a script file [long-script-line]",
+			"bitbucket-pipelines.yml:18:24: error: variable 'DB_PASSWORD' of step 'Build' looks like a hard-coded secret, use a secured variable instead [hardcoded-secret]",
+		}, lintMessages(content, Options{}))
+	})
+
+	t.Run("image credentials", func(t *testing.T) {
+		content := `image:
+  name: registry.example.com/build:1.4
+  username: ci
+  password: hunter2
+pipelines:
+  default:
+    - step:
+        image:
+          name: 123456789012.dkr.ecr.eu-west-1.amazonaws.com/app:2
+          aws:
+            access-key: $AWS_ACCESS_KEY_ID
+            secret-key: wJalrXUtnFEMI
+        script: [make]
+`
+		assert.Equal(t, []string{
+			"bitbucket-pipelines.yml:4:13: error: password of image is hard-coded, use a secured variable instead [hardcoded-secret]",
+			"bitbucket-pipelines.yml:12:25: error: aws secret-key of step image is hard-coded, use a secured variable instead [hardcoded-secret]",
+		}, lintMessages(content, Options{}))
+	})
+
+	t.Run("only with lint", func(t *testing.T) {
+		content := "image: node\npipelines:\n  default:\n    - step:\n        script: [npm ci]\n"
+		assert.Empty(t, ValidatePipelineConfig("bitbucket-pipelines.yml", []byte(content), Options{}))
+		assert.Len(t, lintMessages(content, Options{}), 2)
+	})
+
+	t.Run("severities", func(t *testing.T) {
+		content := "image: node\npipelines:\n  default:\n    - step:\n        script: [npm ci]\n"
+		assert.Equal(t, []string{
+			"bitbucket-pipelines.yml:1:8: error: image 'node' has no tag and runs the latest version, pin it to a version [unpinned-image]",
+		}, lintMessages(content, Options{Severities: map[string]Severity{
+			RuleUnpinnedImage: SeverityError,
+			RuleMissingCache:  SeverityOff,
+		}}))
+		assert.Empty(t, lintMessages(content, Options{Disabled: []string{RuleUnpinnedImage, RuleMissingCache}}))
+	})
+}
+
+func TestValidatePipelineConfig_Suppressions(t *testing.T) {
+	t.Run("lines", func(t *testing.T) {
+		content := `image: node # lint-ignore unpinned-image
+pipelines:
+  default:
+    # lint-ignore
+    - step:
+        services: [redis] # lint-ignore missing-cache
+        script: [npm ci]
+`
+		assert.Equal(t, []string{
+			"bitbucket-pipelines.yml:6:20: error: service 'redis' is not defined in definitions.services [undefined-service]",
+		}, lintMessages(content, Options{}))
+	})
+
+	t.Run("file", func(t *testing.T) {
+		content := `# lint-ignore-file unpinned-image, missing-cache
+image: node
+pipelines:
+  default:
+    - step:
+        script: [npm ci]
+`
+		assert.Empty(t, lintMessages(content, Options{}))
+	})
+
+	t.Run("structural checks cannot be suppressed", func(t *testing.T) {
+		content := "# lint-ignore-file\npipelines:\n  default:\n    - step:\n        name: Build\n"
+		assert.Equal(t, []string{
+			"bitbucket-pipelines.yml:4:7: error: step 'Build' has no script",
+		}, lintMessages(content, Options{}))
+	})
+
+	t.Run("unknown rule", func(t *testing.T) {
+		content := "image: node # lint-ignore unpinned-images\npipelines:\n  default:\n    - step:\n        script: [make]\n"
+		assert.Equal(t, []string{
+			"bitbucket-pipelines.yml:1:8: warning: image 'node' has no tag and runs the latest version, pin it to a version [unpinned-image]",
+			"bitbucket-pipelines.yml:1:13: warning: lint-ignore comment: unknown rule 'unpinned-images', did you mean 'unpinned-image'?",
+		}, lintMessages(content, Options{}))
+	})
+}
+
+func TestFixPipelineConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{
+			"legacy booleans",
+			"options:\n  docker: 'on'\nclone:\n  lfs: no\npipelines:\n  default:\n    - step:\n        script: [make]\n",
+			"options:\n  docker: true\nclone:\n  lfs: false\npipelines:\n  default:\n    - step:\n        script: [make]\n",
+		},
+		{
+			"cache added to a block list",
+			"pipelines:\n  default:\n    - step:\n        caches:\n          - pip\n        script:\n          - npm ci\n          - pip install .\n",
+			"pipelines:\n  default:\n    - step:\n        caches:\n          - node\n          - pip\n        script:\n          - npm ci\n          - pip install .\n",
+		},
+		{
+			"caches added to a flow list",
+			"pipelines:\n  default:\n    - step:\n        caches: []\n        script: [npm ci, mvn package]\n",
+			"pipelines:\n  default:\n    - step:\n        caches: [node, maven]\n        script: [npm ci, mvn package]\n",
+		},
+		{
+			"caches key added",
+			"pipelines:\n  default:\n    - step:\n        name: Build\n        script: [npm ci, mvn package]\n",
+			"pipelines:\n  default:\n    - step:\n        caches:\n          - node\n          - maven\n        name: Build\n        script: [npm ci, mvn package]\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fixed, count := FixPipelineConfig("bitbucket-pipelines.yml", []byte(tt.content), Options{Lint: true})
+			assert.Greater(t, count, 0)
+			assert.Equal(t, tt.expected, string(fixed))
+		})
+	}
+}
+
+func TestApplyFixes(t *testing.T) {
+	data := []byte("key: é yes\n")
+	fixed, count := ApplyFixes(data, Diagnostics{
+		{Fix: &Fix{Edits: []Edit{{Line: 1, Column: 8, EndLine: 1, EndColumn: 11, Text: "true"}}}},
+		{Fix: &Fix{Edits: []Edit{{Line: 1, Column: 9, EndLine: 1, EndColumn: 10, Text: "overlapping"}}}},
+		{Fix: &Fix{Edits: []Edit{{Line: 1, Column: 6, EndLine: 1, EndColumn: 6, Text: "'"}}}},
+		{Fix: &Fix{Edits: []Edit{{Line: 1, Column: 6, EndLine: 1, EndColumn: 6, Text: "\""}}}},
+		{Fix: &Fix{Edits: []Edit{{Line: 3, Column: 1, EndLine: 3, EndColumn: 1, Text: "out of range"}}}},
+		{Message: "no fix"},
+	})
+	require.Equal(t, 2, count)
+	assert.Equal(t, "key: 'é true\n", string(fixed))
+}
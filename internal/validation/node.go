@@ -0,0 +1,294 @@
+package validation
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// validator collects the diagnostics of a file, and the references checked
+// by the rules
+type validator struct {
+	file        string
+	lines       []string
+	options     Options
+	diagnostics Diagnostics
+	pipelines   []pipelineRefs
+	definitions definitionRefs
+	images      []*yaml.Node
+	secrets     []secretRef  // credentials, which lint expects in variables
+	booleans    []*yaml.Node // YAML 1.1 booleans such as yes and off
+}
+
+func (v *validator) report(severity Severity, node *yaml.Node, format string, args ...interface{}) {
+	d := Diagnostic{File: v.file, Severity: severity, Message: fmt.Sprintf(format, args...)}
+	if node != nil {
+		d.Line, d.Column = node.Line, node.Column
+	}
+	v.diagnostics = append(v.diagnostics, d)
+}
+
+func (v *validator) errorf(node *yaml.Node, format string, args ...interface{}) {
+	v.report(SeverityError, node, format, args...)
+}
+
+func (v *validator) warnf(node *yaml.Node, format string, args ...interface{}) {
+	v.report(SeverityWarning, node, format, args...)
+}
+
+var (
+	syntaxErrorPattern = regexp.MustCompile(`^yaml: line (\d+): (.*)$`)
+	typeErrorPattern   = regexp.MustCompile(`^line (\d+): (.*)$`)
+)
+
+// parse reads the first document of data. Syntax errors are reported and
+// yield a nil root.
+func (v *validator) parse(data []byte) *yaml.Node {
+	v.lines = strings.Split(string(data), "\n")
+	var document yaml.Node
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		v.reportYAMLError(err)
+		return nil
+	}
+	if len(document.Content) == 0 {
+		v.errorf(nil, "the file is empty")
+		return nil
+	}
+	return resolve(document.Content[0])
+}
+
+// reportYAMLError turns the errors of the YAML library, which only carry a
+// line, into diagnostics
+func (v *validator) reportYAMLError(err error) {
+	messages := []string{err.Error()}
+	if typeError, ok := err.(*yaml.TypeError); ok {
+		messages = typeError.Errors
+	}
+
+	for _, message := range messages {
+		d := Diagnostic{File: v.file, Severity: SeverityError, Message: strings.TrimPrefix(message, "yaml: ")}
+		for _, pattern := range []*regexp.Regexp{syntaxErrorPattern, typeErrorPattern} {
+			if match := pattern.FindStringSubmatch(message); match != nil {
+				d.Line, _ = strconv.Atoi(match[1])
+				d.Message = match[2]
+				break
+			}
+		}
+		v.diagnostics = append(v.diagnostics, d)
+	}
+}
+
+// pair is a key of a mapping with its value
+type pair struct {
+	key   *yaml.Node
+	value *yaml.Node
+}
+
+// pairs returns the entries of a mapping with aliases resolved and merge
+// keys expanded, keys of the mapping itself winning over merged ones.
+// Duplicate keys are reported.
+func (v *validator) pairs(mapping *yaml.Node) []pair {
+	var pairs, merged []pair
+	seen := make(map[string]*yaml.Node)
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		key, value := mapping.Content[i], resolve(mapping.Content[i+1])
+		if key.Tag == "!!merge" {
+			merged = append(merged, v.merge(value)...)
+			continue
+		}
+		if previous, ok := seen[key.Value]; ok {
+			v.errorf(key, "key '%s' is already defined at line %d", key.Value, previous.Line)
+			continue
+		}
+		seen[key.Value] = key
+		pairs = append(pairs, pair{key: key, value: value})
+	}
+
+	for _, p := range merged {
+		if _, ok := seen[p.key.Value]; !ok {
+			seen[p.key.Value] = p.key
+			pairs = append(pairs, p)
+		}
+	}
+	return pairs
+}
+
+// merge returns the entries merged by a merge key, which references a
+// mapping or a list of mappings, earlier mappings winning
+func (v *validator) merge(value *yaml.Node) []pair {
+	switch value.Kind {
+	case yaml.MappingNode:
+		return v.pairs(value)
+	case yaml.SequenceNode:
+		var merged []pair
+		seen := make(map[string]bool)
+		for _, item := range value.Content {
+			item = resolve(item)
+			if item.Kind != yaml.MappingNode {
+				v.errorf(item, "merge key '<<' expects a mapping or a list of mappings, found %s", describe(item))
+				continue
+			}
+			for _, p := range v.pairs(item) {
+				if !seen[p.key.Value] {
+					seen[p.key.Value] = true
+					merged = append(merged, p)
+				}
+			}
+		}
+		return merged
+	}
+	v.errorf(value, "merge key '<<' expects a mapping or a list of mappings, found %s", describe(value))
+	return nil
+}
+
+// mapping reports an error unless node is a mapping. Null nodes are
+// treated as absent.
+func (v *validator) mapping(node *yaml.Node, what string) bool {
+	return v.expect(node, yaml.MappingNode, what)
+}
+
+// list reports an error unless node is a list. Null nodes are treated as
+// absent.
+func (v *validator) list(node *yaml.Node, what string) bool {
+	return v.expect(node, yaml.SequenceNode, what)
+}
+
+// scalar reports an error unless node is a string, number or boolean. Null
+// nodes are treated as absent.
+func (v *validator) scalar(node *yaml.Node, what string) bool {
+	return v.expect(node, yaml.ScalarNode, what)
+}
+
+func (v *validator) expect(node *yaml.Node, kind yaml.Kind, what string) bool {
+	if isNull(node) {
+		return false
+	}
+	if node.Kind != kind {
+		v.errorf(node, "%s must be %s, found %s", what, kindName(kind), describe(node))
+		return false
+	}
+	return true
+}
+
+// stringList reports an error unless node is a list of strings
+func (v *validator) stringList(node *yaml.Node, what string) {
+	if !v.list(node, what) {
+		return
+	}
+	for _, item := range node.Content {
+		item = resolve(item)
+		if item.Kind != yaml.ScalarNode || isNull(item) {
+			v.errorf(item, "entries of %s must be strings, found %s", what, describe(item))
+		}
+	}
+}
+
+// stringMap reports an error unless node is a mapping of strings
+func (v *validator) stringMap(node *yaml.Node, what string) {
+	if !v.mapping(node, what) {
+		return
+	}
+	for _, p := range v.pairs(node) {
+		if p.value.Kind != yaml.ScalarNode {
+			v.errorf(p.value, "%s '%s' must be a string, found %s", what, p.key.Value, describe(p.value))
+		}
+	}
+}
+
+// legacyBooleans are the YAML 1.1 booleans the YAML library still decodes
+var legacyBooleans = map[string]bool{
+	"y": true, "Y": true, "yes": true, "Yes": true, "YES": true, "on": true, "On": true, "ON": true,
+	"n": false, "N": false, "no": false, "No": false, "NO": false, "off": false, "Off": false, "OFF": false,
+}
+
+// boolean reports an error unless node is true or false, or one of the
+// YAML 1.1 booleans, which are recorded for the lint rules
+func (v *validator) boolean(node *yaml.Node, what string) {
+	if !v.scalar(node, what) || node.Tag == "!!bool" {
+		return
+	}
+	if _, ok := legacyBooleans[node.Value]; ok {
+		v.booleans = append(v.booleans, node)
+		return
+	}
+	v.errorf(node, "%s must be true or false, found '%s'", what, node.Value)
+}
+
+// integer reports an error unless node is a whole number
+func (v *validator) integer(node *yaml.Node, what string) {
+	if v.scalar(node, what) && node.Tag != "!!int" {
+		v.errorf(node, "%s must be a whole number, found '%s'", what, node.Value)
+	}
+}
+
+// oneOf reports an error unless node is one of the values
+func (v *validator) oneOf(node *yaml.Node, what string, values ...string) {
+	if !v.scalar(node, what) {
+		return
+	}
+	for _, value := range values {
+		if node.Value == value {
+			return
+		}
+	}
+	v.errorf(node, "%s must be %s, found '%s'", what, strings.Join(values, " or "), node.Value)
+}
+
+// scalars returns the scalar items of a list
+func scalars(node *yaml.Node) []*yaml.Node {
+	var items []*yaml.Node
+	if node.Kind != yaml.SequenceNode {
+		return nil
+	}
+	for _, item := range node.Content {
+		if item = resolve(item); item.Kind == yaml.ScalarNode && !isNull(item) {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// resolve follows aliases to the node they reference
+func resolve(node *yaml.Node) *yaml.Node {
+	for node.Kind == yaml.AliasNode && node.Alias != nil {
+		node = node.Alias
+	}
+	return node
+}
+
+func isNull(node *yaml.Node) bool {
+	return node == nil || (node.Kind == yaml.ScalarNode && node.Tag == "!!null")
+}
+
+func isEmpty(node *yaml.Node) bool {
+	return isNull(node) || (node.Kind != yaml.ScalarNode && len(node.Content) == 0)
+}
+
+func kindName(kind yaml.Kind) string {
+	switch kind {
+	case yaml.MappingNode:
+		return "a mapping"
+	case yaml.SequenceNode:
+		return "a list"
+	}
+	return "a string"
+}
+
+// describe names the type of a node for diagnostics
+func describe(node *yaml.Node) string {
+	if node.Kind != yaml.ScalarNode {
+		return kindName(node.Kind)
+	}
+	switch node.Tag {
+	case "!!null":
+		return "nothing"
+	case "!!bool":
+		return "a boolean"
+	case "!!int", "!!float":
+		return "a number"
+	}
+	return "a string"
+}
@@ -0,0 +1,775 @@
+package validation
+
+import (
+	"fmt"
+	"reflect"
+
+	"bitbucket-runner/internal/models"
+	"bitbucket-runner/internal/suggest"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ValidatePipelineConfig checks the content of a bitbucket-pipelines.yml
+// file and returns all the problems found, sorted by position
+func ValidatePipelineConfig(file string, data []byte, options Options) Diagnostics {
+	v := &validator{
+		file:        file,
+		options:     options,
+		definitions: definitionRefs{services: make(map[string][]*yaml.Node), caches: make(map[string]bool)},
+	}
+	root := v.parse(data)
+	if root != nil {
+		v.validateRoot(root)
+		v.checkFields(root, reflect.TypeOf(models.PipelineConfig{}), "the configuration")
+		v.checkReferences()
+		if options.Lint {
+			v.lint()
+		}
+	}
+
+	// Whatever the checks above missed still fails decoding
+	if !v.diagnostics.HasErrors() {
+		var config models.PipelineConfig
+		if err := yaml.Unmarshal(data, &config); err != nil {
+			v.reportYAMLError(err)
+		}
+	}
+	v.suppress()
+	if options.Pipeline != nil {
+		v.selectPipeline(root)
+	}
+	return v.diagnostics.normalize()
+}
+
+func (v *validator) validateRoot(root *yaml.Node) {
+	if root.Kind != yaml.MappingNode {
+		v.errorf(root, "the configuration must be a mapping, found %s", describe(root))
+		return
+	}
+
+	var pipelines *pair
+	exported := false
+	for _, p := range v.pairs(root) {
+		switch p.key.Value {
+		case "image":
+			v.validateImage(p.value, "image")
+		case "clone":
+			v.validateClone(p.value)
+		case "pipelines":
+			pipelines = &pair{key: p.key, value: p.value}
+		case "definitions":
+			v.validateDefinitions(p.value)
+		case "options":
+			v.validateOptions(p.value)
+		case "export":
+			v.boolean(p.value, "export")
+			exported = p.value.Value == "true"
+		}
+	}
+
+	if pipelines == nil {
+		// A shared configuration may only export the pipelines of its
+		// definitions
+		if !exported {
+			v.errorf(root, "no pipelines defined, the configuration needs a pipelines section")
+		}
+		return
+	}
+	v.validatePipelines(pipelines.key, pipelines.value)
+}
+
+func (v *validator) validateClone(node *yaml.Node) {
+	if !v.mapping(node, "clone") {
+		return
+	}
+	for _, p := range v.pairs(node) {
+		switch p.key.Value {
+		case "enabled", "lfs":
+			v.boolean(p.value, "clone "+p.key.Value)
+		case "depth":
+			if p.value.Value != "full" {
+				v.integer(p.value, "clone depth")
+			}
+		}
+	}
+}
+
+func (v *validator) validateOptions(node *yaml.Node) {
+	if !v.mapping(node, "options") {
+		return
+	}
+	for _, p := range v.pairs(node) {
+		switch p.key.Value {
+		case "docker":
+			v.boolean(p.value, "options docker")
+		case "size":
+			v.oneOf(p.value, "options size", models.StepSizes...)
+		}
+	}
+}
+
+func (v *validator) validateDefinitions(node *yaml.Node) {
+	if !v.mapping(node, "definitions") {
+		return
+	}
+	for _, p := range v.pairs(node) {
+		switch p.key.Value {
+		case "steps":
+			v.validateDefinedSteps(p.value)
+		case "services":
+			if !v.mapping(p.value, "definitions services") {
+				continue
+			}
+			for _, service := range v.pairs(p.value) {
+				v.validateService(service.key, service.value)
+			}
+		case "caches":
+			if !v.mapping(p.value, "definitions caches") {
+				continue
+			}
+			for _, cache := range v.pairs(p.value) {
+				v.validateCache(cache.key, cache.value)
+			}
+		case "pipelines":
+			if !v.mapping(p.value, "definitions pipelines") {
+				continue
+			}
+			// Shared pipelines are imported as custom pipelines, which may
+			// declare variables
+			for _, named := range v.pairs(p.value) {
+				v.checkPipeline(named.key.Value, true, named.key, named.value)
+			}
+		}
+	}
+}
+
+// validateDefinedSteps checks the steps of definitions. They may leave out
+// the script, which the steps merging them add: the script of the steps
+// of the pipelines is checked once merged.
+func (v *validator) validateDefinedSteps(node *yaml.Node) {
+	if !v.list(node, "definitions steps") {
+		return
+	}
+	for _, item := range node.Content {
+		if step := v.entry(resolve(item), "an entry of definitions steps", "step"); step != nil {
+			v.checkStep(*step, false)
+		}
+	}
+}
+
+func (v *validator) validateService(key, node *yaml.Node) {
+	what := fmt.Sprintf("service '%s'", key.Value)
+	hasImage := false
+	var ports []*yaml.Node
+	if v.mapping(node, what) {
+		for _, p := range v.pairs(node) {
+			switch p.key.Value {
+			case "image":
+				if hasImage = v.scalar(p.value, what+" image"); hasImage {
+					v.images = append(v.images, p.value)
+				}
+			case "environment":
+				v.stringMap(p.value, what+" variable")
+			case "ports":
+				v.stringList(p.value, what+" ports")
+				ports = scalars(p.value)
+			}
+		}
+	}
+	v.definitions.services[key.Value] = ports
+
+	// The docker service is provided by the runner
+	if !hasImage && key.Value != dockerService {
+		v.errorf(key, "%s has no image", what)
+	}
+}
+
+// validateImage checks the image of the configuration or of a step, written
+// as its name or as an object with the credentials of its registry
+func (v *validator) validateImage(node *yaml.Node, what string) {
+	if isNull(node) {
+		return
+	}
+	if node.Kind == yaml.ScalarNode {
+		v.images = append(v.images, node)
+		return
+	}
+	if node.Kind != yaml.MappingNode {
+		v.errorf(node, "%s must be a name or a mapping, found %s", what, describe(node))
+		return
+	}
+
+	var name, username, password *yaml.Node
+	for _, p := range v.pairs(node) {
+		switch p.key.Value {
+		case "name":
+			if v.scalar(p.value, what+" name") {
+				name = p.value
+				v.images = append(v.images, p.value)
+			}
+		case "username":
+			if v.scalar(p.value, what+" username") {
+				username = p.value
+			}
+		case "password":
+			if v.scalar(p.value, what+" password") {
+				password = p.value
+				v.secrets = append(v.secrets, secretRef{node: p.value, what: "password of " + what})
+			}
+		case "email":
+			v.scalar(p.value, what+" email")
+		case "run-as-user":
+			v.integer(p.value, what+" run-as-user")
+		case "aws":
+			v.validateImageAWS(p.value, what)
+		}
+	}
+
+	switch {
+	case name == nil:
+		v.errorf(node, "%s has no name", what)
+	case username != nil && password == nil:
+		v.errorf(username, "%s has a username but no password", what)
+	case password != nil && username == nil:
+		v.errorf(password, "%s has a password but no username", what)
+	}
+}
+
+// validateImageAWS checks the credentials of an image stored in Amazon ECR
+func (v *validator) validateImageAWS(node *yaml.Node, what string) {
+	if !v.mapping(node, what+" aws") {
+		return
+	}
+	var accessKey, secretKey *yaml.Node
+	for _, p := range v.pairs(node) {
+		switch p.key.Value {
+		case "access-key":
+			if v.scalar(p.value, what+" aws access-key") {
+				accessKey = p.value
+			}
+		case "secret-key":
+			if v.scalar(p.value, what+" aws secret-key") {
+				secretKey = p.value
+				v.secrets = append(v.secrets, secretRef{node: p.value, what: "aws secret-key of " + what})
+			}
+		case "oidc-role":
+			v.scalar(p.value, what+" aws oidc-role")
+		}
+	}
+	if (accessKey == nil) != (secretKey == nil) {
+		v.errorf(node, "%s aws needs both access-key and secret-key", what)
+	}
+}
+
+func (v *validator) validateCache(key, node *yaml.Node) {
+	what := fmt.Sprintf("cache '%s'", key.Value)
+	v.definitions.caches[key.Value] = true
+	if isNull(node) {
+		v.errorf(key, "%s has no path", what)
+		return
+	}
+	if node.Kind == yaml.ScalarNode {
+		return
+	}
+	if !v.mapping(node, what) {
+		return
+	}
+	for _, p := range v.pairs(node) {
+		switch p.key.Value {
+		case "key", "path":
+			v.scalar(p.value, what+" "+p.key.Value)
+		case "paths":
+			v.stringList(p.value, what+" paths")
+		}
+	}
+}
+
+func (v *validator) validatePipelines(key, node *yaml.Node) {
+	if isNull(node) {
+		v.errorf(key, "no pipelines defined")
+		return
+	}
+	if !v.mapping(node, "pipelines") {
+		return
+	}
+
+	defined := 0
+	for _, p := range v.pairs(node) {
+		kind := models.PipelineKind(p.key.Value)
+		switch kind {
+		case models.PipelineKindDefault:
+			defined++
+			v.validatePipeline(models.Selector{Kind: kind}, p.key, p.value)
+		case models.PipelineKindBranches, models.PipelineKindTags, models.PipelineKindPullRequests, models.PipelineKindCustom:
+			if !v.mapping(p.value, "pipelines "+p.key.Value) {
+				continue
+			}
+			for _, named := range v.pairs(p.value) {
+				defined++
+				v.validatePipeline(models.Selector{Kind: kind, Name: named.key.Value}, named.key, named.value)
+			}
+		}
+	}
+
+	if defined == 0 {
+		v.errorf(key, "no pipelines defined")
+	}
+}
+
+// validatePipeline checks a pipeline of the pipelines section
+func (v *validator) validatePipeline(selector models.Selector, key, node *yaml.Node) {
+	v.checkPipeline(selector.String(), selector.Kind == models.PipelineKindCustom, key, node)
+}
+
+// checkPipeline checks the entries of the pipeline named name, or its
+// import. Bitbucket refuses to start a pipeline with a manual step, so the
+// first step or stage must be triggered automatically. Only custom pipelines
+// declare variables.
+func (v *validator) checkPipeline(name string, custom bool, key, node *yaml.Node) {
+	what := fmt.Sprintf("pipeline '%s'", name)
+	if isEmpty(node) {
+		v.errorf(key, "%s has no steps", what)
+		return
+	}
+	if resolve(node).Kind == yaml.MappingNode {
+		v.validateImport(what, key, resolve(node))
+		return
+	}
+	if !v.list(node, what) {
+		return
+	}
+
+	v.pipelines = append(v.pipelines, pipelineRefs{name: name})
+	steps := 0
+	for i, item := range node.Content {
+		entry := v.entry(resolve(item), "an entry of "+what, "step", "parallel", "stage", "variables")
+		if entry == nil {
+			// Invalid entries are not counted as missing steps
+			steps++
+			continue
+		}
+
+		first := steps == 0
+		var trigger *yaml.Node
+		switch entry.key.Value {
+		case "step":
+			steps++
+			trigger = v.validateStep(*entry)
+		case "parallel":
+			steps += v.validateParallel(*entry)
+		case "stage":
+			var count int
+			count, trigger = v.validateStage(*entry)
+			steps += count
+		case "variables":
+			if i > 0 || !custom {
+				v.errorf(entry.key, "variables must be the first entry of a custom pipeline")
+			}
+			v.validateVariables(*entry)
+		}
+
+		if trigger != nil && trigger.Value == models.TriggerManual && first {
+			v.errorf(trigger, "the first step of %s cannot be manual", what)
+		}
+	}
+
+	if steps == 0 {
+		v.errorf(key, "%s has no steps", what)
+	}
+}
+
+// validateImport checks a pipeline imported from a shared repository,
+// whose import names the repository, the ref and the exported pipeline
+func (v *validator) validateImport(what string, key, node *yaml.Node) {
+	found := false
+	for _, p := range v.pairs(node) {
+		if p.key.Value != "import" {
+			continue
+		}
+		found = true
+		if !v.scalar(p.value, what+" import") {
+			continue
+		}
+		if _, err := models.ParseImport(p.value.Value); err != nil {
+			v.errorf(p.value, "%s: %v", what, err)
+		}
+	}
+	if !found {
+		v.errorf(key, "%s must be a list of steps or an import, found a mapping without import", what)
+	}
+}
+
+// entry checks that node is a mapping with a single key among allowed,
+// returning that key and its value
+func (v *validator) entry(node *yaml.Node, what string, allowed ...string) *pair {
+	expected := allowed[0]
+	for i, name := range allowed[1:] {
+		if i == len(allowed)-2 {
+			expected += " or " + name
+		} else {
+			expected += ", " + name
+		}
+	}
+
+	if node.Kind != yaml.MappingNode {
+		v.errorf(node, "%s must be %s, found %s", what, expected, describe(node))
+		return nil
+	}
+	pairs := v.pairs(node)
+	if len(pairs) == 0 {
+		v.errorf(node, "%s must be %s", what, expected)
+		return nil
+	}
+
+	first := pairs[0]
+	valid := false
+	for _, name := range allowed {
+		valid = valid || first.key.Value == name
+	}
+	if !valid {
+		if match, ok := suggest.Closest(first.key.Value, allowed); ok {
+			v.errorf(first.key, "%s must be %s, found '%s', did you mean '%s'?", what, expected, first.key.Value, match)
+		} else {
+			v.errorf(first.key, "%s must be %s, found '%s'", what, expected, first.key.Value)
+		}
+		return nil
+	}
+	for _, extra := range pairs[1:] {
+		v.errorf(extra.key, "unexpected '%s' next to '%s', check its indentation", extra.key.Value, first.key.Value)
+	}
+	return &first
+}
+
+// validateStep checks a step of the pipeline being checked and returns its
+// trigger node, if any
+func (v *validator) validateStep(entry pair) *yaml.Node {
+	trigger, refs := v.checkStep(entry, true)
+	if refs != nil && len(v.pipelines) > 0 {
+		pipeline := &v.pipelines[len(v.pipelines)-1]
+		pipeline.steps = append(pipeline.steps, *refs)
+	}
+	return trigger
+}
+
+// checkStep checks a step, which needs a script when complete, and returns
+// its trigger node and its references. Aliases and merge keys are resolved,
+// so a step is checked as it runs.
+func (v *validator) checkStep(entry pair, complete bool) (*yaml.Node, *stepRefs) {
+	what := "step"
+	if entry.value.Kind == yaml.MappingNode {
+		for _, p := range v.pairs(entry.value) {
+			if p.key.Value == "name" && p.value.Kind == yaml.ScalarNode && !isNull(p.value) {
+				what = fmt.Sprintf("step '%s'", p.value.Value)
+			}
+		}
+	}
+	if isNull(entry.value) {
+		if complete {
+			v.errorf(entry.key, "%s has no script", what)
+		}
+		return nil, nil
+	}
+	if !v.mapping(entry.value, what) {
+		return nil, nil
+	}
+
+	var trigger *yaml.Node
+	hasScript := false
+	refs := stepRefs{entry: entry.key, node: entry.value}
+	own := make(map[*yaml.Node]bool)
+	for i := 0; i < len(entry.value.Content); i += 2 {
+		own[entry.value.Content[i]] = true
+	}
+	for _, p := range v.pairs(entry.value) {
+		reported := len(v.diagnostics)
+		switch p.key.Value {
+		case "name":
+			if v.scalar(p.value, what+" name") {
+				refs.name = p.value
+			}
+		case "image":
+			v.validateImage(p.value, what+" image")
+		case "deployment":
+			if v.scalar(p.value, what+" deployment") {
+				v.deployment(p.value)
+			}
+		case "trigger":
+			v.oneOf(p.value, what+" trigger", models.TriggerManual, models.TriggerAutomatic)
+			trigger = p.value
+		case "script":
+			if isEmpty(p.value) {
+				v.errorf(p.key, "%s has an empty script", what)
+			}
+			v.validateScript(p.value, what+" script")
+			refs.script = scalars(p.value)
+			hasScript = true
+		case "after-script":
+			v.validateScript(p.value, what+" after-script")
+		case "services":
+			v.stringList(p.value, what+" services")
+			refs.services = scalars(p.value)
+		case "caches":
+			v.stringList(p.value, what+" caches")
+			refs.caches = scalars(p.value)
+			refs.cacheList = p.value
+		case "artifacts":
+			v.validateArtifacts(p.value, what)
+		case "condition":
+			v.validateCondition(p.value, what)
+		case "environment":
+			v.stringMap(p.value, what+" variable")
+			if p.value.Kind == yaml.MappingNode {
+				refs.environment = v.pairs(p.value)
+			}
+		}
+		if !own[p.key] {
+			// Merged values are reported once, where they are defined
+			v.diagnostics = v.diagnostics[:reported]
+		}
+	}
+
+	if !hasScript && complete {
+		v.errorf(entry.key, "%s has no script", what)
+	}
+	return trigger, &refs
+}
+
+// deployment records a deployment of the pipeline being checked
+func (v *validator) deployment(environment *yaml.Node) {
+	if len(v.pipelines) > 0 {
+		pipeline := &v.pipelines[len(v.pipelines)-1]
+		pipeline.deployments = append(pipeline.deployments, environment)
+	}
+}
+
+func (v *validator) validateArtifacts(node *yaml.Node, step string) {
+	if resolve(node).Kind == yaml.SequenceNode {
+		v.stringList(node, step+" artifact paths")
+		return
+	}
+	if !v.mapping(node, step+" artifacts") {
+		return
+	}
+	for _, p := range v.pairs(node) {
+		if p.key.Value == "paths" {
+			v.stringList(p.value, step+" artifact paths")
+		}
+	}
+}
+
+// validateScript checks a script, a list of commands and of pipes: mappings
+// naming the pipe and the variables it is given, strings or lists of strings
+func (v *validator) validateScript(node *yaml.Node, what string) {
+	if !v.list(node, what) {
+		return
+	}
+	for _, item := range node.Content {
+		item = resolve(item)
+		switch {
+		case item.Kind == yaml.ScalarNode && !isNull(item):
+		case item.Kind == yaml.MappingNode:
+			v.validatePipe(item, what)
+		default:
+			v.errorf(item, "entries of %s must be strings or pipes, found %s", what, describe(item))
+		}
+	}
+}
+
+func (v *validator) validatePipe(node *yaml.Node, what string) {
+	hasPipe := false
+	for _, p := range v.pairs(node) {
+		switch p.key.Value {
+		case "pipe":
+			hasPipe = v.scalar(p.value, what+" pipe")
+		case "variables":
+			if !v.mapping(p.value, what+" pipe variables") {
+				continue
+			}
+			for _, variable := range v.pairs(p.value) {
+				value := resolve(variable.value)
+				if value.Kind == yaml.SequenceNode {
+					v.stringList(value, fmt.Sprintf("%s pipe variable '%s'", what, variable.key.Value))
+				} else if value.Kind != yaml.ScalarNode {
+					v.errorf(value, "%s pipe variable '%s' must be a string or a list, found %s", what, variable.key.Value, describe(value))
+				}
+			}
+		default:
+			v.unknownField(p.key, what+" pipe", fieldsOf(reflect.TypeOf(models.Pipe{})))
+		}
+	}
+	if !hasPipe {
+		v.errorf(node, "%s entry has no pipe", what)
+	}
+}
+
+func (v *validator) validateCondition(node *yaml.Node, owner string) {
+	if !v.mapping(node, owner+" condition") {
+		return
+	}
+	for _, p := range v.pairs(node) {
+		if p.key.Value != "changesets" || !v.mapping(p.value, owner+" changesets") {
+			continue
+		}
+		paths := 0
+		for _, changesets := range v.pairs(p.value) {
+			switch changesets.key.Value {
+			case "includePaths", "excludePaths":
+				v.stringList(changesets.value, owner+" "+changesets.key.Value)
+				if !isEmpty(changesets.value) {
+					paths++
+				}
+			}
+		}
+		if paths == 0 {
+			v.warnf(p.key, "%s changesets have no includePaths or excludePaths, any change matches", owner)
+		}
+	}
+}
+
+// validateParallel checks a parallel group, a list of steps or a mapping
+// with fail-fast and steps, and returns its number of steps
+func (v *validator) validateParallel(entry pair) int {
+	steps := entry.value
+	if entry.value.Kind == yaml.MappingNode {
+		steps = nil
+		for _, p := range v.pairs(entry.value) {
+			switch p.key.Value {
+			case "fail-fast":
+				v.boolean(p.value, "parallel fail-fast")
+			case "steps":
+				steps = p.value
+			}
+		}
+	}
+
+	if isEmpty(steps) {
+		v.errorf(entry.key, "parallel group has no steps")
+		return 0
+	}
+	if !v.list(steps, "parallel steps") {
+		return 1
+	}
+	if len(steps.Content) == 1 {
+		v.warnf(entry.key, "parallel group has a single step, it runs like a regular step")
+	}
+	for _, item := range steps.Content {
+		if step := v.entry(resolve(item), "an entry of a parallel group", "step"); step != nil {
+			v.validateStep(*step)
+		}
+	}
+	return len(steps.Content)
+}
+
+// validateStage checks a stage and returns its number of steps and its
+// trigger node, if any
+func (v *validator) validateStage(entry pair) (int, *yaml.Node) {
+	what := "stage"
+	if isEmpty(entry.value) {
+		v.errorf(entry.key, "%s has no steps", what)
+		return 0, nil
+	}
+	if !v.mapping(entry.value, what) {
+		return 1, nil
+	}
+	for _, p := range v.pairs(entry.value) {
+		if p.key.Value == "name" && p.value.Kind == yaml.ScalarNode && !isNull(p.value) {
+			what = fmt.Sprintf("stage '%s'", p.value.Value)
+		}
+	}
+
+	var trigger, steps *yaml.Node
+	for _, p := range v.pairs(entry.value) {
+		switch p.key.Value {
+		case "name":
+			v.scalar(p.value, what+" name")
+		case "trigger":
+			v.oneOf(p.value, what+" trigger", models.TriggerManual, models.TriggerAutomatic)
+			trigger = p.value
+		case "deployment":
+			if v.scalar(p.value, what+" deployment") {
+				v.deployment(p.value)
+			}
+		case "condition":
+			v.validateCondition(p.value, what)
+		case "steps":
+			steps = p.value
+		}
+	}
+
+	if isEmpty(steps) {
+		v.errorf(entry.key, "%s has no steps", what)
+		return 0, trigger
+	}
+	if !v.list(steps, what+" steps") {
+		return 1, trigger
+	}
+	for _, item := range steps.Content {
+		if step := v.entry(resolve(item), "an entry of "+what, "step"); step != nil {
+			v.validateStep(*step)
+		}
+	}
+	return len(steps.Content), trigger
+}
+
+// validateVariables checks the variables of a custom pipeline
+func (v *validator) validateVariables(entry pair) {
+	if isEmpty(entry.value) {
+		v.errorf(entry.key, "variables must list at least one variable")
+		return
+	}
+	if !v.list(entry.value, "variables") {
+		return
+	}
+
+	declared := make(map[string]*yaml.Node)
+	for _, item := range entry.value.Content {
+		item = resolve(item)
+		if !v.mapping(item, "a variable") {
+			if isNull(item) {
+				v.errorf(item, "variable has no name")
+			}
+			continue
+		}
+
+		var name, value *yaml.Node
+		var allowed []string
+		for _, p := range v.pairs(item) {
+			switch p.key.Value {
+			case "name":
+				if v.scalar(p.value, "variable name") {
+					name = p.value
+				}
+			case "default":
+				if v.scalar(p.value, "variable default") {
+					value = p.value
+				}
+			case "description":
+				v.scalar(p.value, "variable description")
+			case "allowed-values":
+				v.stringList(p.value, "variable allowed-values")
+				if p.value.Kind == yaml.SequenceNode {
+					for _, allowedValue := range p.value.Content {
+						allowed = append(allowed, resolve(allowedValue).Value)
+					}
+				}
+			}
+		}
+
+		if name == nil {
+			v.errorf(item, "variable has no name")
+			continue
+		}
+		if previous, ok := declared[name.Value]; ok {
+			v.errorf(name, "variable '%s' is already declared at line %d", name.Value, previous.Line)
+		}
+		declared[name.Value] = name
+
+		if value != nil {
+			variable := models.Variable{Name: name.Value, AllowedValues: allowed}
+			if err := variable.Check(value.Value); err != nil {
+				v.errorf(value, "default of variable '%s': %v", name.Value, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,387 @@
+package validation
+
+import (
+	"testing"
+
+	"bitbucket-runner/internal/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidatePipelineConfig(t *testing.T) {
+	messages := func(diagnostics Diagnostics) []string {
+		var lines []string
+		for _, d := range diagnostics {
+			lines = append(lines, d.String())
+		}
+		return lines
+	}
+
+	t.Run("valid configuration", func(t *testing.T) {
+		content := `image: node:18
+clone:
+  depth: 50
+definitions:
+  services:
+    postgres:
+      image: postgres:15
+      environment:
+        POSTGRES_PASSWORD: secret
+    docker: {}
+  caches:
+    npm: ~/.npm
+pipelines:
+  default:
+    - step:
+        name: Build
+        caches: [node, npm]
+        script: [npm ci]
+        artifacts:
+          paths: [dist/**]
+    - parallel:
+        fail-fast: true
+        steps:
+          - step:
+              services: [postgres]
+              script: [npm test]
+          - step:
+              script: [npm run lint]
+    - stage:
+        name: Deploy
+        trigger: manual
+        condition:
+          changesets:
+            includePaths: [src/**]
+        steps:
+          - step:
+              script: [./deploy.sh]
+  custom:
+    release:
+      - variables:
+          - name: Version
+            default: "1.0"
+      - step:
+          script: [./release.sh]
+`
+		assert.Empty(t, ValidatePipelineConfig("bitbucket-pipelines.yml", []byte(content), Options{}))
+	})
+
+	t.Run("full clones and artifact lists", func(t *testing.T) {
+		content := `clone:
+  depth: full
+pipelines:
+  default:
+    - step:
+        script: [make]
+        artifacts: [dist/**, reports/*.xml]
+`
+		assert.Empty(t, ValidatePipelineConfig("bitbucket-pipelines.yml", []byte(content), Options{}))
+
+		content = "clone:\n  depth: shallow\npipelines:\n  default:\n    - step:\n        script: [make]\n        artifacts: [[dist]]\n"
+		assert.Equal(t, []string{
+			"bitbucket-pipelines.yml:2:10: error: clone depth must be a whole number, found 'shallow'",
+			"bitbucket-pipelines.yml:7:21: error: entries of step artifact paths must be strings, found a list",
+		}, messages(ValidatePipelineConfig("bitbucket-pipelines.yml", []byte(content), Options{})))
+	})
+
+	t.Run("pipes", func(t *testing.T) {
+		content := `pipelines:
+  default:
+    - step:
+        script:
+          - make
+          - pipe: atlassian/aws-s3-deploy:1.1.0
+            variables:
+              S3_BUCKET: my-bucket
+              EXTRA_ARGS: [--delete]
+        after-script:
+          - pipe: docker://alpine:3.19
+`
+		assert.Empty(t, ValidatePipelineConfig("bitbucket-pipelines.yml", []byte(content), Options{}))
+
+		content = "pipelines:\n  default:\n    - step:\n        script:\n          - variables: {A: 1}\n          - pipe: atlassian/x:1\n            variables: {B: {C: 2}}\n            varaibles: {}\n          - [make]\n"
+		assert.Equal(t, []string{
+			"bitbucket-pipelines.yml:5:13: error: step script entry has no pipe",
+			"bitbucket-pipelines.yml:7:28: error: step script pipe variable 'B' must be a string or a list, found a mapping",
+			"bitbucket-pipelines.yml:8:13: error: unknown field \"varaibles\" in step script pipe, did you mean \"variables\"?",
+			"bitbucket-pipelines.yml:9:13: error: entries of step script must be strings or pipes, found a list",
+		}, messages(ValidatePipelineConfig("bitbucket-pipelines.yml", []byte(content), Options{})))
+	})
+
+	t.Run("selected pipeline", func(t *testing.T) {
+		content := `definitions:
+  services:
+    redis: {}
+pipelines:
+  default:
+    - step:
+        name: Build
+  branches:
+    'feature/*':
+      - step:
+          trigger: later
+          script: [make]
+`
+		validate := func(selector models.Selector) []string {
+			return messages(ValidatePipelineConfig("bitbucket-pipelines.yml", []byte(content), Options{Pipeline: &selector}))
+		}
+		assert.Equal(t, []string{
+			"bitbucket-pipelines.yml:3:5: error: service 'redis' has no image",
+			"bitbucket-pipelines.yml:11:20: error: step trigger must be manual or automatic, found 'later'",
+		}, validate(models.Selector{Kind: models.PipelineKindBranches, Name: "feature/login"}))
+		assert.Equal(t, []string{
+			"bitbucket-pipelines.yml:3:5: error: service 'redis' has no image",
+			"bitbucket-pipelines.yml:6:7: error: step 'Build' has no script",
+		}, validate(models.Selector{Kind: models.PipelineKindDefault}))
+		assert.Contains(t, validate(models.Selector{Kind: models.PipelineKindTags, Name: "v1"}),
+			"bitbucket-pipelines.yml:4:1: error: pipeline 'tags:v1' is not defined, available pipelines: default, branches:feature/*")
+	})
+
+	t.Run("collects all problems with positions", func(t *testing.T) {
+		content := `pipelines:
+  default:
+    - step:
+        name: Build
+    - step:
+        trigger: later
+        script: [make]
+  branches:
+    main:
+      - parallel:
+          - step:
+              script: [make test]
+`
+		diagnostics := ValidatePipelineConfig("bitbucket-pipelines.yml", []byte(content), Options{})
+		assert.Equal(t, []string{
+			"bitbucket-pipelines.yml:3:7: error: step 'Build' has no script",
+			"bitbucket-pipelines.yml:6:18: error: step trigger must be manual or automatic, found 'later'",
+			"bitbucket-pipelines.yml:10:9: warning: parallel group has a single step, it runs like a regular step",
+		}, messages(diagnostics))
+		assert.True(t, diagnostics.HasErrors())
+		assert.Len(t, diagnostics.Errors(), 2)
+		assert.Len(t, diagnostics.Warnings(), 1)
+	})
+
+	t.Run("syntax error", func(t *testing.T) {
+		content := "pipelines:\n  default:\n    - step:\n      script: [make\n"
+		diagnostics := ValidatePipelineConfig("bitbucket-pipelines.yml", []byte(content), Options{})
+		require.Len(t, diagnostics, 1)
+		assert.Equal(t, SeverityError, diagnostics[0].Severity)
+		assert.Greater(t, diagnostics[0].Line, 0)
+		assert.NotContains(t, diagnostics[0].Message, "yaml:")
+	})
+
+	t.Run("structure", func(t *testing.T) {
+		tests := []struct {
+			name     string
+			content  string
+			expected string
+		}{
+			{"empty file", "", "bitbucket-pipelines.yml: error: the file is empty"},
+			{"no pipelines", "image: alpine\n", "bitbucket-pipelines.yml:1:1: error: no pipelines defined, the configuration needs a pipelines section"},
+			{"empty pipelines", "pipelines:\n", "bitbucket-pipelines.yml:1:1: error: no pipelines defined"},
+			{"pipeline without steps", "pipelines:\n  default: []\n", "bitbucket-pipelines.yml:2:3: error: pipeline 'default' has no steps"},
+			{"wrong type", "pipelines:\n  branches:\n    main:\n      - step:\n          script: make\n",
+				"bitbucket-pipelines.yml:5:19: error: step script must be a list, found a string"},
+			{"unknown entry", "pipelines:\n  default:\n    - steps:\n        script: [make]\n",
+				"bitbucket-pipelines.yml:3:7: error: an entry of pipeline 'default' must be step, parallel, stage or variables, found 'steps', did you mean 'step'?"},
+			{"misindented key", "pipelines:\n  default:\n    - step:\n      script: [make]\n",
+				"bitbucket-pipelines.yml:3:7: error: step has no script"},
+			{"duplicate key", "pipelines:\n  default:\n    - step:\n        script: [make]\n        script: [make test]\n",
+				"bitbucket-pipelines.yml:5:9: error: key 'script' is already defined at line 4"},
+			{"manual first step", "pipelines:\n  default:\n    - step:\n        trigger: manual\n        script: [make]\n",
+				"bitbucket-pipelines.yml:4:18: error: the first step of pipeline 'default' cannot be manual"},
+			{"empty stage", "pipelines:\n  default:\n    - step:\n        script: [make]\n    - stage:\n        name: Deploy\n",
+				"bitbucket-pipelines.yml:5:7: error: stage 'Deploy' has no steps"},
+			{"variables outside custom pipeline", "pipelines:\n  default:\n    - variables:\n        - name: A\n    - step:\n        script: [make]\n",
+				"bitbucket-pipelines.yml:3:7: error: variables must be the first entry of a custom pipeline"},
+			{"default not allowed", "pipelines:\n  custom:\n    deploy:\n      - variables:\n          - name: Env\n            default: prod\n            allowed-values: [dev, staging]\n      - step:\n          script: [make]\n",
+				"bitbucket-pipelines.yml:6:22: error: default of variable 'Env': value 'prod' of variable 'Env' is not one of the allowed values: dev, staging"},
+			{"service without image", "definitions:\n  services:\n    redis:\n      ports: ['6379']\npipelines:\n  default:\n    - step:\n        script: [make]\n",
+				"bitbucket-pipelines.yml:3:5: error: service 'redis' has no image"},
+			{"invalid size", "options:\n  size: 3x\npipelines:\n  default:\n    - step:\n        script: [make]\n",
+				"bitbucket-pipelines.yml:2:9: error: options size must be 1x or 2x or 4x or 8x or 16x, found '3x'"},
+			{"changesets without paths", "pipelines:\n  default:\n    - step:\n        script: [make]\n        condition:\n          changesets: {}\n",
+				"bitbucket-pipelines.yml:6:11: warning: step changesets have no includePaths or excludePaths, any change matches"},
+		}
+
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				diagnostics := ValidatePipelineConfig("bitbucket-pipelines.yml", []byte(tt.content), Options{})
+				assert.Contains(t, messages(diagnostics), tt.expected)
+			})
+		}
+	})
+
+	t.Run("anchors and merge keys", func(t *testing.T) {
+		content := `definitions:
+  steps:
+    - step: &build
+        name: Build
+        script: [make]
+pipelines:
+  default:
+    - step: *build
+    - step:
+        <<: *build
+        name: Test
+  branches:
+    main:
+      - step:
+          <<: *build
+`
+		assert.Empty(t, ValidatePipelineConfig("bitbucket-pipelines.yml", []byte(content), Options{}))
+	})
+
+	t.Run("step definitions", func(t *testing.T) {
+		content := `definitions:
+  steps:
+    - step: &base
+        image: golang:1.21
+        caches: gomod
+        scirpt: [make]
+    - step: &test
+        name: Test
+        script: [go test ./...]
+    - step:
+pipelines:
+  default:
+    - step:
+        <<: *base
+        name: Build
+        script: [go build ./...]
+    - step:
+        <<: [*test, *base]
+        trigger: sometimes
+    - step:
+        <<: *base
+        name: Lint
+`
+		assert.Equal(t, []string{
+			"bitbucket-pipelines.yml:5:17: error: step caches must be a list, found a string",
+			"bitbucket-pipelines.yml:6:9: error: unknown field \"scirpt\" in step, did you mean \"script\"?",
+			"bitbucket-pipelines.yml:19:18: error: step 'Test' trigger must be manual or automatic, found 'sometimes'",
+			"bitbucket-pipelines.yml:20:7: error: step 'Lint' has no script",
+		}, messages(ValidatePipelineConfig("bitbucket-pipelines.yml", []byte(content), Options{})))
+
+		diagnostics := ValidatePipelineConfig("bitbucket-pipelines.yml", []byte("definitions:\n  steps:\n    step: {}\npipelines:\n  default:\n    - step:\n        script: [make]\n"), Options{})
+		assert.Contains(t, messages(diagnostics), "bitbucket-pipelines.yml:3:5: error: definitions steps must be a list, found a mapping")
+	})
+
+	t.Run("imports", func(t *testing.T) {
+		shared := `export: true
+definitions:
+  pipelines:
+    build:
+      - variables:
+          - name: Goal
+            default: verify
+      - step:
+          script: [mvn $Goal]
+`
+		assert.Empty(t, ValidatePipelineConfig("bitbucket-pipelines.yml", []byte(shared), Options{}))
+
+		content := `definitions:
+  pipelines:
+    release:
+      - step:
+          name: Release
+pipelines:
+  default:
+    import: shared-pipelines:master:build
+  branches:
+    main:
+      import: shared-pipelines:build
+  custom:
+    deploy:
+      improt: shared-pipelines:master:deploy
+    nightly:
+      import: [shared-pipelines, master, nightly]
+`
+		assert.Equal(t, []string{
+			"bitbucket-pipelines.yml:4:9: error: step 'Release' has no script",
+			"bitbucket-pipelines.yml:11:15: error: pipeline 'branches:main': invalid import 'shared-pipelines:build', expected <repository>:<ref>:<pipeline>",
+			"bitbucket-pipelines.yml:13:5: error: pipeline 'custom:deploy' must be a list of steps or an import, found a mapping without import",
+			"bitbucket-pipelines.yml:14:7: error: unknown field \"improt\" in custom 'deploy', did you mean \"import\"?",
+			"bitbucket-pipelines.yml:16:15: error: pipeline 'custom:nightly' import must be a string, found a list",
+		}, messages(ValidatePipelineConfig("bitbucket-pipelines.yml", []byte(content), Options{})))
+	})
+
+	t.Run("images", func(t *testing.T) {
+		content := `image:
+  name: registry.example.com/build:1.4
+  username: $REGISTRY_USER
+  password: $REGISTRY_PASSWORD
+  run-as-user: 1000
+pipelines:
+  default:
+    - step:
+        name: Build
+        image:
+          username: $REGISTRY_USER
+          password: $REGISTRY_PASSWORD
+        script: [make]
+    - step:
+        name: Push
+        image:
+          name: 123456789012.dkr.ecr.eu-west-1.amazonaws.com/app:2
+          run-as-user: root
+          aws:
+            access-key: $AWS_ACCESS_KEY_ID
+            sercet-key: $AWS_SECRET_ACCESS_KEY
+        script: [make push]
+    - step:
+        image: [node]
+        script: [npm ci]
+`
+		assert.Equal(t, []string{
+			"bitbucket-pipelines.yml:11:11: error: step 'Build' image has no name",
+			"bitbucket-pipelines.yml:18:24: error: step 'Push' image run-as-user must be a whole number, found 'root'",
+			"bitbucket-pipelines.yml:20:13: error: step 'Push' image aws needs both access-key and secret-key",
+			"bitbucket-pipelines.yml:21:13: error: unknown field \"sercet-key\" in aws, did you mean \"secret-key\"?",
+			"bitbucket-pipelines.yml:24:16: error: step image must be a name or a mapping, found a list",
+		}, messages(ValidatePipelineConfig("bitbucket-pipelines.yml", []byte(content), Options{})))
+	})
+
+	t.Run("unknown fields", func(t *testing.T) {
+		content := `pipeline:
+  default: []
+pipelines:
+  branch:
+    main: []
+  default:
+    - step:
+        script: [make]
+        after_script: [make clean]
+        artifact:
+          paths: [dist]
+        deployment: production
+        services: [postgres]
+definitions:
+  services:
+    postgres:
+      image: postgres:15
+      environmnet:
+        POSTGRES_PASSWORD: secret
+      memory: 1024
+`
+		assert.Equal(t, []string{
+			"bitbucket-pipelines.yml:1:1: error: unknown field \"pipeline\" in the configuration, did you mean \"pipelines\"?",
+			"bitbucket-pipelines.yml:4:3: error: unknown field \"branch\" in pipelines, did you mean \"branches\"?",
+			"bitbucket-pipelines.yml:9:9: error: unknown field \"after_script\" in step, did you mean \"after-script\"?",
+			"bitbucket-pipelines.yml:10:9: error: unknown field \"artifact\" in step, did you mean \"artifacts\"?",
+			"bitbucket-pipelines.yml:18:7: error: unknown field \"environmnet\" in services 'postgres', did you mean \"environment\"?",
+			"bitbucket-pipelines.yml:20:7: warning: field \"memory\" in services 'postgres' is not supported and is ignored",
+		}, messages(ValidatePipelineConfig("bitbucket-pipelines.yml", []byte(content), Options{})))
+	})
+
+	t.Run("error lists the errors", func(t *testing.T) {
+		diagnostics := ValidatePipelineConfig("bitbucket-pipelines.yml", []byte("pipelines:\n  default:\n    - step:\n        name: A\n    - step:\n        name: B\n"), Options{})
+		err := diagnostics.Err()
+		require.Error(t, err)
+		assert.Equal(t, "bitbucket-pipelines.yml:3:7: error: step 'A' has no script\nbitbucket-pipelines.yml:5:7: error: step 'B' has no script", err.Error())
+
+		assert.NoError(t, Diagnostics{{Severity: SeverityWarning}}.Err())
+	})
+}
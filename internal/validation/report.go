@@ -0,0 +1,55 @@
+package validation
+
+// ReportVersion is the version of the JSON report. It changes only when
+// fields are removed or change meaning, so tools can rely on the format.
+const ReportVersion = 1
+
+// Report is the result of validating configuration files, in the stable
+// format of the JSON output
+type Report struct {
+	Version int          `json:"version"`
+	Valid   bool         `json:"valid"`
+	Files   []FileReport `json:"files"`
+	Rules   []Rule       `json:"rules"`
+	Summary Summary      `json:"summary"`
+}
+
+// FileReport is the result of validating one file
+type FileReport struct {
+	Path        string      `json:"path"`
+	Valid       bool        `json:"valid"`
+	Diagnostics Diagnostics `json:"diagnostics"`
+	Summary     Summary     `json:"summary"`
+}
+
+// Summary counts diagnostics by severity
+type Summary struct {
+	Errors   int `json:"errors"`
+	Warnings int `json:"warnings"`
+}
+
+// NewFileReport returns the result of a file from its diagnostics
+func NewFileReport(path string, diagnostics Diagnostics) FileReport {
+	if diagnostics == nil {
+		diagnostics = Diagnostics{}
+	}
+	summary := Summary{Errors: len(diagnostics.Errors()), Warnings: len(diagnostics.Warnings())}
+	return FileReport{Path: path, Valid: summary.Errors == 0, Diagnostics: diagnostics, Summary: summary}
+}
+
+// NewReport returns the report of the files, describing the rules checked
+func NewReport(rules []Rule, files ...FileReport) Report {
+	report := Report{Version: ReportVersion, Valid: true, Files: files, Rules: rules}
+	if report.Files == nil {
+		report.Files = []FileReport{}
+	}
+	if report.Rules == nil {
+		report.Rules = []Rule{}
+	}
+	for _, file := range files {
+		report.Valid = report.Valid && file.Valid
+		report.Summary.Errors += file.Summary.Errors
+		report.Summary.Warnings += file.Summary.Warnings
+	}
+	return report
+}
@@ -0,0 +1,95 @@
+package validation
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewReport(t *testing.T) {
+	pipeline := NewFileReport("bitbucket-pipelines.yml", Diagnostics{
+		{File: "bitbucket-pipelines.yml", Line: 3, Column: 7, Severity: SeverityError, Message: "step has no script"},
+		{File: "bitbucket-pipelines.yml", Line: 1, Column: 8, Severity: SeverityWarning, Message: "image 'node' has no tag", Rule: RuleUnpinnedImage},
+	})
+	runner := NewFileReport("bitbucket-runner.yml", nil)
+	report := NewReport(Options{Lint: true, Disabled: []string{RuleLongScriptLine}}.CheckedRules(), pipeline, runner)
+
+	assert.Equal(t, ReportVersion, report.Version)
+	assert.False(t, report.Valid)
+	assert.Equal(t, Summary{Errors: 1, Warnings: 1}, report.Summary)
+	assert.False(t, report.Files[0].Valid)
+	assert.True(t, report.Files[1].Valid)
+	assert.Len(t, report.Rules, len(Rules)+len(LintRules)-1)
+
+	data, err := json.Marshal(report.Files[1])
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"path":"bitbucket-runner.yml","valid":true,"diagnostics":[],"summary":{"errors":0,"warnings":0}}`, string(data))
+}
+
+func TestReport_SARIF(t *testing.T) {
+	content := "image: node\noptions:\n  docker: yes\npipelines:\n  default:\n    - step:\n        name: Build\n"
+	options := Options{Lint: true}
+	report := NewReport(options.CheckedRules(), NewFileReport("ci/bitbucket-pipelines.yml",
+		ValidatePipelineConfig("ci/bitbucket-pipelines.yml", []byte(content), options)))
+
+	data, err := json.Marshal(report.SARIF())
+	require.NoError(t, err)
+
+	var log struct {
+		Version string `json:"version"`
+		Runs    []struct {
+			ColumnKind string `json:"columnKind"`
+			Tool       struct {
+				Driver struct {
+					Rules []struct {
+						ID string `json:"id"`
+					} `json:"rules"`
+				} `json:"driver"`
+			} `json:"tool"`
+			Results []json.RawMessage `json:"results"`
+		} `json:"runs"`
+	}
+	require.NoError(t, json.Unmarshal(data, &log))
+	assert.Equal(t, "2.1.0", log.Version)
+	require.Len(t, log.Runs, 1)
+	run := log.Runs[0]
+	assert.Equal(t, "unicodeCodePoints", run.ColumnKind)
+	assert.Equal(t, structureRule.ID, run.Tool.Driver.Rules[0].ID)
+	require.Len(t, run.Results, 3)
+
+	assert.JSONEq(t, `{
+		"ruleId": "unpinned-image",
+		"ruleIndex": 7,
+		"level": "warning",
+		"message": {"text": "image 'node' has no tag and runs the latest version, pin it to a version"},
+		"locations": [{"physicalLocation": {"artifactLocation": {"uri": "ci/bitbucket-pipelines.yml"}, "region": {"startLine": 1, "startColumn": 8}}}]
+	}`, string(run.Results[0]))
+	assert.JSONEq(t, `{
+		"ruleId": "deprecated-syntax",
+		"ruleIndex": 11,
+		"level": "warning",
+		"message": {"text": "'yes' is a YAML 1.1 boolean, write true"},
+		"locations": [{"physicalLocation": {"artifactLocation": {"uri": "ci/bitbucket-pipelines.yml"}, "region": {"startLine": 3, "startColumn": 11}}}],
+		"fixes": [{
+			"description": {"text": "replace 'yes' with true"},
+			"artifactChanges": [{
+				"artifactLocation": {"uri": "ci/bitbucket-pipelines.yml"},
+				"replacements": [{"deletedRegion": {"startLine": 3, "startColumn": 11, "endLine": 3, "endColumn": 14}, "insertedContent": {"text": "true"}}]
+			}]
+		}]
+	}`, string(run.Results[1]))
+	assert.JSONEq(t, `{
+		"ruleId": "invalid-configuration",
+		"ruleIndex": 0,
+		"level": "error",
+		"message": {"text": "step 'Build' has no script"},
+		"locations": [{"physicalLocation": {"artifactLocation": {"uri": "ci/bitbucket-pipelines.yml"}, "region": {"startLine": 6, "startColumn": 7}}}]
+	}`, string(run.Results[2]))
+}
+
+func TestArtifactURI(t *testing.T) {
+	assert.Equal(t, "bitbucket-pipelines.yml", artifactURI("./bitbucket-pipelines.yml"))
+	assert.Equal(t, "file:///home/user/.config/bitbucket-runner/config.yml", artifactURI("/home/user/.config/bitbucket-runner/config.yml"))
+}
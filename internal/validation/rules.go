@@ -0,0 +1,313 @@
+package validation
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"bitbucket-runner/internal/models"
+	"bitbucket-runner/internal/suggest"
+
+	"gopkg.in/yaml.v3"
+)
+
+// dockerService is the service Bitbucket provides without a definition
+const dockerService = "docker"
+
+// Rule is a check across the pipeline definition that can be disabled.
+// The structural checks are always performed.
+type Rule struct {
+	ID          string   `json:"id"`
+	Severity    Severity `json:"severity"`
+	Description string   `json:"description"`
+}
+
+// IDs of the rules
+const (
+	RuleUndefinedService    = "undefined-service"
+	RuleUndefinedCache      = "undefined-cache"
+	RuleDuplicateStepName   = "duplicate-step-name"
+	RulePortConflict        = "port-conflict"
+	RuleDeploymentOrder     = "deployment-order"
+	RuleDuplicateDeployment = "duplicate-deployment"
+)
+
+// Rules lists the rules with their default severity
+var Rules = []Rule{
+	{RuleUndefinedService, SeverityError, "services of steps are defined in definitions.services or are the docker service"},
+	{RuleUndefinedCache, SeverityError, "caches of steps are defined in definitions.caches or predefined"},
+	{RuleDuplicateStepName, SeverityWarning, "steps of a pipeline have distinct names, which identify them in runner step types and plans"},
+	{RulePortConflict, SeverityError, "services of a step, which share the step network, use distinct ports"},
+	{RuleDeploymentOrder, SeverityError, "pipelines deploy to test, staging and production environments in that order"},
+	{RuleDuplicateDeployment, SeverityError, "pipelines deploy to each environment once"},
+}
+
+// LookupRule returns the validation or lint rule with the given ID
+func LookupRule(id string) (Rule, bool) {
+	for _, rule := range allRules() {
+		if rule.ID == id {
+			return rule, true
+		}
+	}
+	return Rule{}, false
+}
+
+func allRules() []Rule {
+	return append(append([]Rule{}, Rules...), LintRules...)
+}
+
+func isLintRule(id string) bool {
+	for _, rule := range LintRules {
+		if rule.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckRuleIDs returns an error naming the first unknown rule ID, with the
+// closest known ID as a suggestion
+func CheckRuleIDs(ids []string) error {
+	var known []string
+	for _, rule := range allRules() {
+		known = append(known, rule.ID)
+	}
+	for _, id := range ids {
+		if _, ok := LookupRule(id); ok {
+			continue
+		}
+		if match, ok := suggest.Closest(id, known); ok {
+			return fmt.Errorf("unknown rule '%s', did you mean '%s'?", id, match)
+		}
+		return fmt.Errorf("unknown rule '%s', expected one of %s", id, strings.Join(known, ", "))
+	}
+	return nil
+}
+
+// Options adjusts a validation
+type Options struct {
+	// Disabled lists the IDs of the rules not to check
+	Disabled []string
+	// Severities overrides the severity of rules, SeverityOff disabling them
+	Severities map[string]Severity
+	// Lint enables the lint rules
+	Lint bool
+	// Pipeline limits the diagnostics of the pipelines section to those of
+	// the selected pipeline
+	Pipeline *models.Selector
+}
+
+// LintOptions returns the options set by the lint section of the runner
+// configuration: the severities of its rules
+func LintOptions(config models.LintConfig) Options {
+	severities := make(map[string]Severity, len(config.Rules))
+	for id, severity := range config.Rules {
+		severities[id] = Severity(severity)
+	}
+	return Options{Severities: severities}
+}
+
+// severity returns the severity of a rule, and whether it is checked
+func (o Options) severity(rule Rule) (Severity, bool) {
+	for _, disabled := range o.Disabled {
+		if disabled == rule.ID {
+			return "", false
+		}
+	}
+	if isLintRule(rule.ID) && !o.Lint {
+		return "", false
+	}
+
+	severity := rule.Severity
+	if configured, ok := o.Severities[rule.ID]; ok {
+		severity = configured
+	}
+	return severity, severity != SeverityOff
+}
+
+// CheckedRules returns the rules checked with the options, with their
+// configured severity
+func (o Options) CheckedRules() []Rule {
+	var rules []Rule
+	for _, rule := range allRules() {
+		if severity, checked := o.severity(rule); checked {
+			rule.Severity = severity
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// violation reports a diagnostic of a checked rule, returning it so a fix
+// can be attached, or nil
+func (v *validator) violation(id string, node *yaml.Node, format string, args ...interface{}) *Diagnostic {
+	rule, ok := LookupRule(id)
+	if !ok {
+		return nil
+	}
+	severity, checked := v.options.severity(rule)
+	if !checked {
+		return nil
+	}
+	v.report(severity, node, format, args...)
+	d := &v.diagnostics[len(v.diagnostics)-1]
+	d.Rule = id
+	return d
+}
+
+// pipelineRefs are the references of a pipeline collected by the
+// structural checks
+type pipelineRefs struct {
+	name        string
+	steps       []stepRefs
+	deployments []*yaml.Node
+}
+
+// stepRefs are the references of a step. Entry is the step key, which is
+// distinct for every use of an anchored step.
+type stepRefs struct {
+	entry       *yaml.Node
+	node        *yaml.Node
+	name        *yaml.Node
+	services    []*yaml.Node
+	caches      []*yaml.Node
+	cacheList   *yaml.Node
+	script      []*yaml.Node
+	environment []pair
+}
+
+// secretRef is a credential of the configuration, described by what
+type secretRef struct {
+	node *yaml.Node
+	what string
+}
+
+// definitionRefs are the services and caches of the definitions
+type definitionRefs struct {
+	services map[string][]*yaml.Node // ports by service
+	caches   map[string]bool
+}
+
+// checkReferences applies the rules once the whole file is walked, as
+// definitions may follow the pipelines
+func (v *validator) checkReferences() {
+	for _, pipeline := range v.pipelines {
+		names := make(map[string]*yaml.Node)
+		for _, step := range pipeline.steps {
+			v.checkServices(step)
+			v.checkCaches(step)
+
+			if step.name == nil {
+				continue
+			}
+			if previous, ok := names[step.name.Value]; ok {
+				v.violation(RuleDuplicateStepName, step.entry, "step name '%s' is already used at line %d of pipeline '%s'",
+					step.name.Value, previous.Line, pipeline.name)
+				continue
+			}
+			names[step.name.Value] = step.entry
+		}
+		v.checkDeployments(pipeline)
+	}
+}
+
+func (v *validator) checkServices(step stepRefs) {
+	ports := make(map[string]string)
+	for _, service := range step.services {
+		if service.Value == dockerService {
+			continue
+		}
+		servicePorts, ok := v.definitions.services[service.Value]
+		if !ok {
+			defined := make([]string, 0, len(v.definitions.services))
+			for name := range v.definitions.services {
+				defined = append(defined, name)
+			}
+			v.violation(RuleUndefinedService, service, "service '%s' is not defined in definitions.services%s",
+				service.Value, didYouMean(service.Value, defined))
+			continue
+		}
+
+		for _, port := range servicePorts {
+			number := containerPort(port.Value)
+			if other, ok := ports[number]; ok && other != service.Value {
+				v.violation(RulePortConflict, service, "services '%s' and '%s' both use port %s, which collide on the shared step network",
+					other, service.Value, number)
+				continue
+			}
+			ports[number] = service.Value
+		}
+	}
+}
+
+func (v *validator) checkCaches(step stepRefs) {
+	for _, cache := range step.caches {
+		if v.definitions.caches[cache.Value] {
+			continue
+		}
+		if _, ok := models.PredefinedCaches[cache.Value]; ok {
+			continue
+		}
+
+		known := make([]string, 0, len(v.definitions.caches)+len(models.PredefinedCaches))
+		for name := range v.definitions.caches {
+			known = append(known, name)
+		}
+		for name := range models.PredefinedCaches {
+			known = append(known, name)
+		}
+		v.violation(RuleUndefinedCache, cache, "cache '%s' is neither defined in definitions.caches nor predefined%s",
+			cache.Value, didYouMean(cache.Value, known))
+	}
+}
+
+// deploymentRanks orders the environment types of Bitbucket. Environments
+// with other names have a type configured in the repository settings and
+// are not ordered.
+var deploymentRanks = map[string]int{
+	"test":       0,
+	"staging":    1,
+	"production": 2,
+}
+
+func (v *validator) checkDeployments(pipeline pipelineRefs) {
+	used := make(map[string]*yaml.Node)
+	var latest *yaml.Node
+	for _, deployment := range pipeline.deployments {
+		environment := strings.ToLower(deployment.Value)
+		if previous, ok := used[environment]; ok {
+			v.violation(RuleDuplicateDeployment, deployment, "deployment environment '%s' is already used at line %d of pipeline '%s'",
+				deployment.Value, previous.Line, pipeline.name)
+			continue
+		}
+		used[environment] = deployment
+
+		rank, ordered := deploymentRanks[environment]
+		if !ordered {
+			continue
+		}
+		if latest != nil && rank < deploymentRanks[strings.ToLower(latest.Value)] {
+			v.violation(RuleDeploymentOrder, deployment, "deployment to '%s' follows the deployment to '%s' at line %d, environments are deployed in the order test, staging, production",
+				deployment.Value, latest.Value, latest.Line)
+			continue
+		}
+		latest = deployment
+	}
+}
+
+// containerPort returns the port a service listens on from a port
+// specification such as "5432", "8080:80" or "53/udp"
+func containerPort(spec string) string {
+	if i := strings.LastIndex(spec, ":"); i >= 0 {
+		spec = spec[i+1:]
+	}
+	return strings.TrimSuffix(spec, "/tcp")
+}
+
+func didYouMean(word string, candidates []string) string {
+	sort.Strings(candidates)
+	if match, ok := suggest.Closest(word, candidates); ok {
+		return fmt.Sprintf(", did you mean '%s'?", match)
+	}
+	return ""
+}
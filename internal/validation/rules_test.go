@@ -0,0 +1,78 @@
+package validation
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidatePipelineConfig_Rules(t *testing.T) {
+	content := `definitions:
+  services:
+    postgres:
+      image: postgres:15
+      ports: ['5432']
+    pgbouncer:
+      image: pgbouncer
+      ports: ['6432:5432']
+  caches:
+    gems: vendor/bundle
+pipelines:
+  default:
+    - step:
+        name: Test
+        services: [postgres, pgbouncer, redis, docker]
+        caches: [gem, node]
+        script: [rake]
+    - step:
+        name: Test
+        deployment: production
+        script: [./deploy.sh]
+    - stage:
+        deployment: staging
+        steps:
+          - step:
+              script: [./deploy.sh]
+    - step:
+        deployment: Production
+        script: [./deploy.sh]
+  branches:
+    main:
+      - step:
+          name: Test
+          deployment: test
+          script: [./deploy.sh]
+      - step:
+          deployment: my-env
+          script: [./deploy.sh]
+      - step:
+          deployment: staging
+          script: [./deploy.sh]
+`
+	validate := func(options Options) []string {
+		var messages []string
+		for _, d := range ValidatePipelineConfig("bitbucket-pipelines.yml", []byte(content), options) {
+			messages = append(messages, d.String())
+		}
+		return messages
+	}
+
+	assert.Equal(t, []string{
+		"bitbucket-pipelines.yml:15:30: error: services 'postgres' and 'pgbouncer' both use port 5432, which collide on the shared step network [port-conflict]",
+		"bitbucket-pipelines.yml:15:41: error: service 'redis' is not defined in definitions.services [undefined-service]",
+		"bitbucket-pipelines.yml:16:18: error: cache 'gem' is neither defined in definitions.caches nor predefined, did you mean 'gems'? [undefined-cache]",
+		"bitbucket-pipelines.yml:18:7: warning: step name 'Test' is already used at line 13 of pipeline 'default' [duplicate-step-name]",
+		"bitbucket-pipelines.yml:23:21: error: deployment to 'staging' follows the deployment to 'production' at line 20, environments are deployed in the order test, staging, production [deployment-order]",
+		"bitbucket-pipelines.yml:28:21: error: deployment environment 'Production' is already used at line 20 of pipeline 'default' [duplicate-deployment]",
+	}, validate(Options{}))
+
+	assert.Empty(t, validate(Options{Disabled: []string{
+		RuleUndefinedService, RuleUndefinedCache, RuleDuplicateStepName, RulePortConflict, RuleDeploymentOrder, RuleDuplicateDeployment,
+	}}))
+}
+
+func TestCheckRuleIDs(t *testing.T) {
+	assert.NoError(t, CheckRuleIDs([]string{RulePortConflict, RuleUndefinedCache}))
+	assert.EqualError(t, CheckRuleIDs([]string{"port-conflicts"}), "unknown rule 'port-conflicts', did you mean 'port-conflict'?")
+	assert.ErrorContains(t, CheckRuleIDs([]string{"everything"}), "expected one of undefined-service, undefined-cache")
+}
@@ -0,0 +1,57 @@
+package validation
+
+import (
+	"fmt"
+	"reflect"
+
+	"bitbucket-runner/internal/models"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ValidateRunnerConfig checks the content of a runner configuration file
+// and returns all the problems found, sorted by position
+func ValidateRunnerConfig(file string, data []byte) Diagnostics {
+	v := &validator{file: file}
+	root := v.parse(data)
+	if root != nil {
+		if root.Kind != yaml.MappingNode {
+			v.errorf(root, "the runner configuration must be a mapping, found %s", describe(root))
+		} else {
+			v.checkFields(root, reflect.TypeOf(models.RunnerConfig{}), "the runner configuration")
+			v.validateLintConfig(root)
+		}
+	}
+
+	if !v.diagnostics.HasErrors() {
+		var config models.RunnerConfig
+		if err := yaml.Unmarshal(data, &config); err != nil {
+			v.reportYAMLError(err)
+		} else if err := config.Validate(); err != nil {
+			v.errorf(root, "%v", err)
+		}
+	}
+	return v.diagnostics.normalize()
+}
+
+// validateLintConfig checks that lint.rules maps known rule IDs to a
+// severity
+func (v *validator) validateLintConfig(root *yaml.Node) {
+	for _, p := range v.pairs(root) {
+		if p.key.Value != "lint" || !v.mapping(p.value, "lint") {
+			continue
+		}
+		for _, lint := range v.pairs(p.value) {
+			if lint.key.Value != "rules" || !v.mapping(lint.value, "lint rules") {
+				continue
+			}
+			for _, rule := range v.pairs(lint.value) {
+				if err := CheckRuleIDs([]string{rule.key.Value}); err != nil {
+					v.errorf(rule.key, "%v", err)
+				}
+				v.oneOf(rule.value, fmt.Sprintf("severity of rule '%s'", rule.key.Value),
+					string(SeverityError), string(SeverityWarning), string(SeverityOff))
+			}
+		}
+	}
+}
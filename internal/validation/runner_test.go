@@ -0,0 +1,115 @@
+package validation
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateRunnerConfig(t *testing.T) {
+	t.Run("valid configuration", func(t *testing.T) {
+		content := `version: "1.0"
+defaults:
+  image: alpine
+  timeout: 600
+docker:
+  pullPolicy: always
+stepTypes:
+  build:
+    image: golang:1.21
+    timeout: 300
+    volumes:
+      - host: /tmp
+        container: /cache
+        readOnly: true
+`
+		assert.Empty(t, ValidateRunnerConfig("bitbucket-runner.yml", []byte(content)))
+	})
+
+	t.Run("unknown fields", func(t *testing.T) {
+		content := `version: "1.0"
+defaults:
+  image: alpine
+  timeout: 600
+docker:
+  pull_policy: always
+stepTypes:
+  build:
+    image: golang:1.21
+    timeout: 300
+    volumes:
+      - host: /tmp
+        container: /cache
+        readonly: true
+loging:
+  level: debug
+`
+		var messages []string
+		for _, d := range ValidateRunnerConfig("bitbucket-runner.yml", []byte(content)) {
+			messages = append(messages, d.String())
+		}
+		assert.Equal(t, []string{
+			"bitbucket-runner.yml:6:3: error: unknown field \"pull_policy\" in docker, did you mean \"pullPolicy\"?",
+			"bitbucket-runner.yml:14:9: error: unknown field \"readonly\" in volumes, did you mean \"readOnly\"?",
+			"bitbucket-runner.yml:15:1: error: unknown field \"loging\" in the runner configuration, did you mean \"logging\"?",
+		}, messages)
+	})
+
+	t.Run("invalid values", func(t *testing.T) {
+		diagnostics := ValidateRunnerConfig("bitbucket-runner.yml", []byte("version: \"1.0\"\ndefaults:\n  image: alpine\n  timeout: soon\n"))
+		require.Len(t, diagnostics, 1)
+		assert.Equal(t, 4, diagnostics[0].Line)
+		assert.Contains(t, diagnostics[0].Message, "cannot unmarshal")
+	})
+
+	t.Run("transforms", func(t *testing.T) {
+		content := "version: \"1.0\"\ndefaults:\n  image: alpine\n  timeout: 600\ntransforms:\n  - name: sonar\n    args: [--stage, test]\n"
+		diagnostics := ValidateRunnerConfig("bitbucket-runner.yml", []byte(content))
+		require.Len(t, diagnostics, 1)
+		assert.Equal(t, "bitbucket-runner.yml:1:1: error: transform 1 must have a command", diagnostics[0].String())
+	})
+
+	t.Run("state directory", func(t *testing.T) {
+		for _, dir := range []string{"/var/lib/runner", "../state", "."} {
+			diagnostics := ValidateRunnerConfig("bitbucket-runner.yml", []byte("version: \"1.0\"\ndefaults:\n  image: alpine\n  timeout: 600\n  stateDir: "+dir+"\n"))
+			require.Len(t, diagnostics, 1, dir)
+			assert.Equal(t, "bitbucket-runner.yml:1:1: error: state directory '"+dir+"' must be a directory inside the project", diagnostics[0].String())
+		}
+		assert.Empty(t, ValidateRunnerConfig("bitbucket-runner.yml", []byte("version: \"1.0\"\ndefaults:\n  image: alpine\n  timeout: 600\n  stateDir: build/state\n")))
+	})
+
+	t.Run("image rewrites", func(t *testing.T) {
+		tests := map[string]string{
+			"    - match: node:16\n":                                        "bitbucket-runner.yml:1:1: error: image rewrite 1 must have a replacement",
+			"    - replace: node:16-bullseye\n":                             "bitbucket-runner.yml:1:1: error: image rewrite 1 must have either a match or a regex",
+			"    - {regex: \"(\", replace: x}\n":                            "bitbucket-runner.yml:1:1: error: image rewrite 1 has an invalid regex: error parsing regexp: missing closing ): `(`",
+			"    - {regex: \"a)|(b\", replace: x}\n":                        "bitbucket-runner.yml:1:1: error: image rewrite 1 has an invalid regex: error parsing regexp: unexpected ): `a)|(b`",
+			"    - {match: \"docker.io/*\", replace: \"mirror.local/*\"}\n": "",
+		}
+		for rewrite, expected := range tests {
+			content := "version: \"1.0\"\ndefaults:\n  image: alpine\n  timeout: 600\ndocker:\n  rewrites:\n" + rewrite
+			var messages []string
+			for _, d := range ValidateRunnerConfig("bitbucket-runner.yml", []byte(content)) {
+				messages = append(messages, d.String())
+			}
+			if expected == "" {
+				assert.Empty(t, messages, rewrite)
+			} else {
+				assert.Equal(t, []string{expected}, messages, rewrite)
+			}
+		}
+	})
+
+	t.Run("lint rules", func(t *testing.T) {
+		content := "version: \"1.0\"\nlint:\n  rules:\n    unpinned-image: off\n    missing-caches: warning\n    hardcoded-secret: fatal\n"
+		var messages []string
+		for _, d := range ValidateRunnerConfig("bitbucket-runner.yml", []byte(content)) {
+			messages = append(messages, d.String())
+		}
+		assert.Equal(t, []string{
+			"bitbucket-runner.yml:5:5: error: unknown rule 'missing-caches', did you mean 'missing-cache'?",
+			"bitbucket-runner.yml:6:23: error: severity of rule 'hardcoded-secret' must be error or warning or off, found 'fatal'",
+		}, messages)
+	})
+}
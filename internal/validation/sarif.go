@@ -0,0 +1,199 @@
+package validation
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// SARIF 2.1.0 identifiers
+const (
+	sarifVersion = "2.1.0"
+	sarifSchema  = "https://json.schemastore.org/sarif-2.1.0.json"
+	toolName     = "bitbucket-runner"
+)
+
+// structureRule stands for the structural checks, which have no rule ID of
+// their own, as code scanning tools expect every result to have one
+var structureRule = Rule{
+	ID:          "invalid-configuration",
+	Severity:    SeverityError,
+	Description: "the configuration has the structure, fields and values Bitbucket supports",
+}
+
+// SARIFLog is a SARIF 2.1.0 log, the format code scanning and code review
+// tools ingest
+type SARIFLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []SARIFRun `json:"runs"`
+}
+
+// SARIFRun is a run of a tool
+type SARIFRun struct {
+	Tool       SARIFTool     `json:"tool"`
+	ColumnKind string        `json:"columnKind"`
+	Results    []SARIFResult `json:"results"`
+}
+
+// SARIFTool describes the tool and its rules
+type SARIFTool struct {
+	Driver SARIFDriver `json:"driver"`
+}
+
+// SARIFDriver is the component of the tool that ran
+type SARIFDriver struct {
+	Name  string      `json:"name"`
+	Rules []SARIFRule `json:"rules"`
+}
+
+// SARIFRule is the metadata of a rule
+type SARIFRule struct {
+	ID                   string             `json:"id"`
+	ShortDescription     SARIFMessage       `json:"shortDescription"`
+	DefaultConfiguration SARIFConfiguration `json:"defaultConfiguration"`
+}
+
+// SARIFConfiguration is the default configuration of a rule
+type SARIFConfiguration struct {
+	Level string `json:"level"`
+}
+
+// SARIFMessage is a plain text message
+type SARIFMessage struct {
+	Text string `json:"text"`
+}
+
+// SARIFResult is a diagnostic
+type SARIFResult struct {
+	RuleID    string          `json:"ruleId"`
+	RuleIndex int             `json:"ruleIndex"`
+	Level     string          `json:"level"`
+	Message   SARIFMessage    `json:"message"`
+	Locations []SARIFLocation `json:"locations"`
+	Fixes     []SARIFFix      `json:"fixes,omitempty"`
+}
+
+// SARIFLocation is the position of a result
+type SARIFLocation struct {
+	PhysicalLocation SARIFPhysicalLocation `json:"physicalLocation"`
+}
+
+// SARIFPhysicalLocation is a region of a file
+type SARIFPhysicalLocation struct {
+	ArtifactLocation SARIFArtifactLocation `json:"artifactLocation"`
+	Region           *SARIFRegion          `json:"region,omitempty"`
+}
+
+// SARIFArtifactLocation is the URI of a file, relative to the repository
+// for files within it
+type SARIFArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+// SARIFRegion is a range of a file. Lines and columns are 1-based, the end
+// column excluded.
+type SARIFRegion struct {
+	StartLine   int `json:"startLine"`
+	StartColumn int `json:"startColumn,omitempty"`
+	EndLine     int `json:"endLine,omitempty"`
+	EndColumn   int `json:"endColumn,omitempty"`
+}
+
+// SARIFFix is a fix of a result
+type SARIFFix struct {
+	Description     SARIFMessage          `json:"description"`
+	ArtifactChanges []SARIFArtifactChange `json:"artifactChanges"`
+}
+
+// SARIFArtifactChange is the change of one file
+type SARIFArtifactChange struct {
+	ArtifactLocation SARIFArtifactLocation `json:"artifactLocation"`
+	Replacements     []SARIFReplacement    `json:"replacements"`
+}
+
+// SARIFReplacement replaces a region, empty for insertions
+type SARIFReplacement struct {
+	DeletedRegion   SARIFRegion  `json:"deletedRegion"`
+	InsertedContent SARIFMessage `json:"insertedContent"`
+}
+
+// SARIF converts the report to a SARIF log. Columns count characters,
+// which the log declares as unicodeCodePoints.
+func (r Report) SARIF() SARIFLog {
+	rules := append([]Rule{structureRule}, r.Rules...)
+	driver := SARIFDriver{Name: toolName, Rules: []SARIFRule{}}
+	indexes := make(map[string]int)
+	for i, rule := range rules {
+		indexes[rule.ID] = i
+		driver.Rules = append(driver.Rules, SARIFRule{
+			ID:                   rule.ID,
+			ShortDescription:     SARIFMessage{Text: rule.Description},
+			DefaultConfiguration: SARIFConfiguration{Level: sarifLevel(rule.Severity)},
+		})
+	}
+
+	run := SARIFRun{Tool: SARIFTool{Driver: driver}, ColumnKind: "unicodeCodePoints", Results: []SARIFResult{}}
+	for _, file := range r.Files {
+		uri := artifactURI(file.Path)
+		for _, d := range file.Diagnostics {
+			id := d.Rule
+			if _, ok := indexes[id]; !ok {
+				id = structureRule.ID
+			}
+			result := SARIFResult{
+				RuleID:    id,
+				RuleIndex: indexes[id],
+				Level:     sarifLevel(d.Severity),
+				Message:   SARIFMessage{Text: d.Message},
+				Locations: []SARIFLocation{{PhysicalLocation: SARIFPhysicalLocation{
+					ArtifactLocation: SARIFArtifactLocation{URI: uri},
+					Region:           sarifRegion(d.Line, d.Column),
+				}}},
+			}
+			if d.Fix != nil {
+				change := SARIFArtifactChange{ArtifactLocation: SARIFArtifactLocation{URI: uri}}
+				for _, edit := range d.Fix.Edits {
+					region := SARIFRegion{StartLine: edit.Line, StartColumn: edit.Column, EndLine: edit.EndLine, EndColumn: edit.EndColumn}
+					change.Replacements = append(change.Replacements, SARIFReplacement{
+						DeletedRegion:   region,
+						InsertedContent: SARIFMessage{Text: edit.Text},
+					})
+				}
+				result.Fixes = []SARIFFix{{
+					Description:     SARIFMessage{Text: d.Fix.Description},
+					ArtifactChanges: []SARIFArtifactChange{change},
+				}}
+			}
+			run.Results = append(run.Results, result)
+		}
+	}
+	return SARIFLog{Schema: sarifSchema, Version: sarifVersion, Runs: []SARIFRun{run}}
+}
+
+func sarifLevel(severity Severity) string {
+	if severity == SeverityWarning {
+		return "warning"
+	}
+	return "error"
+}
+
+// sarifRegion returns the region of a position, nil when it is unknown
+func sarifRegion(line, column int) *SARIFRegion {
+	if line < 1 {
+		return nil
+	}
+	return &SARIFRegion{StartLine: line, StartColumn: column}
+}
+
+// artifactURI turns a path into a URI, relative for files of the
+// repository and file URIs for others
+func artifactURI(path string) string {
+	uri := filepath.ToSlash(path)
+	if filepath.IsAbs(path) {
+		if !strings.HasPrefix(uri, "/") {
+			uri = "/" + uri
+		}
+		return "file://" + uri
+	}
+	return strings.TrimPrefix(uri, "./")
+}
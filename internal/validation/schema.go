@@ -0,0 +1,206 @@
+package validation
+
+import (
+	"reflect"
+	"sort"
+
+	"bitbucket-runner/internal/models"
+)
+
+// JSON Schema dialect and identifiers of the generated schemas
+const (
+	schemaDialect    = "http://json-schema.org/draft-07/schema#"
+	pipelineSchemaID = "bitbucket-pipelines.schema.json"
+	runnerSchemaID   = "bitbucket-runner.schema.json"
+)
+
+// Schema is a JSON Schema, limited to the keywords the generated schemas use
+type Schema struct {
+	Schema               string             `json:"$schema,omitempty"`
+	ID                   string             `json:"$id,omitempty"`
+	Ref                  string             `json:"$ref,omitempty"`
+	Title                string             `json:"title,omitempty"`
+	Description          string             `json:"description,omitempty"`
+	Type                 string             `json:"type,omitempty"`
+	Enum                 []string           `json:"enum,omitempty"`
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	PropertyNames        *Schema            `json:"propertyNames,omitempty"`
+	AdditionalProperties interface{}        `json:"additionalProperties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	MinProperties        int                `json:"minProperties,omitempty"`
+	MaxProperties        int                `json:"maxProperties,omitempty"`
+	Items                *Schema            `json:"items,omitempty"`
+	OneOf                []*Schema          `json:"oneOf,omitempty"`
+	AllOf                []*Schema          `json:"allOf,omitempty"`
+	Definitions          map[string]*Schema `json:"definitions,omitempty"`
+}
+
+// requiredFields lists, by model type, the fields a file must set
+var requiredFields = map[reflect.Type][]string{
+	reflect.TypeOf(models.Step{}):          {"script"},
+	reflect.TypeOf(models.Stage{}):         {"steps"},
+	reflect.TypeOf(models.Parallel{}):      {"steps"},
+	reflect.TypeOf(models.Variable{}):      {"name"},
+	reflect.TypeOf(models.RunnerConfig{}):  {"version", "defaults"},
+	reflect.TypeOf(models.DefaultConfig{}): {"image", "timeout"},
+	reflect.TypeOf(models.StepType{}):      {"image", "timeout"},
+	reflect.TypeOf(models.Image{}):         {"name"},
+	reflect.TypeOf(models.ImageRewrite{}):  {"replace"},
+	reflect.TypeOf(models.Pipe{}):          {"pipe"},
+}
+
+// fieldEnums lists, by model type, the values fields are restricted to
+var fieldEnums = map[reflect.Type]map[string][]string{
+	reflect.TypeOf(models.Step{}): {
+		"trigger": {models.TriggerAutomatic, models.TriggerManual},
+		"size":    models.StepSizes,
+	},
+	reflect.TypeOf(models.Stage{}):        {"trigger": {models.TriggerAutomatic, models.TriggerManual}},
+	reflect.TypeOf(models.Options{}):      {"size": models.StepSizes},
+	reflect.TypeOf(models.DockerConfig{}): {"pullPolicy": models.PullPolicies},
+	reflect.TypeOf(models.PortMapping{}):  {"protocol": {"tcp", "udp"}},
+}
+
+// scalarForms are the types that may also be written as a string
+var scalarForms = map[reflect.Type]bool{
+	reflect.TypeOf(models.Cache{}): true,
+	reflect.TypeOf(models.Image{}): true,
+}
+
+// PipelineSchema returns the JSON Schema of bitbucket-pipelines.yml,
+// generated from models.PipelineConfig
+func PipelineSchema() *Schema {
+	return newSchema(reflect.TypeOf(models.PipelineConfig{}), pipelineSchemaID, "Bitbucket Pipelines configuration")
+}
+
+// RunnerSchema returns the JSON Schema of the runner configuration,
+// generated from models.RunnerConfig
+func RunnerSchema() *Schema {
+	return newSchema(reflect.TypeOf(models.RunnerConfig{}), runnerSchemaID, "bitbucket-runner configuration")
+}
+
+func newSchema(t reflect.Type, id, title string) *Schema {
+	g := &schemaGenerator{definitions: make(map[string]*Schema)}
+	root := g.structSchema(t)
+	root.Schema, root.ID, root.Title = schemaDialect, id, title
+	if len(g.definitions) > 0 {
+		root.Definitions = g.definitions
+	}
+	return root
+}
+
+// schemaGenerator collects the definitions of the struct types referenced
+// by a schema, which lets recursive types such as parallel steps refer to
+// themselves
+type schemaGenerator struct {
+	definitions map[string]*Schema
+}
+
+func (g *schemaGenerator) schemaOf(t reflect.Type) *Schema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice, reflect.Array:
+		list := &Schema{Type: "array", Items: g.schemaOf(t.Elem())}
+		mapping, ok := mappingForms[t]
+		if !ok {
+			return list
+		}
+		if _, ok := g.definitions[t.Name()]; !ok {
+			g.definitions[t.Name()] = &Schema{OneOf: []*Schema{list, g.schemaOf(mapping)}}
+		}
+		return &Schema{Ref: "#/definitions/" + t.Name()}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: g.schemaOf(t.Elem())}
+	case reflect.Struct:
+		if _, ok := g.definitions[t.Name()]; !ok {
+			g.definitions[t.Name()] = nil // reserved while generating
+			g.definitions[t.Name()] = g.structSchema(t)
+		}
+		return &Schema{Ref: "#/definitions/" + t.Name()}
+	}
+	return &Schema{}
+}
+
+// structSchema describes the fields of a struct type, along with the
+// alternative forms the type accepts
+func (g *schemaGenerator) structSchema(t reflect.Type) *Schema {
+	schema := &Schema{Type: "object", Properties: make(map[string]*Schema), AdditionalProperties: false}
+	for name, field := range fieldsOf(t) {
+		property := g.schemaOf(field)
+		if values, ok := fieldEnums[t][name]; ok {
+			property.Enum = values
+		}
+		schema.Properties[name] = describeProperty(property, fieldDescriptions[t][name])
+	}
+	for _, name := range unsupportedFields[t] {
+		schema.Properties[name] = &Schema{Description: fieldDescriptions[t][name] + " Ignored by the runner.", Enum: fieldEnums[t][name]}
+	}
+	schema.Required = requiredFields[t]
+	if entryTypes[t] {
+		// A pipeline entry holds a single step, parallel group, stage or
+		// variables declaration
+		schema.MinProperties, schema.MaxProperties = 1, 1
+	}
+	if t == reflect.TypeOf(models.LintConfig{}) {
+		schema.Properties["rules"] = describeProperty(lintRulesSchema(), fieldDescriptions[t]["rules"])
+	}
+	if t == reflect.TypeOf(models.Step{}) {
+		// Script entries are commands or pipes, which Step keeps as text
+		entry := &Schema{OneOf: []*Schema{{Type: "string"}, g.schemaOf(reflect.TypeOf(models.Pipe{}))}}
+		for _, name := range []string{"script", "after-script"} {
+			schema.Properties[name] = describeProperty(&Schema{Type: "array", Items: entry}, fieldDescriptions[t][name])
+		}
+	}
+	if t == reflect.TypeOf(models.CloneConfig{}) {
+		depth := &Schema{OneOf: []*Schema{{Type: "integer"}, {Type: "string", Enum: []string{"full"}}}}
+		schema.Properties["depth"] = describeProperty(depth, fieldDescriptions[t]["depth"])
+	}
+
+	var forms []*Schema
+	if list, ok := listForms[t]; ok {
+		forms = append(forms, g.schemaOf(list))
+	}
+	if scalarForms[t] {
+		forms = append(forms, &Schema{Type: "string"})
+	}
+	if len(forms) == 0 {
+		return schema
+	}
+	return &Schema{OneOf: append(forms, schema)}
+}
+
+// describeProperty sets the description of a property. References are
+// wrapped, as keywords next to $ref are ignored.
+func describeProperty(property *Schema, description string) *Schema {
+	if property.Ref != "" && description != "" {
+		return &Schema{Description: description, AllOf: []*Schema{property}}
+	}
+	property.Description = description
+	return property
+}
+
+// lintRulesSchema restricts lint.rules to known rule IDs and severities
+func lintRulesSchema() *Schema {
+	var ids []string
+	for _, rule := range allRules() {
+		ids = append(ids, rule.ID)
+	}
+	sort.Strings(ids)
+	return &Schema{
+		Type:                 "object",
+		PropertyNames:        &Schema{Enum: ids},
+		AdditionalProperties: &Schema{Type: "string", Enum: []string{string(SeverityError), string(SeverityWarning), string(SeverityOff)}},
+	}
+}
@@ -0,0 +1,100 @@
+package validation
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var updateSchemas = flag.Bool("update", false, "regenerate the schema files")
+
+// TestSchemaFiles keeps the published schemas in sync with the models. Run
+// it with -update, or make schema, after changing them.
+func TestSchemaFiles(t *testing.T) {
+	for file, schema := range map[string]*Schema{
+		pipelineSchemaID: PipelineSchema(),
+		runnerSchemaID:   RunnerSchema(),
+	} {
+		t.Run(file, func(t *testing.T) {
+			generated, err := json.MarshalIndent(schema, "", "  ")
+			require.NoError(t, err)
+			generated = append(generated, '\n')
+
+			path := filepath.Join("..", "..", "schema", file)
+			if *updateSchemas {
+				require.NoError(t, os.WriteFile(path, generated, 0644))
+			}
+			published, err := os.ReadFile(path)
+			require.NoError(t, err)
+			assert.Equal(t, string(published), string(generated), "%s is out of date, run make schema", path)
+		})
+	}
+}
+
+func TestPipelineSchema(t *testing.T) {
+	schema := PipelineSchema()
+	// Shared configurations export the pipelines of their definitions only
+	assert.Empty(t, schema.Required)
+	assert.Equal(t, "#/definitions/Pipeline", schema.Definitions["Pipelines"].Properties["default"].AllOf[0].Ref)
+
+	step := schema.Definitions["Step"]
+	require.NotNil(t, step)
+	assert.Equal(t, []string{"script"}, step.Required)
+	assert.Equal(t, []string{"automatic", "manual"}, step.Properties["trigger"].Enum)
+	assert.Equal(t, []string{"1x", "2x", "4x", "8x", "16x"}, step.Properties["size"].Enum)
+	assert.Contains(t, step.Properties, "after-script")
+
+	entry := schema.Definitions["StepWrapper"]
+	assert.Equal(t, 1, entry.MaxProperties)
+	assert.Equal(t, "#/definitions/Parallel", entry.Properties["parallel"].AllOf[0].Ref)
+	assert.Equal(t, "Steps running in parallel.", entry.Properties["parallel"].Description)
+
+	// Parallel groups are a list of steps or an object with fail-fast
+	parallel := schema.Definitions["Parallel"]
+	require.Len(t, parallel.OneOf, 2)
+	assert.Equal(t, "array", parallel.OneOf[0].Type)
+	assert.Contains(t, parallel.OneOf[1].Properties, "fail-fast")
+
+	// Pipelines are a list of entries or an import
+	pipeline := schema.Definitions["Pipeline"]
+	require.Len(t, pipeline.OneOf, 2)
+	assert.Equal(t, "#/definitions/StepWrapper", pipeline.OneOf[0].Items.Ref)
+	assert.Equal(t, "#/definitions/PipelineImport", pipeline.OneOf[1].Ref)
+
+	for name, definition := range schema.Definitions {
+		assert.NotNil(t, definition, name)
+	}
+}
+
+func TestSchemaDescriptions(t *testing.T) {
+	var check func(name string, schema *Schema)
+	check = func(name string, schema *Schema) {
+		for _, form := range schema.OneOf {
+			check(name, form)
+		}
+		for property, field := range schema.Properties {
+			assert.NotEmpty(t, field.Description, "field %s of %s has no description", property, name)
+		}
+	}
+	for _, schema := range []*Schema{PipelineSchema(), RunnerSchema()} {
+		check("the configuration", schema)
+		for name, definition := range schema.Definitions {
+			check(name, definition)
+		}
+	}
+}
+
+func TestRunnerSchema(t *testing.T) {
+	schema := RunnerSchema()
+	assert.Equal(t, []string{"always", "missing", "never"}, schema.Definitions["DockerConfig"].Properties["pullPolicy"].Enum)
+	assert.Equal(t, []string{"image", "timeout"}, schema.Definitions["DefaultConfig"].Required)
+
+	rules := schema.Definitions["LintConfig"].Properties["rules"]
+	assert.Contains(t, rules.PropertyNames.Enum, RuleHardcodedSecret)
+	assert.Contains(t, rules.PropertyNames.Enum, RuleUndefinedService)
+}
@@ -0,0 +1,86 @@
+package validation
+
+import (
+	"bitbucket-runner/internal/models"
+
+	"gopkg.in/yaml.v3"
+)
+
+// selectPipeline keeps, of the diagnostics of the pipelines section, those
+// of the pipeline selected by the options; the other sections apply to every
+// pipeline. A selector naming no pipeline is reported instead.
+func (v *validator) selectPipeline(root *yaml.Node) {
+	if root == nil || root.Kind != yaml.MappingNode {
+		return
+	}
+	var key, section *yaml.Node
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "pipelines" {
+			key, section = root.Content[i], resolve(root.Content[i+1])
+		}
+	}
+	if section == nil || section.Kind != yaml.MappingNode {
+		return
+	}
+
+	// Select against the names of the file, so branch and tag selectors
+	// match the patterns as for a run
+	config := &models.PipelineConfig{Pipelines: &models.Pipelines{}}
+	nodes := make(map[models.Selector][2]*yaml.Node)
+	for i := 0; i+1 < len(section.Content); i += 2 {
+		kind, pipelines := section.Content[i], resolve(section.Content[i+1])
+		if kind.Value == string(models.PipelineKindDefault) {
+			config.Pipelines.Default = models.Pipeline{{}}
+			nodes[models.Selector{Kind: models.PipelineKindDefault}] = [2]*yaml.Node{kind, pipelines}
+			continue
+		}
+		named := make(map[string]models.Pipeline)
+		switch models.PipelineKind(kind.Value) {
+		case models.PipelineKindBranches:
+			config.Pipelines.Branches = named
+		case models.PipelineKindTags:
+			config.Pipelines.Tags = named
+		case models.PipelineKindPullRequests:
+			config.Pipelines.PullRequests = named
+		case models.PipelineKindCustom:
+			config.Pipelines.Custom = named
+		default:
+			continue
+		}
+		if pipelines.Kind != yaml.MappingNode {
+			continue
+		}
+		for j := 0; j+1 < len(pipelines.Content); j += 2 {
+			name := pipelines.Content[j]
+			named[name.Value] = models.Pipeline{{}}
+			nodes[models.Selector{Kind: models.PipelineKind(kind.Value), Name: name.Value}] = [2]*yaml.Node{name, pipelines.Content[j+1]}
+		}
+	}
+
+	_, selected, err := config.Select(*v.options.Pipeline)
+	if err != nil {
+		v.errorf(key, "%v", err)
+		return
+	}
+	pipeline := nodes[selected]
+	first, last := pipeline[0].Line, lastLine(pipeline[1])
+	start, end := section.Line, lastLine(section)
+	var kept Diagnostics
+	for _, d := range v.diagnostics {
+		if d.Line < start || d.Line > end || (d.Line >= first && d.Line <= last) {
+			kept = append(kept, d)
+		}
+	}
+	v.diagnostics = kept
+}
+
+// lastLine returns the last line a node or its descendants start on
+func lastLine(node *yaml.Node) int {
+	line := node.Line
+	for _, child := range node.Content {
+		if l := lastLine(child); l > line {
+			line = l
+		}
+	}
+	return line
+}
@@ -0,0 +1,94 @@
+package validation
+
+import (
+	"regexp"
+	"strings"
+)
+
+// suppressionPattern matches the comments suppressing rules, such as
+// "# lint-ignore hardcoded-secret" or "# lint-ignore-file unpinned-image"
+var suppressionPattern = regexp.MustCompile(`(?:^|\s)#\s*lint-ignore(-file)?\b([^#]*)`)
+
+// suppressions are the rules suppressed by comments, allRulesID standing
+// for a comment that names none
+type suppressions struct {
+	file  []string
+	lines map[int][]string
+}
+
+const allRulesID = "*"
+
+// parseSuppressions reads the suppression comments. A comment after a value
+// applies to its line, a comment on a line of its own to the next line.
+// Unknown rule IDs are reported as warnings.
+func (v *validator) parseSuppressions() suppressions {
+	s := suppressions{lines: make(map[int][]string)}
+	for i, line := range v.lines {
+		match := suppressionPattern.FindStringSubmatchIndex(line)
+		if match == nil {
+			continue
+		}
+		column := len([]rune(line[:match[0]])) + 1
+		if line[match[0]] != '#' {
+			column++
+		}
+		ids := v.suppressedRules(line[match[4]:match[5]], i+1, column)
+
+		if match[2] >= 0 {
+			s.file = append(s.file, ids...)
+			continue
+		}
+		target := i + 1
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			target = i + 2
+		}
+		s.lines[target] = append(s.lines[target], ids...)
+	}
+	return s
+}
+
+// suppressedRules parses the comma or space separated rule IDs of a
+// comment, all rules when it names none
+func (v *validator) suppressedRules(text string, line, column int) []string {
+	var ids []string
+	for _, id := range strings.FieldsFunc(text, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }) {
+		if err := CheckRuleIDs([]string{id}); err != nil {
+			v.diagnostics = append(v.diagnostics, Diagnostic{
+				File: v.file, Line: line, Column: column, Severity: SeverityWarning,
+				Message: "lint-ignore comment: " + err.Error(),
+			})
+			continue
+		}
+		ids = append(ids, id)
+	}
+	if strings.TrimSpace(text) == "" {
+		return []string{allRulesID}
+	}
+	return ids
+}
+
+// suppressed reports whether a comment suppresses the diagnostic. Only
+// diagnostics of rules can be suppressed.
+func (s suppressions) suppressed(d Diagnostic) bool {
+	if d.Rule == "" {
+		return false
+	}
+	for _, ids := range [][]string{s.file, s.lines[d.Line]} {
+		if contains(ids, allRulesID) || contains(ids, d.Rule) {
+			return true
+		}
+	}
+	return false
+}
+
+// suppress removes the diagnostics suppressed by comments
+func (v *validator) suppress() {
+	s := v.parseSuppressions()
+	kept := v.diagnostics[:0]
+	for _, d := range v.diagnostics {
+		if !s.suppressed(d) {
+			kept = append(kept, d)
+		}
+	}
+	v.diagnostics = kept
+}
@@ -0,0 +1,169 @@
+package workspace
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"bitbucket-runner/internal/glob"
+)
+
+// Workspace is an isolated copy of the project sources used as the clone
+// directory of a single step, mirroring the fresh clone Bitbucket performs
+// for every step.
+type Workspace struct {
+	Dir string
+}
+
+// Create copies sourceDir into a new temporary directory. Relative paths
+// listed in exclude (such as the runner state directory) are not copied.
+func Create(sourceDir string, exclude ...string) (*Workspace, error) {
+	dir, err := os.MkdirTemp("", "bitbucket-runner-workspace-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create workspace directory: %w", err)
+	}
+
+	skip := make(map[string]bool, len(exclude))
+	for _, path := range exclude {
+		skip[filepath.Clean(path)] = true
+	}
+
+	err = CopyTree(sourceDir, dir, func(rel string) bool {
+		return skip[rel]
+	})
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to copy %s into workspace: %w", sourceDir, err)
+	}
+
+	return &Workspace{Dir: dir}, nil
+}
+
+// Remove deletes the workspace directory
+func (w *Workspace) Remove() error {
+	return os.RemoveAll(w.Dir)
+}
+
+// CollectArtifacts copies every file in the workspace matching one of the
+// artifact patterns into destDir, preserving relative paths. It returns the
+// relative paths of the collected files.
+func (w *Workspace) CollectArtifacts(patterns []string, destDir string) ([]string, error) {
+	var collected []string
+
+	err := filepath.WalkDir(w.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(w.Dir, path)
+		if err != nil {
+			return err
+		}
+		if !glob.MatchAny(patterns, filepath.ToSlash(rel)) {
+			return nil
+		}
+
+		if err := copyEntry(path, filepath.Join(destDir, rel), d); err != nil {
+			return err
+		}
+		collected = append(collected, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to collect artifacts: %w", err)
+	}
+
+	return collected, nil
+}
+
+// RestoreArtifacts copies previously collected artifacts from srcDir into
+// the workspace. A missing srcDir means there is nothing to restore.
+func (w *Workspace) RestoreArtifacts(srcDir string) error {
+	if _, err := os.Stat(srcDir); os.IsNotExist(err) {
+		return nil
+	}
+
+	if err := CopyTree(srcDir, w.Dir, nil); err != nil {
+		return fmt.Errorf("failed to restore artifacts: %w", err)
+	}
+	return nil
+}
+
+// CopyTree recursively copies src into dst. Entries for which skip returns
+// true (given their slash-separated path relative to src) are not copied.
+func CopyTree(src, dst string, skip func(rel string) bool) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if rel != "." && skip != nil && skip(filepath.ToSlash(rel)) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		target := filepath.Join(dst, rel)
+		if d.IsDir() {
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		}
+
+		return copyEntry(path, target, d)
+	})
+}
+
+func copyEntry(src, dst string, d fs.DirEntry) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+
+	if d.Type()&fs.ModeSymlink != 0 {
+		link, err := os.Readlink(src)
+		if err != nil {
+			return err
+		}
+		os.Remove(dst)
+		return os.Symlink(link, dst)
+	}
+
+	if !d.Type().IsRegular() {
+		// Sockets, devices and pipes have no meaning inside a workspace
+		return nil
+	}
+
+	info, err := d.Info()
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,64 @@
+package workspace
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+}
+
+func TestCreate(t *testing.T) {
+	src := t.TempDir()
+	writeFile(t, filepath.Join(src, "bitbucket-pipelines.yml"), "pipelines: {}")
+	writeFile(t, filepath.Join(src, "src", "main.go"), "package main")
+	writeFile(t, filepath.Join(src, ".bitbucket-runner", "runs", "1", "context.json"), "{}")
+
+	ws, err := Create(src, ".bitbucket-runner")
+	require.NoError(t, err)
+	defer ws.Remove()
+
+	assert.FileExists(t, filepath.Join(ws.Dir, "bitbucket-pipelines.yml"))
+	assert.FileExists(t, filepath.Join(ws.Dir, "src", "main.go"))
+	assert.NoDirExists(t, filepath.Join(ws.Dir, ".bitbucket-runner"))
+
+	require.NoError(t, ws.Remove())
+	assert.NoDirExists(t, ws.Dir)
+}
+
+func TestWorkspace_Artifacts(t *testing.T) {
+	src := t.TempDir()
+	ws, err := Create(src)
+	require.NoError(t, err)
+	defer ws.Remove()
+
+	writeFile(t, filepath.Join(ws.Dir, "dist", "app.js"), "console.log(1)")
+	writeFile(t, filepath.Join(ws.Dir, "dist", "css", "app.css"), "body {}")
+	writeFile(t, filepath.Join(ws.Dir, "README.md"), "readme")
+
+	artifactsDir := t.TempDir()
+	collected, err := ws.CollectArtifacts([]string{"dist/**"}, artifactsDir)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"dist/app.js", "dist/css/app.css"}, collected)
+	assert.NoFileExists(t, filepath.Join(artifactsDir, "README.md"))
+
+	next, err := Create(src)
+	require.NoError(t, err)
+	defer next.Remove()
+
+	require.NoError(t, next.RestoreArtifacts(artifactsDir))
+	data, err := os.ReadFile(filepath.Join(next.Dir, "dist", "css", "app.css"))
+	require.NoError(t, err)
+	assert.Equal(t, "body {}", string(data))
+
+	t.Run("missing artifacts directory", func(t *testing.T) {
+		assert.NoError(t, next.RestoreArtifacts(filepath.Join(artifactsDir, "missing")))
+	})
+}